@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// writeGate lets admin operations pause the write path: handlers that
+// mutate the store hold it shared, admin tasks hold it exclusively.
+var writeGate sync.RWMutex
+
+// pauseWrites blocks new writes and waits until every write already made
+// has reached the logger. The returned func resumes writes.
+func pauseWrites() func() {
+	writeGate.Lock()
+
+	if w, ok := transact.(interface{ Wait() }); ok {
+		w.Wait()
+	}
+
+	return writeGate.Unlock
+}
+
+// draining makes write handlers turn clients away; see DrainHandler
+var draining atomic.Bool
+
+// DrainRetryAfter is the Retry-After, in seconds, sent with writes
+// rejected while draining
+const DrainRetryAfter = 30
+
+// ErrDraining rejects writes while the server is drained
+var ErrDraining = fmt.Errorf("%w: draining for maintenance", ErrUnavailable)
+
+// beginWrite takes the write gate for a handler that mutates the store,
+// or fails with ErrDraining, or ErrStandby until a standby is promoted.
+// The flags are checked under the gate, so once DrainHandler returns no
+// write is in flight or can start. Call the returned func when done.
+func beginWrite() (func(), error) {
+	writeGate.RLock()
+	if draining.Load() {
+		writeGate.RUnlock()
+		return nil, ErrDraining
+	}
+	if standby.Load() != nil {
+		writeGate.RUnlock()
+		return nil, ErrStandby
+	}
+
+	return writeGate.RUnlock, nil
+}
+
+// DrainResponse is the body returned by the drain endpoints
+type DrainResponse struct {
+	Draining bool `json:"draining"`
+}
+
+// DrainHandler expects to be called from http POST at "/v1/_drain"
+// resource, behind requireAuth. Once every write in flight has reached
+// the logger, writes are refused with a 503 until UndrainHandler is
+// called; reads carry on.
+func DrainHandler(w http.ResponseWriter, r *http.Request) {
+	setDraining(w, true)
+}
+
+// UndrainHandler expects to be called from http POST at "/v1/_undrain"
+// resource, behind requireAuth. It lets writes through again.
+func UndrainHandler(w http.ResponseWriter, r *http.Request) {
+	setDraining(w, false)
+}
+
+func setDraining(w http.ResponseWriter, on bool) {
+	resume := pauseWrites()
+	draining.Store(on)
+	resume()
+
+	logger.Info("drain", "draining", on)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DrainResponse{Draining: on})
+}
+
+// CompactResponse is the body returned by the compaction endpoints
+type CompactResponse struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+}
+
+// FlushResponse is the body returned by FlushHandler
+type FlushResponse struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+// SnapshotResponse is the body returned by SnapshotHandler
+type SnapshotResponse struct {
+	Sequence uint64 `json:"sequence"`
+	Keys     int    `json:"keys"`
+}
+
+// CompactStatsHandler expects to be called from http GET at
+// "/v1/_compact?dryrun=1" resource, behind requireAuth. It reports what
+// compacting the log would reclaim without touching it.
+func CompactStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("dryrun") != "1" {
+		writeError(w, r, fmt.Errorf("%w: GET only supports dryrun=1", ErrInvalidArgument))
+		return
+	}
+
+	c, ok := transact.(Compactor)
+	if !ok {
+		writeError(w, r, fmt.Errorf("compaction %w", ErrNotSupported))
+		return
+	}
+
+	before, after, err := c.CompactStats()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CompactResponse{Before: before, After: after})
+}
+
+// CompactHandler expects to be called from http POST at "/v1/_compact"
+// resource, behind requireAuth. Writes are paused while the log is
+// rewritten.
+func CompactHandler(w http.ResponseWriter, r *http.Request) {
+	c, ok := transact.(Compactor)
+	if !ok {
+		writeError(w, r, fmt.Errorf("compaction %w", ErrNotSupported))
+		return
+	}
+
+	before, after, err := compactNow(c, false)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CompactResponse{Before: before, After: after})
+}
+
+// SnapshotHandler expects to be called from http POST at "/v1/_snapshot"
+// resource, behind requireAuth.
+func SnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := transact.(Snapshotter)
+	if !ok {
+		writeError(w, r, fmt.Errorf("snapshots %w", ErrNotSupported))
+		return
+	}
+
+	resp, err := takeSnapshot(s)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// FlushHandler expects to be called from http POST at "/v1/_flush"
+// resource, behind requireAuth. It forces every write made so far to
+// disk and reports the last durable sequence.
+func FlushHandler(w http.ResponseWriter, r *http.Request) {
+	f, ok := transact.(Flusher)
+	if !ok {
+		writeError(w, r, fmt.Errorf("flushing %w", ErrNotSupported))
+		return
+	}
+
+	if err := f.Flush(); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FlushResponse{Sequence: f.Durable()})
+}
+
+// BackupHandler expects to be called from http GET at "/v1/_backup"
+// resource, behind requireAuth. It streams a copy of the whole
+// transaction log, taken without pausing writes, that can be restored by
+// starting a server on it.
+func BackupHandler(w http.ResponseWriter, r *http.Request) {
+	b, ok := transact.(Backuper)
+	if !ok {
+		writeError(w, r, fmt.Errorf("backups %w", ErrNotSupported))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="transact.log"`)
+
+	// once the copy has started the status can't change
+	if err := b.Backup(w); err != nil {
+		logger.Error("backup failed", "err", err)
+	}
+}
+
+// LogHandler expects to be called from http GET at "/v1/_log?from=N"
+// resource, behind requireAuth. It streams the transaction log from
+// sequence N (default 1) as JSON lines. With tail=1 it keeps following
+// the log, as ReplicateHandler does.
+func LogHandler(w http.ResponseWriter, r *http.Request) {
+	if tail, _ := strconv.ParseBool(r.URL.Query().Get("tail")); tail {
+		ReplicateHandler(w, r)
+		return
+	}
+
+	from, err := fromParam(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	lr, ok := transact.(LogReader)
+	if !ok {
+		writeError(w, r, fmt.Errorf("reading the log %w", ErrNotSupported))
+		return
+	}
+
+	events, errs := lr.ReadLog(from)
+	streamLog(w, r, events, errs, nil)
+}
+
+// KeyHistoryHandler expects to be called from http GET at
+// "/v1/{key}/history" resource. It streams every put and delete of the
+// key still in the transaction log, oldest first, as JSON lines.
+// Compaction forgets all but a key's latest put.
+func KeyHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err == nil {
+		err = validateKey(key)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	lr, ok := transact.(LogReader)
+	if !ok {
+		writeError(w, r, fmt.Errorf("reading the log %w", ErrNotSupported))
+		return
+	}
+
+	events, errs := lr.ReadLog(1)
+	streamLog(w, r, events, errs, func(e Event) bool {
+		return e.Key == key && e.EventType != EventShutdown
+	})
+}
+
+// streamLog writes the events keep accepts (all of them if it's nil) as
+// JSON lines
+func streamLog(w http.ResponseWriter, r *http.Request, events <-chan Event, errs <-chan error, keep func(Event) bool) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+
+	// keep draining after a write error, or once the request is cancelled,
+	// so the reader can finish
+	var werr error
+	sent := 0
+	for e := range events {
+		if keep != nil && !keep(e) {
+			continue
+		}
+		if werr == nil {
+			werr = r.Context().Err()
+		}
+		if werr == nil {
+			werr = enc.Encode(e)
+		}
+		sent++
+	}
+
+	if err := <-errs; err != nil {
+		if sent == 0 {
+			writeError(w, r, err)
+			return
+		}
+		logger.Error("log read failed", "sent", sent, "err", err)
+	}
+}
+
+// fromParam is the request's from sequence number, 1 if not given
+func fromParam(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("from")
+	if v == "" {
+		return 1, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: from must be a sequence number", ErrInvalidArgument)
+	}
+
+	return n, nil
+}
+
+// SequenceResponse is the body returned by SequenceHandler
+type SequenceResponse struct {
+	Sequence uint64 `json:"sequence"`
+}
+
+// SequenceHandler expects to be called from http GET at "/v1/_seq"
+// resource. It returns the sequence number of the last event logged, so
+// replicas can tell how far behind they are.
+func SequenceHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := transact.(Sequencer)
+	if !ok {
+		writeError(w, r, fmt.Errorf("sequence %w", ErrNotSupported))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SequenceResponse{Sequence: s.LastSequence()})
+}
+
+// ReplicateHandler expects to be called from http GET at
+// "/v1/_replicate?from=N" resource, behind requireAuth. It streams the
+// log from sequence N as JSON lines like LogHandler, then keeps the
+// response open and streams each new event as it's logged, until the
+// client goes away. A replica that reconnects resumes from the sequence
+// after the last one it saw. Under an AuthPolicy events on keys the
+// caller may not GET are left out.
+func ReplicateHandler(w http.ResponseWriter, r *http.Request) {
+	from, err := fromParam(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	lr, canRead := transact.(LogReader)
+	n, canWait := transact.(Notifier)
+	if !canRead || !canWait {
+		writeError(w, r, fmt.Errorf("replication %w", ErrNotSupported))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+
+	for {
+		// ask for the wakeup before reading, so no write slips between
+		written := n.Written()
+
+		events, errs := lr.ReadLog(from)
+		var werr error
+		for e := range events {
+			if werr == nil && (e.EventType == EventShutdown || authorize(r, "GET", e.Key) == nil) {
+				werr = enc.Encode(e)
+			}
+			from = e.Sequence + 1
+		}
+		if err := <-errs; err != nil {
+			logger.Warn("replication stream stopped", "err", err)
+			return
+		}
+		if werr != nil {
+			return
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		select {
+		case <-written:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// takeSnapshot pauses writes so the snapshot matches the log exactly
+func takeSnapshot(s Snapshotter) (SnapshotResponse, error) {
+	resume := pauseWrites()
+	defer resume()
+
+	state, versions := kvs.SnapshotVersions()
+
+	seq, err := s.Snapshot(state, versions)
+	if err != nil {
+		return SnapshotResponse{}, err
+	}
+
+	return SnapshotResponse{Sequence: seq, Keys: len(state)}, nil
+}
+
+// snapshotEvery snapshots the store every d until ctx is done, for
+// loggers that support it, so a restart only replays the events since the
+// last one
+func snapshotEvery(ctx context.Context, d time.Duration) {
+	s, ok := transact.(Snapshotter)
+	if !ok {
+		logger.Warn("snapshots not supported by this backend")
+		return
+	}
+
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			resp, err := takeSnapshot(s)
+			if err != nil {
+				logger.Error("snapshot failed", "err", err)
+				continue
+			}
+			logger.Info("snapshot", "sequence", resp.Sequence, "keys", resp.Keys)
+		}
+	}
+}
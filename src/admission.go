@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// limitRequests admits at most n requests to next at once, answering the
+// rest with a 503 straight away rather than queueing them, so a flood
+// can't exhaust the server. Streams hold their slot for as long as they
+// run. n of 0 or less is no limit.
+func limitRequests(n int, next http.Handler) http.Handler {
+	if n <= 0 {
+		return next
+	}
+
+	slots := make(chan struct{}, n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, fmt.Errorf("%w: %d requests already in flight", ErrUnavailable, n))
+		}
+	})
+}
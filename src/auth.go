@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// Errors for requests to endpoints behind requireAuth
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+)
+
+// authTokens hold the hashes of the bearer tokens requireAuth accepts,
+// set from the auth settings and changed by TokenRotateHandler. Only
+// endpoints wrapped in requireAuth check them, and key requests once an
+// AuthPolicy is set.
+var (
+	authMu     sync.RWMutex
+	authTokens []authToken
+)
+
+// authToken is an accepted token and the user it names, "" for none
+type authToken struct {
+	hash tokenHash
+	user string
+}
+
+// tokenHash is how a token is kept, so the secret itself isn't held
+type tokenHash [sha256.Size]byte
+
+func hashToken(token string) tokenHash {
+	return sha256.Sum256([]byte(token))
+}
+
+// setAuthTokens replaces the accepted tokens with tokens, which name no
+// user
+func setAuthTokens(tokens ...string) {
+	setAuth(tokens, nil)
+}
+
+// setAuth replaces the accepted tokens with tokens, each taken whole and
+// naming no user, and users, each "user:secret" naming the user of secret.
+// An entry of users without both is an error, and nothing is replaced.
+func setAuth(tokens, users []string) error {
+	parsed := make([]authToken, 0, len(tokens)+len(users))
+	for _, t := range tokens {
+		parsed = append(parsed, authToken{hash: hashToken(t)})
+	}
+	for _, u := range users {
+		user, secret, ok := strings.Cut(u, ":")
+		if !ok || user == "" || secret == "" {
+			return fmt.Errorf("%w: user token must be user:secret", ErrInvalidArgument)
+		}
+		parsed = append(parsed, authToken{hash: hashToken(secret), user: user})
+	}
+
+	authMu.Lock()
+	authTokens = parsed
+	authMu.Unlock()
+	return nil
+}
+
+// findToken is the index of token in authTokens, or -1. Callers must hold
+// authMu.
+func findToken(token string) int {
+	h := hashToken(token)
+	for i, t := range authTokens {
+		if subtle.ConstantTimeCompare(h[:], t.hash[:]) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// requireAuth guards a handler with a bearer token. With no tokens
+// configured the handler is refused outright, as it's only used for
+// operations too dangerous to leave open.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkToken(r); err != nil {
+			if errors.Is(err, ErrUnauthorized) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="cngo"`)
+			}
+			writeError(w, r, err)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// bearerToken is the token in the request's Authorization header
+func bearerToken(r *http.Request) (string, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return "", fmt.Errorf("%w: bearer token required", ErrUnauthorized)
+	}
+	return strings.TrimPrefix(h, "Bearer "), nil
+}
+
+// checkToken accepts a request bearing one of authTokens
+func checkToken(r *http.Request) error {
+	authMu.RLock()
+	defer authMu.RUnlock()
+
+	if len(authTokens) == 0 {
+		return fmt.Errorf("%w: configure auth tokens to enable this endpoint", ErrForbidden)
+	}
+
+	token, err := bearerToken(r)
+	if err != nil {
+		return err
+	}
+	if findToken(token) < 0 {
+		return fmt.Errorf("%w: unknown token", ErrUnauthorized)
+	}
+
+	return nil
+}
+
+// AuthPolicy decides whether user may make a request with method on key.
+// user is "" for a request without a bearer token.
+type AuthPolicy func(method, key, user string) bool
+
+var authPolicy atomic.Pointer[AuthPolicy]
+
+// SetAuthPolicy makes every request on a key, and every key a transaction
+// or rename writes, subject to fn. A request bearing a token must
+// authenticate first, and is then checked as the token's user. Denied
+// requests get 403. A nil fn removes the policy.
+func SetAuthPolicy(fn AuthPolicy) {
+	if fn == nil {
+		authPolicy.Store(nil)
+		return
+	}
+	authPolicy.Store(&fn)
+}
+
+// requestUser authenticates r, returning the user of its token, or ""
+// if it has none
+func requestUser(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") == "" {
+		return "", nil
+	}
+
+	token, err := bearerToken(r)
+	if err != nil {
+		return "", err
+	}
+
+	authMu.RLock()
+	defer authMu.RUnlock()
+
+	i := findToken(token)
+	if i < 0 {
+		return "", fmt.Errorf("%w: unknown token", ErrUnauthorized)
+	}
+	return authTokens[i].user, nil
+}
+
+// authorize checks r may use method on key under any AuthPolicy
+func authorize(r *http.Request, method, key string) error {
+	policy := authPolicy.Load()
+	if policy == nil {
+		return nil
+	}
+
+	user, err := requestUser(r)
+	if err != nil {
+		return err
+	}
+	if !(*policy)(method, key, user) {
+		return fmt.Errorf("%w: %s of %q not allowed", ErrForbidden, method, key)
+	}
+	return nil
+}
+
+// authorizeKeys is router middleware applying any AuthPolicy to requests
+// routed by a key. The key is checked as the handler will see it, decoded
+// from base64 if b64key asks; one that doesn't decode is refused with 400.
+func authorizeKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := mux.Vars(r)["key"]; ok && authPolicy.Load() != nil {
+			key, err := requestKey(r)
+			if err == nil {
+				err = authorize(r, r.Method, key)
+			}
+			if err != nil {
+				if errors.Is(err, ErrUnauthorized) {
+					w.Header().Set("WWW-Authenticate", `Bearer realm="cngo"`)
+				}
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rotateToken swaps old for replacement in one step, so no request sees
+// both or neither
+func rotateToken(old, replacement string) error {
+	authMu.Lock()
+	defer authMu.Unlock()
+
+	i := findToken(old)
+	if i < 0 {
+		return fmt.Errorf("%w: unknown token", ErrUnauthorized)
+	}
+	authTokens[i].hash = hashToken(replacement)
+
+	return nil
+}
+
+// TokenRotateHandler expects to be called from http POST at
+// "/v1/_admin/token" resource, behind requireAuth, with the new token as
+// the body. The token the request was made with stops working and the
+// new one takes its place; other configured tokens are left alone. The
+// change lasts until restart, when the configured tokens apply again.
+func TokenRotateHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readValue(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	replacement := strings.TrimSpace(string(body))
+	if replacement == "" {
+		writeError(w, r, fmt.Errorf("%w: new token must not be empty", ErrInvalidArgument))
+		return
+	}
+
+	old, err := bearerToken(r)
+	if err == nil {
+		err = rotateToken(old, replacement)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	logger.Info("auth token rotated")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Backuper is implemented by loggers that can copy their log while it's
+// being written
+type Backuper interface {
+	Backup(w io.Writer) error
+}
+
+// Backup writes a copy of the whole log, rotated segments included, as a
+// single log in the logger's format. The copy holds every event up to
+// the moment Backup is called. It reads through handles of its own, up to
+// the size the log had then, so writers are only held up while buffered
+// events are flushed.
+func (l *FileTransactionLogger) Backup(w io.Writer) error {
+	l.mu.Lock()
+	if err := l.flush(); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	f, err := os.Open(l.filename)
+	if err != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	segments, err := l.openSegments(0)
+	if err != nil {
+		l.mu.Unlock()
+		f.Close()
+		return err
+	}
+	size, format := l.offset, l.format
+	l.mu.Unlock()
+
+	defer f.Close()
+	defer closeAll(segments)
+
+	bw := bufio.NewWriter(w)
+	if _, err := writeHeader(bw, format); err != nil {
+		return fmt.Errorf("cannot write backup: %w", err)
+	}
+
+	for _, s := range segments {
+		if err := copyEvents(bw, s, format); err != nil {
+			return err
+		}
+	}
+	if err := copyEvents(bw, io.LimitReader(f, size), format); err != nil {
+		return err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("cannot write backup: %w", err)
+	}
+	return nil
+}
+
+// copyEvents decodes every event in r and encodes it to w
+func copyEvents(w io.Writer, r io.Reader, format LogFormat) error {
+	next := eventDecoder(r, format)
+	for {
+		e, err := next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := encodeEvent(w, format, e); err != nil {
+			return fmt.Errorf("cannot write backup: %w", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen fails a write without trying it, while the breaker
+// guarding its backend is open
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker open; the database is failing", ErrUnavailable)
+
+// BreakerPolicy configures a circuit breaker. After Threshold writes in a
+// row fail, writes fail at once for Cooldown; then one is let through as
+// a probe, closing the breaker if it succeeds and reopening it if not.
+type BreakerPolicy struct {
+	Threshold int // consecutive failures that open the breaker; 0 disables it
+	Cooldown  time.Duration
+}
+
+// Breaker states, as reported in BreakerStats
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open" // a probe is in flight
+)
+
+// breaker is a circuit breaker. The zero value, with no threshold, lets
+// everything through.
+type breaker struct {
+	policy BreakerPolicy
+	clock  Clock // nil means the real clock
+
+	mu       sync.Mutex
+	state    string // "" is closed
+	failures int    // in a row
+	openedAt time.Time
+	trips    int
+}
+
+// allow returns ErrCircuitOpen if a write mustn't be tried now. Once the
+// cooldown has passed it lets one write through as a probe, whose outcome
+// must be passed to record.
+func (b *breaker) allow() error {
+	if b.policy.Threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if now(b.clock).Sub(b.openedAt) < b.policy.Cooldown {
+			return ErrCircuitOpen
+		}
+		b.state = BreakerHalfOpen
+		return nil
+	case BreakerHalfOpen:
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// record counts the outcome of a write allow let through. failed is
+// whether it failed in a way that says the backend is down, not merely
+// that the write was bad.
+func (b *breaker) record(failed bool) {
+	if b.policy.Threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state == BreakerHalfOpen {
+			logger.Info("circuit breaker closed; the database is answering again")
+		}
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.policy.Threshold {
+		if b.state != BreakerHalfOpen {
+			logger.Warn("circuit breaker opened; failing writes fast",
+				"failures", b.failures, "cooldown", b.policy.Cooldown)
+			b.trips++
+		}
+		b.state = BreakerOpen
+		b.openedAt = now(b.clock)
+	}
+}
+
+// BreakerStats describes a circuit breaker for _stats
+type BreakerStats struct {
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"` // while open
+	Trips    int        `json:"trips"`               // times it has opened
+}
+
+func (b *breaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerStats{State: b.state, Failures: b.failures, Trips: b.trips}
+	if s.State == "" {
+		s.State = BreakerClosed
+	}
+	if s.State != BreakerClosed {
+		at := b.openedAt
+		s.OpenedAt = &at
+	}
+	return s
+}
+
+// BreakerReporter is implemented by loggers guarded by a circuit breaker
+type BreakerReporter interface {
+	BreakerStats() BreakerStats
+}
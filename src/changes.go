@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ChangeBuffer is how many changes a _changes subscriber may fall behind
+// by before it's dropped
+const ChangeBuffer = 256
+
+// Change is one put or delete, as sent to _changes subscribers
+type Change struct {
+	Type  string `json:"type"` // "put" or "delete"
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// changeFeed fans store changes out to subscribers. A subscriber that
+// can't keep up is dropped rather than slowing writers down, so it knows
+// it missed changes instead of silently skipping some.
+type changeFeed struct {
+	mu   sync.Mutex
+	subs map[chan Change]struct{}
+}
+
+// changes feeds _changes; run hooks it up to kvs
+var changes = &changeFeed{subs: make(map[chan Change]struct{})}
+
+// publish is a ChangeFunc for KVS.OnChange
+func (f *changeFeed) publish(key, value string, deleted bool) {
+	c := Change{Type: "put", Key: key, Value: value}
+	if deleted {
+		c.Type = "delete"
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for ch := range f.subs {
+		select {
+		case ch <- c:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of changes from now on. It's closed if the
+// subscriber falls ChangeBuffer changes behind; call cancel when done.
+func (f *changeFeed) subscribe() (ch <-chan Change, cancel func()) {
+	c := make(chan Change, ChangeBuffer)
+
+	f.mu.Lock()
+	f.subs[c] = struct{}{}
+	f.mu.Unlock()
+
+	return c, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if _, ok := f.subs[c]; ok {
+			delete(f.subs, c)
+			close(c)
+		}
+	}
+}
+
+// ChangesHandler expects to be called from http GET at "/v1/_changes"
+// resource, behind requireAuth. It streams every put and delete across
+// the store as server-sent events, named for the change type, with the
+// Change as JSON data. Under an AuthPolicy only changes to keys the
+// caller may GET are sent. A client too slow to keep up gets a final
+// "dropped" event and should reconnect and resync.
+func ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, fmt.Errorf("%w: streaming not supported", ErrUnavailable))
+		return
+	}
+
+	ch, cancel := changes.subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case c, ok := <-ch:
+			if !ok {
+				fmt.Fprint(w, "event: dropped\ndata: {}\n\n")
+				flusher.Flush()
+				return
+			}
+			if authorize(r, "GET", c.Key) != nil {
+				continue
+			}
+
+			data, _ := json.Marshal(c)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", c.Type, data)
+			flusher.Flush()
+		}
+	}
+}
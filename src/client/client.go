@@ -0,0 +1,176 @@
+// Package client wraps the cngo HTTP API for Go consumers.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrNotFound is returned when the requested key does not exist
+var ErrNotFound = errors.New("no such key")
+
+// StatusError describes an unexpected response from the server
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("cngo: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Client talks to a cngo server
+type Client struct {
+	baseURL    string
+	HTTPClient *http.Client
+}
+
+// New makes a Client for the server at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) keyURL(key string) string {
+	return c.baseURL + "/v1/" + url.PathEscape(key)
+}
+
+// do sends the request and turns non-2xx responses into errors. The
+// caller must close the returned body.
+func (c *Client) do(ctx context.Context, method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.send(req)
+}
+
+// send is do for a request the caller has made
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, &StatusError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+}
+
+// Get the value stored at key
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.keyURL(key), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	val, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(val), nil
+}
+
+// Put value at key
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	resp, err := c.do(ctx, http.MethodPut, c.keyURL(key), strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Delete the value at key
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.keyURL(key), nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Sequence returns the sequence number of the last event in the server's
+// transaction log
+func (c *Client) Sequence(ctx context.Context) (uint64, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.baseURL+"/v1/_seq", nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Sequence uint64 `json:"sequence"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("cngo: bad sequence response: %w", err)
+	}
+
+	return body.Sequence, nil
+}
+
+// Keys returns every key in sorted order, paging through the scan endpoint
+func (c *Client) Keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	cursor := ""
+
+	for {
+		page, next, err := c.Scan(ctx, cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+
+		if next == "" {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// Scan returns one page of up to limit sorted keys after cursor, plus the
+// cursor for the next page ("" when done). A limit of 0 uses the server
+// default.
+func (c *Client) Scan(ctx context.Context, cursor string, limit int) ([]string, string, error) {
+	q := url.Values{}
+	if cursor != "" {
+		q.Set("cursor", cursor)
+	}
+	if limit > 0 {
+		q.Set("limit", fmt.Sprint(limit))
+	}
+
+	resp, err := c.do(ctx, http.MethodGet, c.baseURL+"/v1/_scan?"+q.Encode(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var page struct {
+		Keys []string `json:"keys"`
+		Next string   `json:"next"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", fmt.Errorf("cngo: bad scan response: %w", err)
+	}
+
+	return page.Keys, page.Next, nil
+}
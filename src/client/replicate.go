@@ -0,0 +1,226 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Event is one entry of the server's transaction log
+type Event struct {
+	Sequence uint64 `json:"sequence"`
+	Type     string `json:"type"` // "put", "delete" or "shutdown"
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Version  uint64 `json:"version,omitempty"`
+	Modified int64  `json:"modified,omitempty"` // Unix nanoseconds
+}
+
+// Store is where a Replica applies the events it receives
+type Store interface {
+	Put(key, value string) error
+	Delete(key string) error
+}
+
+// EventStore is a Store that takes whole events, sequence numbers and
+// all. A Replica hands such a store every event, shutdown markers too,
+// through Apply rather than Put and Delete.
+type EventStore interface {
+	Store
+	Apply(e Event) error
+}
+
+// DefaultRetryDelay is how long a Replica waits before reconnecting
+const DefaultRetryDelay = time.Second
+
+// DefaultLagInterval is how often a running Replica asks the server for
+// its latest sequence, to work out its lag
+const DefaultLagInterval = 5 * time.Second
+
+// Replica keeps a local Store in step with a server by following its
+// replication stream
+type Replica struct {
+	Client     *Client
+	Store      Store
+	RetryDelay time.Duration // 0 uses DefaultRetryDelay
+
+	// Token is the bearer token sent with each request for the stream,
+	// which the server only serves to a client bearing one
+	Token string
+
+	// LagInterval is how often Run refreshes the server's sequence; 0
+	// uses DefaultLagInterval and a negative interval never refreshes
+	LagInterval time.Duration
+
+	next    atomic.Uint64 // sequence of the next event to apply
+	primary atomic.Uint64 // the server's last sequence, once known
+	known   atomic.Bool
+}
+
+// NewReplica makes a Replica applying the server's events to s, starting
+// after sequence applied (0 for the whole log)
+func NewReplica(c *Client, s Store, applied uint64) *Replica {
+	r := &Replica{Client: c, Store: s}
+	r.next.Store(applied + 1)
+	return r
+}
+
+// Applied is the sequence number of the last event applied to the store,
+// where a later NewReplica can resume from
+func (r *Replica) Applied() uint64 {
+	return r.next.Load() - 1
+}
+
+// RefreshLag asks the server for its latest sequence and returns how many
+// events the replica is behind it
+func (r *Replica) RefreshLag(ctx context.Context) (uint64, error) {
+	seq, err := r.Client.Sequence(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	r.primary.Store(seq)
+	r.known.Store(true)
+
+	lag, _ := r.Lag()
+	return lag, nil
+}
+
+// Lag is how many events the replica is behind the server as of the
+// last refresh, and false if the server's sequence isn't known yet.
+// Events the replica has applied since count against it straight away.
+func (r *Replica) Lag() (uint64, bool) {
+	if !r.known.Load() {
+		return 0, false
+	}
+
+	primary, applied := r.primary.Load(), r.Applied()
+	if applied >= primary {
+		return 0, true
+	}
+	return primary - applied, true
+}
+
+// WriteMetrics writes the replica's applied sequence and, once known,
+// its lag as gauges in the Prometheus text format
+func (r *Replica) WriteMetrics(w io.Writer) {
+	fmt.Fprintf(w, "# HELP cngo_replica_applied_sequence Sequence of the last event applied.\n")
+	fmt.Fprintf(w, "# TYPE cngo_replica_applied_sequence gauge\n")
+	fmt.Fprintf(w, "cngo_replica_applied_sequence %d\n", r.Applied())
+
+	if lag, ok := r.Lag(); ok {
+		fmt.Fprintf(w, "# HELP cngo_replica_lag Events behind the primary.\n")
+		fmt.Fprintf(w, "# TYPE cngo_replica_lag gauge\n")
+		fmt.Fprintf(w, "cngo_replica_lag %d\n", lag)
+	}
+}
+
+// refreshLag keeps the server's sequence current until ctx is done
+func (r *Replica) refreshLag(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		r.RefreshLag(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run follows the server until ctx is done, reconnecting whenever the
+// stream drops and resuming after the last applied event. It returns
+// early only if the store rejects an event. Meanwhile it refreshes the
+// server's sequence every LagInterval, for Lag.
+func (r *Replica) Run(ctx context.Context) error {
+	delay := r.RetryDelay
+	if delay == 0 {
+		delay = DefaultRetryDelay
+	}
+
+	every := r.LagInterval
+	if every == 0 {
+		every = DefaultLagInterval
+	}
+	if every > 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go r.refreshLag(ctx, every)
+	}
+
+	for {
+		err := r.follow(ctx)
+		if _, ok := err.(*applyError); ok {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// applyError is a Store failure, which reconnecting won't fix
+type applyError struct {
+	seq uint64
+	err error
+}
+
+func (e *applyError) Error() string {
+	return fmt.Sprintf("cngo: applying event %d: %v", e.seq, e.err)
+}
+
+func (e *applyError) Unwrap() error { return e.err }
+
+// follow applies events from one connection to the stream until it ends
+func (r *Replica) follow(ctx context.Context) error {
+	u := fmt.Sprintf("%s/v1/_replicate?from=%d", r.Client.baseURL, r.next.Load())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+
+	resp, err := r.Client.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("cngo: bad replication event: %w", err)
+		}
+
+		var err error
+		switch es, ok := r.Store.(EventStore); {
+		case ok:
+			err = es.Apply(e)
+		case e.Type == "put":
+			err = r.Store.Put(e.Key, e.Value)
+		case e.Type == "delete":
+			err = r.Store.Delete(e.Key)
+		}
+		if err != nil {
+			return &applyError{seq: e.Sequence, err: err}
+		}
+		r.next.Store(e.Sequence + 1)
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rhardin/cngo/client"
+)
+
+func TestClient(t *testing.T) {
+	useTempLogger(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	c := client.New(srv.URL)
+	ctx := context.Background()
+
+	t.Run("Put Then Get", func(t *testing.T) {
+		expect := "was here"
+		if err := c.Put(ctx, "client rob", expect); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := c.Get(ctx, "client rob")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expect {
+			t.Errorf("Want: %s; Got: %s", expect, got)
+		}
+	})
+
+	t.Run("Missing Key Is ErrNotFound", func(t *testing.T) {
+		_, err := c.Get(ctx, "client missing")
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("Want: %v; Got: %v", client.ErrNotFound, err)
+		}
+	})
+
+	t.Run("Delete Removes Key", func(t *testing.T) {
+		c.Put(ctx, "client delete me", "42")
+		if err := c.Delete(ctx, "client delete me"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := c.Get(ctx, "client delete me")
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("Want: %v; Got: %v", client.ErrNotFound, err)
+		}
+	})
+
+	t.Run("Keys Pages Through Everything", func(t *testing.T) {
+		c.Put(ctx, "client k1", "1")
+		c.Put(ctx, "client k2", "2")
+
+		keys, err := c.Keys(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := 0
+		for _, k := range keys {
+			if k == "client k1" || k == "client k2" {
+				found++
+			}
+		}
+		if found != 2 {
+			t.Errorf("Want: %d; Got: %d in %v", 2, found, keys)
+		}
+	})
+
+	t.Run("Context Is Honoured", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if _, err := c.Get(cctx, "client rob"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Want: %v; Got: %v", context.Canceled, err)
+		}
+	})
+}
+
+func TestReplica(t *testing.T) {
+	useTempLogger(t)
+	useAdminToken(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	// the writer mustn't share connections the test drops
+	c := client.New(srv.URL)
+	c.HTTPClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local := KVS{M: make(map[string]string)}
+	r := client.NewReplica(client.New(srv.URL), &local, 0)
+	r.RetryDelay = 10 * time.Millisecond
+	r.Token = adminToken
+
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+
+	// eventually waits for the replica to see key hold want ("" for absent)
+	eventually := func(t *testing.T, key, want string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			got, err := local.Get(key)
+			if want == "" && err == ErrorNoSuchKey || err == nil && got == want {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		got, err := local.Get(key)
+		t.Fatalf("Want: %s=%q; Got: %q %v", key, want, got, err)
+	}
+
+	t.Run("Catches Up And Stays In Sync", func(t *testing.T) {
+		c.Put(ctx, "replica a", "1")
+		c.Put(ctx, "replica b", "1")
+		eventually(t, "replica b", "1")
+
+		c.Put(ctx, "replica a", "2")
+		c.Delete(ctx, "replica b")
+		eventually(t, "replica a", "2")
+		eventually(t, "replica b", "")
+	})
+
+	t.Run("Resumes After A Dropped Connection", func(t *testing.T) {
+		applied := r.Applied()
+		srv.CloseClientConnections()
+
+		if err := c.Put(ctx, "replica c", "1"); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, "replica c", "1")
+
+		// only the new put, not the whole log again
+		if got := r.Applied(); got != applied+1 {
+			t.Errorf("Want: %d; Got: %d", applied+1, got)
+		}
+	})
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Want: %v; Got: %v", context.Canceled, err)
+	}
+}
+
+// gatedStore applies each event only once the test lets it through
+type gatedStore struct {
+	KVS
+	step chan struct{}
+}
+
+func (s *gatedStore) Put(key, value string) error {
+	<-s.step
+	return s.KVS.Put(key, value)
+}
+
+func TestReplicaLag(t *testing.T) {
+	useTempLogger(t)
+	useAdminToken(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := client.New(srv.URL)
+	for _, k := range []string{"lag a", "lag b", "lag c", "lag d"} {
+		c.Put(ctx, k, "1")
+	}
+
+	local := &gatedStore{KVS: KVS{M: make(map[string]string)}, step: make(chan struct{})}
+	r := client.NewReplica(client.New(srv.URL), local, 0)
+	r.LagInterval = -1
+	r.Token = adminToken
+
+	if _, known := r.Lag(); known {
+		t.Error("Want: lag unknown before a refresh")
+	}
+	before, err := r.RefreshLag(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != 4 {
+		t.Errorf("Want: %d; Got: %d", 4, before)
+	}
+
+	go r.Run(ctx)
+
+	// lagAfter lets n more events through and returns the lag once applied
+	lagAfter := func(n int) uint64 {
+		want := r.Applied() + uint64(n)
+		for i := 0; i < n; i++ {
+			local.step <- struct{}{}
+		}
+		for r.Applied() < want {
+			time.Sleep(time.Millisecond)
+		}
+		lag, _ := r.Lag()
+		return lag
+	}
+
+	if lag := lagAfter(1); lag != 3 {
+		t.Errorf("Want: %d; Got: %d", 3, lag)
+	}
+	if lag := lagAfter(3); lag != 0 {
+		t.Errorf("Want: %d; Got: %d", 0, lag)
+	}
+
+	var buf strings.Builder
+	r.WriteMetrics(&buf)
+	for _, want := range []string{"cngo_replica_applied_sequence 4", "cngo_replica_lag 0"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Want: %s in metrics; Got: %s", want, buf.String())
+		}
+	}
+}
+
+func TestPromote(t *testing.T) {
+	l := useTempLogger(t)
+	useAdminToken(t)
+	kvs = KVS{M: make(map[string]string)}
+	t.Cleanup(func() { kvs = KVS{M: make(map[string]string)} })
+
+	// the primary's log starts at 5, as if it had been compacted
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/_replicate" {
+			w.Write([]byte(`{"sequence": 7}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer primary-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"sequence": 5, "type": "put", "key": "standby-a", "value": "1", "version": 1}
+{"sequence": 6, "type": "put", "key": "standby-b", "value": "1", "version": 1}
+{"sequence": 7, "type": "delete", "key": "standby-a"}
+`))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer primary.Close()
+
+	if err := startStandby(primary.URL, "primary-secret"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stopStandby()
+		standby.Store(nil)
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for l.LastSequence() < 7 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Run("Standby Replicates And Refuses Writes", func(t *testing.T) {
+		if got, _ := kvs.Get("standby-b"); got != "1" {
+			t.Errorf("Want: %s; Got: %s", "1", got)
+		}
+		if _, err := kvs.Get("standby-a"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if rec := do("PUT", "/v1/standby-c", "1"); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+
+	t.Run("Promoted Standby Takes Writes", func(t *testing.T) {
+		rec := doAdmin("POST", "/v1/_promote", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `"sequence":7`) {
+			t.Errorf("Want: sequence 7; Got: %s", rec.Body.String())
+		}
+
+		if rec := do("PUT", "/v1/standby-c", "1"); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+	})
+
+	t.Run("Sequence Continues From The Primary's", func(t *testing.T) {
+		l.Wait()
+		if got := l.LastSequence(); got != 8 {
+			t.Errorf("Want: %d; Got: %d", 8, got)
+		}
+	})
+
+	t.Run("Promoting Twice Is 409", func(t *testing.T) {
+		if rec := doAdmin("POST", "/v1/_promote", ""); rec.Code != http.StatusConflict {
+			t.Errorf("Want: %d; Got: %d", http.StatusConflict, rec.Code)
+		}
+	})
+}
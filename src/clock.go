@@ -0,0 +1,21 @@
+package main
+
+import "time"
+
+// Clock tells the time. Anything time-based takes one so tests can swap
+// in a fake and move time along deterministically.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// now reads c, falling back to the real clock when c is nil
+func now(c Clock) time.Time {
+	if c == nil {
+		return realClock{}.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,126 @@
+package cluster
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func keys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestRing(t *testing.T) {
+	t.Run("Empty Ring Has No Owner", func(t *testing.T) {
+		if got := NewRing(0).Owner("a"); got != "" {
+			t.Errorf("Want: no owner; Got: %s", got)
+		}
+	})
+
+	t.Run("Ownership Is Stable And Spread", func(t *testing.T) {
+		r := NewRing(0, "a:1", "b:1", "c:1")
+		counts := make(map[string]int)
+
+		for _, k := range keys(3000) {
+			owner := r.Owner(k)
+			if again := r.Owner(k); again != owner {
+				t.Fatalf("Want: %s; Got: %s", owner, again)
+			}
+			counts[owner]++
+		}
+
+		for _, n := range r.Nodes() {
+			if counts[n] < 500 {
+				t.Errorf("Want: a fair share for %s; Got: %d of 3000", n, counts[n])
+			}
+		}
+	})
+
+	t.Run("Adding A Node Only Moves Keys To It", func(t *testing.T) {
+		r := NewRing(0, "a:1", "b:1", "c:1")
+		before := make(map[string]string)
+		for _, k := range keys(3000) {
+			before[k] = r.Owner(k)
+		}
+
+		r.Add("d:1")
+
+		moved := 0
+		for k, was := range before {
+			if now := r.Owner(k); now != was {
+				if now != "d:1" {
+					t.Fatalf("%s: Want: %s or d:1; Got: %s", k, was, now)
+				}
+				moved++
+			}
+		}
+		if moved == 0 || moved > 1500 {
+			t.Errorf("Want: roughly a quarter of keys moved; Got: %d of 3000", moved)
+		}
+	})
+
+	t.Run("Removing A Node Only Moves Its Keys", func(t *testing.T) {
+		r := NewRing(0, "a:1", "b:1", "c:1")
+		before := make(map[string]string)
+		for _, k := range keys(3000) {
+			before[k] = r.Owner(k)
+		}
+
+		r.Remove("b:1")
+
+		for k, was := range before {
+			now := r.Owner(k)
+			if was != "b:1" && now != was {
+				t.Fatalf("%s: Want: %s; Got: %s", k, was, now)
+			}
+			if now == "b:1" {
+				t.Fatalf("%s: Want: not b:1; Got: b:1", k)
+			}
+		}
+	})
+}
+
+func TestForwarder(t *testing.T) {
+	serve := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		})
+	}
+	keyFromPath := func(r *http.Request) (string, bool) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/")
+		return key, key != r.URL.Path
+	}
+
+	remote := httptest.NewServer(serve("remote"))
+	defer remote.Close()
+	self := "self:1"
+	ring := NewRing(0, self, remote.URL)
+
+	fwd := &Forwarder{Ring: ring, Self: self, Key: keyFromPath}
+	local := httptest.NewServer(fwd.Handler(serve("local")))
+	defer local.Close()
+
+	for _, k := range keys(20) {
+		resp, err := http.Get(local.URL + "/v1/" + k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		want := "local"
+		if ring.Owner(k) == remote.URL {
+			want = "remote"
+		}
+		if string(body) != want {
+			t.Errorf("%s: Want: %s; Got: %s", k, want, body)
+		}
+	}
+}
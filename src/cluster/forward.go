@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ForwardedHeader marks a request one node has proxied to another. The
+// receiving node always serves it, so a disagreement about the ring can't
+// bounce a request around forever.
+const ForwardedHeader = "X-Cngo-Forwarded"
+
+// Forwarder proxies requests for keys this node doesn't own to their owner
+type Forwarder struct {
+	Ring *Ring
+	Self string // this node's address, as it appears on the ring
+
+	// Key extracts the key a request is about. Requests it reports no key
+	// for are always served locally.
+	Key func(r *http.Request) (string, bool)
+
+	mu      sync.Mutex
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// Handler serves requests for owned keys with next and proxies the rest
+func (f *Forwarder) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ForwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, ok := f.Key(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		owner := f.Ring.Owner(key)
+		if owner == "" || owner == f.Self {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		proxy, err := f.proxy(owner)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		r.Header.Set(ForwardedHeader, f.Self)
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// proxy returns the reverse proxy for node, making it on first use
+func (f *Forwarder) proxy(node string) (*httputil.ReverseProxy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if p, ok := f.proxies[node]; ok {
+		return p, nil
+	}
+
+	target := node
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.proxies == nil {
+		f.proxies = make(map[string]*httputil.ReverseProxy)
+	}
+	p := httputil.NewSingleHostReverseProxy(u)
+	f.proxies[node] = p
+
+	return p, nil
+}
@@ -0,0 +1,123 @@
+// Package cluster spreads keys over several cngo nodes with consistent
+// hashing, and forwards requests for keys a node doesn't own.
+package cluster
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultReplicas is the number of points each node gets on the ring. More
+// points spread keys more evenly at the cost of a bigger ring.
+const DefaultReplicas = 128
+
+// Ring maps keys to node addresses. Adding or removing a node only moves
+// the keys that node gains or loses; every other key keeps its owner.
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	points   []uint64          // sorted hashes of every virtual node
+	owners   map[uint64]string // point to node address
+	nodes    map[string]bool
+}
+
+// NewRing makes a ring holding nodes, with replicas points per node; less
+// than 1 means DefaultReplicas
+func NewRing(replicas int, nodes ...string) *Ring {
+	if replicas < 1 {
+		replicas = DefaultReplicas
+	}
+
+	r := &Ring{
+		replicas: replicas,
+		owners:   make(map[uint64]string),
+		nodes:    make(map[string]bool),
+	}
+	for _, n := range nodes {
+		r.Add(n)
+	}
+
+	return r
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// Add puts node on the ring. Adding a node twice is a no-op.
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.nodes[node] {
+		return
+	}
+	r.nodes[node] = true
+
+	for i := 0; i < r.replicas; i++ {
+		p := hash(strconv.Itoa(i) + "#" + node)
+		if _, taken := r.owners[p]; taken {
+			continue // vanishingly rare; first node keeps the point
+		}
+		r.owners[p] = node
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes node off the ring, handing its keys to the next nodes along
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.nodes[node] {
+		return
+	}
+	delete(r.nodes, node)
+
+	points := r.points[:0]
+	for _, p := range r.points {
+		if r.owners[p] == node {
+			delete(r.owners, p)
+			continue
+		}
+		points = append(points, p)
+	}
+	r.points = points
+}
+
+// Owner is the node responsible for key, or "" if the ring is empty
+func (r *Ring) Owner(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0 // wrap around
+	}
+
+	return r.owners[r.points[i]]
+}
+
+// Nodes lists the nodes on the ring, sorted
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+
+	return nodes
+}
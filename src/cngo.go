@@ -2,130 +2,1517 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/rhardin/cngo/cluster"
+	"github.com/rhardin/cngo/config"
 )
 
-var transact *FileTransactionLogger
+var transact TransactionLogger
+
+// ready is set once the transaction log has been replayed
+var ready atomic.Bool
 
 var kvs = KVS{M: make(map[string]string)}
 
-func initTransactionLogger() error {
+// initTransactionLogger opens the configured logger, replays it into the
+// store and starts it. The caller makes it the package's transact.
+func initTransactionLogger(cfg *config.Config) (TransactionLogger, error) {
+	l, err := openTransactionLogger(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = replay(l, &kvs)
+	// a standby's log has no shutdown markers; see WriteSequenced
+	if t, ok := l.(*FileTransactionLogger); ok && err == nil && !t.LastShutdownClean() && cfg.Cluster.Primary == "" {
+		logger.Warn("transaction log has no shutdown marker; the last run may have crashed")
+	}
+
+	l.Run()
+	go logErrors(l.Err())
+
+	if err == nil {
+		ready.Store(true)
+	}
+
+	return l, err
+}
+
+// openTransactionLogger opens the configured logger without reading or
+// starting it
+func openTransactionLogger(cfg *config.Config) (TransactionLogger, error) {
+	var l TransactionLogger
 	var err error
 
-	t, err := MakeFileTransactionLogger("transact.log")
+	switch cfg.Backend {
+	case "postgres":
+		l, err = MakePostgresTransactionLogger(PostgresDBParams{
+			dsn:   cfg.Postgres.DSN,
+			retry: RetryPolicy{Attempts: cfg.Postgres.Attempts, Backoff: cfg.Postgres.RetryBackoff},
+			breaker: BreakerPolicy{
+				Threshold: cfg.Postgres.BreakerThreshold,
+				Cooldown:  cfg.Postgres.BreakerCooldown,
+			},
+		})
+	default:
+		opts := []FileLoggerOption{WithFlushInterval(cfg.Log.FlushInterval)}
+		if cfg.Log.Format == "msgpack" {
+			opts = append(opts, WithFormat(FormatMsgPack))
+		}
+		if cfg.Log.Shards > 1 {
+			l, err = MakeShardedTransactionLogger(cfg.Log.Path, cfg.Log.Shards, opts...)
+		} else {
+			l, err = MakeFileTransactionLogger(cfg.Log.Path, opts...)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create event  %w", err)
+		return nil, fmt.Errorf("failed to create event  %w", err)
 	}
-	transact = t
 
-	events, errors := transact.ReadEvents()
+	return l, nil
+}
+
+// logErrors logs the write failures a running logger reports, which
+// nothing else waits on, and keeps the latest for _errors
+func logErrors(errs <-chan error) {
+	for err := range errs {
+		logger.Error("transaction log write failed", "err", err)
+		recentErrors.add(err)
+	}
+}
+
+// replay rebuilds s from the logger: the latest snapshot if the logger
+// keeps them, then every event logged after it.
+func replay(l TransactionLogger, s *KVS) error {
+	var err error
+
+	var snapshotSeq uint64
+	if sn, ok := l.(Snapshotter); ok {
+		seq, state, versions, err := sn.LoadSnapshot()
+		if err != nil {
+			return fmt.Errorf("failed to load snapshot: %w", err)
+		}
+		s.Import(state, versions)
+		snapshotSeq = seq
+	}
+
+	startup.start(l)
+	defer startup.finish()
+	logCounts.reset()
+
+	var apply func(Event)
+	var wait func()
+	if replayWorkers > 1 {
+		apply, wait = applyParallel(s, replayWorkers)
+	}
+
+	events, errors := l.ReadEvents()
 	e, ok := Event{}, true
 
 	for ok && err == nil {
 		select {
 		case err, ok = <-errors:
 		case e, ok = <-events:
-			switch e.EventType {
-			case EventDelete:
-				err = kvs.Delete(e.Key)
-			case EventPut:
-				err = kvs.Put(e.Key, e.Value)
+			if !ok {
+				break
+			}
+			startup.event(e.Sequence)
+			logCounts.add(e.EventType)
+
+			if e.Sequence <= snapshotSeq {
+				continue // already in the snapshot
+			}
+
+			if apply != nil {
+				apply(e)
+				continue
 			}
+			err = applyEvent(s, e)
 		}
 	}
 
-	transact.Run()
-
+	if wait != nil {
+		wait()
+	}
 	return err
 }
 
+// replayWorkers is how many goroutines replay applies events on; 0 or 1
+// applies them in the order read
+var replayWorkers = 1
+
+// applyEvent applies one replayed event to s
+func applyEvent(s *KVS, e Event) error {
+	switch e.EventType {
+	case EventDelete:
+		return s.Delete(e.Key)
+	case EventPut:
+		s.restore(e.Key, e.Value, e.Version, e.Modified)
+	}
+	return nil
+}
+
+// applyParallel starts n workers applying events to s, and returns apply
+// to hand them events and wait to let them finish. Events are routed by
+// key, so each key's events are applied in log order by one worker while
+// different keys proceed at once. The store's lock still serializes the
+// writes themselves; what runs in parallel is encoding values, which
+// dominates for compressed or encrypted stores.
+func applyParallel(s *KVS, n int) (apply func(Event), wait func()) {
+	// keys are routed by their stripe, so more workers would sit idle
+	n = min(n, keyStripes)
+
+	queues := make([]chan Event, n)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan Event, 64)
+		wg.Add(1)
+		go func(q <-chan Event) {
+			defer wg.Done()
+			for e := range q {
+				applyEvent(s, e) // restore and Delete can't fail
+			}
+		}(queues[i])
+	}
+
+	apply = func(e Event) {
+		queues[stripe(s.NormalizeKey(e.Key))%uint32(n)] <- e
+	}
+	wait = func() {
+		for _, q := range queues {
+			close(q)
+		}
+		wg.Wait()
+	}
+	return apply, wait
+}
+
+// preload seeds the store from a JSON object of keys to string values,
+// logging each as a put, and returns how many keys it stored. Unlike
+// replay this is fresh data, so keys are validated and MaxKeys applies.
+func preload(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read preload file: %w", err)
+	}
+
+	var seed map[string]string
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return 0, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// check every key before storing any, so a bad file stores nothing
+	for key := range seed {
+		if err := validateKey(key); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for key, value := range seed {
+		key = kvs.NormalizeKey(key)
+		version, err := kvs.PutVersioned(key, value, 0)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := writePut(transact, key, value, version); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return len(seed), nil
+}
+
+// ReadyHandler expects to be called from http GET at "/ready". It reports
+// 503 until the log has been replayed, and while the backend (if it can
+// be pinged) is unreachable.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() {
+		writeError(w, r, fmt.Errorf("%w: replaying transaction log", ErrUnavailable))
+		return
+	}
+
+	if p, ok := transact.(interface{ Ping() error }); ok {
+		if err := p.Ping(); err != nil {
+			writeError(w, r, fmt.Errorf("%w: %v", ErrUnavailable, err))
+			return
+		}
+	}
+
+	w.Write([]byte("ok"))
+}
+
+// MaxKeyLength is the longest key the HTTP API accepts
+const MaxKeyLength = 1024
+
+// maxValueSize caps PUT bodies, in bytes
+var maxValueSize int64 = 1 << 20
+
+// validateKey rejects keys the API or the log can't represent
+func validateKey(key string) error {
+	if key == "" || len(key) > MaxKeyLength {
+		return fmt.Errorf("%w: must be 1-%d bytes", ErrInvalidKey, MaxKeyLength)
+	}
+
+	for _, c := range key {
+		if c < ' ' || c == 0x7f {
+			return fmt.Errorf("%w: control characters not allowed", ErrInvalidKey)
+		}
+	}
+
+	return nil
+}
+
+// b64Flag reports whether the named query flag, b64 for values or
+// b64key for keys, asks for base64
+func b64Flag(r *http.Request, name string) (bool, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return false, nil
+	}
+
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s must be a boolean", ErrInvalidArgument, name)
+	}
+	return on, nil
+}
+
+// requestKey is the {key} of the request, decoded from unpadded
+// URL-safe base64 when b64key is set so keys can hold any bytes, and
+// normalized as the store holds it
+func requestKey(r *http.Request) (string, error) {
+	key := mux.Vars(r)["key"]
+
+	on, err := b64Flag(r, "b64key")
+	if err != nil || !on {
+		return kvs.NormalizeKey(key), err
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return "", fmt.Errorf("%w: key is not valid base64", ErrInvalidKey)
+	}
+	return kvs.NormalizeKey(string(raw)), nil
+}
+
+// readValue reads a request body, enforcing maxValueSize. A gzip
+// Content-Encoding is decompressed, with the limit applying to both the
+// compressed and decompressed sizes so a small zip bomb can't get through.
+func readValue(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	body := http.MaxBytesReader(w, r.Body, maxValueSize)
+
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		return readGzipValue(body)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, enc)
+	}
+
+	val, err := io.ReadAll(body)
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, tooLarge.Limit)
+	}
+
+	return val, err
+}
+
+// readGzipValue decompresses a gzip request body of at most maxValueSize
+// bytes once inflated
+func readGzipValue(body io.Reader) ([]byte, error) {
+	var val []byte
+	zr, err := gzip.NewReader(body)
+	if err == nil {
+		val, err = io.ReadAll(io.LimitReader(zr, maxValueSize+1))
+	}
+
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return nil, fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, tooLarge.Limit)
+	case err != nil:
+		return nil, fmt.Errorf("%w: malformed gzip body: %v", ErrInvalidArgument, err)
+	case int64(len(val)) > maxValueSize:
+		return nil, fmt.Errorf("%w: limit is %d bytes decompressed", ErrBodyTooLarge, maxValueSize)
+	}
+
+	return val, nil
+}
+
+// TTLHeader sets a per-request expiry, in whole seconds, on PUT
+const TTLHeader = "X-Cngo-TTL"
+
+// requestTTL parses the TTL header, or failing that the ttl query
+// parameter; absent or zero means no expiry
+func requestTTL(r *http.Request) (time.Duration, error) {
+	name, v := TTLHeader, r.Header.Get(TTLHeader)
+	if v == "" {
+		name, v = "ttl", r.URL.Query().Get("ttl")
+	}
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a non-negative integer", ErrInvalidArgument, name)
+	}
+
+	return time.Duration(n) * time.Second, nil
+}
+
+// PutTransform rewrites a value on its way into the store, e.g. to
+// normalize or validate it. An error rejects the put with a 400.
+type PutTransform func(key, value string) (string, error)
+
+// putTransform is the registered PutTransform, if any
+var putTransform atomic.Pointer[PutTransform]
+
+// SetPutTransform registers fn to transform every value stored by PUT or
+// a _txn put before it's stored and logged, replacing any transform set
+// before. nil removes it.
+func SetPutTransform(fn PutTransform) {
+	if fn == nil {
+		putTransform.Store(nil)
+		return
+	}
+	putTransform.Store(&fn)
+}
+
+// transformValue runs the registered PutTransform over value
+func transformValue(key, value string) (string, error) {
+	fn := putTransform.Load()
+	if fn == nil {
+		return value, nil
+	}
+
+	value, err := (*fn)(key, value)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	return value, nil
+}
+
 // KeyValuePutHandler exoects to be called from http PUT at
-// "/v1/key/{key}" resource.
+// "/v1/key/{key}" resource. An X-Cngo-TTL header (or ttl parameter)
+// expires the key after that many seconds; the TTL is held in memory
+// only, so a key replayed after a restart comes back without one. With
+// nx=1 the key is only created if absent, otherwise it's a 412. Creating a
+// key is a 201, updating one a 200. With b64=1 the body is base64, and
+// with b64key=1 so is the key, for values and keys of arbitrary bytes.
+// type=int stores the value, which must then be a decimal integer, as a
+// native integer so counters incremented with add avoid reparsing it.
+// An If-Match header holding a version, "0" for an absent key, only puts
+// the value if the key is at that version, otherwise it's a 412.
+// Any PutTransform runs on the decoded value first, and
+// return=representation then echoes the transformed value.
 func KeyValuePutHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, err := requestKey(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := validateKey(key); err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	val, err := io.ReadAll(r.Body)
+	ttl, err := requestTTL(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	nx := false
+	if v := r.URL.Query().Get("nx"); v != "" {
+		if nx, err = strconv.ParseBool(v); err != nil {
+			writeError(w, r, fmt.Errorf("%w: nx must be a boolean", ErrInvalidArgument))
+			return
+		}
+	}
 
+	b64, err := b64Flag(r, "b64")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	body, err := readValue(w, r)
+
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 	defer r.Body.Close()
 
-	err = kvs.Put(key, string(val))
+	val := body
+	if b64 {
+		if val, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(body))); err != nil {
+			writeError(w, r, fmt.Errorf("%w: value is not valid base64", ErrInvalidArgument))
+			return
+		}
+	}
+
+	if putTransform.Load() != nil {
+		v, err := transformValue(key, string(val))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		val, body = []byte(v), []byte(v)
+		if b64 {
+			body = []byte(base64.StdEncoding.EncodeToString(val))
+		}
+	}
+
+	ifVersion, err := ifMatchVersion(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if ifVersion != nil && nx {
+		writeError(w, r, fmt.Errorf("%w: If-Match and nx can't be used together", ErrInvalidArgument))
+		return
+	}
+
+	var n int64
+	numeric := false
+	switch r.URL.Query().Get("type") {
+	case "", "string":
+	case "int":
+		if nx || ifVersion != nil {
+			writeError(w, r, fmt.Errorf("%w: nx and If-Match are not supported with type=int", ErrInvalidArgument))
+			return
+		}
+		if n, err = strconv.ParseInt(strings.TrimSpace(string(val)), 10, 64); err != nil {
+			writeError(w, r, fmt.Errorf("%w: value is not a 64-bit integer", ErrInvalidArgument))
+			return
+		}
+		numeric, val = true, []byte(strconv.FormatInt(n, 10))
+	default:
+		writeError(w, r, fmt.Errorf("%w: type must be string or int", ErrInvalidArgument))
+		return
+	}
+
+	done, err := beginWrite()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
+
+	start := time.Now()
+	var res PutResult
+	if numeric {
+		res, err = kvs.PutInt(key, n, ttl)
+	} else {
+		res, err = putValue(key, string(val), ttl, nx, ifVersion)
+	}
+	observeOp("put", start)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
+		return
+	}
+
+	if err := writePut(transact, key, string(val), res.Version); err != nil {
+		writeError(w, r, err)
 		return
 	}
+	valueSizes.Observe(float64(len(val)))
+	logger.Debug("put", "key", key, "size", len(val))
 
-	transact.WritePut(key, string(val))
-	log.Printf("PUT key=%s value=%s\n", key, val)
+	w.Header().Set("Location", "/v1/"+url.PathEscape(key))
+	w.Header().Set(VersionHeader, strconv.FormatUint(res.Version, 10))
+
+	status := http.StatusOK
+	if res.Created {
+		status = http.StatusCreated
+	}
 
-	w.WriteHeader(http.StatusCreated)
+	if !prefers(r, "return=representation") {
+		w.WriteHeader(status)
+		return
+	}
+
+	w.Header().Set("Preference-Applied", "return=representation")
+	w.WriteHeader(status)
+	w.Write(body)
 }
 
-// KeyValueGetHandler expects to be called from http GET at
-// "/v1/key/{key}" resource.
+// ifMatchVersion is the version in a PUT's If-Match header, quoted or
+// not, or nil without one
+func ifMatchVersion(r *http.Request) (*uint64, error) {
+	h := strings.TrimSpace(r.Header.Get("If-Match"))
+	if h == "" {
+		return nil, nil
+	}
+
+	v, err := strconv.ParseUint(strings.Trim(h, `"`), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: If-Match on a PUT must be a version", ErrInvalidArgument)
+	}
+	return &v, nil
+}
+
+// putValue stores the value for KeyValuePutHandler, only at version
+// ifVersion if it's given
+func putValue(key, value string, ttl time.Duration, nx bool, ifVersion *uint64) (PutResult, error) {
+	if ifVersion != nil {
+		return kvs.setIfVersion(key, value, *ifVersion, ttl)
+	}
+	if !nx {
+		return kvs.PutWithResult(key, value, ttl)
+	}
+
+	created, err := kvs.SetNX(key, value, ttl)
+	if err == nil && !created {
+		err = fmt.Errorf("%w: key exists", ErrPrecondition)
+	}
+
+	return PutResult{Version: 1, Created: true}, err
+}
+
+// strongDurability makes writePut and writeDelete wait for loggers that
+// can fsync to do so, so a write isn't acknowledged until it would
+// survive a crash. Postgres commits are durable whatever it's set to.
+var strongDurability bool
+
+// writePut logs a put, with the key's version and the time kvs made the
+// put if l records them. If l can tell whether the write made it into the
+// log, it waits to find out and returns ErrLogWrite if not.
+func writePut(l TransactionLogger, key, value string, version uint64) error {
+	if err := logPut(l, key, value, version); err != nil {
+		return fmt.Errorf("%w: %w", ErrLogWrite, err)
+	}
+
+	logCounts.add(EventPut)
+	return nil
+}
+
+// writeDelete logs a delete, checked as for writePut
+func writeDelete(l TransactionLogger, key string) error {
+	if err := logDelete(l, key); err != nil {
+		return fmt.Errorf("%w: %w", ErrLogWrite, err)
+	}
+
+	logCounts.add(EventDelete)
+	return nil
+}
+
+// writeBatch logs events as one unit if l can, so a replay applies all of
+// them or none, and returns l's error if they didn't make it into the log.
+// Loggers that can't are sent each event on its own, as by writePut and
+// writeDelete, so for them a failure part way leaves a prefix logged.
+func writeBatch(l TransactionLogger, events []Event) error {
+	bl, ok := l.(BatchLogger)
+	if !ok {
+		for _, e := range events {
+			var err error
+			if e.EventType == EventDelete {
+				err = logDelete(l, e.Key)
+			} else {
+				err = logPut(l, e.Key, e.Value, e.Version)
+			}
+			if err != nil {
+				return err
+			}
+			logCounts.add(e.EventType)
+		}
+		return nil
+	}
+
+	events = append([]Event(nil), events...)
+	for i, e := range events {
+		if e.EventType == EventPut {
+			events[i].Modified = kvs.putTime(e.Key, e.Version)
+		}
+	}
+	if err := bl.WriteBatch(events, strongDurability); err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		logCounts.add(e.EventType)
+	}
+	return nil
+}
+
+// logPut is writePut, returning l's error as it is
+func logPut(l TransactionLogger, key, value string, version uint64) error {
+	modified := kvs.putTime(key, version)
+
+	if sl, ok := l.(SyncLogger); ok && strongDurability {
+		return sl.WritePutSync(key, value, version, modified)
+	}
+
+	if cl, ok := l.(CheckedLogger); ok {
+		return cl.WritePutChecked(key, value, version, modified)
+	}
+
+	if vl, ok := l.(VersionLogger); ok {
+		vl.WritePutVersion(key, value, version, modified)
+		return nil
+	}
+
+	l.WritePut(key, value)
+	return nil
+}
+
+// logDelete is writeDelete, returning l's error as it is
+func logDelete(l TransactionLogger, key string) error {
+	if sl, ok := l.(SyncLogger); ok && strongDurability {
+		return sl.WriteDeleteSync(key)
+	}
+
+	if cl, ok := l.(CheckedLogger); ok {
+		return cl.WriteDeleteChecked(key)
+	}
+
+	l.WriteDelete(key)
+	return nil
+}
+
+// logEviction logs a key kvs evicted to stay within MaxBytes as a delete,
+// so it doesn't come back when the log is replayed
+func logEviction(key string) {
+	if err := writeDelete(transact, key); err != nil {
+		logger.Error("cannot log eviction", "key", key, "err", err)
+	}
+}
+
+// prefers reports whether the request's Prefer header (RFC 7240) asks for
+// the given preference
+func prefers(r *http.Request, pref string) bool {
+	for _, h := range r.Header.Values("Prefer") {
+		for _, p := range strings.Split(h, ",") {
+			if strings.EqualFold(strings.TrimSpace(p), pref) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// FoundHeader tells clients whether a key exists, so an empty value is
+// never mistaken for a missing key
+const FoundHeader = "X-Cngo-Found"
+
+// VersionHeader carries a key's version, which goes up by one on every
+// put, so clients can spot changes without comparing values
+const VersionHeader = "X-Cngo-Version"
+
+// ValueResponse is the body of a GET in JSON format
+type ValueResponse struct {
+	Key      string     `json:"key"`
+	Value    string     `json:"value"`
+	Version  uint64     `json:"version"`
+	Modified *time.Time `json:"modified,omitempty"` // when the key was last put
+}
+
+// KeyValueGetHandler expects to be called from http GET or HEAD at
+// "/v1/key/{key}" resource. The value is sent raw unless the client
+// accepts JSON, and a format=json or format=raw parameter beats the
+// Accept header. A raw value's Content-Type is sniffed from its content.
+// The ETag and Content-Length need the whole value up
+// front, so the raw body is written from that same string rather than
+// streamed with GetInto, but still without copying it. b64=1 sends the
+// value base64 encoded, raw or in JSON, and b64key=1 takes the key in
+// base64 as for PUT. A default=V parameter answers a missing key with a
+// 200 carrying V, still marked not found, instead of a 404; the key is
+// not created. Last-Modified is when the key was last put, and a GET
+// with an If-Modified-Since no earlier than that is a 304. JSON carries
+// the time too, at full precision.
 func KeyValueGetHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, err := requestKey(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	val, err := kvs.Get(key)
-	if errors.Is(err, ErrorNoSuchKey) {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if f := r.URL.Query().Get("format"); f != "" && f != "json" && f != "raw" {
+		writeError(w, r, fmt.Errorf("%w: format must be json or raw", ErrInvalidArgument))
 		return
 	}
+
+	b64, err := b64Flag(r, "b64")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write([]byte(val))
+	start := time.Now()
+	val, version, mod, err := kvs.GetWithMeta(key)
+	observeOp("get", start)
+
+	q := r.URL.Query()
+	switch {
+	case errors.Is(err, ErrorNoSuchKey) && q.Has("default"):
+		val = q.Get("default")
+		w.Header().Set(FoundHeader, "false")
+	case err != nil:
+		w.Header().Set(FoundHeader, "false")
+		writeError(w, r, err)
+		return
+	default:
+		w.Header().Set(FoundHeader, "true")
+		w.Header().Set("ETag", etag(val))
+		w.Header().Set(VersionHeader, strconv.FormatUint(version, 10))
+
+		w.Header().Set("Last-Modified", mod.UTC().Format(http.TimeFormat))
+		if notModifiedSince(r, mod) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Vary", "Accept")
+
+	if b64 {
+		val = base64.StdEncoding.EncodeToString([]byte(val))
+	}
+
+	if acceptsJSON(r) {
+		resp := ValueResponse{Key: key, Value: val, Version: version}
+		if err == nil {
+			mod = mod.UTC()
+			resp.Modified = &mod
+		}
+		body, _ := json.Marshal(resp)
+		body = append(body, '\n')
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		if r.Method != http.MethodHead {
+			w.Write(body)
+		}
+		return
+	}
+
+	if b64 {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", contentType(val))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	io.WriteString(w, val)
+}
+
+// notModifiedSince reports whether r's If-Modified-Since is no earlier
+// than mod, at the header's one second resolution. As HTTP requires, it's
+// ignored when the request has an If-None-Match.
+func notModifiedSince(r *http.Request, mod time.Time) bool {
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	return !mod.Truncate(time.Second).After(since)
+}
+
+// contentType guesses a value's media type, as PUT doesn't record one.
+// http.DetectContentType has no JSON rule, so JSON documents are checked
+// for first.
+func contentType(value string) string {
+	if t := strings.TrimLeft(value, " \t\r\n"); t != "" && (t[0] == '{' || t[0] == '[') && json.Valid([]byte(value)) {
+		return "application/json"
+	}
+
+	if len(value) > 512 {
+		value = value[:512]
+	}
+
+	return http.DetectContentType([]byte(value))
+}
+
+// etag is the strong entity tag for a value
+func etag(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-Match header value lists tag. Weak
+// tags never match, as If-Match requires strong comparison.
+func etagMatches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
 }
 
 // KeyValueDeleteHandler expects to be called from http DELETE at
-// "/v1/key/{key}" resource.
+// "/v1/key/{key}" resource. With an If-Match header the key is only
+// deleted if its current ETag matches, otherwise it's a 412. b64key=1
+// takes the key in base64, as for GET.
 func KeyValueDeleteHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	key := vars["key"]
+	key, err := requestKey(r)
+	if err == nil {
+		err = validateKey(key)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	done, err := beginWrite()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
+
+	start := time.Now()
+	err = deleteKey(key, r.Header.Get("If-Match"))
+	observeOp("delete", start)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	err := kvs.Delete(key)
+	if err := writeDelete(transact, key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteKey deletes key, or with a non-empty ifMatch only if the value
+// still has a matching ETag
+func deleteKey(key, ifMatch string) error {
+	if ifMatch == "" {
+		return kvs.Delete(key)
+	}
+
+	val, err := kvs.Get(key)
 	if errors.Is(err, ErrorNoSuchKey) {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		return fmt.Errorf("%w: no current value", ErrPrecondition)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !etagMatches(ifMatch, etag(val)) {
+		return fmt.Errorf("%w: ETag does not match", ErrPrecondition)
+	}
+
+	// the value may have changed since Get; only delete what we matched
+	deleted, err := kvs.CompareAndDelete(key, val)
+	if errors.Is(err, ErrorNoSuchKey) || (err == nil && !deleted) {
+		return fmt.Errorf("%w: value changed", ErrPrecondition)
+	}
+
+	return err
+}
+
+// AddResponse is the body returned by KeyValueAddHandler
+type AddResponse struct {
+	Key     string `json:"key"`
+	Value   int64  `json:"value"`
+	Version uint64 `json:"version"`
+	Retries int    `json:"retries"`
+}
+
+// KeyValueAddHandler expects to be called from http POST at
+// "/v1/{key}/add" resource, with the integer to add as the body (1 if
+// empty). It replies with the new value and how many times the underlying
+// compare-and-swap had to retry under contention.
+func KeyValueAddHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err == nil {
+		err = validateKey(key)
+	}
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+
+	body, err := readValue(w, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
+	defer r.Body.Close()
+
+	delta := int64(1)
+	if v := strings.TrimSpace(string(body)); v != "" {
+		if delta, err = strconv.ParseInt(v, 10, 64); err != nil {
+			writeError(w, r, fmt.Errorf("%w: delta must be an integer", ErrInvalidArgument))
+			return
+		}
+	}
 
-	transact.WriteDelete(key)
+	done, err := beginWrite()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
 
+	start := time.Now()
+	res, err := kvs.Add(key, delta)
+	observeOp("put", start)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := writePut(transact, key, strconv.FormatInt(res.Value, 10), res.Version); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(VersionHeader, strconv.FormatUint(res.Version, 10))
+	json.NewEncoder(w).Encode(AddResponse{Key: key, Value: res.Value, Version: res.Version, Retries: res.Retries})
+}
+
+// KeyValueRenameHandler expects to be called from http POST at
+// "/v1/{key}/rename" resource, with the new key as the body. Any value
+// already at the new key is replaced. Any AuthPolicy must allow a PUT of
+// the new key too.
+func KeyValueRenameHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err == nil {
+		err = validateKey(key)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	body, err := readValue(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	target := kvs.NormalizeKey(strings.TrimSpace(string(body)))
+	if err := validateKey(target); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := authorize(r, "PUT", target); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	done, err := beginWrite()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
+
+	start := time.Now()
+	val, version, err := kvs.rename(key, target)
+	observeOp("put", start)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// put before delete, so a crash in between leaves both keys rather
+	// than neither
+	if key != target {
+		err = writePut(transact, target, val, version)
+		if err == nil {
+			err = writeDelete(transact, key)
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", "/v1/"+url.PathEscape(target))
+	w.Header().Set(VersionHeader, strconv.FormatUint(version, 10))
 	w.WriteHeader(http.StatusOK)
 }
 
-func init() {
-	err := initTransactionLogger()
+// DeletePrefixResponse is the body returned by DeletePrefixHandler
+type DeletePrefixResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// DeletePrefixHandler expects to be called from http DELETE at
+// "/v1/_keys?prefix=P" resource, behind requireAuth. It deletes every key
+// starting with P, which must not be empty, and logs each delete.
+func DeletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	if prefix == "" {
+		writeError(w, r, fmt.Errorf("%w: prefix must not be empty", ErrInvalidArgument))
+		return
+	}
+
+	done, err := beginWrite()
 	if err != nil {
-		panic(err)
+		writeError(w, r, err)
+		return
 	}
+	defer done()
 
+	start := time.Now()
+	deleted := kvs.deletePrefix(prefix)
+	observeOp("delete", start)
+
+	var failed error
+	for _, k := range deleted {
+		if err := writeDelete(transact, k); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	logger.Info("delete prefix", "prefix", prefix, "deleted", len(deleted))
+
+	if failed != nil {
+		writeError(w, r, failed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeletePrefixResponse{Deleted: len(deleted)})
 }
 
-func main() {
+// DefaultScanLimit is the page size used when _scan is called without a
+// limit, and the largest page a client may ask for.
+const DefaultScanLimit = 1000
+
+// ScanResponse is the body returned by KeyValueScanHandler
+type ScanResponse struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next,omitempty"`
+}
+
+// KeyValueScanHandler expects to be called from http GET at
+// "/v1/_scan?cursor=X&limit=N" resource. Keys are returned sorted, and
+// the next page starts strictly after the returned cursor. Under an
+// AuthPolicy keys the caller may not GET are left out, so a page may
+// hold fewer than limit keys and still have a next.
+func KeyValueScanHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := DefaultScanLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, fmt.Errorf("%w: limit must be a positive integer", ErrInvalidArgument))
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	page, next := kvs.Scan(q.Get("cursor"), limit)
+	keys := []string{}
+	for _, k := range page {
+		if authorize(r, "GET", k) == nil {
+			keys = append(keys, k)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ScanResponse{Keys: keys, Next: next})
+}
+
+// TreeResponse is the body returned by KeyValueTreeHandler
+type TreeResponse struct {
+	Prefix string   `json:"prefix"`
+	Keys   []string `json:"keys"`
+	Dirs   []string `json:"dirs"`
+}
+
+// KeyValueTreeHandler expects to be called from http GET at
+// "/v1/_tree?prefix=P" resource. It lists one level of the keyspace
+// under P, with "/" separating levels: the keys there and the prefixes
+// leading further down. Under an AuthPolicy only keys the caller may GET
+// are listed, and only prefixes leading to one.
+func KeyValueTreeHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	keys, dirs := kvs.tree(prefix, func(k string) bool {
+		return authorize(r, "GET", k) == nil
+	})
+	if keys == nil {
+		keys = []string{}
+	}
+	if dirs == nil {
+		dirs = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TreeResponse{Prefix: prefix, Keys: keys, Dirs: dirs})
+}
+
+// DefaultPrefixLimit is how many pairs _prefix returns when called
+// without a limit, and the most a client may ask for
+const DefaultPrefixLimit = 1000
+
+// TruncatedHeader is set to "true" when _prefix matched more keys than it
+// returned
+const TruncatedHeader = "X-Cngo-Truncated"
+
+// KeyValuePrefixHandler expects to be called from http GET at
+// "/v1/_prefix/{prefix}?limit=N" resource. It replies with a JSON object
+// of the live keys starting with prefix and their values. Past the limit
+// the first keys in sorted order are returned, with TruncatedHeader set;
+// the rest can be found with _scan. Any AuthPolicy is asked about each
+// key as a GET.
+func KeyValuePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	limit := DefaultPrefixLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, fmt.Errorf("%w: limit must be a positive integer", ErrInvalidArgument))
+			return
+		}
+		if n < limit {
+			limit = n
+		}
+	}
+
+	start := time.Now()
+	pairs, more := kvs.GetPrefix(mux.Vars(r)["prefix"], limit)
+	observeOp("get", start)
+
+	for k := range pairs {
+		if err := authorize(r, "GET", k); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	if more {
+		w.Header().Set(TruncatedHeader, "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/v1/{key}", KeyValuePutHandler).Methods("PUT")
-	r.HandleFunc("/v1/{key}", KeyValueGetHandler).Methods("GET")
-	r.HandleFunc("/v1/{key}", KeyValueDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/ready", ReadyHandler).Methods("GET")
+	r.HandleFunc("/startup", StartupHandler).Methods("GET")
+	r.HandleFunc("/metrics", MetricsHandler).Methods("GET")
+
+	r.HandleFunc("/v1/_stats", StatsHandler).Methods("GET")
+	r.HandleFunc("/v1/_scan", KeyValueScanHandler).Methods("GET")
+	r.HandleFunc("/v1/_tree", KeyValueTreeHandler).Methods("GET")
+	r.HandleFunc("/v1/_prefix/{prefix:.*}", KeyValuePrefixHandler).Methods("GET")
+	r.HandleFunc("/v1/_changes", requireAuth(ChangesHandler)).Methods("GET")
+	r.HandleFunc("/v1/_compact", requireAuth(CompactStatsHandler)).Methods("GET")
+	r.HandleFunc("/v1/_compact", requireAuth(CompactHandler)).Methods("POST")
+	r.HandleFunc("/v1/_snapshot", requireAuth(SnapshotHandler)).Methods("POST")
+	r.HandleFunc("/v1/_log", requireAuth(LogHandler)).Methods("GET")
+	r.HandleFunc("/v1/_flush", requireAuth(FlushHandler)).Methods("POST")
+	r.HandleFunc("/v1/_txn", TxnHandler).Methods("POST")
+	r.HandleFunc("/v1/_replicate", requireAuth(ReplicateHandler)).Methods("GET")
+	r.HandleFunc("/v1/_seq", SequenceHandler).Methods("GET")
+	r.HandleFunc("/v1/_errors", ErrorsHandler).Methods("GET")
+	r.HandleFunc("/v1/_verify", VerifyHandler).Methods("GET")
+	r.HandleFunc("/v1/_backup", requireAuth(BackupHandler)).Methods("GET")
+	r.HandleFunc("/v1/_export", requireAuth(ExportHandler)).Methods("GET")
+	r.HandleFunc("/v1/_import", ImportHandler).Methods("POST")
+	r.HandleFunc("/v1/_keys", requireAuth(DeletePrefixHandler)).Methods("DELETE")
+	r.HandleFunc("/v1/_admin/token", requireAuth(TokenRotateHandler)).Methods("POST")
+	r.HandleFunc("/v1/_drain", requireAuth(DrainHandler)).Methods("POST")
+	r.HandleFunc("/v1/_undrain", requireAuth(UndrainHandler)).Methods("POST")
+	r.HandleFunc("/v1/_promote", requireAuth(PromoteHandler)).Methods("POST")
+
+	// keys may hold slashes, so the routes with a suffix come first: a
+	// GET of ".../history" is always the history of the key before it
+	r.HandleFunc("/v1/{key:.+}/add", KeyValueAddHandler).Methods("POST")
+	r.HandleFunc("/v1/{key:.+}/rename", KeyValueRenameHandler).Methods("POST")
+	r.HandleFunc("/v1/{key:.+}/history", KeyHistoryHandler).Methods("GET")
+	r.HandleFunc("/v1/{key:.+}", KeyValuePutHandler).Methods("PUT")
+	r.HandleFunc("/v1/{key:.+}", KeyValuePatchHandler).Methods("PATCH")
+	r.HandleFunc("/v1/{key:.+}", KeyValueGetHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/v1/{key:.+}", KeyValueDeleteHandler).Methods("DELETE")
+
+	r.Use(authorizeKeys)
+
+	return r
+}
+
+// routeKey is the {key} a request was routed by, for cluster forwarding,
+// decoded as the handler will see it. A key that doesn't decode is
+// forwarded by its raw form, for its owner to refuse.
+func routeKey(r *http.Request) (string, bool) {
+	raw, ok := mux.Vars(r)["key"]
+	if !ok {
+		return "", false
+	}
+	key, err := requestKey(r)
+	if err != nil {
+		return kvs.NormalizeKey(raw), true
+	}
+	return key, true
+}
+
+// Shutdown stops the server in order: srv stops accepting requests and
+// waits for those in flight, then writes are paused and the transaction
+// log is closed, so no event can be sent to a closed logger. ctx bounds
+// the whole sequence; whatever is left of it after the requests goes to
+// draining the logger.
+func Shutdown(ctx context.Context, srv *http.Server) error {
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		err = fmt.Errorf("requests still in flight: %w", err)
+	}
+
+	drain := DefaultShutdownDrain
+	if deadline, ok := ctx.Deadline(); ok {
+		drain = time.Until(deadline)
+	}
+
+	return errors.Join(err, closeTransact(drain))
+}
+
+// DefaultShutdownDrain is how long Shutdown gives the logger when ctx has
+// no deadline
+const DefaultShutdownDrain = 10 * time.Second
+
+// taskGroup runs background tasks, like snapshotEvery, until stopped
+type taskGroup struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// tasks are the server's background tasks, stopped by closeTransact
+// before the logger they use is closed
+var tasks taskGroup
+
+// start runs task in its own goroutine, with a context done once stop is
+// called
+func (g *taskGroup) start(task func(ctx context.Context)) {
+	g.mu.Lock()
+	if g.ctx == nil {
+		g.ctx, g.cancel = context.WithCancel(context.Background())
+	}
+	ctx := g.ctx
+	g.wg.Add(1)
+	g.mu.Unlock()
+
+	go func() {
+		defer g.wg.Done()
+		task(ctx)
+	}()
+}
+
+// stop cancels the running tasks and waits for them to return
+func (g *taskGroup) stop() {
+	g.mu.Lock()
+	if g.cancel != nil {
+		g.cancel()
+		g.ctx, g.cancel = nil, nil
+	}
+	g.mu.Unlock()
+
+	g.wg.Wait()
+}
+
+// closeTransact stops the background tasks and any standby replicating,
+// then writes, and closes the logger. Loggers that support it get drain
+// to write out buffered events.
+func closeTransact(drain time.Duration) error {
+	tasks.stop()
+	stopStandby()
+	pauseWrites()
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	type closerWithTimeout interface {
+		CloseWithTimeout(time.Duration) (int, error)
+	}
+
+	if c, ok := transact.(closerWithTimeout); ok {
+		if dropped, err := c.CloseWithTimeout(drain); err != nil {
+			return fmt.Errorf("%d events dropped: %w", dropped, err)
+		}
+	} else if c, ok := transact.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		logger.Error("cngo stopped", "err", err)
+		os.Exit(1)
+	}
+}
+
+// serve configures and starts the server, returning once it fails. Once
+// the transaction log is open it's closed on the way out, so whatever was
+// logged is flushed.
+func serve(fs *flag.FlagSet, args []string, out io.Writer) error {
+	validate := fs.Bool("validate", false, "check the configuration, and that the backend is reachable, then exit")
+
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if *validate {
+		if err := checkConfig(cfg); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "configuration ok")
+		return nil
+	}
+
+	kvs.FoldCase = cfg.FoldKeyCase
+	replayWorkers = cfg.Log.ReplayWorkers
+	kvs.MaxKeys = cfg.Limits.MaxKeys
+	kvs.CompressAbove = cfg.Limits.CompressAbove
+	kvs.MaxBytes = cfg.Limits.MaxBytes
+	maxValueSize = cfg.Limits.MaxValueSize
+	strongDurability = cfg.Log.Durability == "strong"
+	if len(cfg.Metrics.ValueSizeBuckets) > 0 {
+		valueSizes = newHistogram(cfg.Metrics.ValueSizeBuckets...)
+	}
+
+	if err := setAuth(cfg.Auth.Tokens, cfg.Auth.Users); err != nil {
+		return err
+	}
+
+	// offline commands that rewrite the log, like compact, take the lock too
+	if cfg.Backend == "file" {
+		unlock, err := lockLog(cfg.Log.Path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	// listen before replaying, so the probes answer while it runs
+	addr := cfg.Listen
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	// streams like _replicate run until their request's context is done,
+	// so they're cancelled as soon as shutdown starts
+	base, cancelStreams := context.WithCancel(context.Background())
+	gate := newStartupGate()
+	srv := &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           gate,
+		BaseContext:       func(net.Listener) context.Context { return base },
+		ReadHeaderTimeout: cfg.HTTP.ReadTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+	}
+	srv.RegisterOnShutdown(cancelStreams)
+
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	if transact, err = initTransactionLogger(cfg); err != nil {
+		return errors.Join(err, srv.Close())
+	}
+
+	kvs.OnChange(changes.publish)
+	kvs.OnEvict(logEviction)
+
+	if cfg.Cluster.Primary != "" {
+		if err := startStandby(cfg.Cluster.Primary, cfg.Cluster.PrimaryToken); err != nil {
+			return errors.Join(err, srv.Close(), closeTransact(cfg.DrainTimeout))
+		}
+	}
+
+	if cfg.Preload != "" {
+		n, err := preload(cfg.Preload)
+		if err != nil {
+			return errors.Join(err, srv.Close(), closeTransact(cfg.DrainTimeout))
+		}
+		logger.Info("preloaded", "keys", n, "path", cfg.Preload)
+	}
+
+	if cfg.SnapshotInterval > 0 {
+		tasks.start(func(ctx context.Context) { snapshotEvery(ctx, cfg.SnapshotInterval) })
+	}
+	if cfg.Compaction.Check > 0 {
+		tasks.start(func(ctx context.Context) { compactEvery(ctx, cfg.Compaction) })
+	}
+	if cfg.VerifyInterval > 0 {
+		tasks.start(func(ctx context.Context) { verifyEvery(ctx, cfg.VerifyInterval) })
+	}
+
+	router := newRouter()
+	router.Use(clientTimeouts(cfg.HTTP.WriteTimeout, cfg.HTTP.HandlerTimeout))
+	if cfg.Metrics.SlowRequest > 0 {
+		router.Use(slowRequests(cfg.Metrics.SlowRequest))
+	}
+
+	// Keyed requests go to the node owning the key; the _ endpoints, like
+	// _scan, only see this node's keys.
+	if len(cfg.Cluster.Peers) > 0 {
+		ring := cluster.NewRing(0, cfg.Cluster.Peers...)
+		ring.Add(cfg.Cluster.Self)
+
+		fwd := &cluster.Forwarder{Ring: ring, Self: cfg.Cluster.Self, Key: routeKey}
+		router.Use(fwd.Handler)
+	}
+
+	gate.open(limitRequests(cfg.HTTP.MaxRequests, router))
+
+	stopped := make(chan error, 1)
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		defer cancel()
+		stopped <- Shutdown(ctx, srv)
+	}()
+
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return errors.Join(err, closeTransact(cfg.DrainTimeout))
+	}
+	return <-stopped
 }
@@ -1,9 +1,65 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/rhardin/cngo/config"
 )
 
+// useLogBuffer sends the server's log to buf, as text, for the duration
+// of the test
+func useLogBuffer(t *testing.T, buf *bytes.Buffer) {
+	t.Helper()
+
+	saved := logger
+	logger = slog.New(slog.NewTextHandler(buf, nil))
+	t.Cleanup(func() { logger = saved })
+}
+
+// useTempLogger swaps the package logger for a fresh file logger in a
+// temporary directory for the duration of the test.
+func useTempLogger(t *testing.T) *FileTransactionLogger {
+	t.Helper()
+
+	l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+
+	saved := transact
+	transact = l
+	t.Cleanup(func() {
+		transact = saved
+		l.Close()
+	})
+
+	return l
+}
+
 func TestStore(t *testing.T) {
 	t.Run("Get Should Accept Strings", func(t *testing.T) {
 		expect := "was here"
@@ -53,3 +109,4129 @@ func TestStore(t *testing.T) {
 		}
 	})
 }
+
+// fakeClock is a Clock that only moves when told to
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.t = c.t.Add(d)
+	c.mu.Unlock()
+}
+
+func TestFoldCase(t *testing.T) {
+	t.Run("Keys Are Case-Sensitive By Default", func(t *testing.T) {
+		s := &KVS{M: make(map[string]string)}
+		s.Put("Foo", "upper")
+		s.Put("foo", "lower")
+
+		if got, _ := s.Get("Foo"); got != "upper" {
+			t.Errorf("Want: %s; Got: %s", "upper", got)
+		}
+		if _, err := s.Get("FOO"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if got := s.Len(); got != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, got)
+		}
+	})
+
+	t.Run("Folded Keys Collide", func(t *testing.T) {
+		s := &KVS{M: make(map[string]string), FoldCase: true}
+		s.Put("Foo", "upper")
+		s.Put("foo", "lower")
+
+		if got, _ := s.Get("FOO"); got != "lower" {
+			t.Errorf("Want: %s; Got: %s", "lower", got)
+		}
+		if got := s.Len(); got != 1 {
+			t.Errorf("Want: %d; Got: %d", 1, got)
+		}
+
+		s.Delete("fOO")
+		if _, err := s.Get("foo"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+
+	t.Run("Scan Cursors Are Folded", func(t *testing.T) {
+		s := &KVS{M: make(map[string]string), FoldCase: true}
+		for _, k := range []string{"a", "b", "c"} {
+			s.Put(k, "v")
+		}
+
+		// unfolded, "B" sorts before every key and would repeat the page
+		if keys, _ := s.Scan("B", 0); !slices.Equal(keys, []string{"c"}) {
+			t.Errorf("Want: %v; Got: %v", []string{"c"}, keys)
+		}
+	})
+
+	t.Run("Folded Keys Are Logged Lowercase", func(t *testing.T) {
+		l := useTempLogger(t)
+		kvs.FoldCase = true
+		t.Cleanup(func() { kvs.FoldCase = false })
+
+		do("PUT", "/v1/Fold-Me", "v")
+		do("POST", "/v1/fold-ME/rename", "Folded")
+		if got := do("GET", "/v1/FOLDED", "").Body.String(); got != "v" {
+			t.Errorf("Want: %s; Got: %s", "v", got)
+		}
+		l.Wait()
+
+		events, errs := l.ReadLog(1)
+		var keys []string
+		for e := range events {
+			keys = append(keys, e.Key)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"fold-me", "folded", "fold-me"}; !slices.Equal(keys, want) {
+			t.Errorf("Want: %v; Got: %v", want, keys)
+		}
+	})
+}
+
+func TestTTL(t *testing.T) {
+	t.Run("Key Expires When The Clock Passes Its TTL", func(t *testing.T) {
+		clock := newFakeClock()
+		s := KVS{M: make(map[string]string), Clock: clock}
+
+		s.PutWithTTL("session", "abc", time.Minute)
+
+		clock.Advance(59 * time.Second)
+		if got, err := s.Get("session"); err != nil || got != "abc" {
+			t.Errorf("Want: abc; Got: %q %v", got, err)
+		}
+
+		clock.Advance(time.Second)
+		if _, err := s.Get("session"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if _, ok := s.Snapshot()["session"]; ok {
+			t.Error("Want: expired key left out of snapshot")
+		}
+	})
+
+	t.Run("Put Clears A TTL", func(t *testing.T) {
+		clock := newFakeClock()
+		s := KVS{M: make(map[string]string), Clock: clock}
+
+		s.PutWithTTL("session", "abc", time.Minute)
+		s.Put("session", "forever")
+
+		clock.Advance(time.Hour)
+		if got, err := s.Get("session"); err != nil || got != "forever" {
+			t.Errorf("Want: forever; Got: %q %v", got, err)
+		}
+	})
+
+	t.Run("Expired Keys Start Again At Version 1", func(t *testing.T) {
+		clock := newFakeClock()
+		s := KVS{M: make(map[string]string), Clock: clock}
+
+		for _, key := range []string{"appended", "renamed"} {
+			s.PutWithTTL(key, "a", time.Minute)
+			s.Put(key, "b")
+			s.PutWithTTL(key, "c", time.Minute)
+		}
+		s.Put("source", "moved")
+		clock.Advance(time.Hour)
+
+		if _, version, err := s.update("appended", func(old string, _ bool) (string, error) { return old + "x", nil }); err != nil || version != 1 {
+			t.Errorf("Want: version 1; Got: %d %v", version, err)
+		}
+		if _, version, err := s.rename("source", "renamed"); err != nil || version != 1 {
+			t.Errorf("Want: version 1; Got: %d %v", version, err)
+		}
+	})
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	t.Run("Later Mutations Do Not Affect The Copy", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("a", "1")
+		s.Put("b", "2")
+
+		snap := s.Snapshot()
+
+		s.Put("a", "changed")
+		s.Delete("b")
+		s.Put("c", "3")
+
+		if snap["a"] != "1" || snap["b"] != "2" || len(snap) != 2 {
+			t.Errorf("Want: map[a:1 b:2]; Got: %v", snap)
+		}
+	})
+}
+
+func TestScan(t *testing.T) {
+	t.Run("Paging Yields Every Key Exactly Once", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		for i := 0; i < 25; i++ {
+			s.Put(fmt.Sprintf("key%02d", i), "v")
+		}
+
+		seen := map[string]int{}
+		cursor, pages := "", 0
+		for {
+			keys, next := s.Scan(cursor, 10)
+			pages++
+			for _, k := range keys {
+				seen[k]++
+			}
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		if pages != 3 {
+			t.Errorf("Want: %d pages; Got: %d", 3, pages)
+		}
+		if len(seen) != 25 {
+			t.Errorf("Want: %d keys; Got: %d", 25, len(seen))
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Errorf("Want: %s once; Got: %d times", k, n)
+			}
+		}
+	})
+
+	t.Run("Handler Pages Through The Store", func(t *testing.T) {
+		for i := 0; i < 7; i++ {
+			kvs.Put(fmt.Sprintf("scan%d", i), "v")
+		}
+
+		router := newRouter()
+		seen := map[string]int{}
+		cursor := ""
+		for {
+			req := httptest.NewRequest("GET", "/v1/_scan?limit=3&cursor="+url.QueryEscape(cursor), nil)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+			}
+
+			var page ScanResponse
+			if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Keys) > 3 {
+				t.Errorf("Want: at most %d keys; Got: %d", 3, len(page.Keys))
+			}
+			for _, k := range page.Keys {
+				seen[k]++
+			}
+			if page.Next == "" {
+				break
+			}
+			cursor = page.Next
+		}
+
+		for i := 0; i < 7; i++ {
+			k := fmt.Sprintf("scan%d", i)
+			if seen[k] != 1 {
+				t.Errorf("Want: %s once; Got: %d times", k, seen[k])
+			}
+		}
+	})
+
+	t.Run("Handler Rejects A Bad Limit", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/v1/_scan?limit=nope", nil)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestTree(t *testing.T) {
+	s := KVS{M: make(map[string]string)}
+	for _, k := range []string{"a/b/c", "a/b/d", "a/e", "a/f/g", "ab", "h"} {
+		s.Put(k, "v")
+	}
+
+	t.Run("Lists One Level", func(t *testing.T) {
+		keys, dirs := s.Tree("a/")
+		if strings.Join(keys, ",") != "a/e" {
+			t.Errorf("Want: %s; Got: %v", "a/e", keys)
+		}
+		if strings.Join(dirs, ",") != "a/b/,a/f/" {
+			t.Errorf("Want: %s; Got: %v", "a/b/,a/f/", dirs)
+		}
+	})
+
+	t.Run("Empty Prefix Lists The Top", func(t *testing.T) {
+		keys, dirs := s.Tree("")
+		if strings.Join(keys, ",") != "ab,h" {
+			t.Errorf("Want: %s; Got: %v", "ab,h", keys)
+		}
+		if strings.Join(dirs, ",") != "a/" {
+			t.Errorf("Want: %s; Got: %v", "a/", dirs)
+		}
+	})
+
+	t.Run("Handler Returns Keys And Dirs", func(t *testing.T) {
+		kvs.Put("tree/x/1", "v")
+		kvs.Put("tree/y", "v")
+
+		rec := do("GET", "/v1/_tree?prefix=tree/", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got TreeResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(got.Keys, ",") != "tree/y" || strings.Join(got.Dirs, ",") != "tree/x/" {
+			t.Errorf("Want: [tree/y] [tree/x/]; Got: %v %v", got.Keys, got.Dirs)
+		}
+	})
+}
+
+func TestGetPrefix(t *testing.T) {
+	s := KVS{M: make(map[string]string)}
+	s.Put("users/ann/theme", "dark")
+	s.Put("users/ann/lang", "en")
+	s.Put("users/bob/theme", "light")
+	s.PutInt("users/ann/visits", 3, 0)
+	s.Put("usersx", "v")
+
+	t.Run("Returns Matching Pairs", func(t *testing.T) {
+		got, more := s.GetPrefix("users/ann/", 0)
+		want := map[string]string{"users/ann/theme": "dark", "users/ann/lang": "en", "users/ann/visits": "3"}
+		if !maps.Equal(got, want) || more {
+			t.Errorf("Want: %v false; Got: %v %v", want, got, more)
+		}
+	})
+
+	t.Run("Limit Keeps The First Keys", func(t *testing.T) {
+		got, more := s.GetPrefix("users/", 2)
+		want := map[string]string{"users/ann/lang": "en", "users/ann/theme": "dark"}
+		if !maps.Equal(got, want) || !more {
+			t.Errorf("Want: %v true; Got: %v %v", want, got, more)
+		}
+	})
+
+	t.Run("Handler Returns An Object", func(t *testing.T) {
+		kvs.Put("prefix/a", "1")
+		kvs.Put("prefix/b", "2")
+		kvs.Put("prefix/c", "3")
+
+		rec := do("GET", "/v1/_prefix/prefix/", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		var got map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]string{"prefix/a": "1", "prefix/b": "2", "prefix/c": "3"}
+		if !maps.Equal(got, want) {
+			t.Errorf("Want: %v; Got: %v", want, got)
+		}
+		if h := rec.Header().Get(TruncatedHeader); h != "" {
+			t.Errorf("Want: no %s; Got: %q", TruncatedHeader, h)
+		}
+	})
+
+	t.Run("Handler Caps The Result", func(t *testing.T) {
+		rec := do("GET", "/v1/_prefix/prefix/?limit=2", "")
+		var got map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || rec.Header().Get(TruncatedHeader) != "true" {
+			t.Errorf("Want: 2 pairs, truncated; Got: %v %q", got, rec.Header().Get(TruncatedHeader))
+		}
+	})
+
+	t.Run("Bad Limit", func(t *testing.T) {
+		if rec := do("GET", "/v1/_prefix/prefix/?limit=0", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestSlashKeys(t *testing.T) {
+	useTempLogger(t)
+
+	t.Run("Put Get And Delete Round Trip", func(t *testing.T) {
+		if rec := do("PUT", "/v1/a/b/c", "deep"); rec.Code != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if got, _ := kvs.Get("a/b/c"); got != "deep" {
+			t.Errorf("Want: %s; Got: %s", "deep", got)
+		}
+
+		rec := do("GET", "/v1/a/b/c", "")
+		if rec.Code != http.StatusOK || rec.Body.String() != "deep" {
+			t.Errorf("Want: %d %s; Got: %d %s", http.StatusOK, "deep", rec.Code, rec.Body.String())
+		}
+
+		if rec := do("DELETE", "/v1/a/b/c", ""); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if _, err := kvs.Get("a/b/c"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+
+	t.Run("Escaped Slashes Reach The Same Key", func(t *testing.T) {
+		do("PUT", "/v1/"+url.PathEscape("x/y"), "escaped")
+
+		if rec := do("GET", "/v1/x/y", ""); rec.Body.String() != "escaped" {
+			t.Errorf("Want: %s; Got: %s", "escaped", rec.Body.String())
+		}
+	})
+
+	t.Run("Suffix Routes Take Slash Keys", func(t *testing.T) {
+		do("POST", "/v1/n/count/add", "2")
+		if got, _ := kvs.Get("n/count"); got != "2" {
+			t.Errorf("Want: %s; Got: %s", "2", got)
+		}
+
+		do("POST", "/v1/n/count/rename", "n/total")
+		if got, _ := kvs.Get("n/total"); got != "2" {
+			t.Errorf("Want: %s; Got: %s", "2", got)
+		}
+	})
+
+	t.Run("Prefix Delete Removes Them", func(t *testing.T) {
+		setAuthTokens("secret")
+		t.Cleanup(func() { setAuthTokens() })
+
+		do("PUT", "/v1/p/q/1", "v")
+		do("PUT", "/v1/p/q/2", "v")
+
+		req := httptest.NewRequest("DELETE", "/v1/_keys?prefix=p/q/", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if keys, _ := kvs.Tree("p/"); len(keys) != 0 {
+			t.Errorf("Want: no keys; Got: %v", keys)
+		}
+	})
+}
+
+func TestReadyHandler(t *testing.T) {
+	wasReady := ready.Swap(false)
+	t.Cleanup(func() { ready.Store(wasReady) })
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+
+	t.Run("Ready After Replay", func(t *testing.T) {
+		if got := ready(); got != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, got)
+		}
+
+		saved := transact
+		defer func() { transact = saved }()
+
+		cfg := config.Default()
+		cfg.Log.Path = filepath.Join(t.TempDir(), "transact.log")
+		l, err := initTransactionLogger(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		transact = l
+		defer l.(io.Closer).Close()
+
+		if got := ready(); got != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, got)
+		}
+
+		// the logger handlers use is the one that was opened
+		if rec := do("PUT", "/v1/ready-put", "logged"); rec.Code != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		l.(*FileTransactionLogger).Wait()
+
+		events, errs := l.(LogReader).ReadLog(1)
+		found := false
+		for e := range events {
+			found = found || e.Key == "ready-put" && e.Value == "logged"
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if !found {
+			t.Error("Want: PUT in the log")
+		}
+	})
+
+	t.Run("Reflects Postgres Connectivity", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		saved := transact
+		defer func() { transact = saved }()
+
+		mock.ExpectPing()
+		transact = &PostgresTransactionLogger{db: db}
+		if got := ready(); got != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, got)
+		}
+
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+		transact = &PostgresTransactionLogger{db: db}
+		if got := ready(); got != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, got)
+		}
+	})
+}
+
+func TestReplayProgress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transact.log")
+	l, err := MakeFileTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	for i := 0; i < 10; i++ {
+		l.WritePut(fmt.Sprintf("k%d", i), "v")
+	}
+	l.Close()
+
+	savedEvery := replayLogEvery
+	replayLogEvery = 3
+	var out bytes.Buffer
+	useLogBuffer(t, &out)
+	t.Cleanup(func() { replayLogEvery = savedEvery })
+
+	l, err = MakeFileTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := replay(l, &KVS{M: make(map[string]string)}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Progress Is Logged", func(t *testing.T) {
+		for _, want := range []string{
+			`msg="replay progress" events=3 sequence=3`,
+			`msg="replay progress" events=9 sequence=9`,
+			`msg="replay done" events=11`,
+		} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Want: %q in log; Got: %s", want, out.String())
+			}
+		}
+	})
+
+	t.Run("Startup Reports The Finished Replay", func(t *testing.T) {
+		rec := do("GET", "/startup", "")
+
+		var got StartupResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Replaying || got.Events != 11 || got.Sequence != 11 {
+			t.Errorf("Want: false 11 11; Got: %t %d %d", got.Replaying, got.Events, got.Sequence)
+		}
+		if got.Percent == nil || *got.Percent != 100 {
+			t.Errorf("Want: 100; Got: %v", got.Percent)
+		}
+	})
+}
+
+// heldLogger replays whatever the test sends on events, so a replay can
+// be held part way
+type heldLogger struct {
+	*MemoryTransactionLogger
+	events chan Event
+}
+
+func (l *heldLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.events, make(chan error)
+}
+
+func TestStartupGate(t *testing.T) {
+	wasReady := ready.Swap(false)
+	t.Cleanup(func() { ready.Store(wasReady) })
+
+	gate := newStartupGate()
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		gate.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	l := &heldLogger{MakeMemoryTransactionLogger(), make(chan Event)}
+	replayed := make(chan error, 1)
+	go func() { replayed <- replay(l, &KVS{M: make(map[string]string)}) }()
+
+	// the second send waits until the first has been counted
+	for i := uint64(1); i <= 3; i++ {
+		l.events <- Event{Sequence: i, EventType: EventPut, Key: "k", Value: "v"}
+	}
+
+	t.Run("Startup Answers During Replay", func(t *testing.T) {
+		rec := get("/startup")
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, rec.Code)
+		}
+
+		var got StartupResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !got.Replaying || got.Events < 2 {
+			t.Errorf("Want: replaying with at least 2 events; Got: %t %d", got.Replaying, got.Events)
+		}
+
+		if rec := get("/v1/k"); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+
+	close(l.events)
+	if err := <-replayed; err != nil {
+		t.Fatal(err)
+	}
+	ready.Store(true)
+	gate.open(newRouter())
+
+	t.Run("Everything Answers Once Open", func(t *testing.T) {
+		if rec := get("/startup"); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if rec := get("/v1/_stats"); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+	})
+}
+
+func TestParallelReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transact.log")
+	l, err := MakeFileTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%d", i%97)
+		if i%7 == 0 {
+			l.WriteDelete(key)
+		} else {
+			l.WritePutVersion(key, strconv.Itoa(i), 0, 0)
+		}
+	}
+	l.Close()
+
+	load := func(workers int) *KVS {
+		saved := replayWorkers
+		replayWorkers = workers
+		defer func() { replayWorkers = saved }()
+
+		l, err := MakeFileTransactionLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		s := &KVS{M: make(map[string]string), CompressAbove: 1}
+		if err := replay(l, s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	t.Run("Same State As Sequential", func(t *testing.T) {
+		wantState, wantVersions := load(1).SnapshotVersions()
+		gotState, gotVersions := load(8).SnapshotVersions()
+
+		if !maps.Equal(gotState, wantState) {
+			t.Errorf("Want: %v; Got: %v", wantState, gotState)
+		}
+		if !maps.Equal(gotVersions, wantVersions) {
+			t.Errorf("Want: %v; Got: %v", wantVersions, gotVersions)
+		}
+	})
+}
+
+func TestCommands(t *testing.T) {
+	var logs bytes.Buffer
+	useLogBuffer(t, &logs)
+	savedDefault := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(savedDefault) })
+
+	path := filepath.Join(t.TempDir(), "transact.log")
+	l, err := MakeFileTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	for i := 0; i < 10; i++ {
+		l.WritePut("churn", strconv.Itoa(i))
+	}
+	l.WritePut("kept", "v")
+	l.WritePut("gone", "v")
+	l.WriteDelete("gone")
+	l.Close()
+
+	command := func(args ...string) (string, error) {
+		var out bytes.Buffer
+		err := run(args, &out)
+		return out.String(), err
+	}
+
+	t.Run("Unknown Command Is An Error", func(t *testing.T) {
+		_, err := command("frobnicate")
+		if err == nil || !strings.Contains(err.Error(), "compact, fsck, migrate, replay, serve") {
+			t.Errorf("Want: error listing the commands; Got: %v", err)
+		}
+	})
+
+	t.Run("Validate Passes A Good Config", func(t *testing.T) {
+		log := filepath.Join(t.TempDir(), "new.log")
+		out, err := command("-validate", "-log", log)
+		if err != nil {
+			t.Fatalf("Want: %v; Got: %v", nil, err)
+		}
+		if out != "configuration ok\n" {
+			t.Errorf("Want: %q; Got: %q", "configuration ok\n", out)
+		}
+		if _, err := os.Stat(log); !os.IsNotExist(err) {
+			t.Errorf("Want: log not created; Got: %v", err)
+		}
+	})
+
+	t.Run("Validate Fails An Unreachable Database", func(t *testing.T) {
+		_, err := command("serve", "-validate", "-backend", "postgres",
+			"-postgres-dsn", "host=127.0.0.1 port=1 connect_timeout=1 sslmode=disable")
+		if err == nil || !strings.Contains(err.Error(), "postgres") {
+			t.Errorf("Want: postgres error; Got: %v", err)
+		}
+	})
+
+	t.Run("Validate Fails A Bad Setting", func(t *testing.T) {
+		if _, err := command("-validate", "-log-format", "xml"); err == nil {
+			t.Error("Want: error; Got: nil")
+		}
+	})
+
+	t.Run("Help Is Not An Error", func(t *testing.T) {
+		if _, err := command("replay", "-h"); err != nil {
+			t.Errorf("Want: %v; Got: %v", nil, err)
+		}
+	})
+
+	t.Run("Flags Are Checked Per Command", func(t *testing.T) {
+		if _, err := command("replay", "-out", "x"); err == nil {
+			t.Error("Want: error for migrate's flag; Got: nil")
+		}
+	})
+
+	t.Run("Replay Reports The Store", func(t *testing.T) {
+		out, err := command("replay", "-log", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "keys: 2\nsequence: 14\n"; out != want {
+			t.Errorf("Want: %q; Got: %q", want, out)
+		}
+	})
+
+	t.Run("Fsck Passes A Clean Log", func(t *testing.T) {
+		out, err := command("fsck", path)
+		if err != nil {
+			t.Fatalf("Want: %v; Got: %v\n%s", nil, err, out)
+		}
+		for _, want := range []string{"events: 14 (12 puts, 1 deletes)", "keys: 2", "clean shutdown: true", "problems: 0"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("Want: %q; Got: %q", want, out)
+			}
+		}
+	})
+
+	t.Run("Fsck Fails A Corrupt Log", func(t *testing.T) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.SplitAfter(string(data), "\n")
+		corrupt := filepath.Join(t.TempDir(), "corrupt.log")
+		if err := os.WriteFile(corrupt, []byte(string(data)+"not an event\n"+lines[1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := command("fsck", corrupt)
+		if !errors.Is(err, ErrLogCorrupt) {
+			t.Errorf("Want: %v; Got: %v", ErrLogCorrupt, err)
+		}
+		for _, want := range []string{"problems: 2", "malformed event", "out of sequence: 1 after 14"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("Want: %q; Got: %q", want, out)
+			}
+		}
+	})
+
+	t.Run("Migrate Copies The Store", func(t *testing.T) {
+		dest := filepath.Join(t.TempDir(), "migrated.log")
+		if _, err := command("migrate", "-log", path, "-out", dest, "-to-format", "msgpack"); err != nil {
+			t.Fatal(err)
+		}
+
+		m, err := MakeFileTransactionLogger(dest, WithFormat(FormatMsgPack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer m.Close()
+		s := &KVS{M: make(map[string]string)}
+		if err := replay(m, s); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := s.Get("churn"); v != "9" || s.Len() != 2 {
+			t.Errorf("Want: 9 2; Got: %s %d", v, s.Len())
+		}
+
+		if _, err := command("migrate", "-log", path, "-out", dest); err == nil {
+			t.Error("Want: error for an existing -out; Got: nil")
+		}
+	})
+
+	t.Run("Compact Drops Dead Events", func(t *testing.T) {
+		out, err := command("compact", "-log", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "from 14 events to 2"; !strings.Contains(out, want) {
+			t.Errorf("Want: %q; Got: %q", want, out)
+		}
+
+		out, _ = command("replay", "-log", path)
+		if !strings.HasPrefix(out, "keys: 2\n") {
+			t.Errorf("Want: keys: 2; Got: %q", out)
+		}
+	})
+
+	churny := func(t *testing.T) string {
+		path := filepath.Join(t.TempDir(), "churny.log")
+		l, err := MakeFileTransactionLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		for i := 0; i < 50; i++ {
+			l.WritePut("a", strconv.Itoa(i))
+			l.WritePut("b", strconv.Itoa(i))
+			l.WriteDelete("b")
+		}
+		l.WritePut("c", "last")
+		l.Close()
+		return path
+	}
+
+	t.Run("Compact Takes The Log As An Argument", func(t *testing.T) {
+		path := churny(t)
+		out, err := command("compact", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "from 152 events to 2"; !strings.Contains(out, want) {
+			t.Errorf("Want: %q; Got: %q", want, out)
+		}
+
+		l, err := MakeFileTransactionLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		events, errs := l.ReadEvents()
+		var got []string
+		for e := range events {
+			if e.EventType != EventShutdown {
+				got = append(got, fmt.Sprintf("%d %s=%s", e.EventType, e.Key, e.Value))
+			}
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		want := []string{fmt.Sprintf("%d a=49", EventPut), fmt.Sprintf("%d c=last", EventPut)}
+		if !slices.Equal(got, want) {
+			t.Errorf("Want: %q; Got: %q", want, got)
+		}
+
+		if _, err := os.Stat(lockPath(path)); !os.IsNotExist(err) {
+			t.Errorf("Want: lock removed; Got: %v", err)
+		}
+	})
+
+	t.Run("Compact Refuses A Log A Live Server Holds", func(t *testing.T) {
+		path := churny(t)
+		if err := os.WriteFile(lockPath(path), []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := command("compact", path); !errors.Is(err, ErrLocked) {
+			t.Errorf("Want: %v; Got: %v", ErrLocked, err)
+		}
+		if _, err := os.Stat(lockPath(path)); err != nil {
+			t.Errorf("Want: lock kept; Got: %v", err)
+		}
+	})
+
+	t.Run("Compact Takes Over A Stale Lock", func(t *testing.T) {
+		path := churny(t)
+		// past the largest pid linux hands out
+		if err := os.WriteFile(lockPath(path), []byte("4194305\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := command("compact", path); err != nil {
+			t.Errorf("Want: %v; Got: %v", nil, err)
+		}
+	})
+
+	t.Run("Compact Needs The Log To Exist", func(t *testing.T) {
+		missing := filepath.Join(t.TempDir(), "missing.log")
+		if _, err := command("compact", missing); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("Want: %v; Got: %v", os.ErrNotExist, err)
+		}
+	})
+}
+
+func TestShardedKVS(t *testing.T) {
+	t.Run("Get Should Accept Strings", func(t *testing.T) {
+		s := NewShardedKVS(8)
+		expect := "was here"
+		s.Put("rob", expect)
+
+		got, err := s.Get("rob")
+		if err != nil {
+			t.Error(err)
+		}
+		if got != expect {
+			t.Errorf("Want: %s; Got: %s", expect, got)
+		}
+
+		s.Delete("rob")
+		if _, err := s.Get("rob"); err != ErrorNoSuchKey {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Custom Shard Func Colocates Keys", func(t *testing.T) {
+		// route by the part before the first colon
+		byOwner := func(key string) uint64 {
+			owner, _, _ := strings.Cut(key, ":")
+			return fnvShard(owner)
+		}
+		s := NewShardedKVS(64, WithShardFunc(byOwner))
+
+		if s.shard("alice:profile") != s.shard("alice:settings") {
+			t.Error("Want: same shard for alice's keys; Got: different shards")
+		}
+
+		s.Put("alice:profile", "p")
+		s.Put("alice:settings", "s")
+		if got := len(s.shard("alice:profile").M); got != 2 {
+			t.Errorf("Want: %d keys in shard; Got: %d", 2, got)
+		}
+	})
+}
+
+func TestCompactStatsHandler(t *testing.T) {
+	useAdminToken(t)
+
+	t.Run("Dry Run Reports Counts", func(t *testing.T) {
+		l := useTempLogger(t)
+		l.WritePut("a", "1")
+		l.WritePut("a", "2")
+		l.Wait()
+
+		rec := doAdmin("GET", "/v1/_compact?dryrun=1", "")
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got CompactResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (CompactResponse{Before: 2, After: 1}); got != want {
+			t.Errorf("Want: %+v; Got: %+v", want, got)
+		}
+	})
+
+	t.Run("Requires Dry Run", func(t *testing.T) {
+		rec := doAdmin("GET", "/v1/_compact", "")
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+// do sends a request through the router and returns the recorder
+func do(method, target, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return rec
+}
+
+// adminToken is the token useAdminToken configures
+const adminToken = "admin-secret"
+
+// useAdminToken makes adminToken the one token requireAuth accepts, for
+// the endpoints behind it
+func useAdminToken(t *testing.T) {
+	setAuthTokens(adminToken)
+	t.Cleanup(func() { setAuthTokens() })
+}
+
+// doAdmin is do bearing adminToken
+func doAdmin(method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestScheduledCompaction(t *testing.T) {
+	l := useTempLogger(t)
+	t.Cleanup(func() {
+		lastCompaction.Store(nil)
+		compactSchedule.Store(nil)
+	})
+
+	for i := 0; i < 10; i++ {
+		l.WritePut("sched-a", strconv.Itoa(i))
+	}
+	l.WritePut("sched-b", "1")
+	l.Wait()
+
+	t.Run("Outside The Window Waits", func(t *testing.T) {
+		now := time.Now()
+		later := now.Add(2 * time.Hour).Format("15:04")
+		window := later + "-" + now.Add(3*time.Hour).Format("15:04")
+
+		due, err := compactDue(l, config.Compaction{DeadRatio: 0.5, Window: window}, now)
+		if err != nil || due {
+			t.Errorf("Want: %v; Got: %v %v", false, due, err)
+		}
+	})
+
+	t.Run("Breaching The Dead Ratio Compacts", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go compactEvery(ctx, config.Compaction{Check: 5 * time.Millisecond, DeadRatio: 0.5, MinInterval: time.Hour})
+
+		deadline := time.Now().Add(5 * time.Second)
+		for lastCompaction.Load() == nil && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		run := lastCompaction.Load()
+		if run == nil {
+			t.Fatal("Want: a compaction; Got: none")
+		}
+		if !run.Scheduled || run.Before != 11 || run.After != 2 {
+			t.Errorf("Want: scheduled 11 -> 2; Got: %+v", *run)
+		}
+	})
+
+	t.Run("Stats Show The Schedule And Last Run", func(t *testing.T) {
+		var stats StatsResponse
+		json.NewDecoder(do("GET", "/v1/_stats", "").Body).Decode(&stats)
+
+		if stats.Compaction.Schedule == nil || stats.Compaction.Schedule.DeadRatio != 0.5 {
+			t.Errorf("Want: dead ratio 0.5; Got: %+v", stats.Compaction.Schedule)
+		}
+		if stats.Compaction.Last == nil || stats.Compaction.Last.At.IsZero() {
+			t.Errorf("Want: the last compaction; Got: %+v", stats.Compaction.Last)
+		}
+	})
+}
+
+func TestAdminHandlers(t *testing.T) {
+	useAdminToken(t)
+
+	t.Run("Compact Shrinks The Log And Keeps State", func(t *testing.T) {
+		l := useTempLogger(t)
+
+		do("PUT", "/v1/admin-a", "1")
+		do("PUT", "/v1/admin-a", "2")
+		do("PUT", "/v1/admin-b", "1")
+		do("DELETE", "/v1/admin-b", "")
+
+		rec := doAdmin("POST", "/v1/_compact", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got CompactResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (CompactResponse{Before: 4, After: 1}); got != want {
+			t.Errorf("Want: %+v; Got: %+v", want, got)
+		}
+
+		before, _, err := l.CompactStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before != 1 {
+			t.Errorf("Want: %d events left; Got: %d", 1, before)
+		}
+
+		if v, _ := kvs.Get("admin-a"); v != "2" {
+			t.Errorf("Want: %s; Got: %s", "2", v)
+		}
+		if _, err := kvs.Get("admin-b"); err != ErrorNoSuchKey {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Snapshot Captures The Store", func(t *testing.T) {
+		l := useTempLogger(t)
+
+		do("PUT", "/v1/admin-snap", "here")
+
+		rec := doAdmin("POST", "/v1/_snapshot", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got SnapshotResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Sequence != 1 {
+			t.Errorf("Want: %d; Got: %d", 1, got.Sequence)
+		}
+
+		_, state, _, err := l.LoadSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state["admin-snap"] != "here" {
+			t.Errorf("Want: %s; Got: %s", "here", state["admin-snap"])
+		}
+	})
+
+	t.Run("Flush Makes Group Commit Writes Durable", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"),
+			WithFlushInterval(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		saved := transact
+		transact = l
+		defer func() {
+			transact = saved
+			l.Close()
+		}()
+
+		do("PUT", "/v1/admin-flush", "1")
+		do("PUT", "/v1/admin-flush", "2")
+
+		rec := doAdmin("POST", "/v1/_flush", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got FlushResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Sequence != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, got.Sequence)
+		}
+
+		// read the file directly, bypassing anything still buffered
+		if events := readAll(t, l.filename); len(events) != 2 {
+			t.Errorf("Want: 2 events on disk; Got: %+v", events)
+		}
+	})
+
+	t.Run("Log Streams Events From A Sequence", func(t *testing.T) {
+		l := useTempLogger(t)
+
+		do("PUT", "/v1/admin-log", "1")
+		do("PUT", "/v1/admin-log", "2")
+		do("DELETE", "/v1/admin-log", "")
+		l.Wait()
+
+		rec := doAdmin("GET", "/v1/_log?from=2", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got []Event
+		dec := json.NewDecoder(rec.Body)
+		for dec.More() {
+			var e Event
+			if err := dec.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, e)
+		}
+
+		want := []Event{
+			{Sequence: 2, EventType: EventPut, Key: "admin-log", Value: "2", Version: 2},
+			{Sequence: 3, EventType: EventDelete, Key: "admin-log"},
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Want: %+v; Got: %+v", want, got)
+		}
+		for i := range want {
+			got[i].Modified = 0 // checked in TestLastModified
+			if got[i] != want[i] {
+				t.Errorf("Want: %+v; Got: %+v", want[i], got[i])
+			}
+		}
+	})
+}
+
+func TestDrain(t *testing.T) {
+	useTempLogger(t)
+	useAdminToken(t)
+	do("PUT", "/v1/drain-a", "1")
+
+	if rec := doAdmin("POST", "/v1/_drain", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+	}
+	t.Cleanup(func() { draining.Store(false) })
+
+	t.Run("Writes Are 503 While Drained", func(t *testing.T) {
+		for _, method := range []string{"PUT", "DELETE"} {
+			rec := do(method, "/v1/drain-a", "2")
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("%s Want: %d; Got: %d", method, http.StatusServiceUnavailable, rec.Code)
+			}
+			if got := rec.Header().Get("Retry-After"); got != strconv.Itoa(DrainRetryAfter) {
+				t.Errorf("Want: %d; Got: %s", DrainRetryAfter, got)
+			}
+		}
+	})
+
+	t.Run("Reads Carry On", func(t *testing.T) {
+		if rec := do("GET", "/v1/drain-a", ""); rec.Code != http.StatusOK || rec.Body.String() != "1" {
+			t.Errorf("Want: 200 1; Got: %d %s", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("Undrain Lets Writes Through", func(t *testing.T) {
+		doAdmin("POST", "/v1/_undrain", "")
+
+		if rec := do("PUT", "/v1/drain-a", "2"); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+	})
+}
+
+func TestDeletePrefix(t *testing.T) {
+	t.Run("Leaves Other Keys Alone", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		for _, k := range []string{"session:1", "session:2", "sessions", "user:1"} {
+			s.Put(k, "v")
+		}
+
+		if n := s.DeletePrefix("session:"); n != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, n)
+		}
+		keys, _ := s.Scan("", 0)
+		if got := strings.Join(keys, ","); got != "sessions,user:1" {
+			t.Errorf("Want: %s; Got: %s", "sessions,user:1", got)
+		}
+	})
+
+	t.Cleanup(func() { setAuthTokens() })
+
+	del := func(target, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Needs Configured Tokens", func(t *testing.T) {
+		setAuthTokens()
+		if rec := del("/v1/_keys?prefix=x", "any"); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+	})
+
+	t.Run("Needs A Valid Token", func(t *testing.T) {
+		setAuthTokens("secret")
+		for _, token := range []string{"", "guess"} {
+			if rec := del("/v1/_keys?prefix=x", token); rec.Code != http.StatusUnauthorized {
+				t.Errorf("Want: %d; Got: %d", http.StatusUnauthorized, rec.Code)
+			}
+		}
+	})
+
+	t.Run("Empty Prefix Is 400", func(t *testing.T) {
+		setAuthTokens("secret")
+		if rec := del("/v1/_keys?prefix=", "secret"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Handler Logs Each Delete", func(t *testing.T) {
+		setAuthTokens("secret")
+		l := useTempLogger(t)
+		do("PUT", "/v1/dp:a", "1")
+		do("PUT", "/v1/dp:b", "2")
+		do("PUT", "/v1/dq", "3")
+
+		rec := del("/v1/_keys?prefix=dp:", "secret")
+		var got DeletePrefixResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Deleted != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, got.Deleted)
+		}
+
+		l.Wait()
+		deletes := 0
+		for _, e := range readAll(t, l.filename) {
+			if e.EventType == EventDelete {
+				deletes++
+			}
+		}
+		if deletes != 2 {
+			t.Errorf("Want: %d deletes; Got: %d", 2, deletes)
+		}
+		if v, _ := kvs.Get("dq"); v != "3" {
+			t.Errorf("Want: %s; Got: %s", "3", v)
+		}
+	})
+}
+
+func TestTokenRotation(t *testing.T) {
+	setAuthTokens("old", "other")
+	t.Cleanup(func() { setAuthTokens() })
+
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Needs The Current Token", func(t *testing.T) {
+		if rec := send("POST", "/v1/_admin/token", "guess", "new"); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Want: %d; Got: %d", http.StatusUnauthorized, rec.Code)
+		}
+	})
+
+	t.Run("Empty Token Is 400", func(t *testing.T) {
+		if rec := send("POST", "/v1/_admin/token", "old", " "); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Old Token Stops Working", func(t *testing.T) {
+		if rec := send("POST", "/v1/_admin/token", "old", "new"); rec.Code != http.StatusNoContent {
+			t.Fatalf("Want: %d; Got: %d", http.StatusNoContent, rec.Code)
+		}
+
+		// an empty prefix gets past auth to a 400
+		for token, want := range map[string]int{
+			"old":   http.StatusUnauthorized,
+			"new":   http.StatusBadRequest,
+			"other": http.StatusBadRequest,
+		} {
+			if rec := send("DELETE", "/v1/_keys?prefix=", token, ""); rec.Code != want {
+				t.Errorf("%s Want: %d; Got: %d", token, want, rec.Code)
+			}
+		}
+	})
+}
+
+func TestAdminAuth(t *testing.T) {
+	useTempLogger(t)
+	t.Cleanup(func() { setAuthTokens() })
+
+	routes := []struct{ method, target string }{
+		{"GET", "/v1/_log"},
+		{"GET", "/v1/_compact?dryrun=1"},
+		{"POST", "/v1/_compact"},
+		{"POST", "/v1/_snapshot"},
+		{"POST", "/v1/_flush"},
+		{"POST", "/v1/_drain"},
+		{"POST", "/v1/_undrain"},
+		{"GET", "/v1/_backup"},
+		{"POST", "/v1/_promote"},
+		{"GET", "/v1/_export"},
+		{"GET", "/v1/_replicate"},
+	}
+
+	for _, tokens := range [][]string{nil, {adminToken}} {
+		setAuthTokens(tokens...)
+		want := http.StatusUnauthorized
+		if tokens == nil {
+			want = http.StatusForbidden
+		}
+
+		for _, route := range routes {
+			if rec := do(route.method, route.target, ""); rec.Code != want {
+				t.Errorf("%s %s Want: %d; Got: %d", route.method, route.target, want, rec.Code)
+			}
+		}
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	useTempLogger(t)
+	if err := setAuth([]string{"ops:key"}, []string{"alice:a-secret", "bob:b-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	SetAuthPolicy(func(method, key, user string) bool {
+		return method == "GET" && !strings.HasPrefix(key, "secret/") || strings.HasPrefix(key, user+"/")
+	})
+	t.Cleanup(func() {
+		setAuthTokens()
+		SetAuthPolicy(nil)
+	})
+
+	send := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Allows A Write To Your Own Key", func(t *testing.T) {
+		if rec := send("PUT", "/v1/alice/notes", "a-secret", "mine"); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if got, _ := kvs.Get("alice/notes"); got != "mine" {
+			t.Errorf("Want: %s; Got: %s", "mine", got)
+		}
+	})
+
+	t.Run("Denies A Write To Another User's Key", func(t *testing.T) {
+		if rec := send("PUT", "/v1/bob/notes", "a-secret", "theirs"); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+		if _, err := kvs.Get("bob/notes"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+
+		ops := `[{"op": "put", "key": "alice/a", "value": "1"}, {"op": "delete", "key": "bob/b"}]`
+		if rec := send("POST", "/v1/_txn", "a-secret", ops); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+		if rec := send("POST", "/v1/alice/notes/rename", "a-secret", "bob/notes"); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+	})
+
+	t.Run("Anonymous Requests Are Asked About Too", func(t *testing.T) {
+		if rec := send("GET", "/v1/alice/notes", "", ""); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if rec := send("DELETE", "/v1/alice/notes", "", ""); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+	})
+
+	t.Run("Unknown Token Is 401", func(t *testing.T) {
+		if rec := send("GET", "/v1/alice/notes", "guess", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Want: %d; Got: %d", http.StatusUnauthorized, rec.Code)
+		}
+	})
+
+	t.Run("Plain Tokens Are Taken Whole", func(t *testing.T) {
+		if rec := send("GET", "/v1/alice/notes", "ops:key", ""); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if rec := send("GET", "/v1/alice/notes", "key", ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Want: %d; Got: %d", http.StatusUnauthorized, rec.Code)
+		}
+		// the part before the colon isn't a user
+		if rec := send("PUT", "/v1/ops/notes", "ops:key", "x"); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+		if err := setAuth(nil, []string{"nouser"}); err == nil {
+			t.Error("Want: error for a user token without a user")
+		}
+	})
+
+	t.Run("Base64 Keys Are Checked Decoded", func(t *testing.T) {
+		kvs.Put("secret/plans", "hidden")
+
+		if rec := send("GET", "/v1/secret/plans", "", ""); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+		target := "/v1/" + base64.RawURLEncoding.EncodeToString([]byte("secret/plans")) + "?b64key=1"
+		if rec := send("GET", target, "", ""); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+		if rec := send("GET", "/v1/not*base64?b64key=1", "", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Export Leaves Out Denied Keys", func(t *testing.T) {
+		kvs.Put("secret/plans", "hidden")
+
+		rec := send("GET", "/v1/_export", "a-secret", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "secret/plans") {
+			t.Errorf("Want: no secret/plans; Got: %s", rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), "alice/notes") {
+			t.Errorf("Want: alice/notes; Got: %s", rec.Body.String())
+		}
+	})
+
+	// lists checks a listing of keys names alice/notes but not secret/plans
+	lists := func(t *testing.T, rec *httptest.ResponseRecorder) {
+		t.Helper()
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "secret/") {
+			t.Errorf("Want: no secret/plans; Got: %s", rec.Body.String())
+		}
+		if !strings.Contains(rec.Body.String(), "alice/notes") {
+			t.Errorf("Want: alice/notes; Got: %s", rec.Body.String())
+		}
+	}
+
+	t.Run("Scan Leaves Out Denied Keys", func(t *testing.T) {
+		kvs.Put("secret/plans", "hidden")
+		kvs.Put("alice/notes", "mine")
+
+		lists(t, send("GET", "/v1/_scan", "a-secret", ""))
+	})
+
+	t.Run("Tree Leaves Out Denied Keys", func(t *testing.T) {
+		kvs.Put("secret/plans", "hidden")
+		kvs.Put("alice/notes", "mine")
+
+		var got TreeResponse
+		json.NewDecoder(send("GET", "/v1/_tree", "a-secret", "").Body).Decode(&got)
+		if slices.Contains(got.Dirs, "secret/") || !slices.Contains(got.Dirs, "alice/") {
+			t.Errorf("Want: alice/ and no secret/; Got: %v", got.Dirs)
+		}
+		lists(t, send("GET", "/v1/_tree?prefix=alice/", "a-secret", ""))
+	})
+
+	t.Run("Replicate Leaves Out Denied Keys", func(t *testing.T) {
+		l := transact.(*FileTransactionLogger)
+		l.WritePut("secret/plans", "hidden")
+		l.WritePut("alice/notes", "mine")
+		l.Wait()
+
+		// a cancelled request sends what's logged and stops
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", "/v1/_replicate", nil).WithContext(ctx)
+		req.Header.Set("Authorization", "Bearer a-secret")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		lists(t, rec)
+	})
+
+	t.Run("Verify Leaves Out Denied Keys", func(t *testing.T) {
+		kvs.Lock()
+		kvs.M["secret/broken"] = "no version"
+		kvs.M["alice/notes-broken"] = "no version"
+		kvs.Unlock()
+		t.Cleanup(func() {
+			kvs.Lock()
+			delete(kvs.M, "secret/broken")
+			delete(kvs.M, "alice/notes-broken")
+			kvs.Unlock()
+		})
+
+		lists(t, send("GET", "/v1/_verify", "a-secret", ""))
+	})
+}
+
+func TestKeyHistory(t *testing.T) {
+	l := useTempLogger(t)
+	do("PUT", "/v1/hist-a", "1")
+	do("PUT", "/v1/hist-b", "x")
+	do("PUT", "/v1/hist-a", "2")
+	do("DELETE", "/v1/hist-a", "")
+	do("PUT", "/v1/hist-a", "3")
+	l.Wait()
+
+	rec := do("GET", "/v1/hist-a/history", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+	}
+
+	var got []string
+	var last uint64
+	dec := json.NewDecoder(rec.Body)
+	for dec.More() {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Sequence <= last {
+			t.Errorf("Want: sequence after %d; Got: %d", last, e.Sequence)
+		}
+		last = e.Sequence
+		got = append(got, fmt.Sprintf("%s %s", e.EventType, e.Value))
+	}
+
+	want := "put 1,put 2,delete ,put 3"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Want: %s; Got: %s", want, strings.Join(got, ","))
+	}
+}
+
+func TestLogWriteErrors(t *testing.T) {
+	l := useTempLogger(t)
+	do("PUT", "/v1/logfail-b", "1")
+
+	// every write now fails, as on a full or broken disk
+	l.file.Close()
+
+	for _, tc := range []struct{ method, target string }{
+		{"PUT", "/v1/logfail-a"},
+		{"DELETE", "/v1/logfail-b"},
+	} {
+		t.Run(tc.method+" Is A 500", func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader("v"))
+			req.Header.Set("Accept", "application/json")
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("Want: %d; Got: %d", http.StatusInternalServerError, rec.Code)
+			}
+
+			var got ErrorResponse
+			json.NewDecoder(rec.Body).Decode(&got)
+			if got.Code != "log_write_failed" {
+				t.Errorf("Want: %s; Got: %s", "log_write_failed", got.Code)
+			}
+		})
+	}
+
+	t.Run("Nothing Reaches Err", func(t *testing.T) {
+		select {
+		case err := <-l.Err():
+			t.Errorf("Want: nothing; Got: %v", err)
+		default:
+		}
+	})
+}
+
+func TestStrongDurability(t *testing.T) {
+	// group commit an hour apart, so only a strong write fsyncs promptly
+	l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"), WithFlushInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+
+	saved := transact
+	transact = l
+	t.Cleanup(func() {
+		transact = saved
+		strongDurability = false
+		l.Close()
+	})
+
+	t.Run("Relaxed Returns Before The Fsync", func(t *testing.T) {
+		if rec := do("PUT", "/v1/durable-relaxed", "v"); rec.Code != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if got := l.Durable(); got != 0 {
+			t.Errorf("Want: %d; Got: %d", 0, got)
+		}
+	})
+
+	strongDurability = true
+
+	t.Run("Strong Put Returns After The Fsync", func(t *testing.T) {
+		if rec := do("PUT", "/v1/durable-strong", "v"); rec.Code != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if got, want := l.Durable(), l.LastSequence(); got != want || got == 0 {
+			t.Errorf("Want: %d; Got: %d", want, got)
+		}
+	})
+
+	t.Run("Strong Delete Returns After The Fsync", func(t *testing.T) {
+		if rec := do("DELETE", "/v1/durable-strong", ""); rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if got, want := l.Durable(), l.LastSequence(); got != want {
+			t.Errorf("Want: %d; Got: %d", want, got)
+		}
+	})
+}
+
+func TestStatusFor(t *testing.T) {
+	cases := []struct {
+		err  error
+		want int
+	}{
+		{ErrorNoSuchKey, http.StatusNotFound},
+		{fmt.Errorf("%w: too long", ErrInvalidKey), http.StatusBadRequest},
+		{fmt.Errorf("%w: limit", ErrInvalidArgument), http.StatusBadRequest},
+		{fmt.Errorf("%w: eof", ErrInvalidJSON), http.StatusBadRequest},
+		{fmt.Errorf("%w: limit", ErrBodyTooLarge), http.StatusRequestEntityTooLarge},
+		{fmt.Errorf("%w: limit", ErrStoreFull), http.StatusInsufficientStorage},
+		{errors.New("cannot write to log file"), http.StatusInternalServerError},
+		{fmt.Errorf("%w: %w", ErrLogWrite, ErrCircuitOpen), http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		if got := statusFor(c.err); got != c.want {
+			t.Errorf("%v: Want: %d; Got: %d", c.err, c.want, got)
+		}
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	useTempLogger(t)
+
+	t.Run("Oversized Body Is 413", func(t *testing.T) {
+		rec := do("PUT", "/v1/big", strings.Repeat("x", int(maxValueSize)+1))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Want: %d; Got: %d", http.StatusRequestEntityTooLarge, rec.Code)
+		}
+	})
+
+	t.Run("Control Characters In Key Are 400", func(t *testing.T) {
+		rec := do("PUT", "/v1/bad%09key", "v")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestFoundHeader(t *testing.T) {
+	useTempLogger(t)
+	do("PUT", "/v1/found-empty", "")
+
+	cases := []struct {
+		name   string
+		method string
+		key    string
+		code   int
+		found  string
+	}{
+		{"Empty Value GET", "GET", "found-empty", http.StatusOK, "true"},
+		{"Missing Key GET", "GET", "found-missing", http.StatusNotFound, "false"},
+		{"Empty Value HEAD", "HEAD", "found-empty", http.StatusOK, "true"},
+		{"Missing Key HEAD", "HEAD", "found-missing", http.StatusNotFound, "false"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := do(c.method, "/v1/"+c.key, "")
+
+			if rec.Code != c.code {
+				t.Errorf("Want: %d; Got: %d", c.code, rec.Code)
+			}
+			if got := rec.Header().Get(FoundHeader); got != c.found {
+				t.Errorf("Want: %s; Got: %s", c.found, got)
+			}
+		})
+	}
+}
+
+func TestGetDefault(t *testing.T) {
+	useTempLogger(t)
+	do("PUT", "/v1/default-set", "stored")
+
+	t.Run("Miss With Default Is 200", func(t *testing.T) {
+		rec := do("GET", "/v1/default-missing?default=fallback", "")
+		if rec.Code != http.StatusOK || rec.Body.String() != "fallback" {
+			t.Errorf("Want: 200 fallback; Got: %d %s", rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get(FoundHeader); got != "false" {
+			t.Errorf("Want: %s; Got: %s", "false", got)
+		}
+		if _, err := kvs.Get("default-missing"); !errors.Is(err, ErrorNoSuchKey) {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+
+	t.Run("Miss Without Default Is 404", func(t *testing.T) {
+		if rec := do("GET", "/v1/default-missing", ""); rec.Code != http.StatusNotFound {
+			t.Errorf("Want: %d; Got: %d", http.StatusNotFound, rec.Code)
+		}
+	})
+
+	t.Run("Hit Ignores Default", func(t *testing.T) {
+		rec := do("GET", "/v1/default-set?default=fallback", "")
+		if rec.Code != http.StatusOK || rec.Body.String() != "stored" {
+			t.Errorf("Want: 200 stored; Got: %d %s", rec.Code, rec.Body)
+		}
+	})
+}
+
+func TestLastModified(t *testing.T) {
+	useTempLogger(t)
+	do("PUT", "/v1/lastmod", "v")
+
+	get := func(since string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/lastmod", nil)
+		if since != "" {
+			req.Header.Set("If-Modified-Since", since)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	lastMod := get("").Header().Get("Last-Modified")
+
+	t.Run("GET Has Last-Modified", func(t *testing.T) {
+		mod, err := http.ParseTime(lastMod)
+		if err != nil {
+			t.Fatalf("Want: an HTTP date; Got: %q", lastMod)
+		}
+		if want := kvs.ModTime("lastmod").Truncate(time.Second); !mod.Equal(want) {
+			t.Errorf("Want: %v; Got: %v", want, mod)
+		}
+	})
+
+	t.Run("Unchanged Since Is 304", func(t *testing.T) {
+		rec := get(lastMod)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("Want: empty %d; Got: %d %q", http.StatusNotModified, rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("Changed Since Is 200", func(t *testing.T) {
+		earlier := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		if rec := get(earlier); rec.Code != http.StatusOK || rec.Body.String() != "v" {
+			t.Errorf("Want: 200 v; Got: %d %q", rec.Code, rec.Body)
+		}
+	})
+
+	t.Run("Logged Time Is The Store's", func(t *testing.T) {
+		l := useTempLogger(t)
+		clock := newFakeClock()
+		kvs.Clock = clock
+		defer func() { kvs.Clock = nil }()
+
+		do("PUT", "/v1/lastmod-clock", "v")
+		l.Wait()
+
+		events := readAll(t, l.filename)
+		if got := events[len(events)-1].Modified; got != clock.Now().UnixNano() {
+			t.Errorf("Want: %d; Got: %d", clock.Now().UnixNano(), got)
+		}
+	})
+
+	for name, format := range map[string]LogFormat{"TSV": FormatTSV, "MsgPack": FormatMsgPack} {
+		t.Run("Survives A Restart In "+name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "transact.log")
+			l, err := MakeFileTransactionLogger(filename, WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Run()
+			modified := time.Date(2024, 5, 1, 12, 0, 0, 42, time.UTC).UnixNano()
+			l.WritePutVersion("a", "1", 1, modified)
+			l.Close()
+
+			logged := readAll(t, filename, WithFormat(format))[0].Modified
+			if logged != modified {
+				t.Fatalf("Want: %d; Got: %d", modified, logged)
+			}
+
+			reader, err := MakeFileTransactionLogger(filename, WithFormat(format))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+
+			s := KVS{M: make(map[string]string)}
+			if err := replay(reader, &s); err != nil {
+				t.Fatal(err)
+			}
+			if got := s.ModTime("a"); !got.Equal(time.Unix(0, logged)) {
+				t.Errorf("Want: %v; Got: %v", time.Unix(0, logged), got)
+			}
+		})
+	}
+}
+
+func TestGetWithMeta(t *testing.T) {
+	clock := newFakeClock()
+	s := &KVS{M: make(map[string]string), Clock: clock}
+
+	s.Put("meta", "1")
+	clock.Advance(time.Minute)
+	s.Put("meta", "2")
+	clock.Advance(time.Minute)
+	s.Put("other", "x")
+
+	t.Run("Metadata Matches The Last Put", func(t *testing.T) {
+		value, version, modified, err := s.GetWithMeta("meta")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := clock.Now().Add(-time.Minute)
+		if value != "2" || version != 2 || !modified.Equal(want) {
+			t.Errorf("Want: 2 2 %v; Got: %s %d %v", want, value, version, modified)
+		}
+	})
+
+	t.Run("Missing Key", func(t *testing.T) {
+		if _, _, _, err := s.GetWithMeta("nope"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+
+	t.Run("JSON GET Carries The Modification Time", func(t *testing.T) {
+		useTempLogger(t)
+		do("PUT", "/v1/meta-json", "v")
+		do("PUT", "/v1/meta-json", "w")
+
+		rec := do("GET", "/v1/meta-json?format=json", "")
+		var got ValueResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Version != 2 || got.Modified == nil || !got.Modified.Equal(kvs.ModTime("meta-json")) {
+			t.Errorf("Want: 2 %v; Got: %d %v", kvs.ModTime("meta-json"), got.Version, got.Modified)
+		}
+	})
+}
+
+func TestPutResponse(t *testing.T) {
+	useTempLogger(t)
+
+	t.Run("Default Is An Empty 201 With Location", func(t *testing.T) {
+		rec := do("PUT", "/v1/put%20rep", "stored")
+
+		if rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != "/v1/put%20rep" {
+			t.Errorf("Want: %s; Got: %s", "/v1/put%20rep", got)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("Want: empty body; Got: %q", rec.Body.String())
+		}
+	})
+
+	t.Run("Update Is A 200", func(t *testing.T) {
+		if rec := do("PUT", "/v1/put-update", "one"); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if rec := do("PUT", "/v1/put-update", "two"); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		// a deleted key is created afresh
+		do("DELETE", "/v1/put-update", "")
+		if rec := do("PUT", "/v1/put-update", "three"); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+	})
+
+	t.Run("Return Representation Echoes The Value", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/v1/put-rep", strings.NewReader("stored"))
+		req.Header.Set("Prefer", "respond-async, return=representation")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if got := rec.Body.String(); got != "stored" {
+			t.Errorf("Want: %s; Got: %s", "stored", got)
+		}
+		if got := rec.Header().Get("Preference-Applied"); got != "return=representation" {
+			t.Errorf("Want: %s; Got: %s", "return=representation", got)
+		}
+	})
+}
+
+func TestPutTransform(t *testing.T) {
+	useTempLogger(t)
+	t.Cleanup(func() { SetPutTransform(nil) })
+
+	t.Run("Transformed Value Is Stored", func(t *testing.T) {
+		SetPutTransform(func(_, value string) (string, error) {
+			return strings.ToUpper(value), nil
+		})
+
+		req := httptest.NewRequest("PUT", "/v1/shout", strings.NewReader("hello"))
+		req.Header.Set("Prefer", "return=representation")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		if got, _ := kvs.Get("shout"); got != "HELLO" {
+			t.Errorf("Want: %s; Got: %s", "HELLO", got)
+		}
+		if got := rec.Body.String(); got != "HELLO" {
+			t.Errorf("Want: %s; Got: %s", "HELLO", got)
+		}
+
+		do("POST", "/v1/_txn", `[{"op": "put", "key": "shout-txn", "value": "quiet"}]`)
+		if got, _ := kvs.Get("shout-txn"); got != "QUIET" {
+			t.Errorf("Want: %s; Got: %s", "QUIET", got)
+		}
+	})
+
+	t.Run("Rejected Value Is 400", func(t *testing.T) {
+		SetPutTransform(func(key, value string) (string, error) {
+			if !json.Valid([]byte(value)) {
+				return "", errors.New("value must be JSON")
+			}
+			return value, nil
+		})
+
+		if rec := do("PUT", "/v1/strict", "{nope"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+		if _, err := kvs.Get("strict"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if rec := do("PUT", "/v1/strict", `{"ok": true}`); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+	})
+}
+
+func TestTTLHeader(t *testing.T) {
+	useTempLogger(t)
+
+	put := func(key, ttl string) int {
+		req := httptest.NewRequest("PUT", "/v1/"+key, strings.NewReader("v"))
+		if ttl != "" {
+			req.Header.Set(TTLHeader, ttl)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("Valid TTL Expires The Key", func(t *testing.T) {
+		clock := newFakeClock()
+		kvs.Clock = clock
+		defer func() { kvs.Clock = nil }()
+
+		if got := put("ttl-valid", "60"); got != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, got)
+		}
+
+		clock.Advance(time.Minute)
+		if _, err := kvs.Get("ttl-valid"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+
+	t.Run("Absent TTL Never Expires", func(t *testing.T) {
+		clock := newFakeClock()
+		kvs.Clock = clock
+		defer func() { kvs.Clock = nil }()
+
+		if got := put("ttl-absent", ""); got != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, got)
+		}
+
+		clock.Advance(24 * time.Hour)
+		if _, err := kvs.Get("ttl-absent"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Invalid TTL Is 400", func(t *testing.T) {
+		for _, ttl := range []string{"-1", "soon", "1.5"} {
+			if got := put("ttl-invalid", ttl); got != http.StatusBadRequest {
+				t.Errorf("%s: Want: %d; Got: %d", ttl, http.StatusBadRequest, got)
+			}
+		}
+	})
+}
+
+func TestStatsHandler(t *testing.T) {
+	useTempLogger(t)
+	do("PUT", "/v1/stats-key", "v")
+	do("GET", "/v1/stats-key", "")
+
+	rec := do("GET", "/v1/_stats", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+	}
+
+	var got StatsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Keys < 1 {
+		t.Errorf("Want: at least 1 key; Got: %d", got.Keys)
+	}
+	for _, op := range []string{"get", "put"} {
+		h := got.OpDurations[op]
+		if h.Count < 1 {
+			t.Errorf("%s: Want: observations; Got: %+v", op, h)
+		}
+		if len(h.Buckets) != len(opDurationBounds)+1 {
+			t.Errorf("%s: Want: %d buckets; Got: %d", op, len(opDurationBounds)+1, len(h.Buckets))
+		}
+	}
+}
+
+func TestEventCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transact.log")
+	l, err := MakeFileTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	for _, k := range []string{"a", "b", "c", "a"} {
+		l.WritePut(k, "v")
+	}
+	l.WriteDelete("b")
+	l.Close()
+
+	var out bytes.Buffer
+	useLogBuffer(t, &out)
+	l, err = MakeFileTransactionLogger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replay(l, &KVS{M: make(map[string]string)}); err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+
+	saved := transact
+	transact = l
+	t.Cleanup(func() {
+		transact = saved
+		l.Close()
+	})
+
+	t.Run("Replay Counts The Log", func(t *testing.T) {
+		if got, want := logCounts.counts(), (EventCounts{Puts: 4, Deletes: 1}); got != want {
+			t.Errorf("Want: %+v; Got: %+v", want, got)
+		}
+	})
+
+	t.Run("Writes Are Counted Live", func(t *testing.T) {
+		do("PUT", "/v1/counted", "v")
+		do("PUT", "/v1/counted", "w")
+		do("DELETE", "/v1/counted", "")
+		do("DELETE", "/v1/never-there", "")
+
+		var got StatsResponse
+		if err := json.NewDecoder(do("GET", "/v1/_stats", "").Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (EventCounts{Puts: 6, Deletes: 3}); got.Events != want {
+			t.Errorf("Want: %+v; Got: %+v", want, got.Events)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	healthy := func() *KVS {
+		s := &KVS{M: make(map[string]string)}
+		s.Put("a", "1")
+		s.PutWithTTL("b", "2", time.Hour)
+		s.PutInt("n", 3, 0)
+		return s
+	}
+	problems := func(found []Anomaly) []string {
+		var got []string
+		for _, a := range found {
+			got = append(got, a.Key+": "+a.Problem)
+		}
+		return got
+	}
+
+	t.Run("A Healthy Store Passes", func(t *testing.T) {
+		if found, _ := healthy().verify(10, nil); len(found) != 0 {
+			t.Errorf("Want: none; Got: %v", problems(found))
+		}
+	})
+
+	t.Run("Corrupt Entries Are Flagged", func(t *testing.T) {
+		s := healthy()
+		s.M["c"] = "no version"
+		s.expires["gone"] = time.Now()
+		s.M["n"] = "7"
+		s.M["big"] = "more than ten bytes"
+		s.versions["big"] = 1
+
+		found, _ := s.verify(10, nil)
+		want := []string{
+			"big: value of 19 bytes, over the limit of 10",
+			"c: no version",
+			"gone: expiry for a key not in the store",
+			"n: native integer also holds a stored value",
+		}
+		if got := problems(found); !slices.Equal(got, want) {
+			t.Errorf("Want: %q; Got: %q", want, got)
+		}
+	})
+
+	t.Run("Versions Mustn't Go Back", func(t *testing.T) {
+		s := healthy()
+		s.Put("a", "again")
+		_, state := s.verify(0, nil)
+
+		s.versions["a"] = 1
+		found, _ := s.verify(0, state)
+		if got := problems(found); len(got) != 1 || got[0] != "a: version went back from 2 to 1" {
+			t.Errorf("Want: a's version flagged; Got: %q", got)
+		}
+	})
+
+	t.Run("Recreated Keys Start Again", func(t *testing.T) {
+		clock := newFakeClock()
+		s := &KVS{M: make(map[string]string), Clock: clock}
+		s.Put("a", "1")
+		s.Put("a", "2")
+		_, state := s.verify(0, nil)
+
+		clock.Advance(time.Second)
+		s.Delete("a")
+		s.Put("a", "3")
+		if found, _ := s.verify(0, state); len(found) != 0 {
+			t.Errorf("Want: none; Got: %v", problems(found))
+		}
+	})
+
+	t.Run("Handler Reports And Counts Anomalies", func(t *testing.T) {
+		kvs.Lock()
+		kvs.M["verify-corrupt"] = "v"
+		kvs.Unlock()
+		t.Cleanup(func() { kvs.Delete("verify-corrupt") })
+		before := verifyAnomalies.Load()
+		var buf bytes.Buffer
+		useLogBuffer(t, &buf)
+
+		rec := do("GET", "/v1/_verify", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		var got VerifyReport
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(got.Anomalies, Anomaly{Key: "verify-corrupt", Problem: "no version"}) {
+			t.Errorf("Want: verify-corrupt flagged; Got: %v", got.Anomalies)
+		}
+		if verifyAnomalies.Load() <= before {
+			t.Errorf("Want: more than %d anomalies counted; Got: %d", before, verifyAnomalies.Load())
+		}
+		if !strings.Contains(buf.String(), "verify-corrupt") {
+			t.Errorf("Want: verify-corrupt logged; Got: %s", buf.String())
+		}
+	})
+}
+
+func TestLogging(t *testing.T) {
+	t.Run("JSON Records Carry Level And Fields", func(t *testing.T) {
+		var out bytes.Buffer
+		l, err := newLogger(&out, "json", "warn")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		l.Info("hidden")
+		l.Warn("shown", "key", "a", "n", 3)
+
+		var got map[string]any
+		if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+			t.Fatalf("Want: one JSON record; Got: %s", out.String())
+		}
+		if got["level"] != "WARN" || got["msg"] != "shown" || got["key"] != "a" || got["n"] != 3.0 {
+			t.Errorf("Want: WARN shown a 3; Got: %v", got)
+		}
+	})
+
+	t.Run("Bad Settings Are Rejected", func(t *testing.T) {
+		if _, err := newLogger(io.Discard, "xml", "info"); err == nil {
+			t.Error("Want: error for xml")
+		}
+		if _, err := newLogger(io.Discard, "text", "loud"); err == nil {
+			t.Error("Want: error for loud")
+		}
+	})
+}
+
+func TestSlowRequests(t *testing.T) {
+	var out bytes.Buffer
+	useLogBuffer(t, &out)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["key"] == "slow" {
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	r.Use(slowRequests(10 * time.Millisecond))
+
+	t.Run("Fast Requests Are Not Logged", func(t *testing.T) {
+		out.Reset()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/fast", nil))
+		if out.Len() != 0 {
+			t.Errorf("Want: nothing; Got: %s", out.String())
+		}
+	})
+
+	t.Run("Slow Requests Are Logged", func(t *testing.T) {
+		out.Reset()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PUT", "/v1/slow", nil))
+		for _, want := range []string{"level=WARN", `msg="slow request"`, "method=PUT", "key=slow", "took="} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("Want: %s in log; Got: %s", want, out.String())
+			}
+		}
+	})
+}
+
+func TestValueSizes(t *testing.T) {
+	useTempLogger(t)
+
+	saved := valueSizes
+	valueSizes = newHistogram(10, 100)
+	defer func() { valueSizes = saved }()
+
+	for i, n := range []int{5, 10, 50, 500} {
+		do("PUT", fmt.Sprintf("/v1/size-%d", i), strings.Repeat("x", n))
+	}
+
+	t.Run("Metrics Has Cumulative Buckets", func(t *testing.T) {
+		body := do("GET", "/metrics", "").Body.String()
+
+		for _, want := range []string{
+			`cngo_value_size_bytes_bucket{le="10"} 2`,
+			`cngo_value_size_bytes_bucket{le="100"} 3`,
+			`cngo_value_size_bytes_bucket{le="+Inf"} 4`,
+			`cngo_value_size_bytes_sum 565`,
+			`cngo_value_size_bytes_count 4`,
+		} {
+			if !strings.Contains(body, want+"\n") {
+				t.Errorf("Want: %s; Got:\n%s", want, body)
+			}
+		}
+	})
+
+	t.Run("Stats Summarizes", func(t *testing.T) {
+		var got StatsResponse
+		if err := json.NewDecoder(do("GET", "/v1/_stats", "").Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+
+		want := SizeSummary{Count: 4, Min: 5, Max: 500, Avg: 141.25}
+		if got.ValueSizes != want {
+			t.Errorf("Want: %+v; Got: %+v", want, got.ValueSizes)
+		}
+	})
+}
+
+func BenchmarkPut(b *testing.B) {
+	s := KVS{M: make(map[string]string)}
+	keys := benchKeys(1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.Put(keys[i%len(keys)], "value")
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	s := KVS{M: make(map[string]string)}
+	keys := benchKeys(1024)
+	for _, k := range keys {
+		s.Put(k, "value")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.Get(keys[i%len(keys)])
+			i++
+		}
+	})
+}
+
+// BenchmarkImport loads a large snapshot into an empty store, which Import
+// presizes, and one key at a time, which rehashes as the map grows
+func BenchmarkImport(b *testing.B) {
+	keys := benchKeys(100000)
+	state := make(map[string]string, len(keys))
+	for _, k := range keys {
+		state[k] = "value"
+	}
+
+	b.Run("Import", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s := KVS{M: make(map[string]string)}
+			s.Import(state, nil)
+		}
+	})
+
+	b.Run("Put", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s := KVS{M: make(map[string]string)}
+			for k, v := range state {
+				s.Put(k, v)
+			}
+		}
+	})
+}
+
+// BenchmarkMixed is 90% reads and 10% writes from parallel goroutines, to
+// show RWMutex contention
+func BenchmarkMixed(b *testing.B) {
+	s := KVS{M: make(map[string]string)}
+	keys := benchKeys(1024)
+	for _, k := range keys {
+		s.Put(k, "value")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if i%10 == 0 {
+				s.Put(k, "value")
+			} else {
+				s.Get(k)
+			}
+			i++
+		}
+	})
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	s := KVS{M: make(map[string]string)}
+	s.Put("k", "v1")
+
+	if ok, err := s.CompareAndDelete("k", "other"); ok || err != nil {
+		t.Errorf("Want: false <nil>; Got: %v %v", ok, err)
+	}
+	if ok, err := s.CompareAndDelete("k", "v1"); !ok || err != nil {
+		t.Errorf("Want: true <nil>; Got: %v %v", ok, err)
+	}
+	if ok, err := s.CompareAndDelete("k", "v1"); ok || err != ErrorNoSuchKey {
+		t.Errorf("Want: false %v; Got: %v %v", ErrorNoSuchKey, ok, err)
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	useTempLogger(t)
+
+	del := func(key, ifMatch string) int {
+		req := httptest.NewRequest("DELETE", "/v1/"+key, nil)
+		req.Header.Set("If-Match", ifMatch)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	t.Run("Matching ETag Deletes", func(t *testing.T) {
+		do("PUT", "/v1/cas-match", "v1")
+		tag := do("GET", "/v1/cas-match", "").Header().Get("ETag")
+
+		if got := del("cas-match", tag); got != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, got)
+		}
+		if _, err := kvs.Get("cas-match"); err != ErrorNoSuchKey {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Stale ETag Is 412", func(t *testing.T) {
+		do("PUT", "/v1/cas-stale", "v1")
+		tag := do("GET", "/v1/cas-stale", "").Header().Get("ETag")
+		do("PUT", "/v1/cas-stale", "v2")
+
+		if got := del("cas-stale", tag); got != http.StatusPreconditionFailed {
+			t.Errorf("Want: %d; Got: %d", http.StatusPreconditionFailed, got)
+		}
+		if v, _ := kvs.Get("cas-stale"); v != "v2" {
+			t.Errorf("Want: %s; Got: %s", "v2", v)
+		}
+	})
+
+	t.Run("Missing Key Is 412", func(t *testing.T) {
+		if got := del("cas-missing", etag("v1")); got != http.StatusPreconditionFailed {
+			t.Errorf("Want: %d; Got: %d", http.StatusPreconditionFailed, got)
+		}
+	})
+}
+
+func TestTxn(t *testing.T) {
+	l := useTempLogger(t)
+
+	txn := func(body string) *httptest.ResponseRecorder {
+		return do("POST", "/v1/_txn", body)
+	}
+
+	t.Run("All Ops Apply", func(t *testing.T) {
+		do("PUT", "/v1/txn-a", "1")
+		do("PUT", "/v1/txn-gone", "x")
+
+		rec := txn(`[
+			{"op": "put", "key": "txn-a", "value": "2", "compare": "1", "version": 1},
+			{"op": "put", "key": "txn-b", "value": "new", "version": 0},
+			{"op": "delete", "key": "txn-gone"}
+		]`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d %s", http.StatusOK, rec.Code, rec.Body)
+		}
+
+		var got TxnResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		want := []TxnResult{{Key: "txn-a", Version: 2}, {Key: "txn-b", Version: 1}, {Key: "txn-gone", Deleted: true}}
+		if !slices.Equal(got.Results, want) {
+			t.Errorf("Want: %v; Got: %v", want, got.Results)
+		}
+
+		a, _ := kvs.Get("txn-a")
+		b, _ := kvs.Get("txn-b")
+		_, err := kvs.Get("txn-gone")
+		if a != "2" || b != "new" || err != ErrorNoSuchKey {
+			t.Errorf("Want: 2 new %v; Got: %s %s %v", ErrorNoSuchKey, a, b, err)
+		}
+	})
+
+	t.Run("Failed Precondition Applies Nothing", func(t *testing.T) {
+		do("PUT", "/v1/txn-c", "1")
+		seq := l.LastSequence()
+
+		rec := txn(`[
+			{"op": "put", "key": "txn-c", "value": "2"},
+			{"op": "delete", "key": "txn-a"},
+			{"op": "put", "key": "txn-b", "value": "stale", "compare": "old"}
+		]`)
+		if rec.Code != http.StatusConflict {
+			t.Errorf("Want: %d; Got: %d", http.StatusConflict, rec.Code)
+		}
+
+		c, _ := kvs.Get("txn-c")
+		a, _ := kvs.Get("txn-a")
+		b, _ := kvs.Get("txn-b")
+		if c != "1" || a != "2" || b != "new" {
+			t.Errorf("Want: 1 2 new; Got: %s %s %s", c, a, b)
+		}
+		if got := l.LastSequence(); got != seq {
+			t.Errorf("Want: %d; Got: %d", seq, got)
+		}
+	})
+
+	t.Run("Malformed Ops Are 400", func(t *testing.T) {
+		for _, body := range []string{`{}`, `[]`, `[{"op": "get", "key": "k"}]`, `[{"op": "put", "key": ""}]`} {
+			if rec := txn(body); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s: Want: %d; Got: %d", body, http.StatusBadRequest, rec.Code)
+			}
+		}
+	})
+
+	t.Run("Log Failure Changes Nothing", func(t *testing.T) {
+		_, version, _ := kvs.GetVersion("txn-a")
+		failing := failingBatchLogger{MakeMemoryTransactionLogger()}
+		saved := transact
+		transact = failing
+		t.Cleanup(func() { transact = saved })
+
+		rec := txn(`[
+			{"op": "put", "key": "txn-a", "value": "3"},
+			{"op": "put", "key": "txn-d", "value": "1"},
+			{"op": "delete", "key": "txn-c"}
+		]`)
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("Want: %d; Got: %d", http.StatusInternalServerError, rec.Code)
+		}
+
+		a, av, _ := kvs.GetVersion("txn-a")
+		c, _ := kvs.Get("txn-c")
+		_, err := kvs.Get("txn-d")
+		if a != "2" || av != version || c != "1" || err != ErrorNoSuchKey {
+			t.Errorf("Want: 2 v%d 1 %v; Got: %s v%d %s %v", version, ErrorNoSuchKey, a, av, c, err)
+		}
+		if got := len(failing.Events()); got != 0 {
+			t.Errorf("Want: nothing logged; Got: %d events", got)
+		}
+	})
+}
+
+// failingBatchLogger fails every batch, as a full disk would
+type failingBatchLogger struct {
+	*MemoryTransactionLogger
+}
+
+func (l failingBatchLogger) WriteBatch([]Event, bool) error {
+	return errors.New("disk full")
+}
+
+func TestOnChange(t *testing.T) {
+	type change struct {
+		key, value string
+		deleted    bool
+	}
+
+	s := KVS{M: make(map[string]string)}
+	var got []change
+	s.OnChange(func(key, value string, deleted bool) {
+		got = append(got, change{key, value, deleted})
+
+		// hooks run outside the lock, so reading back must not deadlock
+		s.Get(key)
+	})
+
+	s.Put("a", "1")
+	s.PutWithTTL("b", "2", time.Hour)
+	s.Delete("a")
+	s.Delete("never existed")
+	s.CompareAndDelete("b", "2")
+
+	want := []change{
+		{"a", "1", false},
+		{"b", "2", false},
+		{"a", "", true},
+		{"b", "", true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Want: %+v; Got: %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Want: %+v; Got: %+v", want[i], got[i])
+		}
+	}
+}
+
+func TestVersions(t *testing.T) {
+	t.Run("Successive Puts Bump The Version", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("a", "1")
+		s.Put("a", "2")
+		v, _ := s.PutVersioned("a", "3", 0)
+
+		if v != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, v)
+		}
+
+		s.Delete("a")
+		if v, _ := s.PutVersioned("a", "4", 0); v != 1 {
+			t.Errorf("Want: %d; Got: %d", 1, v)
+		}
+	})
+
+	t.Run("GET Reports The Current Version", func(t *testing.T) {
+		useTempLogger(t)
+		do("PUT", "/v1/versioned", "1")
+		do("PUT", "/v1/versioned", "2")
+
+		rec := do("GET", "/v1/versioned", "")
+		if got := rec.Header().Get(VersionHeader); got != "2" {
+			t.Errorf("Want: %s; Got: %s", "2", got)
+		}
+	})
+
+	t.Run("Versions Survive Compaction And Replay", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		s := KVS{M: make(map[string]string)}
+		for _, v := range []string{"1", "2", "3"} {
+			version, _ := s.PutVersioned("a", v, 0)
+			writePut(l, "a", v, version)
+		}
+		l.Wait()
+		if _, _, err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		l, err = MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		restored := KVS{M: make(map[string]string)}
+		if err := replay(l, &restored); err != nil {
+			t.Fatal(err)
+		}
+		if _, v, _ := restored.GetVersion("a"); v != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, v)
+		}
+	})
+}
+
+func TestMaxKeys(t *testing.T) {
+	t.Run("New Keys Beyond The Cap Are Rejected", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), MaxKeys: 2}
+		s.Put("a", "1")
+		s.Put("b", "1")
+
+		if err := s.Put("c", "1"); !errors.Is(err, ErrStoreFull) {
+			t.Errorf("Want: %v; Got: %v", ErrStoreFull, err)
+		}
+		if err := s.Put("a", "2"); err != nil {
+			t.Errorf("Want: update to succeed; Got: %v", err)
+		}
+
+		s.Delete("b")
+		if err := s.Put("c", "1"); err != nil {
+			t.Errorf("Want: room after delete; Got: %v", err)
+		}
+	})
+
+	t.Run("PUT Of A New Key Is 507 When Full", func(t *testing.T) {
+		useTempLogger(t)
+
+		saved := kvs.MaxKeys
+		kvs.MaxKeys = kvs.Len()
+		defer func() { kvs.MaxKeys = saved }()
+
+		if rec := do("PUT", "/v1/max-keys-new", "v"); rec.Code != http.StatusInsufficientStorage {
+			t.Errorf("Want: %d; Got: %d", http.StatusInsufficientStorage, rec.Code)
+		}
+	})
+}
+
+func TestMaxBytes(t *testing.T) {
+	// keys "k0" to "k9" with 8 byte values, 10 bytes each
+	fill := func(s *KVS) {
+		for i := 0; i < 10; i++ {
+			s.Put(fmt.Sprintf("k%d", i), "12345678")
+		}
+	}
+
+	t.Run("Bytes Are Tracked", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("a", "123")
+		s.Put("b", "12345")
+		s.Put("a", "1")
+		s.PutInt("n", 42, 0)
+		s.Rename("b", "bb")
+		s.Delete("a")
+
+		if got, want := s.Bytes(), int64(len("bb12345")+len("n")); got != want {
+			t.Errorf("Want: %d; Got: %d", want, got)
+		}
+	})
+
+	t.Run("A Large Value Evicts Enough Small Ones", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), MaxBytes: 100}
+		fill(&s)
+		for i := 5; i < 10; i++ {
+			s.Get(fmt.Sprintf("k%d", i))
+		}
+
+		if err := s.Put("big", strings.Repeat("x", 47)); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := s.Bytes(); got > s.MaxBytes {
+			t.Errorf("Want: at most %d bytes; Got: %d", s.MaxBytes, got)
+		}
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("k%d", i)
+			_, err := s.Get(key)
+			if evicted := errors.Is(err, ErrorNoSuchKey); evicted != (i < 5) {
+				t.Errorf("Want: %s evicted %v; Got: %v", key, i < 5, evicted)
+			}
+		}
+		if _, err := s.Get("big"); err != nil {
+			t.Errorf("Want: big kept; Got: %v", err)
+		}
+	})
+
+	t.Run("Large Values Go Before Older Small Ones", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), MaxBytes: 100}
+		for i := 0; i < 5; i++ {
+			s.Put(fmt.Sprintf("k%d", i), "12345678")
+		}
+		s.Put("large", strings.Repeat("x", 35))
+
+		var evicted []string
+		s.OnEvict(func(key string) { evicted = append(evicted, key) })
+		s.Put("new", strings.Repeat("x", 17))
+
+		if want := []string{"large"}; !slices.Equal(evicted, want) {
+			t.Errorf("Want: %v; Got: %v", want, evicted)
+		}
+		if got, want := s.Bytes(), int64(70); got != want {
+			t.Errorf("Want: %d; Got: %d", want, got)
+		}
+	})
+
+	t.Run("Values Over The Budget Are Refused", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), MaxBytes: 100}
+		fill(&s)
+
+		if err := s.Put("huge", strings.Repeat("x", 100)); !errors.Is(err, ErrStoreFull) {
+			t.Errorf("Want: %v; Got: %v", ErrStoreFull, err)
+		}
+		if got := s.Len(); got != 10 {
+			t.Errorf("Want: nothing evicted, 10 keys; Got: %d", got)
+		}
+	})
+
+	t.Run("Renaming Onto A Longer Key Stays In Budget", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), MaxBytes: 100}
+		fill(&s)
+
+		if err := s.Rename("k9", "k9-renamed"); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.Bytes(); got > s.MaxBytes {
+			t.Errorf("Want: at most %d bytes; Got: %d", s.MaxBytes, got)
+		}
+		if _, err := s.Get("k9-renamed"); err != nil {
+			t.Errorf("Want: k9-renamed kept; Got: %v", err)
+		}
+
+		long := strings.Repeat("k", 95)
+		if err := s.Rename("k8", long); !errors.Is(err, ErrStoreFull) {
+			t.Errorf("Want: %v; Got: %v", ErrStoreFull, err)
+		}
+		if _, err := s.Get("k8"); err != nil {
+			t.Errorf("Want: k8 left in place; Got: %v", err)
+		}
+	})
+
+	t.Run("Evictions Are Logged As Deletes", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		saved := transact
+		transact = l
+
+		s := KVS{M: make(map[string]string), MaxBytes: 19}
+		s.OnEvict(logEviction)
+		for _, k := range []string{"a", "b"} {
+			s.Put(k, "123456789")
+			l.WritePut(k, "123456789")
+		}
+		transact = saved
+		l.Close()
+
+		if l, err = MakeFileTransactionLogger(path); err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		replayed := KVS{M: make(map[string]string)}
+		if err := replay(l, &replayed); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := replayed.Get("a"); !errors.Is(err, ErrorNoSuchKey) {
+			t.Errorf("Want: a evicted after replay; Got: %v", err)
+		}
+		if _, err := replayed.Get("b"); err != nil {
+			t.Errorf("Want: b kept; Got: %v", err)
+		}
+	})
+
+	t.Run("A Transaction Over The Budget Keeps Its Keys", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		saved := transact
+		transact = l
+		kvs = KVS{M: make(map[string]string), MaxBytes: 30}
+		kvs.OnEvict(logEviction)
+		t.Cleanup(func() { kvs = KVS{M: make(map[string]string)} })
+
+		do("PUT", "/v1/old", "12345678")
+		rec := do("POST", "/v1/_txn", `[
+			{"op": "put", "key": "t1", "value": "123456789012345678"},
+			{"op": "put", "key": "t2", "value": "123456789012345678"}
+		]`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d %s", http.StatusOK, rec.Code, rec.Body)
+		}
+		transact = saved
+		l.Close()
+
+		if l, err = MakeFileTransactionLogger(path); err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		replayed := KVS{M: make(map[string]string)}
+		if err := replay(l, &replayed); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []*KVS{&kvs, &replayed} {
+			for _, k := range []string{"t1", "t2"} {
+				if _, err := s.Get(k); err != nil {
+					t.Errorf("Want: %s kept; Got: %v", k, err)
+				}
+			}
+			if _, err := s.Get("old"); !errors.Is(err, ErrorNoSuchKey) {
+				t.Errorf("Want: old evicted; Got: %v", err)
+			}
+		}
+	})
+}
+
+func TestErrorsHandler(t *testing.T) {
+	var buf bytes.Buffer
+	useLogBuffer(t, &buf)
+	saved := recentErrors
+	recentErrors = &errorRing{buf: make([]LoggedError, 3)}
+	t.Cleanup(func() { recentErrors = saved })
+
+	errs := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		logErrors(errs)
+		close(done)
+	}()
+	for i := 1; i <= 5; i++ {
+		errs <- fmt.Errorf("write %d failed", i)
+	}
+	close(errs)
+	<-done
+
+	rec := do("GET", "/v1/_errors", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+	}
+
+	var resp ErrorsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Only The Latest Are Kept, Oldest First", func(t *testing.T) {
+		want := []string{"write 3 failed", "write 4 failed", "write 5 failed"}
+		var got []string
+		for _, e := range resp.Errors {
+			got = append(got, e.Error)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("Want: %v; Got: %v", want, got)
+		}
+	})
+
+	t.Run("Total Counts Every Error", func(t *testing.T) {
+		if resp.Total != 5 {
+			t.Errorf("Want: %d; Got: %d", 5, resp.Total)
+		}
+	})
+
+	t.Run("Errors Have Times", func(t *testing.T) {
+		for _, e := range resp.Errors {
+			if e.Time.IsZero() {
+				t.Errorf("Want: a time for %q; Got: none", e.Error)
+			}
+		}
+	})
+}
+
+func TestJSONErrors(t *testing.T) {
+	useTempLogger(t)
+
+	cases := []struct {
+		name   string
+		method string
+		target string
+		status int
+		code   string
+	}{
+		{"Missing Key Is no_such_key", "GET", "/v1/json-missing", http.StatusNotFound, "no_such_key"},
+		{"Bad Key Is invalid_key", "PUT", "/v1/bad%09key", http.StatusBadRequest, "invalid_key"},
+		{"Bad Limit Is invalid_argument", "GET", "/v1/_scan?limit=x", http.StatusBadRequest, "invalid_argument"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.target, strings.NewReader("v"))
+			req.Header.Set("Accept", "text/plain;q=0.5, application/json")
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			if rec.Code != c.status {
+				t.Errorf("Want: %d; Got: %d", c.status, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Want: %s; Got: %s", "application/json", got)
+			}
+
+			var got ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Code != c.code || got.Error == "" {
+				t.Errorf("Want: code %s; Got: %+v", c.code, got)
+			}
+		})
+	}
+
+	t.Run("Plain Text Without Accept", func(t *testing.T) {
+		rec := do("GET", "/v1/json-missing", "")
+
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+			t.Errorf("Want: text/plain; Got: %s", got)
+		}
+	})
+}
+
+func TestGetFormat(t *testing.T) {
+	useTempLogger(t)
+	do("PUT", "/v1/format-key", "stored")
+
+	cases := []struct {
+		name   string
+		query  string
+		accept string
+		json   bool
+	}{
+		{"Raw By Default", "", "", false},
+		{"Accept Selects JSON", "", "application/json", true},
+		{"Query Selects JSON", "?format=json", "", true},
+		{"Query Selects Raw", "?format=raw", "", false},
+		{"Query Raw Beats Accept JSON", "?format=raw", "application/json", false},
+		{"Query JSON Beats Accept Text", "?format=json", "text/plain", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v1/format-key"+c.query, nil)
+			if c.accept != "" {
+				req.Header.Set("Accept", c.accept)
+			}
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+			}
+
+			if !c.json {
+				if got := rec.Body.String(); got != "stored" {
+					t.Errorf("Want: %s; Got: %s", "stored", got)
+				}
+				return
+			}
+
+			var got ValueResponse
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Key != "format-key" || got.Value != "stored" || got.Version != 1 {
+				t.Errorf("Want: format-key stored 1; Got: %+v", got)
+			}
+		})
+	}
+
+	t.Run("Query Applies To Errors", func(t *testing.T) {
+		rec := do("GET", "/v1/format-missing?format=json", "")
+		if got := rec.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Want: %s; Got: %s", "application/json", got)
+		}
+	})
+
+	t.Run("Unknown Format Is Rejected", func(t *testing.T) {
+		if rec := do("GET", "/v1/format-key?format=xml", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestBase64(t *testing.T) {
+	binary := string([]byte{0, 1, '\t', '\n', 0xff, 0xfe, '\\'})
+
+	t.Run("Binary Values Round Trip", func(t *testing.T) {
+		useTempLogger(t)
+		body := base64.StdEncoding.EncodeToString([]byte(binary))
+
+		if rec := do("PUT", "/v1/b64-a?b64=1", body); rec.Code != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if v, _ := kvs.Get("b64-a"); v != binary {
+			t.Errorf("Want: %q; Got: %q", binary, v)
+		}
+
+		rec := do("GET", "/v1/b64-a?b64=1", "")
+		if got := rec.Body.String(); got != body {
+			t.Errorf("Want: %s; Got: %s", body, got)
+		}
+	})
+
+	t.Run("Base64 Keys Round Trip", func(t *testing.T) {
+		useTempLogger(t)
+		key := base64.RawURLEncoding.EncodeToString([]byte("a/b?c%d"))
+
+		do("PUT", "/v1/"+key+"?b64key=1", "v")
+		if v, _ := kvs.Get("a/b?c%d"); v != "v" {
+			t.Errorf("Want: %s; Got: %s", "v", v)
+		}
+
+		rec := do("GET", "/v1/"+key+"?b64key=1&format=json", "")
+		var got ValueResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Key != "a/b?c%d" || got.Value != "v" {
+			t.Errorf("Want: a/b?c%%d v; Got: %s %s", got.Key, got.Value)
+		}
+	})
+
+	t.Run("Base64 Keys Delete And Route Decoded", func(t *testing.T) {
+		useTempLogger(t)
+		key := base64.RawURLEncoding.EncodeToString([]byte("a/b?c%d"))
+		do("PUT", "/v1/"+key+"?b64key=1", "v")
+
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/v1/"+key+"?b64key=1", nil), map[string]string{"key": key})
+		if got, ok := routeKey(req); !ok || got != "a/b?c%d" {
+			t.Errorf("Want: %s true; Got: %s %v", "a/b?c%d", got, ok)
+		}
+
+		if rec := do("DELETE", "/v1/"+key+"?b64key=1", ""); rec.Code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if _, err := kvs.Get("a/b?c%d"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if rec := do("DELETE", "/v1/not*b64?b64key=1", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Base64 Keys Add Decoded", func(t *testing.T) {
+		useTempLogger(t)
+		key := base64.RawURLEncoding.EncodeToString([]byte("a/b?n"))
+
+		if rec := do("POST", "/v1/"+key+"/add?b64key=1", "2"); rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if v, _ := kvs.Get("a/b?n"); v != "2" {
+			t.Errorf("Want: %s; Got: %s", "2", v)
+		}
+		if _, err := kvs.Get(key); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if rec := do("POST", "/v1/not*b64/add?b64key=1", "1"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Base64 Keys Rename Decoded", func(t *testing.T) {
+		useTempLogger(t)
+		key := base64.RawURLEncoding.EncodeToString([]byte("a/b?old"))
+		kvs.Put("a/b?old", "v")
+		kvs.Put(key, "raw")
+
+		if rec := do("POST", "/v1/"+key+"/rename?b64key=1", "b64-renamed"); rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if v, _ := kvs.Get("b64-renamed"); v != "v" {
+			t.Errorf("Want: %s; Got: %s", "v", v)
+		}
+		if v, _ := kvs.Get(key); v != "raw" {
+			t.Errorf("Want: %s; Got: %s", "raw", v)
+		}
+
+		bad := base64.RawURLEncoding.EncodeToString([]byte("bad\x01key"))
+		if rec := do("POST", "/v1/"+bad+"/rename?b64key=1", "b64-other"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Base64 Keys Show Decoded History", func(t *testing.T) {
+		l := useTempLogger(t)
+		key := base64.RawURLEncoding.EncodeToString([]byte("a/b?hist"))
+		do("PUT", "/v1/"+key+"?b64key=1", "decoded")
+		do("PUT", "/v1/"+key, "raw")
+		l.Wait()
+
+		rec := do("GET", "/v1/"+key+"/history?b64key=1", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "decoded") || strings.Contains(rec.Body.String(), "raw") {
+			t.Errorf("Want: only the decoded key's puts; Got: %s", rec.Body.String())
+		}
+	})
+
+	t.Run("Bad Base64 Is 400", func(t *testing.T) {
+		for _, target := range []string{"/v1/b64-b?b64=1", "/v1/not*b64?b64key=1", "/v1/b64-b?b64=maybe"} {
+			if rec := do("PUT", target, "!!!"); rec.Code != http.StatusBadRequest {
+				t.Errorf("%s Want: %d; Got: %d", target, http.StatusBadRequest, rec.Code)
+			}
+		}
+	})
+}
+
+func TestContentType(t *testing.T) {
+	useTempLogger(t)
+
+	cases := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"JSON Object", `{"a": [1, 2]}`, "application/json"},
+		{"JSON Array", ` [1, 2]`, "application/json"},
+		{"Broken JSON Is Text", `{"a": `, "text/plain; charset=utf-8"},
+		{"Plain Text", "just words", "text/plain; charset=utf-8"},
+		{"HTML", "<!DOCTYPE html><p>hi</p>", "text/html; charset=utf-8"},
+		{"PNG", "\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			do("PUT", "/v1/sniffed", c.value)
+
+			rec := do("GET", "/v1/sniffed", "")
+			if got := rec.Header().Get("Content-Type"); got != c.want {
+				t.Errorf("Want: %s; Got: %s", c.want, got)
+			}
+		})
+	}
+}
+
+func TestPreload(t *testing.T) {
+	t.Run("Seeds And Logs Every Key", func(t *testing.T) {
+		l := useTempLogger(t)
+		path := filepath.Join(t.TempDir(), "seed.json")
+		os.WriteFile(path, []byte(`{"preload-a": "1", "preload-b": "two"}`), 0644)
+
+		n, err := preload(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, n)
+		}
+
+		if got, _ := kvs.Get("preload-b"); got != "two" {
+			t.Errorf("Want: %s; Got: %s", "two", got)
+		}
+
+		l.Wait()
+		logged := map[string]string{}
+		events, errs := l.ReadLog(1)
+		for e := range events {
+			logged[e.Key] = e.Value
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if logged["preload-a"] != "1" || logged["preload-b"] != "two" {
+			t.Errorf("Want: both keys logged; Got: %v", logged)
+		}
+	})
+
+	t.Run("Malformed File Stores Nothing", func(t *testing.T) {
+		useTempLogger(t)
+		dir := t.TempDir()
+
+		for name, content := range map[string]string{
+			"truncated.json": `{"preload-bad": "1"`,
+			"numbers.json":   `{"preload-bad": 1}`,
+			"badkey.json":    `{"preload-bad": "1", "": "empty key"}`,
+		} {
+			path := filepath.Join(dir, name)
+			os.WriteFile(path, []byte(content), 0644)
+
+			if _, err := preload(path); err == nil {
+				t.Errorf("Want: error for %s", name)
+			}
+		}
+
+		if _, err := kvs.Get("preload-bad"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+}
+
+func TestSetNX(t *testing.T) {
+	t.Run("Acquire, Contest And Reacquire After Expiry", func(t *testing.T) {
+		clock := newFakeClock()
+		s := KVS{M: make(map[string]string), Clock: clock}
+
+		if ok, err := s.SetNX("lock", "a", time.Minute); !ok || err != nil {
+			t.Fatalf("Want: acquired; Got: %v %v", ok, err)
+		}
+		if ok, _ := s.SetNX("lock", "b", time.Minute); ok {
+			t.Error("Want: contested acquire to fail; Got: acquired")
+		}
+		if got, _ := s.Get("lock"); got != "a" {
+			t.Errorf("Want: %s; Got: %s", "a", got)
+		}
+
+		clock.Advance(time.Minute)
+		if ok, _ := s.SetNX("lock", "b", time.Minute); !ok {
+			t.Error("Want: reacquired after expiry; Got: not acquired")
+		}
+		if got, v, _ := s.GetVersion("lock"); got != "b" || v != 1 {
+			t.Errorf("Want: b at version 1; Got: %s at version %d", got, v)
+		}
+	})
+
+	t.Run("PUT With nx=1 Is 412 When Held", func(t *testing.T) {
+		useTempLogger(t)
+
+		if rec := do("PUT", "/v1/nx-lock?nx=1&ttl=30", "a"); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if rec := do("PUT", "/v1/nx-lock?nx=1&ttl=30", "b"); rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("Want: %d; Got: %d", http.StatusPreconditionFailed, rec.Code)
+		}
+		if rec := do("PUT", "/v1/nx-lock?nx=maybe", "b"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestSetIfVersion(t *testing.T) {
+	t.Run("Matching Version Writes", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+
+		v, err := s.SetIfVersion("k", "a", 0)
+		if err != nil || v != 1 {
+			t.Fatalf("Want: 1 <nil>; Got: %d %v", v, err)
+		}
+		if v, err = s.SetIfVersion("k", "b", 1); err != nil || v != 2 {
+			t.Errorf("Want: 2 <nil>; Got: %d %v", v, err)
+		}
+		if got, _ := s.Get("k"); got != "b" {
+			t.Errorf("Want: %s; Got: %s", "b", got)
+		}
+	})
+
+	t.Run("Mismatched Version Leaves The Key", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("k", "a")
+		s.Put("k", "b")
+
+		for _, expected := range []uint64{0, 1, 3} {
+			if _, err := s.SetIfVersion("k", "c", expected); !errors.Is(err, ErrVersionMismatch) {
+				t.Errorf("Want: %v; Got: %v", ErrVersionMismatch, err)
+			}
+		}
+		if got, _ := s.Get("k"); got != "b" {
+			t.Errorf("Want: %s; Got: %s", "b", got)
+		}
+	})
+
+	t.Run("If-Match Carries The Version", func(t *testing.T) {
+		useTempLogger(t)
+		put := func(ifMatch, body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("PUT", "/v1/if-version", strings.NewReader(body))
+			req.Header.Set("If-Match", ifMatch)
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+			return rec
+		}
+
+		if rec := put(`"0"`, "a"); rec.Code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, rec.Code)
+		}
+		if rec := put("1", "b"); rec.Code != http.StatusOK || rec.Header().Get(VersionHeader) != "2" {
+			t.Errorf("Want: %d version 2; Got: %d version %s", http.StatusOK, rec.Code, rec.Header().Get(VersionHeader))
+		}
+
+		rec := put("1", "c")
+		if rec.Code != http.StatusPreconditionFailed {
+			t.Errorf("Want: %d; Got: %d", http.StatusPreconditionFailed, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "at version 2") {
+			t.Errorf("Want: at version 2; Got: %s", rec.Body.String())
+		}
+		if got, _ := kvs.Get("if-version"); got != "b" {
+			t.Errorf("Want: %s; Got: %s", "b", got)
+		}
+
+		if rec := put(etag("b"), "c"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat("compressible ", 1000)
+
+	t.Run("Large Values Round Trip Compressed", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), CompressAbove: 1024}
+		s.Put("large", large)
+
+		if !s.compressed["large"] || len(s.M["large"]) >= len(large) {
+			t.Errorf("Want: compressed; Got: %d bytes held", len(s.M["large"]))
+		}
+		if got, _ := s.Get("large"); got != large {
+			t.Errorf("Want: %d bytes; Got: %d bytes", len(large), len(got))
+		}
+		if got := s.Snapshot()["large"]; got != large {
+			t.Errorf("Want: %d bytes; Got: %d bytes", len(large), len(got))
+		}
+		if ok, _ := s.CompareAndDelete("large", large); !ok {
+			t.Error("Want: deleted; Got: value mismatch")
+		}
+	})
+
+	t.Run("Small Values Are Stored As Is", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), CompressAbove: 1024}
+		s.Put("small", "tiny")
+
+		if s.compressed["small"] || s.M["small"] != "tiny" {
+			t.Errorf("Want: %s uncompressed; Got: %q", "tiny", s.M["small"])
+		}
+	})
+}
+
+func TestCodecs(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	aesCodec, err := NewAESCodec(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codecs := map[string]ValueCodec{
+		"Identity": IdentityCodec{},
+		"Gzip":     GzipCodec{},
+		"AES":      aesCodec,
+		"Chain":    ChainCodec{GzipCodec{}, aesCodec},
+	}
+	values := []string{"", "tiny", strings.Repeat("compressible ", 1000)}
+
+	for name, codec := range codecs {
+		t.Run(name+" Round Trips", func(t *testing.T) {
+			for _, v := range values {
+				got, err := codec.Decode(codec.Encode([]byte(v)))
+				if err != nil || string(got) != v {
+					t.Errorf("Want: %d bytes; Got: %d bytes %v", len(v), len(got), err)
+				}
+			}
+		})
+
+		t.Run(name+" Store Round Trips", func(t *testing.T) {
+			s := KVS{M: make(map[string]string), Codec: codec}
+			for i, v := range values {
+				k := fmt.Sprint("k", i)
+				s.Put(k, v)
+
+				if got, _ := s.Get(k); got != v {
+					t.Errorf("Want: %d bytes; Got: %d bytes", len(v), len(got))
+				}
+				var buf bytes.Buffer
+				if s.GetInto(k, &buf); buf.String() != v {
+					t.Errorf("Want: %d bytes; Got: %d bytes", len(v), buf.Len())
+				}
+			}
+		})
+	}
+
+	t.Run("AES Hides The Value", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), Codec: aesCodec}
+		s.Put("secret", "plain text")
+
+		if strings.Contains(s.M["secret"], "plain text") {
+			t.Error("Want: ciphertext held; Got: plain text")
+		}
+	})
+
+	t.Run("AES Rejects Another Key", func(t *testing.T) {
+		other, _ := NewAESCodec(bytes.Repeat([]byte{8}, 32))
+		if _, err := other.Decode(aesCodec.Encode([]byte("v"))); !errors.Is(err, ErrCiphertext) {
+			t.Errorf("Want: %v; Got: %v", ErrCiphertext, err)
+		}
+	})
+}
+
+func TestGetInto(t *testing.T) {
+	s := KVS{M: make(map[string]string), CompressAbove: 1024}
+	large := strings.Repeat("compressible ", 1000)
+	s.Put("small", "tiny")
+	s.Put("large", large)
+
+	for key, want := range map[string]string{"small": "tiny", "large": large} {
+		var buf bytes.Buffer
+		if err := s.GetInto(key, &buf); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != want {
+			t.Errorf("%s: Want: %d bytes; Got: %d bytes", key, len(want), buf.Len())
+		}
+	}
+
+	if err := s.GetInto("missing", io.Discard); err != ErrorNoSuchKey {
+		t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+	}
+}
+
+// BenchmarkGetInto compares writing a value out via Get, which converts it
+// to a byte slice, with GetInto, which doesn't
+func BenchmarkGetInto(b *testing.B) {
+	s := KVS{M: make(map[string]string)}
+	s.Put("key", strings.Repeat("v", 64*1024))
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v, _ := s.Get("key")
+			io.Discard.Write([]byte(v))
+		}
+	})
+
+	b.Run("GetInto", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.GetInto("key", io.Discard)
+		}
+	})
+}
+
+func TestGzipPut(t *testing.T) {
+	useTempLogger(t)
+
+	put := func(key string, body []byte, encoding string) int {
+		req := httptest.NewRequest("PUT", "/v1/"+key, bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+
+	t.Run("Gzip Body Is Stored Decompressed", func(t *testing.T) {
+		if got := put("gzip-put", gzipped("inflated"), "gzip"); got != http.StatusCreated {
+			t.Fatalf("Want: %d; Got: %d", http.StatusCreated, got)
+		}
+		if v, _ := kvs.Get("gzip-put"); v != "inflated" {
+			t.Errorf("Want: %s; Got: %s", "inflated", v)
+		}
+	})
+
+	t.Run("Malformed Gzip Is 400", func(t *testing.T) {
+		if got := put("gzip-bad", []byte("not gzip"), "gzip"); got != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, got)
+		}
+	})
+
+	t.Run("Decompressed Size Is Limited", func(t *testing.T) {
+		bomb := gzipped(strings.Repeat("x", int(maxValueSize)+1))
+		if got := put("gzip-bomb", bomb, "gzip"); got != http.StatusRequestEntityTooLarge {
+			t.Errorf("Want: %d; Got: %d", http.StatusRequestEntityTooLarge, got)
+		}
+	})
+
+	t.Run("Unknown Encoding Is 415", func(t *testing.T) {
+		if got := put("gzip-br", []byte("v"), "br"); got != http.StatusUnsupportedMediaType {
+			t.Errorf("Want: %d; Got: %d", http.StatusUnsupportedMediaType, got)
+		}
+	})
+}
+
+func TestReadModifyWrite(t *testing.T) {
+	t.Run("CompareAndSwap Only Swaps A Match", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("a", "1")
+
+		if ok, _ := s.CompareAndSwap("a", "2", "3"); ok {
+			t.Error("Want: no swap; Got: swapped")
+		}
+		if ok, _ := s.CompareAndSwap("a", "1", "3"); !ok {
+			t.Error("Want: swapped; Got: no swap")
+		}
+		if _, err := s.CompareAndSwap("missing", "", "1"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if v, _ := s.Get("a"); v != "3" {
+			t.Errorf("Want: %s; Got: %s", "3", v)
+		}
+	})
+
+	t.Run("Increment And Append", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+
+		s.Increment("n", 5)
+		if n, _ := s.Increment("n", -2); n != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, n)
+		}
+
+		s.Put("word", "x")
+		if _, err := s.Increment("word", 1); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("Want: %v; Got: %v", ErrNotInteger, err)
+		}
+
+		if n, _ := s.Append("word", "yz"); n != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, n)
+		}
+	})
+
+	t.Run("Concurrent Increments Are Not Lost", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					s.Increment("n", 1)
+					s.Put("other", "v")
+				}
+			}()
+		}
+		wg.Wait()
+
+		if v, _ := s.Get("n"); v != "1000" {
+			t.Errorf("Want: %s; Got: %s", "1000", v)
+		}
+	})
+
+	t.Run("TTL Survives An Update", func(t *testing.T) {
+		clock := newFakeClock()
+		s := KVS{M: make(map[string]string), Clock: clock}
+		s.PutWithTTL("n", "1", time.Minute)
+		s.Increment("n", 1)
+
+		clock.Advance(time.Minute)
+		if _, err := s.Get("n"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+}
+
+func TestNativeInts(t *testing.T) {
+	t.Run("Reads Render Decimal", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.PutInt("n", -42, 0)
+
+		if v, _ := s.Get("n"); v != "-42" {
+			t.Errorf("Want: %s; Got: %s", "-42", v)
+		}
+		var buf bytes.Buffer
+		if s.GetInto("n", &buf); buf.String() != "-42" {
+			t.Errorf("Want: %s; Got: %s", "-42", buf.String())
+		}
+		if m := s.Snapshot(); m["n"] != "-42" {
+			t.Errorf("Want: %s; Got: %s", "-42", m["n"])
+		}
+	})
+
+	t.Run("Increment Converts Strings And Doesn't Allocate", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("n", "10")
+		s.Increment("n", 1)
+
+		if _, native := s.ints["n"]; !native {
+			t.Fatal("Want: native after Increment")
+		}
+		if allocs := testing.AllocsPerRun(100, func() { s.Increment("n", 1) }); allocs != 0 {
+			t.Errorf("Want: %d allocs; Got: %v", 0, allocs)
+		}
+		if v, _ := s.Get("n"); v != "112" {
+			t.Errorf("Want: %s; Got: %s", "112", v)
+		}
+	})
+
+	t.Run("String Put Replaces It", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.PutInt("n", 1, 0)
+		s.Put("n", "one")
+
+		if v, _ := s.Get("n"); v != "one" {
+			t.Errorf("Want: %s; Got: %s", "one", v)
+		}
+		if _, err := s.Increment("n", 1); !errors.Is(err, ErrNotInteger) {
+			t.Errorf("Want: %v; Got: %v", ErrNotInteger, err)
+		}
+	})
+
+	t.Run("Rename Keeps It Native", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.PutInt("a", 7, 0)
+		s.Rename("a", "b")
+
+		if _, native := s.ints["b"]; !native {
+			t.Error("Want: b native")
+		}
+		if v, _ := s.Get("b"); v != "7" {
+			t.Errorf("Want: %s; Got: %s", "7", v)
+		}
+	})
+
+	t.Run("Handler Stores type=int", func(t *testing.T) {
+		l := useTempLogger(t)
+
+		if rec := do("PUT", "/v1/int-a?type=int", "seven"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+		do("PUT", "/v1/int-a?type=int", " 0041")
+		do("POST", "/v1/int-a/add", "1")
+
+		if rec := do("GET", "/v1/int-a", ""); rec.Body.String() != "42" {
+			t.Errorf("Want: %s; Got: %s", "42", rec.Body)
+		}
+
+		l.Close()
+		events := readAll(t, l.filename)
+		if len(events) < 2 || events[0].Value != "41" || events[1].Value != "42" {
+			t.Errorf("Want: 41 then 42 logged; Got: %v", events)
+		}
+	})
+}
+
+// BenchmarkIncrement compares adding to a counter held as a decimal
+// string, parsed and formatted each time, with one held natively
+func BenchmarkIncrement(b *testing.B) {
+	b.Run("String", func(b *testing.B) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("n", "0")
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			s.update("n", func(v string, _ bool) (string, error) {
+				n, _ := strconv.ParseInt(v, 10, 64)
+				return strconv.FormatInt(n+1, 10), nil
+			})
+		}
+	})
+
+	b.Run("Native", func(b *testing.B) {
+		s := KVS{M: make(map[string]string)}
+		s.PutInt("n", 0, 0)
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			s.Increment("n", 1)
+		}
+	})
+}
+
+func TestAdd(t *testing.T) {
+	t.Run("Concurrent Adds Are Not Lost", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					if _, err := s.Add("n", 3); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if v, _ := s.Get("n"); v != "3000" {
+			t.Errorf("Want: %s; Got: %s", "3000", v)
+		}
+	})
+
+	t.Run("Handler Returns The Sum", func(t *testing.T) {
+		useTempLogger(t)
+		kvs.Delete("add-a")
+
+		do("POST", "/v1/add-a/add", "")
+		rec := do("POST", "/v1/add-a/add", "41")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+
+		var got AddResponse
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if want := (AddResponse{Key: "add-a", Value: 42, Version: 2}); got != want {
+			t.Errorf("Want: %+v; Got: %+v", want, got)
+		}
+	})
+
+	t.Run("Bad Delta Is 400", func(t *testing.T) {
+		if rec := do("POST", "/v1/add-b/add", "lots"); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Non-Integer Value Is 409", func(t *testing.T) {
+		useTempLogger(t)
+		kvs.Put("add-c", "word")
+
+		if rec := do("POST", "/v1/add-c/add", "1"); rec.Code != http.StatusConflict {
+			t.Errorf("Want: %d; Got: %d", http.StatusConflict, rec.Code)
+		}
+	})
+}
+
+func TestRename(t *testing.T) {
+	t.Run("Moves A Present Key", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("a", "1")
+
+		if err := s.Rename("a", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("a"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if v, _ := s.Get("b"); v != "1" {
+			t.Errorf("Want: %s; Got: %s", "1", v)
+		}
+	})
+
+	t.Run("Absent Key Is ErrorNoSuchKey", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+
+		if err := s.Rename("a", "b"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if _, err := s.Get("b"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+	})
+
+	t.Run("Existing Target Is Overwritten", func(t *testing.T) {
+		s := KVS{M: make(map[string]string), MaxKeys: 2}
+		s.Put("a", "1")
+		s.Put("b", "2")
+
+		if err := s.Rename("a", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if v, version, _ := s.GetVersion("b"); v != "1" || version != 2 {
+			t.Errorf("Want: 1 2; Got: %s %d", v, version)
+		}
+		if s.Len() != 1 {
+			t.Errorf("Want: %d; Got: %d", 1, s.Len())
+		}
+	})
+
+	t.Run("Handler Logs A Put And A Delete", func(t *testing.T) {
+		l := useTempLogger(t)
+		kvs.Put("rename-a", "v")
+
+		rec := do("POST", "/v1/rename-a/rename", "rename-b")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, rec.Code)
+		}
+		if got := rec.Header().Get("Location"); got != "/v1/rename-b" {
+			t.Errorf("Want: %s; Got: %s", "/v1/rename-b", got)
+		}
+
+		l.Wait()
+		reader, err := MakeFileTransactionLogger(l.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+
+		s := KVS{M: make(map[string]string)}
+		if err := replay(reader, &s); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("rename-a"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if v, _ := s.Get("rename-b"); v != "v" {
+			t.Errorf("Want: %s; Got: %s", "v", v)
+		}
+	})
+
+	t.Run("Missing Key Is 404", func(t *testing.T) {
+		if rec := do("POST", "/v1/rename-none/rename", "rename-c"); rec.Code != http.StatusNotFound {
+			t.Errorf("Want: %d; Got: %d", http.StatusNotFound, rec.Code)
+		}
+	})
+}
+
+// BenchmarkUpdateParallel runs read-modify-writes on many distinct keys
+// in parallel, once holding the store's write lock throughout and once via
+// update, which holds only the key's stripe while computing the new value.
+// Cheap updates like Increment pay for the extra lock; the stripe wins as
+// the modify step gets costlier, as with Append on large values, and only
+// with several CPUs.
+func TestMergePatch(t *testing.T) {
+	patch := func(t *testing.T, s *KVS, p string) string {
+		t.Helper()
+		v, _, err := s.MergePatch("doc", []byte(p), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	t.Run("Adds A Field", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("doc", `{"a":1}`)
+		if got, want := patch(t, &s, `{"b":"x"}`), `{"a":1,"b":"x"}`; got != want {
+			t.Errorf("Want: %s; Got: %s", want, got)
+		}
+	})
+
+	t.Run("Updates Nested Fields", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("doc", `{"a":{"b":1,"c":2},"d":[1,2]}`)
+		if got, want := patch(t, &s, `{"a":{"b":3},"d":[9]}`), `{"a":{"b":3,"c":2},"d":[9]}`; got != want {
+			t.Errorf("Want: %s; Got: %s", want, got)
+		}
+	})
+
+	t.Run("Null Deletes A Field", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("doc", `{"a":1,"b":{"c":2,"d":3}}`)
+		if got, want := patch(t, &s, `{"a":null,"b":{"c":null},"e":null}`), `{"b":{"d":3}}`; got != want {
+			t.Errorf("Want: %s; Got: %s", want, got)
+		}
+	})
+
+	t.Run("Numbers Keep Their Precision", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("doc", `{"n":9007199254740993}`)
+		if got, want := patch(t, &s, `{}`), `{"n":9007199254740993}`; got != want {
+			t.Errorf("Want: %s; Got: %s", want, got)
+		}
+	})
+
+	t.Run("Invalid JSON Is ErrInvalidJSON", func(t *testing.T) {
+		s := KVS{M: make(map[string]string)}
+		s.Put("doc", `not json`)
+		if _, _, err := s.MergePatch("doc", []byte(`{}`), nil); !errors.Is(err, ErrInvalidJSON) {
+			t.Errorf("Want: %v; Got: %v", ErrInvalidJSON, err)
+		}
+		s.Put("doc", `{}`)
+		if _, _, err := s.MergePatch("doc", []byte(`{`), nil); !errors.Is(err, ErrInvalidJSON) {
+			t.Errorf("Want: %v; Got: %v", ErrInvalidJSON, err)
+		}
+	})
+
+	t.Run("Handler Stores And Logs The Result", func(t *testing.T) {
+		l := useTempLogger(t)
+		kvs.Put("patch-doc", `{"name":"ann","age":30}`)
+
+		req := httptest.NewRequest("PATCH", "/v1/patch-doc", strings.NewReader(`{"age":31,"name":null}`))
+		req.Header.Set("Content-Type", MergePatchType)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d %s", http.StatusOK, rec.Code, rec.Body)
+		}
+		if got, want := rec.Body.String(), `{"age":31}`; got != want {
+			t.Errorf("Want: %s; Got: %s", want, got)
+		}
+		if v, _ := kvs.Get("patch-doc"); v != `{"age":31}` {
+			t.Errorf("Want: %s; Got: %s", `{"age":31}`, v)
+		}
+
+		l.Wait()
+		events, _ := l.ReadLog(0)
+		var last Event
+		for e := range events {
+			last = e
+		}
+		if last.Key != "patch-doc" || last.Value != `{"age":31}` {
+			t.Errorf("Want: put of patch-doc; Got: %+v", last)
+		}
+	})
+
+	t.Run("Handler Needs The Merge Patch Type", func(t *testing.T) {
+		rec := do("PATCH", "/v1/patch-doc", `{}`)
+		if rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Want: %d; Got: %d", http.StatusUnsupportedMediaType, rec.Code)
+		}
+		if got := rec.Header().Get("Accept-Patch"); got != MergePatchType {
+			t.Errorf("Want: %s; Got: %s", MergePatchType, got)
+		}
+	})
+
+	t.Run("Handler Rejects Bad JSON And Missing Keys", func(t *testing.T) {
+		kvs.Put("patch-text", "plain")
+		for target, want := range map[string]int{
+			"/v1/patch-text":    http.StatusBadRequest,
+			"/v1/patch-missing": http.StatusNotFound,
+		} {
+			req := httptest.NewRequest("PATCH", target, strings.NewReader(`{"a":1}`))
+			req.Header.Set("Content-Type", MergePatchType)
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Errorf("%s: Want: %d; Got: %d", target, want, rec.Code)
+			}
+		}
+	})
+
+	patchAs := func(target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", target, strings.NewReader(body))
+		req.Header.Set("Content-Type", MergePatchType)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Base64 Keys Patch Decoded", func(t *testing.T) {
+		useTempLogger(t)
+		key := base64.RawURLEncoding.EncodeToString([]byte("a/b?doc"))
+		kvs.Put("a/b?doc", `{"a":1}`)
+
+		if rec := patchAs("/v1/"+key+"?b64key=1", "", `{"b":2}`); rec.Code != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d %s", http.StatusOK, rec.Code, rec.Body)
+		}
+		if v, _ := kvs.Get("a/b?doc"); v != `{"a":1,"b":2}` {
+			t.Errorf("Want: %s; Got: %s", `{"a":1,"b":2}`, v)
+		}
+		if _, err := kvs.Get(key); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if rec := patchAs("/v1/not*b64?b64key=1", "", `{}`); rec.Code != http.StatusBadRequest {
+			t.Errorf("Want: %d; Got: %d", http.StatusBadRequest, rec.Code)
+		}
+	})
+
+	t.Run("Policy Checks The Decoded Key", func(t *testing.T) {
+		useTempLogger(t)
+		if err := setAuth(nil, []string{"alice:a-secret"}); err != nil {
+			t.Fatal(err)
+		}
+		SetAuthPolicy(func(method, key, user string) bool {
+			return !strings.HasPrefix(key, "secret/")
+		})
+		t.Cleanup(func() {
+			setAuthTokens()
+			SetAuthPolicy(nil)
+		})
+
+		kvs.Put("secret/doc", `{"a":1}`)
+		key := base64.RawURLEncoding.EncodeToString([]byte("secret/doc"))
+		kvs.Put(key, `{"a":1}`)
+
+		if rec := patchAs("/v1/"+key+"?b64key=1", "a-secret", `{"a":2}`); rec.Code != http.StatusForbidden {
+			t.Errorf("Want: %d; Got: %d", http.StatusForbidden, rec.Code)
+		}
+		for _, k := range []string{"secret/doc", key} {
+			if v, _ := kvs.Get(k); v != `{"a":1}` {
+				t.Errorf("Want: %s unchanged; Got: %s", k, v)
+			}
+		}
+	})
+}
+
+func BenchmarkUpdateParallel(b *testing.B) {
+	keys := benchKeys(1024)
+
+	run := func(b *testing.B, initial string, fn func(string) string, striped bool) {
+		s := KVS{M: make(map[string]string)}
+		for _, k := range keys {
+			s.Put(k, initial)
+		}
+		var next atomic.Int64
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			i := int(next.Add(1)) * 97
+			for pb.Next() {
+				k := keys[i%len(keys)]
+				if striped {
+					s.update(k, func(v string, _ bool) (string, error) { return fn(v), nil })
+				} else {
+					s.Lock()
+					s.put(k, fn(s.M[k]), false, keepTTL)
+					s.Unlock()
+				}
+				i++
+			}
+		})
+	}
+
+	increment := func(v string) string {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		return strconv.FormatInt(n+1, 10)
+	}
+	rotate := func(v string) string { return v[1:] + v[:1] }
+	large := strings.Repeat("v", 4096)
+
+	b.Run("Increment/GlobalLock", func(b *testing.B) { run(b, "0", increment, false) })
+	b.Run("Increment/Striped", func(b *testing.B) { run(b, "0", increment, true) })
+	b.Run("Rotate4K/GlobalLock", func(b *testing.B) { run(b, large, rotate, false) })
+	b.Run("Rotate4K/Striped", func(b *testing.B) { run(b, large, rotate, true) })
+}
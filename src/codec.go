@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// ValueCodec transforms values as the store holds them in memory. Encode
+// runs on every put and Decode on every read, so a store's Codec must be
+// set before anything is put and never changed. Values are logged and
+// snapshotted decoded.
+type ValueCodec interface {
+	Encode(value []byte) []byte
+	Decode(stored []byte) ([]byte, error)
+}
+
+// IdentityCodec holds values as they are
+type IdentityCodec struct{}
+
+// Encode returns value unchanged
+func (IdentityCodec) Encode(value []byte) []byte { return value }
+
+// Decode returns stored unchanged
+func (IdentityCodec) Decode(stored []byte) ([]byte, error) { return stored, nil }
+
+// GzipCodec compresses every value. Unlike KVS.CompressAbove it doesn't
+// skip small values, which gzip's header can make larger.
+type GzipCodec struct {
+	Level int // a compress/gzip level; 0 uses gzip.BestSpeed
+}
+
+// Encode gzips value
+func (c GzipCodec) Encode(value []byte) []byte {
+	level := c.Level
+	if level == 0 {
+		level = gzip.BestSpeed
+	}
+
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		zw = gzip.NewWriter(&buf)
+	}
+	zw.Write(value)
+	zw.Close()
+
+	return buf.Bytes()
+}
+
+// Decode gunzips stored
+func (GzipCodec) Decode(stored []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// AESCodec encrypts values with AES-GCM, each under a fresh random nonce
+// that's stored in front of it
+type AESCodec struct {
+	aead cipher.AEAD
+}
+
+// ErrCiphertext is returned when a value fails to decrypt
+var ErrCiphertext = errors.New("value does not decrypt")
+
+// NewAESCodec makes an AESCodec from a 16, 24 or 32 byte key, for
+// AES-128, AES-192 or AES-256
+func NewAESCodec(key []byte) (*AESCodec, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AESCodec{aead: aead}, nil
+}
+
+// Encode encrypts value
+func (c *AESCodec) Encode(value []byte) []byte {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("cngo: no randomness for a nonce: " + err.Error())
+	}
+
+	return c.aead.Seal(nonce, nonce, value, nil)
+}
+
+// Decode decrypts stored, failing if it was tampered with or encrypted
+// under another key
+func (c *AESCodec) Decode(stored []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(stored) < n {
+		return nil, ErrCiphertext
+	}
+
+	value, err := c.aead.Open(nil, stored[:n], stored[n:], nil)
+	if err != nil {
+		return nil, ErrCiphertext
+	}
+	return value, nil
+}
+
+// ChainCodec applies codecs in order on Encode and in reverse on Decode,
+// e.g. GzipCodec then an AESCodec to compress before encrypting
+type ChainCodec []ValueCodec
+
+// Encode runs value through each codec in turn
+func (c ChainCodec) Encode(value []byte) []byte {
+	for _, codec := range c {
+		value = codec.Encode(value)
+	}
+	return value
+}
+
+// Decode undoes Encode
+func (c ChainCodec) Decode(stored []byte) ([]byte, error) {
+	for i := len(c) - 1; i >= 0; i-- {
+		var err error
+		if stored, err = c[i].Decode(stored); err != nil {
+			return nil, err
+		}
+	}
+	return stored, nil
+}
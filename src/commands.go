@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rhardin/cngo/config"
+)
+
+// command is one of cngo's subcommands. Each gets its own flag set, to
+// which loadConfig adds the usual settings.
+type command struct {
+	run  func(fs *flag.FlagSet, args []string, out io.Writer) error
+	help string
+}
+
+// commands are picked by the first argument; without one cngo serves
+var commands = map[string]command{
+	"serve":   {serve, "run the server (the default)"},
+	"compact": {compactCommand, "compact the transaction log, or the file log given, while the server is stopped"},
+	"replay":  {replayCommand, "replay the transaction log and report what it holds"},
+	"migrate": {migrateCommand, "copy the store into a new file log, e.g. to change its format"},
+	"fsck":    {fsckCommand, "check a file log for corruption without loading it"},
+}
+
+// run dispatches args to a subcommand, which writes any report to out
+func run(args []string, out io.Writer) error {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q; want one of %s", name, strings.Join(commandNames(), ", "))
+	}
+
+	fs := flag.NewFlagSet("cngo "+name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: cngo %s [flags]\n%s\n\n", name, cmd.help)
+		fs.PrintDefaults()
+	}
+
+	err := cmd.run(fs, args, out)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadConfig parses args into the settings, along with whatever flags the
+// command has already added to fs, and sets up logging from them
+func loadConfig(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	cfg, err := config.Load(fs, args, os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	if logger, err = newLogger(os.Stderr, cfg.Logging.Format, cfg.Logging.Level); err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+
+	return cfg, nil
+}
+
+// checkConfig goes beyond config.Validate to check that what cfg names is
+// there to use: the postgres database answers, or the log's directory can
+// be written to. Nothing is created or changed.
+func checkConfig(cfg *config.Config) error {
+	if cfg.Preload != "" {
+		if _, err := os.Stat(cfg.Preload); err != nil {
+			return fmt.Errorf("preload: %w", err)
+		}
+	}
+
+	if cfg.Backend == "postgres" {
+		db, err := sql.Open("postgres", PostgresDBParams{dsn: cfg.Postgres.DSN}.connString())
+		if err != nil {
+			return fmt.Errorf("postgres: %w", err)
+		}
+		defer db.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			return fmt.Errorf("postgres: %w", err)
+		}
+		return nil
+	}
+
+	// an existing log must be openable for writing; a new one needs a
+	// directory to go in
+	if f, err := os.OpenFile(cfg.Log.Path, os.O_RDWR, 0); err == nil {
+		return f.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("log: %w", err)
+	}
+
+	dir := filepath.Dir(cfg.Log.Path)
+	f, err := os.CreateTemp(dir, ".cngo-check-*")
+	if err != nil {
+		return fmt.Errorf("log: directory %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkTimeout bounds how long checkConfig waits for the database
+const checkTimeout = 10 * time.Second
+
+// readLog opens the configured log and replays it into a fresh store.
+// The logger isn't started, so nothing is written to it.
+func readLog(cfg *config.Config) (TransactionLogger, *KVS, error) {
+	l, err := openTransactionLogger(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &KVS{M: make(map[string]string)}
+	if err := replay(l, s); err != nil {
+		closeLogger(l)
+		return nil, nil, err
+	}
+
+	return l, s, nil
+}
+
+// closeLogger closes l if it needs closing
+func closeLogger(l TransactionLogger) error {
+	if c, ok := l.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// compactCommand compacts the file log named by its argument, or else the
+// configured log, in place. The compacted log is written beside the old
+// one and renamed over it. A file log is locked while it's compacted, and
+// it refuses to start if a running server holds the lock.
+func compactCommand(fs *flag.FlagSet, args []string, out io.Writer) error {
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() > 0 {
+		cfg.Backend, cfg.Log.Path = "file", fs.Arg(0)
+	}
+	if cfg.Backend == "file" {
+		if _, err := os.Stat(cfg.Log.Path); err != nil {
+			return fmt.Errorf("log: %w", err)
+		}
+		unlock, err := lockLog(cfg.Log.Path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	l, _, err := readLog(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeLogger(l)
+
+	c, ok := l.(Compactor)
+	if !ok {
+		return fmt.Errorf("compaction %w", ErrNotSupported)
+	}
+
+	before, after, err := c.Compact()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "compacted %s from %d events to %d\n", cfg.Log.Path, before, after)
+	return closeLogger(l)
+}
+
+// replayCommand replays the configured log and reports the resulting
+// store, without serving it
+func replayCommand(fs *flag.FlagSet, args []string, out io.Writer) error {
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	l, s, err := readLog(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeLogger(l)
+
+	fmt.Fprintf(out, "keys: %d\n", s.Len())
+	if seq, ok := l.(Sequencer); ok {
+		fmt.Fprintf(out, "sequence: %d\n", seq.LastSequence())
+	}
+	return nil
+}
+
+// migrateCommand replays the configured log, from any backend, and
+// writes the store out as a new file log holding a put per key
+func migrateCommand(fs *flag.FlagSet, args []string, out io.Writer) error {
+	dest := fs.String("out", "", "write the new log to this file, which mustn't exist")
+	format := fs.String("to-format", "tsv", "format of the new log: tsv or msgpack")
+
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var opts []FileLoggerOption
+	switch *format {
+	case "tsv":
+	case "msgpack":
+		opts = append(opts, WithFormat(FormatMsgPack))
+	default:
+		return fmt.Errorf("-to-format must be tsv or msgpack, not %q", *format)
+	}
+	if *dest == "" {
+		return errors.New("-out is required")
+	}
+	if _, err := os.Stat(*dest); err == nil {
+		return fmt.Errorf("%s already exists", *dest)
+	}
+
+	l, s, err := readLog(cfg)
+	if err != nil {
+		return err
+	}
+	defer closeLogger(l)
+
+	w, err := MakeFileTransactionLogger(*dest, opts...)
+	if err != nil {
+		return err
+	}
+	w.Run()
+
+	state, versions := s.SnapshotVersions()
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := w.WritePutChecked(k, state[k], versions[k], s.ModTime(k).UnixNano()); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "migrated %d keys to %s\n", len(keys), *dest)
+	return nil
+}
+
+// fsckCommand checks the file log named by its argument, or else the
+// configured one, failing with ErrLogCorrupt if it has problems
+func fsckCommand(fs *flag.FlagSet, args []string, out io.Writer) error {
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	path := cfg.Log.Path
+	if fs.NArg() > 0 {
+		path = fs.Arg(0)
+	}
+	format := FormatTSV
+	if cfg.Log.Format == "msgpack" {
+		format = FormatMsgPack
+	}
+
+	report, err := fsckLog(path, format)
+	if err != nil {
+		return err
+	}
+
+	report.Print(out)
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%s: %w", path, ErrLogCorrupt)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/rhardin/cngo/config"
+)
+
+// CompactionRun describes a finished compaction
+type CompactionRun struct {
+	At        time.Time `json:"at"`
+	Before    int       `json:"before"` // events in the log beforehand
+	After     int       `json:"after"`
+	Scheduled bool      `json:"scheduled"` // rather than asked for
+}
+
+// lastCompaction is the latest compaction, scheduled or asked for
+var lastCompaction atomic.Pointer[CompactionRun]
+
+// compactSchedule is the automatic compaction schedule, nil without one
+var compactSchedule atomic.Pointer[config.Compaction]
+
+// compactNow compacts c with writes paused, as they must be, and records
+// the run
+func compactNow(c Compactor, scheduled bool) (before, after int, err error) {
+	resume := pauseWrites()
+	before, after, err = c.Compact()
+	resume()
+
+	if err == nil {
+		lastCompaction.Store(&CompactionRun{At: time.Now().UTC(), Before: before, After: after, Scheduled: scheduled})
+	}
+	return before, after, err
+}
+
+// compactEvery checks the log every cfg.Check until ctx is done,
+// compacting it whenever compactDue says to
+func compactEvery(ctx context.Context, cfg config.Compaction) {
+	c, ok := transact.(Compactor)
+	if !ok {
+		logger.Warn("compaction not supported by this backend")
+		return
+	}
+	compactSchedule.Store(&cfg)
+
+	ticker := time.NewTicker(cfg.Check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			due, err := compactDue(c, cfg, t)
+			if err != nil {
+				logger.Error("compaction check failed", "err", err)
+				continue
+			}
+			if !due {
+				continue
+			}
+
+			before, after, err := compactNow(c, true)
+			if err != nil {
+				logger.Error("scheduled compaction failed", "err", err)
+				continue
+			}
+			logger.Info("compacted log", "before", before, "after", after)
+		}
+	}
+}
+
+// compactDue reports whether c's log should be compacted at t: it's
+// outside MinInterval of the last compaction and inside any Window, and
+// it has reached MinSize or DeadRatio. Either way compaction must have
+// something to drop.
+func compactDue(c Compactor, cfg config.Compaction, t time.Time) (bool, error) {
+	if last := lastCompaction.Load(); last != nil && t.Sub(last.At) < cfg.MinInterval {
+		return false, nil
+	}
+	if !inWindow(cfg.Window, t) {
+		return false, nil
+	}
+
+	big := false
+	if s, ok := c.(Sizer); ok && cfg.MinSize > 0 {
+		big = s.Size() >= cfg.MinSize
+	}
+	if !big && cfg.DeadRatio == 0 {
+		return false, nil
+	}
+
+	before, after, err := c.CompactStats()
+	if err != nil || after >= before {
+		return false, err
+	}
+	if big {
+		return true, nil
+	}
+	return float64(before-after)/float64(before) >= cfg.DeadRatio, nil
+}
+
+// inWindow reports whether t's local time of day falls in window, as
+// config.ParseWindow reads it. An empty window is any time.
+func inWindow(window string, t time.Time) bool {
+	if window == "" {
+		return true
+	}
+	start, end, err := config.ParseWindow(window)
+	if err != nil {
+		return true // Validate has already refused it
+	}
+
+	t = t.Local()
+	day := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if start <= end {
+		return day >= start && day < end
+	}
+	return day >= start || day < end
+}
+
+// CompactionStats is the compaction part of StatsResponse
+type CompactionStats struct {
+	Schedule *CompactionSchedule `json:"schedule,omitempty"`
+	Last     *CompactionRun      `json:"last,omitempty"`
+}
+
+// CompactionSchedule reports config.Compaction
+type CompactionSchedule struct {
+	Check       string  `json:"check"`
+	MinSize     int64   `json:"min_size,omitempty"`
+	DeadRatio   float64 `json:"dead_ratio,omitempty"`
+	MinInterval string  `json:"min_interval,omitempty"`
+	Window      string  `json:"window,omitempty"`
+}
+
+func compactionStats() CompactionStats {
+	stats := CompactionStats{Last: lastCompaction.Load()}
+	if cfg := compactSchedule.Load(); cfg != nil {
+		stats.Schedule = &CompactionSchedule{
+			Check:       cfg.Check.String(),
+			MinSize:     cfg.MinSize,
+			DeadRatio:   cfg.DeadRatio,
+			MinInterval: cfg.MinInterval.String(),
+			Window:      cfg.Window,
+		}
+	}
+	return stats
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// pack returns value as it should be held in M, and whether it has to be
+// unpacked: encoded if the store has a Codec, or else gzipped if it's at
+// least CompressAbove bytes and compressing actually saves space
+func (s *KVS) pack(value string) (stored string, packed bool) {
+	if s.Codec != nil {
+		return string(s.Codec.Encode([]byte(value))), true
+	}
+
+	if s.CompressAbove <= 0 || len(value) < s.CompressAbove {
+		return value, false
+	}
+
+	var buf bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	zw.Write([]byte(value))
+	zw.Close()
+
+	if buf.Len() >= len(value) {
+		return value, false
+	}
+
+	return buf.String(), true
+}
+
+// unpack reverses pack. The data never left memory, so a failure here is
+// a bug rather than bad input.
+func (s *KVS) unpack(stored string) string {
+	var buf strings.Builder
+	if err := s.unpackTo(&buf, stored); err != nil {
+		panic("cngo: corrupt packed value: " + err.Error())
+	}
+
+	return buf.String()
+}
+
+// unpackTo decodes a packed value straight into w
+func (s *KVS) unpackTo(w io.Writer, stored string) error {
+	if s.Codec != nil {
+		value, err := s.Codec.Decode([]byte(stored))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(value)
+		return err
+	}
+
+	zr, err := gzip.NewReader(strings.NewReader(stored))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, zr)
+	return err
+}
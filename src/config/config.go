@@ -0,0 +1,688 @@
+// Package config loads the server's settings from defaults, an optional
+// YAML or TOML file, CNGO_* environment variables and command line flags,
+// each layer overriding the one before.
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the server can be configured with
+type Config struct {
+	Listen           string        `yaml:"listen" toml:"listen"`
+	Backend          string        `yaml:"backend" toml:"backend"` // "file" or "postgres"
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" toml:"snapshot_interval"`
+	VerifyInterval   time.Duration `yaml:"verify_interval" toml:"verify_interval"` // store integrity checks; 0 runs none
+	DrainTimeout     time.Duration `yaml:"drain_timeout" toml:"drain_timeout"`
+	Preload          string        `yaml:"preload" toml:"preload"`             // JSON object of seed keys
+	FoldKeyCase      bool          `yaml:"fold_key_case" toml:"fold_key_case"` // case-insensitive keys
+
+	Log      Log      `yaml:"log" toml:"log"`
+	Postgres Postgres `yaml:"postgres" toml:"postgres"`
+	Limits   Limits   `yaml:"limits" toml:"limits"`
+	Auth     Auth     `yaml:"auth" toml:"auth"`
+	Cluster  Cluster  `yaml:"cluster" toml:"cluster"`
+	Metrics  Metrics  `yaml:"metrics" toml:"metrics"`
+	Logging  Logging  `yaml:"logging" toml:"logging"`
+	HTTP     HTTP     `yaml:"http" toml:"http"`
+
+	Compaction Compaction `yaml:"compaction" toml:"compaction"`
+}
+
+// Log configures the file backend's transaction log and its durability
+type Log struct {
+	Path          string        `yaml:"path" toml:"path"`
+	Format        string        `yaml:"format" toml:"format"`                 // "tsv" or "msgpack"
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"` // 0 flushes every event
+	Shards        int           `yaml:"shards" toml:"shards"`                 // files to spread writes over; 0 or 1 is one
+	ReplayWorkers int           `yaml:"replay_workers" toml:"replay_workers"` // goroutines applying events at startup; 0 or 1 is one
+
+	// Durability is "relaxed", acknowledging writes once they're in the
+	// log, or "strong", waiting until the log is fsynced
+	Durability string `yaml:"durability" toml:"durability"`
+}
+
+// Postgres configures the postgres backend. Writes failing in ways that
+// may pass, like a dropped connection, are tried up to Attempts times in
+// all, waiting RetryBackoff before the first retry and twice as long
+// before each after it. Once BreakerThreshold writes in a row have
+// failed so, writes fail at once for BreakerCooldown before one is tried
+// again; a threshold of 0 never stops trying.
+type Postgres struct {
+	DSN              string        `yaml:"dsn" toml:"dsn"`
+	Attempts         int           `yaml:"attempts" toml:"attempts"`
+	RetryBackoff     time.Duration `yaml:"retry_backoff" toml:"retry_backoff"`
+	BreakerThreshold int           `yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+}
+
+// Limits caps what clients can store. Zero means no limit, except for
+// MaxValueSize.
+type Limits struct {
+	MaxKeys       int   `yaml:"max_keys" toml:"max_keys"`
+	MaxValueSize  int64 `yaml:"max_value_size" toml:"max_value_size"`
+	CompressAbove int   `yaml:"compress_above" toml:"compress_above"`
+
+	// MaxBytes evicts keys, large and least recently used first, to keep
+	// the store's keys and values under this many bytes in memory
+	MaxBytes int64 `yaml:"max_bytes" toml:"max_bytes"`
+}
+
+// Auth lists the bearer tokens clients may present. Tokens are taken
+// whole and name no user; each of Users is "user:secret", a token that
+// identifies user to any authorization policy.
+type Auth struct {
+	Tokens []string `yaml:"tokens" toml:"tokens"`
+	Users  []string `yaml:"users" toml:"users"`
+}
+
+// Cluster places this node among its peers; no peers runs standalone
+type Cluster struct {
+	Self  string   `yaml:"self" toml:"self"`
+	Peers []string `yaml:"peers" toml:"peers"`
+
+	// Primary, if set, runs this node as a read-only standby replicating
+	// the server at this URL until it's promoted
+	Primary string `yaml:"primary" toml:"primary"`
+
+	// PrimaryToken is the bearer token a standby presents to its primary,
+	// which only streams its log to clients bearing one of its tokens
+	PrimaryToken string `yaml:"primary_token" toml:"primary_token"`
+}
+
+// Logging configures the server's own log, not the transaction log
+type Logging struct {
+	Format string `yaml:"format" toml:"format"` // "text" or "json"
+	Level  string `yaml:"level" toml:"level"`   // "debug", "info", "warn" or "error"
+}
+
+// HTTP bounds how long, and how many, clients can hold the server up.
+// Zero disables a limit.
+type HTTP struct {
+	ReadTimeout  time.Duration `yaml:"read_timeout" toml:"read_timeout"`   // to read a whole request
+	WriteTimeout time.Duration `yaml:"write_timeout" toml:"write_timeout"` // for each write of a response
+
+	// HandlerTimeout cancels a request's context once it has run this
+	// long; streams like _changes are exempt
+	HandlerTimeout time.Duration `yaml:"handler_timeout" toml:"handler_timeout"`
+
+	// MaxRequests is how many requests may be handled at once; more get a
+	// 503
+	MaxRequests int `yaml:"max_requests" toml:"max_requests"`
+}
+
+// Compaction schedules compacting the file log without being asked. The
+// log is looked at every Check, 0 never, and compacted once it's MinSize
+// bytes or DeadRatio of its events would be dropped, but no more often
+// than MinInterval and, if a Window is given, only within it.
+type Compaction struct {
+	Check       time.Duration `yaml:"check" toml:"check"`
+	MinSize     int64         `yaml:"min_size" toml:"min_size"`
+	DeadRatio   float64       `yaml:"dead_ratio" toml:"dead_ratio"`
+	MinInterval time.Duration `yaml:"min_interval" toml:"min_interval"`
+	Window      string        `yaml:"window" toml:"window"` // "HH:MM-HH:MM" local time, which may span midnight
+}
+
+// ParseWindow parses a Compaction.Window into its start and end as
+// offsets from midnight
+func ParseWindow(s string) (start, end time.Duration, err error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+	}
+
+	parse := func(hhmm string) (time.Duration, error) {
+		t, err := time.Parse("15:04", strings.TrimSpace(hhmm))
+		if err != nil {
+			return 0, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+		}
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+	}
+
+	if start, err = parse(from); err != nil {
+		return 0, 0, err
+	}
+	if end, err = parse(to); err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+// Metrics configures what the server measures
+type Metrics struct {
+	// ValueSizeBuckets are the upper bounds, in bytes, of the value size
+	// histogram; empty keeps the server's defaults
+	ValueSizeBuckets []float64 `yaml:"value_size_buckets" toml:"value_size_buckets"`
+
+	// SlowRequest logs a warning for requests taking at least this long;
+	// 0 logs none
+	SlowRequest time.Duration `yaml:"slow_request" toml:"slow_request"`
+}
+
+// Default is the configuration with nothing overridden
+func Default() Config {
+	return Config{
+		Listen:       ":8080",
+		Backend:      "file",
+		DrainTimeout: 10 * time.Second,
+		Log: Log{
+			Path:       "transact.log",
+			Format:     "tsv",
+			Durability: "relaxed",
+		},
+		Postgres: Postgres{
+			Attempts:         3,
+			RetryBackoff:     100 * time.Millisecond,
+			BreakerThreshold: 5,
+			BreakerCooldown:  30 * time.Second,
+		},
+		Limits: Limits{
+			MaxValueSize: 1 << 20,
+		},
+		Logging: Logging{
+			Format: "text",
+			Level:  "info",
+		},
+		Cluster: Cluster{
+			Self: "localhost:8080",
+		},
+		HTTP: HTTP{
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: 30 * time.Second,
+		},
+	}
+}
+
+// Load builds a Config from the defaults, then the file named by the
+// -config flag (if any), then the environment as read by lookupEnv, then
+// the flags in args that were set, and validates the result.
+func Load(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	file := fs.String("config", "", "read settings from this YAML or TOML file")
+	c.registerFlags(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// The file and environment overwrite the flag-bound fields, so note
+	// what was set on the command line to put back afterwards.
+	set := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+
+	if *file != "" {
+		if err := c.ReadFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	for name, value := range set {
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// ReadFile overlays the settings in a .yaml, .yml or .toml file on c.
+// Unknown settings are an error, so typos don't go unnoticed.
+func (c *Config) ReadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %q", path, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("%s: unknown config format %q (want .yaml, .yml or .toml)", path, ext)
+	}
+
+	return nil
+}
+
+// setting is a Config field that can be set from a string, by flag or
+// environment variable
+type setting struct {
+	flag, env, usage string
+	value            flag.Value
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"listen", "CNGO_LISTEN", "address to serve HTTP on", stringValue{&c.Listen}},
+		{"backend", "CNGO_BACKEND", "transaction log backend, file or postgres", stringValue{&c.Backend}},
+		{"snapshot-interval", "CNGO_SNAPSHOT_INTERVAL",
+			"take a snapshot of the store this often (0 disables)", durationValue{&c.SnapshotInterval}},
+		{"verify-interval", "CNGO_VERIFY_INTERVAL",
+			"check the store's internal invariants this often, logging anomalies (0 disables)", durationValue{&c.VerifyInterval}},
+		{"drain-timeout", "CNGO_DRAIN_TIMEOUT",
+			"how long shutdown waits for requests in flight and then the transaction log to flush", durationValue{&c.DrainTimeout}},
+		{"preload", "CNGO_PRELOAD",
+			"seed the store from this JSON object of keys and values at startup", stringValue{&c.Preload}},
+		{"fold-key-case", "CNGO_FOLD_KEY_CASE",
+			"make keys case-insensitive by lowercasing them; keep it set for the life of the log", boolValue{&c.FoldKeyCase}},
+		{"log", "CNGO_LOG", "transaction log file for the file backend", stringValue{&c.Log.Path}},
+		{"log-format", "CNGO_LOG_FORMAT", "transaction log encoding, tsv or msgpack", stringValue{&c.Log.Format}},
+		{"flush-interval", "CNGO_FLUSH_INTERVAL",
+			"group commit: flush and fsync the log this often (0 flushes every event)", durationValue{&c.Log.FlushInterval}},
+		{"durability", "CNGO_DURABILITY",
+			"relaxed acknowledges writes once logged; strong waits for them to be fsynced", stringValue{&c.Log.Durability}},
+		{"log-shards", "CNGO_LOG_SHARDS",
+			"spread the transaction log over this many files, each with its own writer", intValue{&c.Log.Shards}},
+		{"replay-workers", "CNGO_REPLAY_WORKERS",
+			"apply the log at startup on this many goroutines, keeping each key's events in order", intValue{&c.Log.ReplayWorkers}},
+		{"postgres-dsn", "CNGO_POSTGRES_DSN", "connection string for the postgres backend", stringValue{&c.Postgres.DSN}},
+		{"postgres-attempts", "CNGO_POSTGRES_ATTEMPTS",
+			"tries in all for a postgres write failing transiently (1 never retries)", intValue{&c.Postgres.Attempts}},
+		{"postgres-retry-backoff", "CNGO_POSTGRES_RETRY_BACKOFF",
+			"wait before retrying a postgres write, doubled for each retry after", durationValue{&c.Postgres.RetryBackoff}},
+		{"postgres-breaker-threshold", "CNGO_POSTGRES_BREAKER_THRESHOLD",
+			"fail postgres writes fast after this many in a row fail (0 never does)", intValue{&c.Postgres.BreakerThreshold}},
+		{"postgres-breaker-cooldown", "CNGO_POSTGRES_BREAKER_COOLDOWN",
+			"how long postgres writes fail fast before one is tried again", durationValue{&c.Postgres.BreakerCooldown}},
+		{"max-keys", "CNGO_MAX_KEYS",
+			"reject puts of new keys once the store holds this many (0 is no limit)", intValue{&c.Limits.MaxKeys}},
+		{"max-value-size", "CNGO_MAX_VALUE_SIZE", "largest value a PUT may store, in bytes", int64Value{&c.Limits.MaxValueSize}},
+		{"compress-above", "CNGO_COMPRESS_ABOVE",
+			"gzip values of at least this many bytes in memory (0 disables)", intValue{&c.Limits.CompressAbove}},
+		{"max-bytes", "CNGO_MAX_BYTES",
+			"evict large, least recently used keys to hold the store under this many bytes (0 never evicts)", int64Value{&c.Limits.MaxBytes}},
+		{"auth-tokens", "CNGO_AUTH_TOKENS", "comma separated bearer tokens clients may present", listValue{&c.Auth.Tokens}},
+		{"auth-users", "CNGO_AUTH_USERS",
+			"comma separated user:token pairs, bearer tokens that name their user to an authorization policy", listValue{&c.Auth.Users}},
+		{"self", "CNGO_SELF", "this node's address as the other cluster nodes know it", stringValue{&c.Cluster.Self}},
+		{"peers", "CNGO_PEERS",
+			"comma separated addresses of the other cluster nodes (empty runs standalone)", listValue{&c.Cluster.Peers}},
+		{"standby-of", "CNGO_STANDBY_OF",
+			"run as a read-only standby replicating the server at this URL, until promoted", stringValue{&c.Cluster.Primary}},
+		{"standby-token", "CNGO_STANDBY_TOKEN",
+			"bearer token a standby presents to its primary", stringValue{&c.Cluster.PrimaryToken}},
+		{"value-size-buckets", "CNGO_VALUE_SIZE_BUCKETS",
+			"comma separated upper bounds of the value size histogram, in bytes", floatListValue{&c.Metrics.ValueSizeBuckets}},
+		{"logging-format", "CNGO_LOGGING_FORMAT", "server log format, text or json", stringValue{&c.Logging.Format}},
+		{"logging-level", "CNGO_LOGGING_LEVEL",
+			"least severe server log level shown: debug, info, warn or error", stringValue{&c.Logging.Level}},
+		{"slow-request", "CNGO_SLOW_REQUEST",
+			"log a warning for requests taking at least this long (0 disables)", durationValue{&c.Metrics.SlowRequest}},
+		{"read-timeout", "CNGO_READ_TIMEOUT",
+			"give up on a client that takes longer to send its request (0 disables)", durationValue{&c.HTTP.ReadTimeout}},
+		{"write-timeout", "CNGO_WRITE_TIMEOUT",
+			"give up on a client that takes longer to accept any one write of a response (0 disables)", durationValue{&c.HTTP.WriteTimeout}},
+		{"handler-timeout", "CNGO_HANDLER_TIMEOUT",
+			"cancel requests, other than streams, running longer than this (0 disables)", durationValue{&c.HTTP.HandlerTimeout}},
+		{"max-requests", "CNGO_MAX_REQUESTS",
+			"answer requests beyond this many at once with a 503 (0 is no limit)", intValue{&c.HTTP.MaxRequests}},
+		{"compact-check", "CNGO_COMPACT_CHECK",
+			"see whether the log needs compacting this often (0 never compacts it automatically)", durationValue{&c.Compaction.Check}},
+		{"compact-min-size", "CNGO_COMPACT_MIN_SIZE",
+			"compact the log automatically once it's this many bytes (0 ignores size)", int64Value{&c.Compaction.MinSize}},
+		{"compact-dead-ratio", "CNGO_COMPACT_DEAD_RATIO",
+			"compact the log automatically once this fraction of its events is dead (0 ignores them)", floatValue{&c.Compaction.DeadRatio}},
+		{"compact-min-interval", "CNGO_COMPACT_MIN_INTERVAL",
+			"leave at least this long between automatic compactions", durationValue{&c.Compaction.MinInterval}},
+		{"compact-window", "CNGO_COMPACT_WINDOW",
+			"only compact automatically between these local times, as HH:MM-HH:MM (empty is any time)", stringValue{&c.Compaction.Window}},
+	}
+}
+
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	for _, s := range c.settings() {
+		fs.Var(s.value, s.flag, s.usage)
+	}
+}
+
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	for _, s := range c.settings() {
+		v, ok := lookupEnv(s.env)
+		if !ok {
+			continue
+		}
+		if err := s.value.Set(v); err != nil {
+			return fmt.Errorf("%s: %w", s.env, err)
+		}
+	}
+
+	return nil
+}
+
+// Validate reports every bad setting in c at once
+func (c *Config) Validate() error {
+	var problems []string
+	bad := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	if c.Listen == "" {
+		bad("listen must not be empty")
+	}
+
+	switch c.Backend {
+	case "file":
+		if c.Log.Path == "" {
+			bad("log.path is required by the file backend")
+		}
+	case "postgres":
+		if c.Postgres.DSN == "" {
+			bad("postgres.dsn is required by the postgres backend")
+		}
+		if c.Postgres.Attempts < 1 {
+			bad("postgres.attempts must be at least 1, got %d", c.Postgres.Attempts)
+		}
+		if c.Postgres.RetryBackoff < 0 {
+			bad("postgres.retry_backoff must not be negative, got %v", c.Postgres.RetryBackoff)
+		}
+		if c.Postgres.BreakerThreshold < 0 {
+			bad("postgres.breaker_threshold must not be negative, got %d", c.Postgres.BreakerThreshold)
+		}
+		if c.Postgres.BreakerCooldown < 0 {
+			bad("postgres.breaker_cooldown must not be negative, got %v", c.Postgres.BreakerCooldown)
+		}
+	default:
+		bad("backend must be file or postgres, not %q", c.Backend)
+	}
+
+	if c.Log.Format != "tsv" && c.Log.Format != "msgpack" {
+		bad("log.format must be tsv or msgpack, not %q", c.Log.Format)
+	}
+	if c.Log.FlushInterval < 0 {
+		bad("log.flush_interval must not be negative, got %v", c.Log.FlushInterval)
+	}
+	if c.Log.Durability != "relaxed" && c.Log.Durability != "strong" {
+		bad("log.durability must be relaxed or strong, not %q", c.Log.Durability)
+	}
+	if c.Log.Shards < 0 {
+		bad("log.shards must not be negative, got %d", c.Log.Shards)
+	}
+	if c.SnapshotInterval < 0 {
+		bad("snapshot_interval must not be negative, got %v", c.SnapshotInterval)
+	}
+	if c.VerifyInterval < 0 {
+		bad("verify_interval must not be negative, got %v", c.VerifyInterval)
+	}
+	if c.DrainTimeout < 0 {
+		bad("drain_timeout must not be negative, got %v", c.DrainTimeout)
+	}
+
+	if c.Limits.MaxKeys < 0 {
+		bad("limits.max_keys must not be negative, got %d", c.Limits.MaxKeys)
+	}
+	if c.Limits.MaxValueSize <= 0 {
+		bad("limits.max_value_size must be positive, got %d", c.Limits.MaxValueSize)
+	}
+	if c.Limits.CompressAbove < 0 {
+		bad("limits.compress_above must not be negative, got %d", c.Limits.CompressAbove)
+	}
+	if c.Limits.MaxBytes < 0 {
+		bad("limits.max_bytes must not be negative, got %d", c.Limits.MaxBytes)
+	}
+
+	for _, t := range c.Auth.Tokens {
+		if strings.TrimSpace(t) == "" {
+			bad("auth.tokens must not contain empty tokens")
+			break
+		}
+	}
+	for _, u := range c.Auth.Users {
+		if user, secret, ok := strings.Cut(u, ":"); !ok || user == "" || strings.TrimSpace(secret) == "" {
+			bad("auth.users entries must be user:token, got %q", u)
+		}
+	}
+
+	if len(c.Cluster.Peers) > 0 && c.Cluster.Self == "" {
+		bad("cluster.self is required when cluster.peers is set")
+	}
+	if c.Cluster.Primary != "" {
+		if u, err := url.Parse(c.Cluster.Primary); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			bad("cluster.primary must be an http or https URL, not %q", c.Cluster.Primary)
+		}
+		if c.Backend != "file" || c.Log.Shards > 1 {
+			bad("cluster.primary needs the file backend with one log shard")
+		}
+		if c.Preload != "" {
+			bad("preload can't be used with cluster.primary; a standby only takes the primary's writes")
+		}
+	} else if c.Cluster.PrimaryToken != "" {
+		bad("cluster.primary_token needs cluster.primary")
+	}
+
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		bad("logging.format must be text or json, not %q", c.Logging.Format)
+	}
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("logging.level must be debug, info, warn or error, not %q", c.Logging.Level)
+	}
+	if c.Metrics.SlowRequest < 0 {
+		bad("metrics.slow_request must not be negative, got %v", c.Metrics.SlowRequest)
+	}
+
+	if c.Log.ReplayWorkers < 0 {
+		bad("log.replay_workers must not be negative, got %d", c.Log.ReplayWorkers)
+	}
+	if c.HTTP.ReadTimeout < 0 || c.HTTP.WriteTimeout < 0 || c.HTTP.HandlerTimeout < 0 {
+		bad("http timeouts must not be negative")
+	}
+	if c.HTTP.MaxRequests < 0 {
+		bad("http.max_requests must not be negative, got %d", c.HTTP.MaxRequests)
+	}
+	if cp := c.Compaction; cp.Check < 0 || cp.MinSize < 0 || cp.MinInterval < 0 {
+		bad("compaction check, min_size and min_interval must not be negative")
+	}
+	if c.Compaction.DeadRatio < 0 || c.Compaction.DeadRatio > 1 {
+		bad("compaction.dead_ratio must be from 0 to 1, got %v", c.Compaction.DeadRatio)
+	}
+	if c.Compaction.Check > 0 && c.Compaction.MinSize == 0 && c.Compaction.DeadRatio == 0 {
+		bad("compaction.check needs compaction.min_size or compaction.dead_ratio")
+	}
+	if c.Compaction.Window != "" {
+		if _, _, err := ParseWindow(c.Compaction.Window); err != nil {
+			bad("compaction.window: %v", err)
+		}
+	}
+	for i, b := range c.Metrics.ValueSizeBuckets {
+		if b <= 0 || i > 0 && b <= c.Metrics.ValueSizeBuckets[i-1] {
+			bad("metrics.value_size_buckets must be positive and ascending, got %v", c.Metrics.ValueSizeBuckets)
+			break
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n  %s", strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// flag.Value adapters over Config's fields
+
+type stringValue struct{ p *string }
+
+func (v stringValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return *v.p
+}
+
+func (v stringValue) Set(s string) error {
+	*v.p = s
+	return nil
+}
+
+type intValue struct{ p *int }
+
+func (v intValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.Itoa(*v.p)
+}
+
+func (v intValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", s)
+	}
+	*v.p = n
+	return nil
+}
+
+type int64Value struct{ p *int64 }
+
+func (v int64Value) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatInt(*v.p, 10)
+}
+
+func (v int64Value) Set(s string) error {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", s)
+	}
+	*v.p = n
+	return nil
+}
+
+type boolValue struct{ p *bool }
+
+func (v boolValue) String() string {
+	if v.p == nil {
+		return "false"
+	}
+	return strconv.FormatBool(*v.p)
+}
+
+func (v boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a boolean", s)
+	}
+	*v.p = b
+	return nil
+}
+
+// IsBoolFlag lets the flag be given without a value
+func (v boolValue) IsBoolFlag() bool { return true }
+
+type durationValue struct{ p *time.Duration }
+
+func (v durationValue) String() string {
+	if v.p == nil {
+		return "0s"
+	}
+	return v.p.String()
+}
+
+func (v durationValue) Set(s string) error {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", s)
+	}
+	*v.p = d
+	return nil
+}
+
+type listValue struct{ p *[]string }
+
+func (v listValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v listValue) Set(s string) error {
+	*v.p = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.p = append(*v.p, item)
+		}
+	}
+	return nil
+}
+
+type floatValue struct{ p *float64 }
+
+func (v floatValue) String() string {
+	if v.p == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(*v.p, 'g', -1, 64)
+}
+
+func (v floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", s)
+	}
+	*v.p = f
+	return nil
+}
+
+type floatListValue struct{ p *[]float64 }
+
+func (v floatListValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+
+	items := make([]string, len(*v.p))
+	for i, f := range *v.p {
+		items[i] = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strings.Join(items, ",")
+}
+
+func (v floatListValue) Set(s string) error {
+	*v.p = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", item)
+		}
+		*v.p = append(*v.p, f)
+	}
+	return nil
+}
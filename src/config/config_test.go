@@ -0,0 +1,203 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleYAML = `
+listen: ":9090"
+backend: file
+snapshot_interval: 5m
+log:
+  path: /var/lib/cngo/transact.log
+  format: msgpack
+  flush_interval: 50ms
+limits:
+  max_keys: 1000
+  max_value_size: 4096
+auth:
+  tokens: [alpha, beta]
+cluster:
+  self: a:8080
+  peers: [b:8080, c:8080]
+`
+
+const sampleTOML = `
+listen = ":9090"
+backend = "file"
+snapshot_interval = "5m"
+
+[log]
+path = "/var/lib/cngo/transact.log"
+format = "msgpack"
+flush_interval = "50ms"
+
+[limits]
+max_keys = 1000
+max_value_size = 4096
+
+[auth]
+tokens = ["alpha", "beta"]
+
+[cluster]
+self = "a:8080"
+peers = ["b:8080", "c:8080"]
+`
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func load(args []string, env map[string]string) (*Config, error) {
+	fs := flag.NewFlagSet("cngo", flag.ContinueOnError)
+	return Load(fs, args, func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})
+}
+
+func TestLoad(t *testing.T) {
+	for _, name := range []string{"cngo.yaml", "cngo.toml"} {
+		t.Run("Parses "+name, func(t *testing.T) {
+			content := sampleYAML
+			if strings.HasSuffix(name, ".toml") {
+				content = sampleTOML
+			}
+
+			c, err := load([]string{"-config", writeFile(t, name, content)}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.Listen != ":9090" {
+				t.Errorf("Want: %s; Got: %s", ":9090", c.Listen)
+			}
+			if c.SnapshotInterval != 5*time.Minute {
+				t.Errorf("Want: %v; Got: %v", 5*time.Minute, c.SnapshotInterval)
+			}
+			if c.Log.Path != "/var/lib/cngo/transact.log" || c.Log.Format != "msgpack" {
+				t.Errorf("Want: /var/lib/cngo/transact.log msgpack; Got: %s %s", c.Log.Path, c.Log.Format)
+			}
+			if c.Log.FlushInterval != 50*time.Millisecond {
+				t.Errorf("Want: %v; Got: %v", 50*time.Millisecond, c.Log.FlushInterval)
+			}
+			if c.Limits.MaxKeys != 1000 || c.Limits.MaxValueSize != 4096 {
+				t.Errorf("Want: 1000 4096; Got: %d %d", c.Limits.MaxKeys, c.Limits.MaxValueSize)
+			}
+			if strings.Join(c.Auth.Tokens, ",") != "alpha,beta" {
+				t.Errorf("Want: %s; Got: %v", "alpha,beta", c.Auth.Tokens)
+			}
+			if c.Cluster.Self != "a:8080" || len(c.Cluster.Peers) != 2 {
+				t.Errorf("Want: a:8080 [b:8080 c:8080]; Got: %s %v", c.Cluster.Self, c.Cluster.Peers)
+			}
+
+			// unset settings keep their defaults
+			if c.DrainTimeout != 10*time.Second {
+				t.Errorf("Want: %v; Got: %v", 10*time.Second, c.DrainTimeout)
+			}
+		})
+	}
+
+	t.Run("Flags Beat Env Beats File", func(t *testing.T) {
+		path := writeFile(t, "cngo.yaml", sampleYAML)
+		env := map[string]string{"CNGO_LISTEN": ":7070", "CNGO_MAX_KEYS": "5"}
+
+		c, err := load([]string{"-config", path, "-max-keys", "9"}, env)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.Listen != ":7070" {
+			t.Errorf("Want: %s; Got: %s", ":7070", c.Listen)
+		}
+		if c.Limits.MaxKeys != 9 {
+			t.Errorf("Want: %d; Got: %d", 9, c.Limits.MaxKeys)
+		}
+		if c.Log.Format != "msgpack" {
+			t.Errorf("Want: %s; Got: %s", "msgpack", c.Log.Format)
+		}
+	})
+
+	t.Run("Unknown Settings Are Rejected", func(t *testing.T) {
+		path := writeFile(t, "cngo.yaml", "listen: \":9090\"\nlisten_port: 9090\n")
+		if _, err := load([]string{"-config", path}, nil); err == nil {
+			t.Error("Want: error for listen_port")
+		}
+	})
+
+	t.Run("Unknown Extensions Are Rejected", func(t *testing.T) {
+		path := writeFile(t, "cngo.json", "{}")
+		if _, err := load([]string{"-config", path}, nil); err == nil {
+			t.Error("Want: error for .json")
+		}
+	})
+
+	t.Run("Bad Values Are All Reported", func(t *testing.T) {
+		path := writeFile(t, "cngo.yaml", "backend: redis\nlog:\n  durability: eventual\nlimits:\n  max_keys: -1\n  max_bytes: -1\n")
+
+		_, err := load([]string{"-config", path}, nil)
+		if err == nil {
+			t.Fatal("Want: validation error")
+		}
+		for _, want := range []string{"backend", "log.durability", "limits.max_keys", "limits.max_bytes"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Want: %s in error; Got: %v", want, err)
+			}
+		}
+	})
+
+	t.Run("Compaction Schedule Is Checked", func(t *testing.T) {
+		c, err := load([]string{"-compact-check", "1m", "-compact-dead-ratio", "0.5", "-compact-window", "22:00-06:00"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Compaction.DeadRatio != 0.5 || c.Compaction.Window != "22:00-06:00" {
+			t.Errorf("Want: 0.5 22:00-06:00; Got: %v %s", c.Compaction.DeadRatio, c.Compaction.Window)
+		}
+
+		for _, args := range [][]string{
+			{"-compact-check", "1m"},
+			{"-compact-dead-ratio", "2"},
+			{"-compact-window", "late"},
+		} {
+			if _, err := load(args, nil); err == nil || !strings.Contains(err.Error(), "compaction") {
+				t.Errorf("Want: compaction error for %v; Got: %v", args, err)
+			}
+		}
+	})
+
+	t.Run("Tokens Are Taken Whole", func(t *testing.T) {
+		c, err := load([]string{"-auth-tokens", "a:b", "-auth-users", "alice:secret"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Auth.Tokens) != 1 || c.Auth.Tokens[0] != "a:b" {
+			t.Errorf("Want: [a:b]; Got: %v", c.Auth.Tokens)
+		}
+
+		for _, user := range []string{"alice", ":secret", "alice:"} {
+			if _, err := load([]string{"-auth-users", user}, nil); err == nil || !strings.Contains(err.Error(), "auth.users") {
+				t.Errorf("Want: auth.users error for %q; Got: %v", user, err)
+			}
+		}
+	})
+
+	t.Run("Bad Env Values Name The Variable", func(t *testing.T) {
+		_, err := load(nil, map[string]string{"CNGO_FLUSH_INTERVAL": "soon"})
+		if err == nil || !strings.Contains(err.Error(), "CNGO_FLUSH_INTERVAL") {
+			t.Errorf("Want: error naming CNGO_FLUSH_INTERVAL; Got: %v", err)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrorHistory is how many logger errors _errors keeps
+const ErrorHistory = 100
+
+// LoggedError is one error reported by the transaction logger
+type LoggedError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// errorRing holds the most recent logger errors, overwriting the oldest
+// once it's full
+type errorRing struct {
+	mu    sync.Mutex
+	buf   []LoggedError
+	next  int
+	total uint64
+}
+
+// recentErrors feeds _errors; logErrors fills it
+var recentErrors = &errorRing{buf: make([]LoggedError, ErrorHistory)}
+
+func (r *errorRing) add(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf[r.next] = LoggedError{Time: time.Now().UTC(), Error: err.Error()}
+	r.next = (r.next + 1) % len(r.buf)
+	r.total++
+}
+
+// list returns the errors held, oldest first, and how many there have
+// been in all
+func (r *errorRing) list() ([]LoggedError, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.buf)
+	if r.total < uint64(n) {
+		n = int(r.total)
+	}
+	errs := make([]LoggedError, 0, n)
+	for i := 0; i < n; i++ {
+		errs = append(errs, r.buf[(r.next-n+i+len(r.buf))%len(r.buf)])
+	}
+	return errs, r.total
+}
+
+// ErrorsResponse is the body returned by ErrorsHandler
+type ErrorsResponse struct {
+	Errors []LoggedError `json:"errors"`
+	Total  uint64        `json:"total"` // including those no longer held
+}
+
+// ErrorsHandler expects to be called from http GET at "/v1/_errors"
+// resource. It returns the last ErrorHistory errors the transaction
+// logger reported, oldest first, so failed writes can be looked into
+// without searching the server's logs.
+func ErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	errs, total := recentErrors.list()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ErrorsResponse{Errors: errs, Total: total})
+}
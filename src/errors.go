@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Client-caused errors. Handlers wrap these (with %w) so statusFor can map
+// them to a 4xx; anything else is treated as a server fault.
+var (
+	ErrInvalidKey      = errors.New("invalid key")
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrInvalidJSON     = errors.New("invalid JSON")
+	ErrBodyTooLarge    = errors.New("request body too large")
+	ErrPrecondition    = errors.New("precondition failed")
+
+	ErrUnsupportedEncoding  = errors.New("unsupported content encoding")
+	ErrUnsupportedMediaType = errors.New("unsupported media type")
+)
+
+// ErrLogWrite is a change made in memory that the transaction log failed
+// to record, so it won't survive a restart
+var ErrLogWrite = errors.New("transaction log write failed; the change is in memory but not on disk")
+
+// Server-side conditions that aren't faults
+var (
+	ErrNotSupported = errors.New("not supported by this backend")
+	ErrUnavailable  = errors.New("unavailable")
+)
+
+// statusFor maps an error to the HTTP status code it should produce
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, ErrorNoSuchKey):
+		return http.StatusNotFound
+	case errors.Is(err, ErrInvalidKey),
+		errors.Is(err, ErrInvalidArgument),
+		errors.Is(err, ErrInvalidJSON):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrBodyTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrPrecondition):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrNotInteger),
+		errors.Is(err, ErrTxnAborted),
+		errors.Is(err, ErrNotStandby):
+		return http.StatusConflict
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, ErrUnsupportedEncoding),
+		errors.Is(err, ErrUnsupportedMediaType):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ErrStoreFull):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// errorCode is the stable, machine-readable name for an error. Clients
+// can branch on it; the message may change.
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrorNoSuchKey):
+		return "no_such_key"
+	case errors.Is(err, ErrInvalidKey):
+		return "invalid_key"
+	case errors.Is(err, ErrInvalidArgument):
+		return "invalid_argument"
+	case errors.Is(err, ErrInvalidJSON):
+		return "invalid_json"
+	case errors.Is(err, ErrBodyTooLarge):
+		return "body_too_large"
+	case errors.Is(err, ErrVersionMismatch):
+		return "version_mismatch"
+	case errors.Is(err, ErrPrecondition):
+		return "precondition_failed"
+	case errors.Is(err, ErrNotInteger):
+		return "not_integer"
+	case errors.Is(err, ErrTxnAborted):
+		return "txn_aborted"
+	case errors.Is(err, ErrNotStandby):
+		return "not_standby"
+	case errors.Is(err, ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, ErrForbidden):
+		return "forbidden"
+	case errors.Is(err, ErrLogWrite),
+		errors.Is(err, ErrTxnNotLogged):
+		return "log_write_failed"
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return "unsupported_encoding"
+	case errors.Is(err, ErrUnsupportedMediaType):
+		return "unsupported_media_type"
+	case errors.Is(err, ErrStoreFull):
+		return "store_full"
+	case errors.Is(err, ErrNotSupported):
+		return "not_supported"
+	case errors.Is(err, ErrUnavailable):
+		return "unavailable"
+	default:
+		return "internal"
+	}
+}
+
+// ErrorResponse is the body of an error reply to a client that accepts JSON
+type ErrorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeError replies to the request with err and its mapped status code,
+// as an ErrorResponse if the client accepts JSON and as plain text if not
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrDraining) {
+		w.Header().Set("Retry-After", strconv.Itoa(DrainRetryAfter))
+	}
+
+	if !acceptsJSON(r) {
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusFor(err))
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error(), Code: errorCode(err)})
+}
+
+// acceptsJSON reports whether the client wants JSON: a format=json or
+// format=raw query parameter decides, as not every client can set
+// headers, and otherwise the Accept header must list application/json
+func acceptsJSON(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "json":
+		return true
+	case "raw":
+		return false
+	}
+
+	for _, h := range r.Header.Values("Accept") {
+		for _, t := range strings.Split(h, ",") {
+			mt, _, err := mime.ParseMediaType(strings.TrimSpace(t))
+			if err == nil && mt == "application/json" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// entrySize is what key takes up in memory, as counted against MaxBytes:
+// the key and its value as stored, packed if it is. A native integer's
+// value counts as nothing.
+func entrySize(key, stored string) int64 {
+	return int64(len(key) + len(stored))
+}
+
+// recency orders keys by when they were last used, put or read, for
+// evict. It has a lock of its own, as reads only hold the store's read
+// lock.
+type recency struct {
+	mu   sync.Mutex
+	tick uint64            // counts uses
+	last map[string]uint64 // the tick of each key's last use
+}
+
+func (r *recency) use(key string) {
+	r.mu.Lock()
+	if r.last == nil {
+		r.last = make(map[string]uint64)
+	}
+	r.tick++
+	r.last[key] = r.tick
+	r.mu.Unlock()
+}
+
+func (r *recency) forget(key string) {
+	r.mu.Lock()
+	delete(r.last, key)
+	r.mu.Unlock()
+}
+
+// used marks key used now, if the store evicts at all. Callers must hold
+// the lock, or the read lock, and know key is there, so a key deleted
+// meanwhile isn't marked used again.
+func (s *KVS) used(key string) {
+	if s.MaxBytes > 0 {
+		s.recent.use(key)
+	}
+}
+
+// Bytes is what the store's keys and values take up in memory, as counted
+// against MaxBytes
+func (s *KVS) Bytes() int64 {
+	s.RLock()
+	defer s.RUnlock()
+	return s.bytes
+}
+
+// OnEvict registers fn to be called with every key evicted to keep the
+// store within MaxBytes, after the OnChange hooks have seen it deleted,
+// so the eviction can be logged like any delete
+func (s *KVS) OnEvict(fn func(key string)) {
+	s.Lock()
+	s.evictors = append(s.evictors, fn)
+	s.Unlock()
+}
+
+// evict deletes keys until the store is back within MaxBytes. Keys are
+// weighed by their size times the uses of other keys since their own
+// last, so large values and ones left alone go first: a value ten times
+// the size of another goes before it unless it has been used ten times
+// as recently. keep, the keys just put, are never evicted, so keys a
+// write is yet to log can't be logged as evicted first. Each key goes as
+// with Delete, under its stripe, so callers mustn't hold any. It returns
+// the keys evicted.
+func (s *KVS) evict(keep ...string) []string {
+	if s.MaxBytes <= 0 {
+		return nil
+	}
+
+	type candidate struct {
+		key    string
+		size   int64
+		weight float64
+	}
+
+	s.RLock()
+	over := s.bytes - s.MaxBytes
+	if over <= 0 {
+		s.RUnlock()
+		return nil
+	}
+	candidates := make([]candidate, 0, len(s.M))
+	s.recent.mu.Lock()
+	for k, v := range s.M {
+		if slices.Contains(keep, k) {
+			continue
+		}
+		size := entrySize(k, v)
+		age := s.recent.tick - s.recent.last[k] + 1
+		candidates = append(candidates, candidate{k, size, float64(size) * float64(age)})
+	}
+	s.recent.mu.Unlock()
+	s.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].weight != candidates[j].weight {
+			return candidates[i].weight > candidates[j].weight
+		}
+		return candidates[i].key < candidates[j].key
+	})
+
+	var evicted []string
+	for _, c := range candidates {
+		mu := s.stripes.lock(c.key)
+		s.Lock()
+		if s.bytes <= s.MaxBytes {
+			s.Unlock()
+			mu.Unlock()
+			break
+		}
+		existed := s.remove(c.key)
+		hooks, evictors := s.hooks, s.evictors
+		s.Unlock()
+		mu.Unlock()
+
+		if !existed {
+			continue
+		}
+		notify(hooks, c.key, "", true)
+		for _, fn := range evictors {
+			fn(c.key)
+		}
+		evicted = append(evicted, c.key)
+	}
+
+	return evicted
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// ExportLine is one key of an NDJSON export or import
+type ExportLine struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ExportHandler expects to be called from http GET at "/v1/_export"
+// resource, behind requireAuth. It streams every key as a line of NDJSON
+// in key order. Only the keys are listed up front; each value is read as
+// it's written, so the values are never copied whole. It isn't a
+// point-in-time copy: keys changed during the export appear as they were
+// when reached, and keys deleted are left out. With b64=1 values are
+// base64, for values that aren't UTF-8. Under an AuthPolicy only the keys
+// the caller may GET are exported.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	b64, err := b64Flag(r, "b64")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	keys, _ := kvs.Scan("", 0)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for _, key := range keys {
+		if authorize(r, "GET", key) != nil {
+			continue
+		}
+
+		value, err := kvs.Get(key)
+		if errors.Is(err, ErrorNoSuchKey) {
+			continue
+		}
+		if err == nil && b64 {
+			value = base64.StdEncoding.EncodeToString([]byte(value))
+		}
+		if err == nil {
+			err = enc.Encode(ExportLine{Key: key, Value: value})
+		}
+		if err == nil {
+			err = r.Context().Err()
+		}
+		if err != nil {
+			logger.Warn("export stopped", "err", err)
+			return
+		}
+	}
+	bw.Flush()
+}
+
+// ImportResponse is the body returned by ImportHandler
+type ImportResponse struct {
+	Imported int `json:"imported"`
+}
+
+// ImportedHeader is set on a failed import to how many lines were
+// imported before the one that failed
+const ImportedHeader = "X-Cngo-Imported"
+
+// maxImportLine is the longest line ImportHandler reads: a key and value
+// at their limits, each escaped as JSON at worst six bytes for one, with
+// room for the rest of the line. A line is read whole before its value is
+// checked, so without a cap a gzipped body could inflate one without end.
+func maxImportLine() int {
+	return 6*(MaxKeyLength+int(maxValueSize)) + 64
+}
+
+// ImportHandler expects to be called from http POST at "/v1/_import"
+// resource, with NDJSON of ExportLine as the body, optionally gzipped.
+// Lines are put and logged one at a time as they're read, so imports of
+// any size take no more memory than a line, though http.read_timeout
+// still bounds how long the body may take. A line longer than
+// maxImportLine is 413. An import isn't atomic: a bad line stops it with
+// an error naming the line and counting, in the message and in
+// ImportedHeader, the lines before it, which stay stored and logged. With
+// b64=1 values are base64.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	b64, err := b64Flag(r, "b64")
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	var body io.Reader = r.Body
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: %v", ErrInvalidArgument, err))
+			return
+		}
+		body = zr
+	default:
+		writeError(w, r, fmt.Errorf("%w: %q", ErrUnsupportedEncoding, enc))
+		return
+	}
+
+	n := 0
+	fail := func(err error) {
+		w.Header().Set(ImportedHeader, strconv.Itoa(n))
+		writeError(w, r, fmt.Errorf("line %d: %w (%d lines imported before it)", n+1, err, n))
+	}
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxImportLine())
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var line ExportLine
+		err := json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidJSON, err)
+		} else {
+			err = importLine(r, line, b64)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		n++
+	}
+	switch err := scanner.Err(); {
+	case errors.Is(err, bufio.ErrTooLong):
+		fail(fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, maxImportLine()))
+		return
+	case err != nil:
+		fail(fmt.Errorf("%w: %v", ErrInvalidArgument, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ImportResponse{Imported: n})
+}
+
+// importLine puts and logs one line of an import, as a PUT would
+func importLine(r *http.Request, line ExportLine, b64 bool) error {
+	key := kvs.NormalizeKey(line.Key)
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if err := authorize(r, "PUT", key); err != nil {
+		return err
+	}
+
+	value := line.Value
+	if b64 {
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("%w: value is not valid base64", ErrInvalidArgument)
+		}
+		value = string(v)
+	}
+	if int64(len(value)) > maxValueSize {
+		return fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, maxValueSize)
+	}
+	value, err := transformValue(key, value)
+	if err != nil {
+		return err
+	}
+
+	done, err := beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	version, err := kvs.PutVersioned(key, value, 0)
+	if err != nil {
+		return err
+	}
+	valueSizes.Observe(float64(len(value)))
+	return writePut(transact, key, value, version)
+}
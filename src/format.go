@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// LogFormat selects how events are serialized in the file log
+type LogFormat byte
+
+// supported log formats
+const (
+	FormatTSV     LogFormat = iota // tab separated, one event per line
+	FormatMsgPack                  // length-prefixed MessagePack records
+)
+
+// formatTSVLegacy is FormatTSV as written before logs were versioned: no
+// header and unescaped fields. It's only used to keep appending to such
+// logs in their own format; compaction upgrades them.
+const formatTSVLegacy LogFormat = 0xff
+
+// formatTSVv1 is FormatTSV as written before events carried versions. Like
+// formatTSVLegacy, it's only used to append to existing v1 logs.
+const formatTSVv1 LogFormat = 0xfe
+
+// formatTSVv2 is FormatTSV as written before events carried modification
+// times, likewise only used to append to existing v2 logs
+const formatTSVv2 LogFormat = 0xfd
+
+// TSV logs start with a header naming their format version. A log with no
+// header is version 0. Version 1 query-escapes keys and values so tabs and
+// newlines can't break a line. Version 2 adds a fifth field, the key's
+// version, and version 3 a sixth, the event's modification time.
+const (
+	tsvHeader  = "#cngo-log v"
+	tsvVersion = 3
+)
+
+// writeHeader starts a new, empty log in format f, returning bytes written
+func writeHeader(w io.Writer, f LogFormat) (int, error) {
+	if f != FormatTSV {
+		return 0, nil
+	}
+
+	return fmt.Fprintf(w, "%s%d\n", tsvHeader, tsvVersion)
+}
+
+// parseHeader reports the version named by a TSV header line
+func parseHeader(line string) (int, bool) {
+	if !strings.HasPrefix(line, tsvHeader) {
+		return 0, false
+	}
+
+	v, err := strconv.Atoi(strings.TrimPrefix(line, tsvHeader))
+	if err != nil {
+		return 0, false
+	}
+
+	return v, true
+}
+
+// msgpackEvent is the on-disk record for FormatMsgPack. It is encoded as
+// an array rather than a map to keep records small, and carries the value
+// as binary so it survives nulls, tabs and newlines untouched.
+type msgpackEvent struct {
+	_msgpack  struct{} `msgpack:",as_array"`
+	Sequence  uint64
+	EventType EventType
+	Key       string
+	Value     []byte
+	Version   uint64
+	Modified  int64
+}
+
+// msgpackEventV1 is a record written before events carried modification
+// times
+type msgpackEventV1 struct {
+	_msgpack  struct{} `msgpack:",as_array"`
+	Sequence  uint64
+	EventType EventType
+	Key       string
+	Value     []byte
+	Version   uint64
+}
+
+// msgpackEventV0 is a record written before events carried versions. Old
+// and new records can be mixed in one log.
+type msgpackEventV0 struct {
+	_msgpack  struct{} `msgpack:",as_array"`
+	Sequence  uint64
+	EventType EventType
+	Key       string
+	Value     []byte
+}
+
+// encodeEvent writes e to w in the given format, returning bytes written
+func encodeEvent(w io.Writer, f LogFormat, e Event) (int, error) {
+	switch f {
+	case FormatMsgPack:
+		rec, err := msgpack.Marshal(&msgpackEvent{
+			Sequence:  e.Sequence,
+			EventType: e.EventType,
+			Key:       e.Key,
+			Value:     []byte(e.Value),
+			Version:   e.Version,
+			Modified:  e.Modified,
+		})
+		if err != nil {
+			return 0, fmt.Errorf("cannot encode event: %w", err)
+		}
+
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(rec)))
+
+		n, err := w.Write(size[:])
+		if err != nil {
+			return n, err
+		}
+		m, err := w.Write(rec)
+		return n + m, err
+	case formatTSVLegacy:
+		return fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", e.Sequence, e.EventType, e.Key, e.Value)
+	case formatTSVv1:
+		return fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", e.Sequence, e.EventType,
+			url.QueryEscape(e.Key), url.QueryEscape(e.Value))
+	case formatTSVv2:
+		return fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\n", e.Sequence, e.EventType,
+			url.QueryEscape(e.Key), url.QueryEscape(e.Value), e.Version)
+	default:
+		return fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%d\n", e.Sequence, e.EventType,
+			url.QueryEscape(e.Key), url.QueryEscape(e.Value), e.Version, e.Modified)
+	}
+}
+
+// msgpackOverhead is room in a msgpack record for all but the key and
+// value, with plenty to spare
+const msgpackOverhead = 64
+
+// maxRecordSize is the longest msgpack record a decoder accepts: a key and
+// value at their limits and the other fields. A longer length is taken to
+// be corrupt and refused before anything is allocated for it.
+func maxRecordSize() int64 {
+	return MaxKeyLength + maxValueSize + msgpackOverhead
+}
+
+// eventDecoder returns a function yielding successive events from r,
+// or io.EOF once the log is exhausted.
+func eventDecoder(r io.Reader, f LogFormat) func() (Event, error) {
+	next := offsetDecoder(r, f, 0, true)
+
+	return func() (Event, error) {
+		e, _, err := next()
+		return e, err
+	}
+}
+
+// offsetDecoder is eventDecoder, also reporting the byte offset at which
+// each event starts, counting r as starting at offset start. header says
+// whether r is the start of the log, where a TSV header may be; anywhere
+// else the TSV version is the one implied by f.
+func offsetDecoder(r io.Reader, f LogFormat, start int64, header bool) func() (Event, int64, error) {
+	offset := start
+
+	switch f {
+	case FormatMsgPack:
+		br := bufio.NewReader(r)
+
+		return func() (Event, int64, error) {
+			at := offset
+
+			var size [4]byte
+			if _, err := io.ReadFull(br, size[:]); err == io.EOF {
+				return Event{}, at, io.EOF
+			} else if err != nil {
+				return Event{}, at, fmt.Errorf("transaction log read failure: %w", err)
+			}
+
+			n := int64(binary.BigEndian.Uint32(size[:]))
+			if limit := maxRecordSize(); n > limit {
+				return Event{}, at, fmt.Errorf("malformed record: %d bytes is over the limit of %d; raise limits.max_value_size if it was lowered", n, limit)
+			}
+
+			rec := make([]byte, n)
+			if _, err := io.ReadFull(br, rec); err != nil {
+				return Event{}, at, fmt.Errorf("transaction log read failure: %w", err)
+			}
+			offset += int64(len(size) + len(rec))
+
+			var m msgpackEvent
+			if err := msgpack.Unmarshal(rec, &m); err != nil {
+				var v1 msgpackEventV1
+				var v0 msgpackEventV0
+				switch {
+				case msgpack.Unmarshal(rec, &v1) == nil:
+					m = msgpackEvent{
+						Sequence:  v1.Sequence,
+						EventType: v1.EventType,
+						Key:       v1.Key,
+						Value:     v1.Value,
+						Version:   v1.Version,
+					}
+				case msgpack.Unmarshal(rec, &v0) == nil:
+					m = msgpackEvent{
+						Sequence:  v0.Sequence,
+						EventType: v0.EventType,
+						Key:       v0.Key,
+						Value:     v0.Value,
+					}
+				default:
+					return Event{}, at, fmt.Errorf("event decoding failure: %w", err)
+				}
+			}
+
+			return Event{
+				Sequence:  m.Sequence,
+				EventType: m.EventType,
+				Key:       m.Key,
+				Value:     string(m.Value),
+				Version:   m.Version,
+				Modified:  m.Modified,
+			}, at, nil
+		}
+	default:
+		// lines are read whole however long, as a bufio.Scanner would cap
+		// them below the largest escaped value
+		br := bufio.NewReader(r)
+		line, version := 0, formatVersion(f)
+
+		return func() (Event, int64, error) {
+			for {
+				raw, err := br.ReadString('\n')
+				if err == io.EOF && raw == "" {
+					return Event{}, offset, io.EOF
+				} else if err != nil && err != io.EOF {
+					return Event{}, offset, fmt.Errorf("transaction log read failure: %w", err)
+				}
+				line++
+				at := offset
+				offset += int64(len(raw))
+				text := strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r")
+
+				if line == 1 && header {
+					version = 0
+					if v, ok := parseHeader(text); ok {
+						if v > tsvVersion {
+							return Event{}, at, fmt.Errorf("unsupported log format version %d", v)
+						}
+						version = v
+						continue
+					}
+				}
+
+				e, err := parseTSV(text, version)
+				if err != nil {
+					return e, at, fmt.Errorf("line %d: %w", line, err)
+				}
+
+				return e, at, nil
+			}
+		}
+	}
+}
+
+// formatVersion is the TSV version written in format f
+func formatVersion(f LogFormat) int {
+	switch f {
+	case formatTSVLegacy:
+		return 0
+	case formatTSVv1:
+		return 1
+	case formatTSVv2:
+		return 2
+	default:
+		return tsvVersion
+	}
+}
+
+// parseTSV parses one "sequence\ttype\tkey\tvalue[\tversion[\tmodified]]"
+// line of the given format version
+func parseTSV(line string, version int) (Event, error) {
+	var e Event
+
+	want := 4
+	switch {
+	case version >= 3:
+		want = 6
+	case version == 2:
+		want = 5
+	}
+
+	fields := strings.SplitN(line, "\t", want)
+	if len(fields) != want {
+		return e, fmt.Errorf("malformed event: want %d fields, got %d", want, len(fields))
+	}
+
+	if version >= 2 {
+		v, err := strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("malformed version %q", fields[4])
+		}
+		e.Version = v
+	}
+
+	if version >= 3 {
+		m, err := strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("malformed modification time %q", fields[5])
+		}
+		e.Modified = m
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("malformed sequence number %q", fields[0])
+	}
+
+	t, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("malformed event type %q", fields[1])
+	}
+
+	key := fields[2]
+	if version >= 1 {
+		key, err = url.QueryUnescape(key)
+		if err != nil {
+			return e, fmt.Errorf("key decoding failure: %w", err)
+		}
+	}
+
+	// version 0 wrote values raw but always read them back unescaped
+	uv, err := url.QueryUnescape(fields[3])
+	if err != nil {
+		return e, fmt.Errorf("vaalue decoding failure: %w", err)
+	}
+
+	e.Sequence = seq
+	e.EventType = EventType(t)
+	e.Key = key
+	e.Value = uv
+
+	return e, nil
+}
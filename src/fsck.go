@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrLogCorrupt is returned by fsck when a log has problems
+var ErrLogCorrupt = errors.New("transaction log is corrupt")
+
+// fsckMaxProblems is how many problems fsck lists before giving up
+const fsckMaxProblems = 100
+
+// FsckReport is what fsckLog found in a transaction log
+type FsckReport struct {
+	Events, Puts, Deletes int
+	Keys                  int // live at the end of the log
+	Uncommitted           int // events of a batch the log ends without committing
+	LastSequence          uint64
+	CleanShutdown         bool
+	Problems              []string
+}
+
+// fsckLog reads the whole file log at path in format f, checking every
+// event parses and that sequence numbers ascend. Unlike replay it carries
+// on past a bad event, so every problem is reported rather than the first.
+// TSV logs of any version are read as FormatTSV. Rotated segments aren't
+// checked.
+func fsckLog(path string, f LogFormat) (FsckReport, error) {
+	var r FsckReport
+
+	file, err := os.Open(path)
+	if err != nil {
+		return r, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer file.Close()
+
+	problem := func(format string, args ...any) {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+
+	live := make(map[string]bool)
+	next := offsetDecoder(file, f, 0, true)
+	failedAt := int64(-1)
+	var batch batchReader
+
+	for len(r.Problems) < fsckMaxProblems {
+		e, at, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// a decoder that can't get past a failure keeps reporting it
+			// at the same offset
+			if at == failedAt {
+				break
+			}
+			failedAt = at
+			problem("offset %d: %v", at, err)
+			r.CleanShutdown = false
+			continue
+		}
+
+		r.Events++
+		if e.Sequence <= r.LastSequence {
+			problem("offset %d: %v", at, sequenceError(r.LastSequence, e.Sequence))
+		} else {
+			r.LastSequence = e.Sequence
+		}
+
+		if _, known := eventTypeNames[e.EventType]; !known {
+			problem("offset %d: unknown event type %d", at, e.EventType)
+		}
+		// only the end of the log may hold a batch left open, by a crash
+		if batch.open && (e.EventType == EventBegin || e.EventType == EventShutdown) {
+			problem("offset %d: batch has no commit", batch.at)
+		}
+		r.CleanShutdown = e.EventType == EventShutdown
+
+		// puts and deletes count once their batch, if any, commits
+		for _, e := range batch.add(e, at) {
+			switch e.EventType {
+			case EventPut:
+				r.Puts++
+				live[e.Key] = true
+			case EventDelete:
+				r.Deletes++
+				delete(live, e.Key)
+			}
+		}
+	}
+	if batch.open {
+		r.Uncommitted = len(batch.held)
+	}
+	if len(r.Problems) >= fsckMaxProblems {
+		problem("stopped after %d problems", fsckMaxProblems)
+	}
+
+	r.Keys = len(live)
+	return r, nil
+}
+
+// Print writes the report for an operator to read
+func (r FsckReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "events: %d (%d puts, %d deletes)\n", r.Events, r.Puts, r.Deletes)
+	fmt.Fprintf(w, "keys: %d\n", r.Keys)
+	fmt.Fprintf(w, "last sequence: %d\n", r.LastSequence)
+	fmt.Fprintf(w, "clean shutdown: %t\n", r.CleanShutdown)
+	if r.Uncommitted > 0 {
+		fmt.Fprintf(w, "uncommitted: %d (dropped on the next start)\n", r.Uncommitted)
+	}
+	fmt.Fprintf(w, "problems: %d\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(w, "  %s\n", p)
+	}
+}
@@ -1,7 +1,15 @@
 module github.com/rhardin/cngo
 
-go 1.19
+go 1.21
 
 require github.com/gorilla/mux v1.8.0
 
-require github.com/lib/pq v1.10.7
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/lib/pq v1.10.7
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
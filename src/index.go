@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// indexEntry records the byte offset at which an event starts in the log
+type indexEntry struct {
+	sequence uint64
+	offset   int64
+}
+
+// WithIndexInterval keeps a sidecar index next to the log, recording the
+// offset of roughly every nth event so ReadLog can seek rather than scan.
+// The index is advisory: a missing or stale one only costs a full scan,
+// and a missing one is rebuilt by ReadEvents.
+func WithIndexInterval(n int) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.indexEvery = n
+	}
+}
+
+func (l *FileTransactionLogger) indexFile() string {
+	return l.filename + ".idx"
+}
+
+// indexAt adds an entry to index for the event with sequence seq starting
+// at offset, if it's far enough past the last one
+func (l *FileTransactionLogger) indexAt(index []indexEntry, seq uint64, offset int64) []indexEntry {
+	if l.indexEvery <= 0 {
+		return index
+	}
+
+	if n := len(index); n > 0 && seq-index[n-1].sequence < uint64(l.indexEvery) {
+		return index
+	}
+
+	return append(index, indexEntry{sequence: seq, offset: offset})
+}
+
+// loadIndex reads the sidecar index, keeping the entries up to the first
+// malformed one or one past the end of a log of the given size
+func (l *FileTransactionLogger) loadIndex(size int64) {
+	f, err := os.Open(l.indexFile())
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e indexEntry
+		if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &e.sequence, &e.offset); err != nil {
+			break
+		}
+		if e.offset >= size {
+			break
+		}
+		if n := len(l.index); n > 0 && e.sequence <= l.index[n-1].sequence {
+			break
+		}
+		l.index = append(l.index, e)
+	}
+	l.indexSaved = len(l.index)
+}
+
+// saveIndex appends entries added since the last save to the sidecar
+// index. Callers must hold l.mu, and must only save entries for events
+// already flushed to the log.
+func (l *FileTransactionLogger) saveIndex() error {
+	if l.indexSaved == len(l.index) {
+		return nil
+	}
+
+	f, err := os.OpenFile(l.indexFile(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, e := range l.index[l.indexSaved:] {
+		fmt.Fprintf(w, "%d %d\n", e.sequence, e.offset)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	l.indexSaved = len(l.index)
+
+	return f.Close()
+}
+
+// rewriteIndex replaces the sidecar index with the entries in memory.
+// Callers must hold l.mu.
+func (l *FileTransactionLogger) rewriteIndex() error {
+	if err := os.Remove(l.indexFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l.indexSaved = 0
+
+	return l.saveIndex()
+}
+
+// seekIndex finds the last indexed event at or before sequence from.
+// Callers must hold l.mu.
+func (l *FileTransactionLogger) seekIndex(from uint64) (indexEntry, bool) {
+	i := sort.Search(len(l.index), func(i int) bool {
+		return l.index[i].sequence > from
+	})
+	if i == 0 {
+		return indexEntry{}, false
+	}
+
+	return l.index[i-1], true
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrLocked is returned when a live process holds a log's lock file
+var ErrLocked = errors.New("transaction log is locked")
+
+// lockPath is the lock file guarding the file log at path
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// lockLog takes the lock file for the file log at path, recording this
+// process's pid in it, so the server and offline commands that rewrite
+// the log never run on it at once. A lock left behind by a process that's
+// no longer running is taken over. It returns a func removing the lock.
+func lockLog(path string) (unlock func() error, err error) {
+	name := lockPath(path)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+			if err = errors.Join(err, f.Close()); err != nil {
+				os.Remove(name)
+				return nil, fmt.Errorf("cannot write lock file: %w", err)
+			}
+			return func() error { return os.Remove(name) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("cannot create lock file: %w", err)
+		}
+
+		pid, alive := lockHolder(name)
+		if alive {
+			return nil, fmt.Errorf("%w by running process %d; if that isn't cngo, remove %s", ErrLocked, pid, name)
+		}
+
+		logger.Warn("taking over stale lock file", "path", name, "pid", pid)
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("cannot remove stale lock file: %w", err)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s was taken while this process waited", ErrLocked, name)
+}
+
+// lockHolder reads the pid in the lock file name and reports whether that
+// process is still running. A lock that can't be read is taken as stale.
+func lockHolder(name string) (pid int, alive bool) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return 0, false
+	}
+	pid, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return pid, false
+	}
+	// signal 0 only checks the process exists; EPERM means it does, just
+	// under another user
+	err = p.Signal(syscall.Signal(0))
+	return pid, err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -3,18 +3,36 @@ package main
 import (
 	"bufio"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"net/url"
+	"io"
+	"math"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // Event persistence data type
 type Event struct {
-	Sequence  uint64
-	EventType EventType
-	Key       string
-	Value     string
+	Sequence  uint64    `json:"sequence"`
+	EventType EventType `json:"type"`
+	Key       string    `json:"key,omitempty"`
+	Value     string    `json:"value,omitempty"`
+	Version   uint64    `json:"version,omitempty"`  // the key's version after a put; 0 if not recorded
+	Modified  int64     `json:"modified,omitempty"` // when a put was logged, in Unix nanoseconds; 0 if not recorded
+
+	ack   chan<- error // for checked writes, told the outcome instead of Err
+	sync  bool         // a checked write to be fsynced before it's acked
+	batch *[]Event     // for WriteBatch, the puts and deletes to log as one
 }
 
 // EventType kind
@@ -25,8 +43,63 @@ const (
 	_                     = iota
 	EventDelete EventType = iota
 	EventPut
+	EventShutdown // written last by Close; its absence means a crash
+	EventBegin    // opens a batch written by WriteBatch
+	EventCommit   // closes it; replay drops a batch the log ends without one
 )
 
+var eventTypeNames = map[EventType]string{
+	EventDelete:   "delete",
+	EventPut:      "put",
+	EventShutdown: "shutdown",
+	EventBegin:    "begin",
+	EventCommit:   "commit",
+}
+
+// marker reports whether t only marks out a batch, rather than being an
+// event replay applies or reports
+func (t EventType) marker() bool {
+	return t == EventBegin || t == EventCommit
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return "EventType(" + strconv.Itoa(int(t)) + ")"
+}
+
+// MarshalJSON writes known event types by name and unknown ones as their
+// number. The log formats still store the number.
+func (t EventType) MarshalJSON() ([]byte, error) {
+	if name, ok := eventTypeNames[t]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(byte(t))
+}
+
+// UnmarshalJSON accepts either form MarshalJSON writes
+func (t *EventType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n byte
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid event type %s", data)
+		}
+		*t = EventType(n)
+		return nil
+	}
+
+	for et, known := range eventTypeNames {
+		if known == name {
+			*t = et
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown event type %q", name)
+}
+
 // TransactionLogger interface for our state store
 type TransactionLogger interface {
 	WriteDelete(key string)
@@ -38,28 +111,281 @@ type TransactionLogger interface {
 	Run()
 }
 
+// CheckedLogger is a TransactionLogger whose writes can wait to learn
+// whether the event made it into the log. A nil error means the event was
+// written, though only durable as far as the logger's flush settings make
+// it. A failed write is reported to the caller rather than on Err. A
+// put's modified is when the store made it, in Unix nanoseconds, for
+// replay to restore.
+type CheckedLogger interface {
+	WritePutChecked(key, value string, version uint64, modified int64) error
+	WriteDeleteChecked(key string) error
+}
+
+// SyncLogger is a CheckedLogger that can also wait until the event is on
+// stable storage, whatever its flush settings, so a crash straight after
+// can't lose it
+type SyncLogger interface {
+	WritePutSync(key, value string, version uint64, modified int64) error
+	WriteDeleteSync(key string) error
+}
+
+// BatchLogger is implemented by loggers that can log several puts and
+// deletes as one unit, as a transaction needs: replay applies all of them
+// or, if the log ends part way through the batch, none. A nil error means
+// the whole batch was written, as for CheckedLogger; with sync, that it's
+// on stable storage, as for SyncLogger.
+type BatchLogger interface {
+	WriteBatch(events []Event, sync bool) error
+}
+
+// DefaultFlushThreshold is the number of buffered bytes that forces an
+// early flush when a flush interval is configured.
+const DefaultFlushThreshold = 64 * 1024
+
+// Compactor is implemented by loggers that can shrink their log in place
+type Compactor interface {
+	CompactStats() (before, after int, err error)
+	Compact() (before, after int, err error)
+}
+
+// Snapshotter is implemented by loggers that can persist a point-in-time
+// copy of the store, so replay only needs the events after it
+type Snapshotter interface {
+	Snapshot(state map[string]string, versions map[string]uint64) (sequence uint64, err error)
+	LoadSnapshot() (sequence uint64, state map[string]string, versions map[string]uint64, err error)
+}
+
+// VersionLogger is implemented by loggers that record each put's key
+// version, and the time the store made it as for CheckedLogger. Loggers
+// that don't rely on replay counting the puts instead, which only holds
+// while nothing is compacted away.
+type VersionLogger interface {
+	WritePutVersion(key, value string, version uint64, modified int64)
+}
+
+// Flusher is implemented by loggers that can force logged events to
+// stable storage on demand
+type Flusher interface {
+	Flush() error
+	Durable() uint64
+}
+
+// LogReader is implemented by loggers whose log can be read back while
+// they are running, e.g. for archival. ReadEvents is only for replay.
+type LogReader interface {
+	ReadLog(from uint64) (<-chan Event, <-chan error)
+}
+
+// Notifier is implemented by loggers that can wake readers waiting for
+// new events. Written returns a channel closed once an event is logged
+// after the call.
+type Notifier interface {
+	Written() <-chan struct{}
+}
+
+// PendingReporter is implemented by loggers that buffer events in memory
+// before writing them out, so operators can see what a crash would lose
+type PendingReporter interface {
+	Pending() int
+	PeekPending(n int) []Event
+}
+
+// Sequencer is implemented by loggers that can report the sequence
+// number of the last event they've written
+type Sequencer interface {
+	LastSequence() uint64
+}
+
+// Sizer is implemented by loggers that can say how big their log is
+type Sizer interface {
+	Size() int64
+}
+
+// SequencedWriter is implemented by loggers that can record an event
+// under the sequence number it already has, as a standby does with the
+// events it replicates, so its log carries on the primary's numbering
+type SequencedWriter interface {
+	WriteSequenced(e Event) error
+}
+
 // FileTransactionLogger data type for event streams and state
 type FileTransactionLogger struct {
 	events       chan<- Event // write only channel for sending events
 	errors       <-chan error // read only channel for sending errors
 	lastSequence uint64       // the last used num
+	filename     string
 	file         *os.File
+	format       LogFormat
+	buf          *bufio.Writer
 	wg           *sync.WaitGroup
+	done         chan struct{} // closed when the Run goroutine exits
+	mu           sync.Mutex    // guards the file against compaction
+	cleanEnd     bool          // ReadEvents found a shutdown marker last
+	pending      atomic.Int64  // puts and deletes sent but not yet written
+
+	flushInterval  time.Duration // 0 flushes every event, no fsync
+	flushThreshold int           // buffered bytes that force a flush
+	unsynced       int           // bytes written since the last flush
+	unflushed      []Event       // events held in buf since the last flush
+	durable        uint64        // last sequence known to be fsynced
+
+	indexEvery int          // events between index entries; 0 keeps no index
+	index      []indexEntry // ascending by sequence
+	indexSaved int          // entries already in the sidecar file
+	offset     int64        // size of the log including buffered events
+
+	rotateSize  int64 // log size that triggers rotation; 0 never rotates
+	retention   Retention
+	snapshotSeq uint64 // the latest snapshot covers events up to here
+
+	written chan struct{} // closed by the next write; nil until asked for
+
+	sequenceBits int  // width of sequence numbers; 0 means 64
+	warned       bool // the nearing-the-limit warning has been logged
+
+	closeOnce sync.Once
+	closeErr  error // what the first Close returned
+
+	shared   *atomic.Uint64 // numbers events across shards; nil numbers them here
+	borrowed bool           // the last event was numbered by WriteSequenced
+
+	replayRead  atomic.Int64 // bytes ReadEvents has got through
+	replayTotal atomic.Int64 // bytes ReadEvents has to read; 0 if unknown
+}
+
+// FileLoggerOption configures a FileTransactionLogger
+type FileLoggerOption func(*FileTransactionLogger)
+
+// WithFlushInterval enables group commit: events are buffered and the log
+// is flushed and fsync'd every d, or sooner once the flush threshold is hit.
+func WithFlushInterval(d time.Duration) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.flushInterval = d
+	}
+}
+
+// WithFormat selects the on-disk event encoding, FormatTSV by default.
+// A log must always be reopened with the format it was written in.
+func WithFormat(f LogFormat) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.format = f
+	}
+}
+
+// WithSequenceBits limits sequence numbers to n bits, 64 by default.
+// Sequence numbers never wrap: past 7/8 of the limit a warning is logged
+// and compaction renumbers the log from 1, and at the limit writes fail
+// with ErrSequenceExhausted until the log is compacted.
+func WithSequenceBits(n int) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.sequenceBits = n
+	}
+}
+
+// ErrSequenceExhausted is returned for writes once sequence numbers have
+// reached their limit
+var ErrSequenceExhausted = errors.New("transaction log sequence numbers exhausted")
+
+// maxSequence is the largest sequence number the log may use
+func (l *FileTransactionLogger) maxSequence() uint64 {
+	if l.sequenceBits <= 0 || l.sequenceBits >= 64 {
+		return math.MaxUint64
+	}
+	return 1<<l.sequenceBits - 1
+}
+
+// nearSequenceLimit reports whether the log is past 7/8 of its sequence
+// numbers, when compaction renumbers it
+func (l *FileTransactionLogger) nearSequenceLimit() bool {
+	max := l.maxSequence()
+	return l.lastSequence >= max-max/8
+}
+
+// WithFlushThreshold sets how many buffered bytes force an immediate flush
+// when a flush interval is in use.
+func WithFlushThreshold(n int) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.flushThreshold = n
+	}
 }
 
+// DefaultPingCacheTTL is how long a Postgres health check result is reused
+const DefaultPingCacheTTL = 2 * time.Second
+
 // PostgresTransactionLogger data type for event streams and state backed by postgres
 type PostgresTransactionLogger struct {
-	events chan<- Event
-	errors <-chan error
-	db     *sql.DB
+	events   chan<- Event
+	errors   <-chan error
+	db       *sql.DB
+	readFrom uint64 // ReadEvents skips events up to here (the snapshot)
+
+	clock   Clock // nil means the real clock
+	pingMu  sync.Mutex
+	pingTTL time.Duration // 0 uses DefaultPingCacheTTL
+	pingAt  time.Time
+	pingErr error
+
+	retry   RetryPolicy
+	breaker breaker
+
+	done      chan struct{} // closed when the Run goroutine exits
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // PostgresDBParams helper structure for parms
 type PostgresDBParams struct {
 	dbName   string
 	host     string
+	port     int // 0 means 5432
 	user     string
 	password string
+	sslmode  string // "" means "require"
+	dsn      string // if set, used as-is and the fields above are ignored
+	retry    RetryPolicy
+	breaker  BreakerPolicy
+}
+
+// RetryPolicy bounds how the postgres logger retries writes that fail
+// transiently
+type RetryPolicy struct {
+	Attempts int           // tries in all, the first included; 0 or 1 never retries
+	Backoff  time.Duration // wait before the first retry, doubled before each after it
+}
+
+// connString builds a lib/pq connection string. lib/pq has no "prefer"
+// mode, so the default is "require", which is also what it used when no
+// sslmode was given.
+func (c PostgresDBParams) connString() string {
+	if c.dsn != "" {
+		return c.dsn
+	}
+
+	port := c.port
+	if port == 0 {
+		port = 5432
+	}
+
+	sslmode := c.sslmode
+	if sslmode == "" {
+		sslmode = "require"
+	}
+
+	return fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s",
+		quoteConnValue(c.host), port, quoteConnValue(c.dbName),
+		quoteConnValue(c.user), quoteConnValue(c.password), quoteConnValue(sslmode))
+}
+
+// quoteConnValue quotes a connection string value if it needs it
+func quoteConnValue(v string) string {
+	if v != "" && !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
 }
 
 // WritePut for postgres
@@ -72,6 +398,32 @@ func (l *PostgresTransactionLogger) WriteDelete(key string) {
 	l.events <- Event{EventType: EventDelete, Key: key}
 }
 
+// WritePutChecked for postgres waits for the insert. Versions and
+// modification times aren't recorded.
+func (l *PostgresTransactionLogger) WritePutChecked(key, value string, _ uint64, _ int64) error {
+	return l.sendChecked(Event{EventType: EventPut, Key: key, Value: value})
+}
+
+// WriteDeleteChecked for postgres waits for the insert
+func (l *PostgresTransactionLogger) WriteDeleteChecked(key string) error {
+	return l.sendChecked(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteBatch for postgres inserts the events in one SQL transaction and
+// waits for it to commit. Commits are durable, so sync changes nothing.
+func (l *PostgresTransactionLogger) WriteBatch(events []Event, _ bool) error {
+	batch := append([]Event(nil), events...)
+	return l.sendChecked(Event{EventType: EventBegin, batch: &batch})
+}
+
+func (l *PostgresTransactionLogger) sendChecked(e Event) error {
+	ack := make(chan error, 1)
+	e.ack = ack
+
+	l.events <- e
+	return <-ack
+}
+
 // Err for postgres
 func (l *PostgresTransactionLogger) Err() <-chan error {
 	return l.errors
@@ -86,9 +438,10 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 		defer close(outEvent)
 		defer close(outError)
 
-		query := `select sequence, event_type, key, value from Transactions order by sequence`
+		query := `select sequence, event_type, key, value from Transactions
+			where sequence > $1 order by sequence`
 
-		rows, err := l.db.Query(query)
+		rows, err := l.db.Query(query, l.readFrom)
 		if err != nil {
 			outError <- fmt.Errorf("sql query error: %w", err)
 			return
@@ -125,18 +478,268 @@ func (l *PostgresTransactionLogger) Run() {
 	errors := make(chan error, 1)
 	l.errors = errors
 
+	done := make(chan struct{})
+	l.done = done
+
 	go func() {
+		defer close(done)
+
 		query := `insert into Transactions (event_type, key, value) values ($1, $2, $3)`
 
 		for e := range events {
-			_, err := l.db.Exec(query, e.EventType, e.Key, e.Value)
-			if err != nil {
-				errors <- err
+			err := l.breaker.allow()
+			if err == nil {
+				if e.batch != nil {
+					err = l.execBatch(query, *e.batch)
+				} else {
+					err = l.exec(query, e.EventType, e.Key, e.Value)
+				}
+				l.breaker.record(err != nil && retryable(err))
+			}
+			if e.ack != nil {
+				e.ack <- err
+			} else if err != nil {
+				report(errors, err)
 			}
 		}
 	}()
 }
 
+// exec runs a write, retrying it as l.retry allows while it fails in a
+// way retryable thinks may pass. A write whose connection failed may have
+// committed anyway, so a retry can log an event twice; replaying a put or
+// delete twice leaves the same value.
+func (l *PostgresTransactionLogger) exec(query string, args ...any) error {
+	return l.retrying(func() error {
+		_, err := l.db.Exec(query, args...)
+		return err
+	})
+}
+
+// execBatch runs query for each event in one SQL transaction, so either
+// every event is logged or none is, retrying the whole transaction as
+// exec retries a write
+func (l *PostgresTransactionLogger) execBatch(query string, events []Event) error {
+	return l.retrying(func() error {
+		tx, err := l.db.Begin()
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			if _, err := tx.Exec(query, e.EventType, e.Key, e.Value); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		return tx.Commit()
+	})
+}
+
+// retrying calls write until it succeeds, l.retry runs out or it fails in
+// a way retryable thinks won't pass
+func (l *PostgresTransactionLogger) retrying(write func() error) error {
+	backoff := l.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= l.retry.Attempts || !retryable(err) {
+			return err
+		}
+
+		logger.Warn("retrying postgres write", "attempt", attempt, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// BreakerStats reports the state of the breaker guarding writes
+func (l *PostgresTransactionLogger) BreakerStats() BreakerStats {
+	return l.breaker.stats()
+}
+
+// retryable reports whether a failed postgres write might succeed if
+// tried again: the connection broke, or the server shut down or aborted
+// the transaction for a conflict with another
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", // serialization failure, deadlock detected
+			"57P01", "57P02", "57P03": // admin or crash shutdown, cannot connect now
+			return true
+		}
+		return pqErr.Code.Class() == "08" // connection exception
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Close waits for queued events to be inserted, then closes the
+// database. Only the first call does anything; later ones return its
+// result.
+func (l *PostgresTransactionLogger) Close() error {
+	l.closeOnce.Do(func() {
+		if l.events != nil {
+			close(l.events)
+			<-l.done
+		}
+		l.closeErr = l.db.Close()
+	})
+	return l.closeErr
+}
+
+// Ping checks the database is reachable. The result is cached briefly so
+// frequent readiness probes don't hammer the database.
+func (l *PostgresTransactionLogger) Ping() error {
+	l.pingMu.Lock()
+	defer l.pingMu.Unlock()
+
+	ttl := l.pingTTL
+	if ttl == 0 {
+		ttl = DefaultPingCacheTTL
+	}
+
+	t := now(l.clock)
+	if !l.pingAt.IsZero() && t.Sub(l.pingAt) < ttl {
+		return l.pingErr
+	}
+
+	l.pingErr = l.db.Ping()
+	l.pingAt = t
+	if l.pingErr != nil {
+		l.pingErr = fmt.Errorf("database unreachable: %w", l.pingErr)
+	}
+
+	return l.pingErr
+}
+
+func (l *PostgresTransactionLogger) ensureSnapshotTable() error {
+	_, err := l.db.Exec(`create table if not exists Snapshot (
+		sequence bigint not null,
+		key      text   not null primary key,
+		value    text   not null)`)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot table: %w", err)
+	}
+
+	// snapshot tables from before key versions lack the column
+	_, err = l.db.Exec(`alter table Snapshot
+		add column if not exists version bigint not null default 0`)
+	if err != nil {
+		return fmt.Errorf("failed to migrate snapshot table: %w", err)
+	}
+
+	// the snapshot's sequence, kept apart from the rows so an empty
+	// snapshot still has one
+	_, err = l.db.Exec(`create table if not exists SnapshotMeta (
+		id       boolean primary key default true check (id),
+		sequence bigint  not null)`)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot metadata table: %w", err)
+	}
+	return nil
+}
+
+// Snapshot replaces the Snapshot table with state and its key versions,
+// stamped in SnapshotMeta with the latest sequence in Transactions. The
+// caller must make
+// sure state already reflects every logged event; it may reflect a few
+// more, since replaying puts and deletes the state already contains is
+// harmless (versions may jump, but never go backwards).
+func (l *PostgresTransactionLogger) Snapshot(state map[string]string, versions map[string]uint64) (uint64, error) {
+	if err := l.ensureSnapshotTable(); err != nil {
+		return 0, err
+	}
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin snapshot: %w", err)
+	}
+	defer tx.Rollback()
+
+	var seq uint64
+	err = tx.QueryRow(`select coalesce(max(sequence), 0) from Transactions`).Scan(&seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read last sequence: %w", err)
+	}
+
+	if _, err = tx.Exec(`delete from Snapshot`); err != nil {
+		return 0, fmt.Errorf("failed to clear snapshot: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`insert into Snapshot (sequence, key, value, version)
+		values ($1, $2, $3, $4)`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare snapshot insert: %w", err)
+	}
+	defer stmt.Close()
+
+	for k, v := range state {
+		if _, err = stmt.Exec(seq, k, v, versions[k]); err != nil {
+			return 0, fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`insert into SnapshotMeta (id, sequence) values (true, $1)
+		on conflict (id) do update set sequence = excluded.sequence`, seq)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write snapshot sequence: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit snapshot: %w", err)
+	}
+
+	return seq, nil
+}
+
+// LoadSnapshot reads the Snapshot table, and makes the next ReadEvents
+// start after it. With no snapshot taken it reports sequence 0.
+func (l *PostgresTransactionLogger) LoadSnapshot() (uint64, map[string]string, map[string]uint64, error) {
+	if err := l.ensureSnapshotTable(); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var seq uint64
+	err := l.db.QueryRow(`select sequence from SnapshotMeta`).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		// snapshots from before SnapshotMeta only have it on their rows
+		err = l.db.QueryRow(`select coalesce(max(sequence), 0) from Snapshot`).Scan(&seq)
+	}
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("failed to read snapshot sequence: %w", err)
+	}
+
+	rows, err := l.db.Query(`select key, value, version from Snapshot`)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	state := make(map[string]string)
+	versions := make(map[string]uint64)
+
+	for rows.Next() {
+		var k, v string
+		var version uint64
+		if err := rows.Scan(&k, &v, &version); err != nil {
+			return 0, nil, nil, fmt.Errorf("error reading row: %w", err)
+		}
+		state[k] = v
+		versions[k] = version
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, nil, fmt.Errorf("snapshot read error: %w", err)
+	}
+
+	l.readFrom = seq
+
+	return seq, state, versions, nil
+}
+
 func (l *PostgresTransactionLogger) verifyTableExists() (bool, error) {
 	return true, nil
 }
@@ -146,44 +749,119 @@ func (l *PostgresTransactionLogger) createTable() error {
 }
 
 // MakeFileTransactionLogger constructor-ish a FNL
-func MakeFileTransactionLogger(filename string) (*FileTransactionLogger, error) {
+func MakeFileTransactionLogger(filename string, opts ...FileLoggerOption) (*FileTransactionLogger, error) {
 	var err error
-	var l = FileTransactionLogger{wg: &sync.WaitGroup{}}
+	var l = FileTransactionLogger{
+		filename:       filename,
+		wg:             &sync.WaitGroup{},
+		flushThreshold: DefaultFlushThreshold,
+	}
+	for _, opt := range opts {
+		opt(&l)
+	}
+
 	l.file, err = os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
 	}
+	l.buf = bufio.NewWriter(l.file)
+
+	if err = l.checkHeader(); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+
+	info, err := l.file.Stat()
+	if err != nil {
+		l.file.Close()
+		return nil, fmt.Errorf("cannot stat transaction log file: %w", err)
+	}
+	l.offset = info.Size()
+
+	if l.indexEvery > 0 {
+		l.loadIndex(l.offset)
+	}
 
 	return &l, nil
 }
 
+// checkHeader starts an empty TSV log with a version header, and keeps
+// appending to an older log in its own format.
+func (l *FileTransactionLogger) checkHeader() error {
+	if l.format != FormatTSV {
+		return nil
+	}
+
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot stat transaction log file: %w", err)
+	}
+
+	if info.Size() == 0 {
+		if _, err := writeHeader(l.file, l.format); err != nil {
+			return fmt.Errorf("cannot write log header: %w", err)
+		}
+		return nil
+	}
+
+	first := make([]byte, len(tsvHeader)+8)
+	n, err := l.file.ReadAt(first, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("cannot read log header: %w", err)
+	}
+	line, _, _ := strings.Cut(string(first[:n]), "\n")
+
+	switch v, ok := parseHeader(line); {
+	case !ok:
+		l.format = formatTSVLegacy
+	case v == 1:
+		l.format = formatTSVv1
+	case v == 2:
+		l.format = formatTSVv2
+	}
+
+	return nil
+}
+
 // MakePostgresTransactionLogger constructor func
 func MakePostgresTransactionLogger(config PostgresDBParams) (TransactionLogger, error) {
-	connStr := fmt.Sprintf("host=%s dbname=%s user=%s password=%s", config.host, config.dbName, config.user, config.password)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", config.connString())
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db: %w", err)
 	}
 
 	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to open db connection: %w", err)
 	}
 
-	logger := &PostgresTransactionLogger{db: db}
+	l := &PostgresTransactionLogger{db: db, retry: config.retry, breaker: breaker{policy: config.breaker}}
 
-	exists, err := logger.verifyTableExists()
+	exists, err := l.verifyTableExists()
 	if err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to verify table exists: %w", err)
 	}
 	if !exists {
-		if err = logger.createTable(); err != nil {
+		if err = l.createTable(); err != nil {
+			db.Close()
 			return nil, fmt.Errorf("failed to create table: %w", err)
 		}
 	}
 
-	return logger, nil
+	return l, nil
+}
+
+// report passes err on to a logger's Err channel without blocking, so a
+// writer goroutine can't wedge when nobody reads it. Errors that don't
+// fit are logged instead.
+func report(errors chan<- error, err error) {
+	select {
+	case errors <- err:
+	default:
+		logger.Error("transaction log error dropped; Err() is not being read", "err", err)
+	}
 }
 
 // Run does the file transaction logging
@@ -194,95 +872,1073 @@ func (l *FileTransactionLogger) Run() {
 	errors := make(chan error, 1)
 	l.errors = errors
 
+	done := make(chan struct{})
+	l.done = done
+
 	// Start retrieving events from the events channel and writing them
 	// to the transaction log
 	go func() {
-		for e := range events {
-			l.lastSequence++
+		defer close(done)
 
-			_, err := fmt.Fprintf(
-				l.file,
-				"%d\t%d\t%s\t%s\n",
-				l.lastSequence, e.EventType, e.Key, e.Value)
+		var tick <-chan time.Time
+		if l.flushInterval > 0 {
+			ticker := time.NewTicker(l.flushInterval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
 
-			if err != nil {
-				errors <- fmt.Errorf("cannot write to log file: %w", err)
-			}
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					l.mu.Lock()
+					err := l.flush()
+					l.mu.Unlock()
 
-			l.wg.Done()
+					if err != nil {
+						report(errors, err)
+					}
+					return
+				}
+
+				write := l.write
+				if e.batch != nil {
+					write = l.writeBatch
+				}
+				err := write(e)
+				if err == nil && e.sync {
+					l.mu.Lock()
+					err = l.syncWritten()
+					l.mu.Unlock()
+				}
+				if e.ack != nil {
+					e.ack <- err
+				} else if err != nil {
+					report(errors, err)
+				}
+
+				l.wg.Done()
+			case <-tick:
+				l.mu.Lock()
+				err := l.flush()
+				l.mu.Unlock()
+
+				if err != nil {
+					report(errors, err)
+				}
+			}
 		}
 	}()
 }
 
-// ReadEvents gets the transaction log and reads it into channels
-func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
-	scanner := bufio.NewScanner(l.file)
-	outEvent := make(chan Event)
-	outError := make(chan error, 1)
-
-	go func() {
-		var e Event
+// write appends e to the log, flushing as the durability settings require
+func (l *FileTransactionLogger) write(e Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-		defer close(outEvent)
-		defer close(outError)
+	// no longer queued, whether or not it's written, and under l.mu so
+	// Pending never counts it twice
+	if e.EventType != EventShutdown {
+		defer l.pending.Add(-1)
+	}
 
-		for scanner.Scan() {
-			line := scanner.Text()
+	// the numbers a standby logs are the primary's, so it has none of its
+	// own to spend on a shutdown marker
+	if e.EventType == EventShutdown && l.borrowed {
+		return nil
+	}
 
-			fmt.Sscanf(line, "%d\t%d\t%s\t%s", &e.Sequence, &e.EventType, &e.Key, &e.Value)
+	if err := l.append(e, true); err != nil {
+		return err
+	}
 
-			// Sanity check: are the sequence numbers ascending order?
-			if l.lastSequence >= e.Sequence {
-				outError <- fmt.Errorf("transaction numbers out of sequence")
-				return
-			}
+	return l.settle()
+}
 
-			uv, err := url.QueryUnescape(e.Value)
-			if err != nil {
-				outError <- fmt.Errorf("vaalue decoding failure: %w", err)
-				return
-			}
+// writeBatch appends the events of a batch between begin and commit
+// markers, with no flush or rotation among them, so the batch reaches the
+// log as a whole
+func (l *FileTransactionLogger) writeBatch(b Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	batch := *b.batch
+	defer l.pending.Add(-int64(len(batch)))
 
-			e.Value = uv
-			l.lastSequence = e.Sequence
-			outEvent <- e
-		}
+	// running out of numbers part way would leave the batch open
+	if n := uint64(len(batch)) + 2; l.lastSequence+n > l.maxSequence() {
+		return fmt.Errorf("%w at %d; compact the log to renumber it", ErrSequenceExhausted, l.lastSequence)
+	}
 
-		if err := scanner.Err(); err != nil {
-			outError <- fmt.Errorf("transaction log read failure: %w", err)
-			return
+	// only the begin marker is indexed, so ReadLog never seeks into the
+	// middle of a batch
+	if err := l.append(Event{EventType: EventBegin}, true); err != nil {
+		return err
+	}
+	for _, e := range batch {
+		if err := l.append(e, false); err != nil {
+			return err
 		}
-	}()
+	}
+	if err := l.append(Event{EventType: EventCommit}, false); err != nil {
+		return err
+	}
 
-	return outEvent, outError
+	return l.settle()
 }
 
-// Wait for io
-func (l *FileTransactionLogger) Wait() {
-	l.wg.Wait()
+// append numbers e and encodes it into the write buffer, indexing it if
+// index is set. Callers must hold l.mu.
+func (l *FileTransactionLogger) append(e Event, index bool) error {
+	if l.lastSequence >= l.maxSequence() {
+		return fmt.Errorf("%w at %d; compact the log to renumber it", ErrSequenceExhausted, l.lastSequence)
+	}
+	switch {
+	case e.Sequence != 0:
+		if e.Sequence <= l.lastSequence {
+			return sequenceError(l.lastSequence, e.Sequence)
+		}
+		l.lastSequence = e.Sequence
+	case l.shared != nil:
+		l.lastSequence = l.shared.Add(1)
+	default:
+		l.lastSequence++
+	}
+	l.borrowed = e.Sequence != 0
+	e.Sequence = l.lastSequence
+
+	if !l.warned && l.nearSequenceLimit() {
+		l.warned = true
+		logger.Warn("transaction log sequence is nearing its limit; compaction will renumber it",
+			"sequence", l.lastSequence, "limit", l.maxSequence())
+	}
+
+	n, err := encodeEvent(l.buf, l.format, e)
+	l.unsynced += n
+	if !e.EventType.marker() {
+		l.unflushed = append(l.unflushed, e)
+	}
+	l.wake()
+	if index {
+		l.index = l.indexAt(l.index, e.Sequence, l.offset)
+	}
+	l.offset += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write to log file: %w", err)
+	}
+
+	return nil
+}
+
+// settle rotates or flushes the log once events are appended, as the
+// settings require. Callers must hold l.mu.
+func (l *FileTransactionLogger) settle() error {
+	if l.rotateSize > 0 && l.offset >= l.rotateSize {
+		return l.rotate()
+	}
+
+	if l.flushInterval == 0 || l.unsynced >= l.flushThreshold {
+		return l.flush()
+	}
+
+	return nil
+}
+
+// flush writes out buffered events and, in group commit mode, fsyncs them.
+// Callers must hold l.mu.
+func (l *FileTransactionLogger) flush() error {
+	if l.unsynced == 0 {
+		return nil
+	}
+	l.unsynced = 0
+
+	if err := l.buf.Flush(); err != nil {
+		return fmt.Errorf("cannot write to log file: %w", err)
+	}
+	clear(l.unflushed)
+	l.unflushed = l.unflushed[:0]
+
+	// the index is advisory; a failed save only costs a scan later
+	l.saveIndex()
+
+	if l.flushInterval > 0 {
+		return l.sync()
+	}
+
+	return nil
+}
+
+// sync fsyncs the log file. Callers must hold l.mu.
+func (l *FileTransactionLogger) sync() error {
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync log file: %w", err)
+	}
+	l.durable = l.lastSequence
+
+	return nil
+}
+
+// syncWritten flushes and fsyncs every event written so far, unless a
+// flush already has. Callers must hold l.mu.
+func (l *FileTransactionLogger) syncWritten() error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+	if l.durable == l.lastSequence {
+		return nil
+	}
+
+	return l.sync()
+}
+
+// Flush waits for every event sent so far to be written, then fsyncs the
+// log whatever the flush interval, as an explicit durability checkpoint
+func (l *FileTransactionLogger) Flush() error {
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.flush(); err != nil {
+		return err
+	}
+
+	return l.sync()
+}
+
+// Written returns a channel closed once the next event is written. The
+// event is in the log as far as ReadLog is concerned, not necessarily on
+// stable storage.
+func (l *FileTransactionLogger) Written() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.written == nil {
+		l.written = make(chan struct{})
+	}
+
+	return l.written
+}
+
+// LastSequence is the sequence number of the last event written
+func (l *FileTransactionLogger) LastSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastSequence
+}
+
+// Size is the length of the log file in bytes, counting events still
+// buffered. Sealed segments aren't included.
+func (l *FileTransactionLogger) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.offset
+}
+
+// wake closes the channel handed out by Written. Callers must hold l.mu.
+func (l *FileTransactionLogger) wake() {
+	if l.written != nil {
+		close(l.written)
+		l.written = nil
+	}
+}
+
+// Pending is how many events have been sent but not yet handed to the
+// OS: those queued for the Run goroutine and those it holds in its write
+// buffer. A crash of the process would lose them all. Events handed to the
+// OS but not yet fsynced aren't counted; see Durable.
+func (l *FileTransactionLogger) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.pending.Load()) + len(l.unflushed)
+}
+
+// PeekPending returns up to n of the buffered events Pending counts,
+// oldest first. Events still queued can't be seen until they're written
+// to the buffer.
+func (l *FileTransactionLogger) PeekPending(n int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n > len(l.unflushed) {
+		n = len(l.unflushed)
+	}
+	return append([]Event(nil), l.unflushed[:n]...)
+}
+
+// Durable is the last sequence number known to be on stable storage
+func (l *FileTransactionLogger) Durable() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.durable
+}
+
+// ReadEvents gets the transaction log, rotated segments first, and reads
+// it into channels. If the log should have an index but it's missing, it
+// is rebuilt on the way.
+func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	l.mu.Lock()
+	segments, err := l.openSegments(0)
+	l.mu.Unlock()
+
+	if err != nil {
+		outEvent := make(chan Event)
+		outError := make(chan error, 1)
+		outError <- err
+		close(outEvent)
+		close(outError)
+		return outEvent, outError
+	}
+
+	return l.readEvents(segments, l.file, l.indexEvery > 0 && len(l.index) == 0, true)
+}
+
+// ReadEventsFrom parses events in the logger's format from any reader,
+// e.g. a stream or a decompressed backup, with the same sequence checks
+// as ReadEvents. The stream is checked on its own, so it may start from
+// any sequence, and the logger's own sequence and replay progress are
+// left alone.
+func (l *FileTransactionLogger) ReadEventsFrom(r io.Reader) (<-chan Event, <-chan error) {
+	return l.readEvents(nil, r, false, false)
+}
+
+// readEvents replays segments and then r, closing the segments when done.
+// own is set for the logger's own log, whose last sequence, clean end and
+// progress are kept on l for the logger to carry on from; any other
+// stream is read with state of its own.
+func (l *FileTransactionLogger) readEvents(segments []*os.File, r io.Reader, reindex, own bool) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+		defer closeAll(segments)
+
+		var last uint64
+		if own {
+			l.mu.Lock()
+			last = l.lastSequence
+			l.mu.Unlock()
+		}
+		// an empty log has nothing to recover
+		clean, failed := true, false
+		// where a batch the log ends part way through starts, if it does
+		torn := int64(-1)
+
+		// the logger learns where its log ended before the channels close
+		defer func() {
+			if !own {
+				return
+			}
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			// retention may have deleted every event the snapshot covers;
+			// new events must still be numbered after it
+			if !failed && last < l.snapshotSeq {
+				last = l.snapshotSeq
+			}
+			l.lastSequence = last
+			l.cleanEnd = clean && !failed
+
+			if !failed && torn >= 0 {
+				if err := l.cut(torn); err != nil {
+					outError <- err
+				}
+			}
+		}()
+
+		var total, base int64
+		for _, f := range segments {
+			if info, err := f.Stat(); err == nil {
+				total += info.Size()
+			}
+		}
+		if f, ok := r.(*os.File); ok {
+			if info, err := f.Stat(); err == nil {
+				total += info.Size()
+			}
+		} else {
+			total = 0 // can't tell
+		}
+		if own {
+			l.replayRead.Store(0)
+			l.replayTotal.Store(total)
+		}
+
+		read := func(next func() (Event, int64, error), reindex bool) error {
+			var batch batchReader
+			for {
+				e, offset, err := next()
+				if err == io.EOF {
+					torn = -1
+					if batch.open {
+						torn = batch.at
+					}
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				if own {
+					l.replayRead.Store(base + offset)
+				}
+
+				// Sanity check: are the sequence numbers ascending order?
+				if last >= e.Sequence {
+					return sequenceError(last, e.Sequence)
+				}
+
+				if reindex && !batch.open {
+					l.mu.Lock()
+					l.index = l.indexAt(l.index, e.Sequence, offset)
+					l.mu.Unlock()
+				}
+
+				last = e.Sequence
+				clean = e.EventType == EventShutdown
+				for _, e := range batch.add(e, offset) {
+					outEvent <- e
+				}
+			}
+		}
+
+		for _, f := range segments {
+			if err := read(offsetDecoder(f, l.format, 0, true), false); err != nil {
+				failed = true
+				outError <- err
+				return
+			}
+			if info, err := f.Stat(); err == nil {
+				base += info.Size()
+			}
+		}
+
+		if err := read(offsetDecoder(r, l.format, 0, true), reindex); err != nil {
+			failed = true
+			outError <- err
+			return
+		}
+
+		if reindex {
+			l.mu.Lock()
+			l.rewriteIndex()
+			l.mu.Unlock()
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// Replay errors for logs whose sequence numbers don't strictly ascend
+var (
+	ErrDuplicateSequence = errors.New("duplicate sequence number")
+	ErrOutOfSequence     = errors.New("transaction numbers out of sequence")
+)
+
+// sequenceError describes reading seq right after last. A repeated number
+// usually means a logging bug or two logs concatenated together.
+func sequenceError(last, seq uint64) error {
+	if seq == last {
+		return fmt.Errorf("%w: %d", ErrDuplicateSequence, seq)
+	}
+
+	return fmt.Errorf("%w: %d after %d", ErrOutOfSequence, seq, last)
+}
+
+// batchReader holds back the events of a batch until its commit marker
+// is read, so a batch the log ends part way through is never delivered.
+// The markers themselves never are.
+type batchReader struct {
+	open bool
+	held []Event
+	at   int64 // where the open batch's begin marker starts
+}
+
+// add takes the next event read, starting at offset at, and returns the
+// events now ready to deliver
+func (b *batchReader) add(e Event, at int64) []Event {
+	switch {
+	case e.EventType == EventBegin:
+		b.open, b.held, b.at = true, nil, at
+		return nil
+	case e.EventType == EventCommit:
+		held := b.held
+		b.open, b.held = false, nil
+		return held
+	case b.open && e.EventType != EventShutdown:
+		b.held = append(b.held, e)
+		return nil
+	}
+
+	// a shutdown is never logged inside a batch, so one that is ends it
+	// unfinished
+	b.open, b.held = false, nil
+	return []Event{e}
+}
+
+// committed wraps an event decoder to yield only the events replay
+// applies: those outside batches, and those of committed ones
+func committed(next func() (Event, error)) func() (Event, error) {
+	var b batchReader
+	var ready []Event
+
+	return func() (Event, error) {
+		for len(ready) == 0 {
+			e, err := next()
+			if err != nil {
+				return e, err
+			}
+			ready = b.add(e, 0)
+		}
+
+		e := ready[0]
+		ready = ready[1:]
+		return e, nil
+	}
+}
+
+// cut truncates the log at offset, where a batch starts that a crash left
+// without its commit, so events logged from now on don't follow it and
+// join it. Callers must hold l.mu.
+func (l *FileTransactionLogger) cut(offset int64) error {
+	if err := l.file.Truncate(offset); err != nil {
+		return fmt.Errorf("cannot drop uncommitted batch: %w", err)
+	}
+	l.offset = offset
+
+	i := sort.Search(len(l.index), func(i int) bool {
+		return l.index[i].offset >= offset
+	})
+	if i < len(l.index) {
+		l.index = l.index[:i]
+		l.rewriteIndex()
+	}
+
+	logger.Warn("dropped a transaction the log ends part way through", "offset", offset)
+	return nil
+}
+
+// ReadLog streams the logged events with a sequence of at least from. It
+// flushes buffered events first, then reads through a handle of its own so
+// the running logger is undisturbed. The caller must drain the channels.
+func (l *FileTransactionLogger) ReadLog(from uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	l.mu.Lock()
+	err := l.flush()
+	var f *os.File
+	if err == nil {
+		f, err = os.Open(l.filename)
+		if err != nil {
+			err = fmt.Errorf("cannot open transaction log file: %w", err)
+		}
+	}
+	var segments []*os.File
+	if err == nil {
+		if segments, err = l.openSegments(from); err != nil {
+			f.Close()
+		}
+	}
+	format := l.format
+	seek, indexed := l.seekIndex(from)
+	l.mu.Unlock()
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		if err != nil {
+			outError <- err
+			return
+		}
+		defer f.Close()
+		defer closeAll(segments)
+
+		send := func(next func() (Event, error)) error {
+			for {
+				e, err := next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+
+				if e.Sequence >= from {
+					outEvent <- e
+				}
+			}
+		}
+
+		for _, s := range segments {
+			if err := send(committed(eventDecoder(s, format))); err != nil {
+				outError <- err
+				return
+			}
+		}
+
+		next := eventDecoder(f, format)
+		if indexed {
+			next = seekEvent(f, format, seek)
+		}
+		if err := send(committed(next)); err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// seekEvent decodes f from the indexed event at, falling back to reading
+// the whole log if the index turns out to be stale
+func seekEvent(f *os.File, format LogFormat, at indexEntry) func() (Event, error) {
+	if _, err := f.Seek(at.offset, io.SeekStart); err == nil {
+		next := offsetDecoder(f, format, at.offset, false)
+		if e, _, err := next(); err == nil && e.Sequence == at.sequence {
+			first := true
+			return func() (Event, error) {
+				if first {
+					first = false
+					return e, nil
+				}
+				e, _, err := next()
+				return e, err
+			}
+		}
+	}
+
+	f.Seek(0, io.SeekStart)
+	return eventDecoder(f, format)
+}
+
+// LastShutdownClean reports whether the log read by ReadEvents ended with
+// a shutdown marker, i.e. the previous run closed the logger rather than
+// crashing. Only meaningful once the ReadEvents channels are closed.
+func (l *FileTransactionLogger) LastShutdownClean() bool {
+	return l.cleanEnd
+}
+
+// compactEvents reads a whole log and returns its event count along with
+// the latest put for each live key, in sequence order. With tombstones,
+// the latest delete of each dead key is kept too, for logs whose earlier
+// segments or snapshot may still hold puts of it.
+func compactEvents(r io.Reader, f LogFormat, tombstones bool) (int, []Event, error) {
+	count := 0
+	live := make(map[string]Event)
+	next := committed(eventDecoder(r, f))
+
+	for {
+		e, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		count++
+		switch e.EventType {
+		case EventPut:
+			live[e.Key] = e
+		case EventDelete:
+			if tombstones {
+				live[e.Key] = e
+			} else {
+				delete(live, e.Key)
+			}
+		}
+	}
+
+	events := make([]Event, 0, len(live))
+	for _, e := range live {
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Sequence < events[j].Sequence
+	})
+
+	return count, events, nil
+}
+
+// CompactStats scans the log on disk and reports how many events it holds
+// now and how many would survive compaction (one put per live key),
+// without rewriting anything.
+func (l *FileTransactionLogger) CompactStats() (before, after int, err error) {
+	f, err := os.Open(l.filename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer f.Close()
+
+	before, live, err := compactEvents(f, l.format, l.keepsTombstones())
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return before, len(live), nil
+}
+
+// Compact rewrites the log keeping only the latest put for each live key.
+// Sequence numbers are preserved, so new events carry on where the log
+// left off. Writes queue up behind the compaction until it is done.
+// Rotated segments are left alone, so deletes are kept while any exist.
+//
+// Once sequence numbers are near their limit, and there are no segments,
+// the kept events are renumbered from 1 instead. The snapshot is dropped,
+// as its sequence number would no longer mean anything, and readers
+// following the log by sequence number must start over.
+func (l *FileTransactionLogger) Compact() (before, after int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.flush(); err != nil {
+		return 0, 0, err
+	}
+
+	f, err := os.Open(l.filename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	before, live, err := compactEvents(f, l.format, l.keepsTombstones())
+	f.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	renumber := l.nearSequenceLimit() && !l.hasSegments()
+	if renumber {
+		for i := range live {
+			live[i].Sequence = uint64(i + 1)
+		}
+
+		// the old snapshot would skip the renumbered events on replay;
+		// the compacted log holds the whole state without it
+		if err := os.Remove(l.snapshotFile()); err != nil && !os.IsNotExist(err) {
+			return 0, 0, fmt.Errorf("cannot remove snapshot: %w", err)
+		}
+		l.snapshotSeq = 0
+	}
+
+	// compaction upgrades older logs to the current version
+	format := l.format
+	if format == formatTSVLegacy || format == formatTSVv1 || format == formatTSVv2 {
+		format = FormatTSV
+	}
+
+	var index []indexEntry
+	var offset int64
+
+	tmp := l.filename + ".compact"
+	err = writeFileSync(tmp, func(w io.Writer) error {
+		n, err := writeHeader(w, format)
+		if err != nil {
+			return err
+		}
+		offset = int64(n)
+
+		for _, e := range live {
+			index = l.indexAt(index, e.Sequence, offset)
+			n, err := encodeEvent(w, format, e)
+			if err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot write compacted log: %w", err)
+	}
+
+	if err := os.Rename(tmp, l.filename); err != nil {
+		os.Remove(tmp)
+		return 0, 0, fmt.Errorf("cannot replace log file: %w", err)
+	}
+
+	f, err = os.OpenFile(l.filename, os.O_RDWR|os.O_APPEND, 0755)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot reopen transaction log file: %w", err)
+	}
+	l.file.Close()
+	l.file = f
+	l.buf.Reset(l.file)
+	l.format = format
+	l.offset = offset
+
+	if renumber {
+		l.lastSequence = uint64(len(live))
+		l.durable = l.lastSequence
+		l.warned = false
+	}
+
+	if l.indexEvery > 0 {
+		l.index = index
+		l.rewriteIndex()
+	}
+
+	return before, len(live), nil
+}
+
+// fileSnapshot is the on-disk form of a FileTransactionLogger snapshot
+type fileSnapshot struct {
+	Sequence uint64            `json:"sequence"`
+	State    map[string]string `json:"state"`
+	Versions map[string]uint64 `json:"versions,omitempty"`
 }
 
-// WritePut send put events
+func (l *FileTransactionLogger) snapshotFile() string {
+	return l.filename + ".snap"
+}
+
+// keepsTombstones reports whether compaction must keep deletes: a key
+// deleted after a snapshot or in the current file may be put again by
+// replaying the snapshot or a rotated segment. A snapshot that can't be
+// checked counts as there.
+func (l *FileTransactionLogger) keepsTombstones() bool {
+	if l.hasSegments() {
+		return true
+	}
+	_, err := os.Stat(l.snapshotFile())
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// Snapshot saves state and its key versions as of the last logged event
+// next to the log. The caller must make sure state reflects exactly the
+// events logged so far.
+func (l *FileTransactionLogger) Snapshot(state map[string]string, versions map[string]uint64) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A snapshot must never cover events that aren't on disk, or a crash
+	// would reuse their sequence numbers and replay would skip the new ones.
+	if err := l.flush(); err != nil {
+		return 0, err
+	}
+	if err := l.sync(); err != nil {
+		return 0, err
+	}
+
+	tmp := l.snapshotFile() + ".tmp"
+	err := writeFileSync(tmp, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(fileSnapshot{
+			Sequence: l.lastSequence,
+			State:    state,
+			Versions: versions,
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("cannot write snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmp, l.snapshotFile()); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("cannot replace snapshot: %w", err)
+	}
+	l.snapshotSeq = l.lastSequence
+
+	if err := l.retain(); err != nil {
+		return 0, err
+	}
+
+	return l.lastSequence, nil
+}
+
+// LoadSnapshot reads the latest snapshot, if there is one. A missing
+// snapshot is not an error and reports sequence 0.
+func (l *FileTransactionLogger) LoadSnapshot() (uint64, map[string]string, map[string]uint64, error) {
+	f, err := os.Open(l.snapshotFile())
+	if os.IsNotExist(err) {
+		return 0, nil, nil, nil
+	}
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("cannot open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	var snap fileSnapshot
+	if err := json.NewDecoder(f).Decode(&snap); err != nil {
+		return 0, nil, nil, fmt.Errorf("snapshot decoding failure: %w", err)
+	}
+	l.snapshotSeq = snap.Sequence
+
+	return snap.Sequence, snap.State, snap.Versions, nil
+}
+
+// writeFileSync creates (or truncates) name, fills it via fill and fsyncs
+// it before closing, so it can be safely renamed into place.
+func writeFileSync(name string, fill func(w io.Writer) error) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err = fill(w); err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+
+	return err
+}
+
+// ReplayProgress reports how many bytes the last ReadEvents has read of
+// the total it has to, which is 0 if that's unknown
+func (l *FileTransactionLogger) ReplayProgress() (read, total int64) {
+	return l.replayRead.Load(), l.replayTotal.Load()
+}
+
+// Wait for io
+func (l *FileTransactionLogger) Wait() {
+	l.wg.Wait()
+}
+
+// WritePut send put events, modified now
 func (l *FileTransactionLogger) WritePut(key, value string) {
+	l.WritePutVersion(key, value, 0, time.Now().UnixNano())
+}
+
+// WritePutVersion sends a put event recording the key's new version and
+// when the store made the put
+func (l *FileTransactionLogger) WritePutVersion(key, value string, version uint64, modified int64) {
 	l.wg.Add(1)
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+	l.pending.Add(1)
+	l.events <- Event{EventType: EventPut, Key: key, Value: value, Version: version, Modified: modified}
 }
 
 // WriteDelete send delete events
 func (l *FileTransactionLogger) WriteDelete(key string) {
 	l.wg.Add(1)
+	l.pending.Add(1)
 	l.events <- Event{EventType: EventDelete, Key: key}
 }
 
-// Close the connection to io
+// WritePutChecked sends a put event and waits for it to be written
+func (l *FileTransactionLogger) WritePutChecked(key, value string, version uint64, modified int64) error {
+	return l.sendChecked(Event{EventType: EventPut, Key: key, Value: value, Version: version, Modified: modified})
+}
+
+// WriteDeleteChecked sends a delete event and waits for it to be written
+func (l *FileTransactionLogger) WriteDeleteChecked(key string) error {
+	return l.sendChecked(Event{EventType: EventDelete, Key: key})
+}
+
+// WritePutSync sends a put event and waits for it to be fsynced
+func (l *FileTransactionLogger) WritePutSync(key, value string, version uint64, modified int64) error {
+	return l.sendChecked(Event{EventType: EventPut, Key: key, Value: value, Version: version, Modified: modified, sync: true})
+}
+
+// WriteDeleteSync sends a delete event and waits for it to be fsynced
+func (l *FileTransactionLogger) WriteDeleteSync(key string) error {
+	return l.sendChecked(Event{EventType: EventDelete, Key: key, sync: true})
+}
+
+// WriteSequenced logs a put or delete under its own sequence number,
+// which must be past the last one logged, and waits for it to be written.
+// Sequence numbers left out in between are skipped.
+func (l *FileTransactionLogger) WriteSequenced(e Event) error {
+	if e.Sequence == 0 {
+		return fmt.Errorf("%w: event has no sequence number", ErrInvalidArgument)
+	}
+	return l.sendChecked(Event{
+		Sequence:  e.Sequence,
+		EventType: e.EventType,
+		Key:       e.Key,
+		Value:     e.Value,
+		Version:   e.Version,
+		Modified:  e.Modified,
+	})
+}
+
+// WriteBatch sends the events as a batch and waits for them to be
+// written between begin and commit markers or, with sync, fsynced
+func (l *FileTransactionLogger) WriteBatch(events []Event, sync bool) error {
+	batch := make([]Event, len(events))
+	for i, e := range events {
+		batch[i] = Event{EventType: e.EventType, Key: e.Key, Value: e.Value, Version: e.Version, Modified: e.Modified}
+	}
+
+	ack := make(chan error, 1)
+	l.wg.Add(1)
+	l.pending.Add(int64(len(batch)))
+	l.events <- Event{EventType: EventBegin, ack: ack, sync: sync, batch: &batch}
+	return <-ack
+}
+
+func (l *FileTransactionLogger) sendChecked(e Event) error {
+	ack := make(chan error, 1)
+	e.ack = ack
+
+	l.wg.Add(1)
+	l.pending.Add(1)
+	l.events <- e
+	return <-ack
+}
+
+// Close the connection to io, marking the log as cleanly shut down and
+// fsyncing it. Only the first call does anything; later ones return its
+// result.
 func (l *FileTransactionLogger) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.close()
+	})
+	return l.closeErr
+}
+
+func (l *FileTransactionLogger) close() error {
+	if l.events != nil {
+		l.wg.Add(1)
+		l.events <- Event{EventType: EventShutdown}
+	}
+
 	l.wg.Wait()
 
 	if l.events != nil {
 		close(l.events) // Terminates Run loop and goroutine
+		<-l.done        // ...which does the final flush
 	}
 
-	return l.file.Close()
+	l.mu.Lock()
+	err := l.sync()
+	l.mu.Unlock()
+
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ErrCloseTimeout is returned by CloseWithTimeout when buffered events
+// couldn't be written in time
+var ErrCloseTimeout = errors.New("timed out closing transaction log")
+
+// CloseWithTimeout is Close, but gives up after d rather than hanging on a
+// wedged disk. On timeout it reports how many puts and deletes were never
+// written, and the log is left without a shutdown marker.
+func (l *FileTransactionLogger) CloseWithTimeout(d time.Duration) (dropped int, err error) {
+	closed := make(chan error, 1)
+	go func() {
+		closed <- l.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		return 0, err
+	case <-time.After(d):
+		return int(l.pending.Load()), fmt.Errorf("%w after %v", ErrCloseTimeout, d)
+	}
 }
 
 // Err send errors on channel
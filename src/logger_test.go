@@ -0,0 +1,1902 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+// readAll replays the log at filename and returns its events
+func readAll(t *testing.T, filename string, opts ...FileLoggerOption) []Event {
+	t.Helper()
+
+	l, err := MakeFileTransactionLogger(filename, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	var got []Event
+	events, errs := l.ReadEvents()
+	for e := range events {
+		got = append(got, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	return got
+}
+
+func TestFileTransactionLoggerFlush(t *testing.T) {
+	t.Run("Group Commit Is Durable Within One Interval", func(t *testing.T) {
+		interval := 20 * time.Millisecond
+		filename := filepath.Join(t.TempDir(), "transact.log")
+
+		l, err := MakeFileTransactionLogger(filename, WithFlushInterval(interval))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.Run()
+
+		l.WritePut("rob", "durable")
+		l.Wait()
+
+		time.Sleep(2 * interval)
+
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(got), "rob\tdurable") {
+			t.Errorf("Want: event on disk; Got: %q", got)
+		}
+	})
+
+	t.Run("Threshold Forces An Early Flush", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+
+		l, err := MakeFileTransactionLogger(filename,
+			WithFlushInterval(time.Hour), WithFlushThreshold(1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.Run()
+
+		l.WritePut("rob", "early")
+		l.Wait()
+
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(got), "rob\tearly") {
+			t.Errorf("Want: event on disk; Got: %q", got)
+		}
+	})
+
+	t.Run("Close Does A Final Flush", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+
+		l, err := MakeFileTransactionLogger(filename, WithFlushInterval(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		l.WritePut("rob", "closed")
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(string(got), "rob\tclosed") {
+			t.Errorf("Want: event on disk; Got: %q", got)
+		}
+	})
+
+	t.Run("Buffered Events Are Pending Until Flushed", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+
+		l, err := MakeFileTransactionLogger(filename, WithFlushInterval(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.Run()
+
+		l.WritePut("rob", "1")
+		l.WritePut("sam", "2")
+		l.WriteDelete("rob")
+		l.Wait()
+
+		if got := l.Pending(); got != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, got)
+		}
+		if peek := l.PeekPending(2); len(peek) != 2 || peek[0].Key != "rob" || peek[1].Key != "sam" {
+			t.Errorf("Want: rob sam; Got: %v", peek)
+		}
+
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := l.Pending(); got != 0 {
+			t.Errorf("Want: %d; Got: %d", 0, got)
+		}
+	})
+}
+
+func TestMsgPackFormat(t *testing.T) {
+	t.Run("Round Trips Binary Values", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		want := []Event{
+			{Sequence: 1, EventType: EventPut, Key: "nul", Value: "a\x00b"},
+			{Sequence: 2, EventType: EventPut, Key: "newline", Value: "line one\nline two\t!"},
+			{Sequence: 3, EventType: EventDelete, Key: "nul"},
+			{Sequence: 4, EventType: EventShutdown},
+		}
+
+		l, err := MakeFileTransactionLogger(filename, WithFormat(FormatMsgPack))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		for _, e := range want {
+			switch e.EventType {
+			case EventPut:
+				l.WritePut(e.Key, e.Value)
+			case EventDelete:
+				l.WriteDelete(e.Key)
+			}
+		}
+		l.Close()
+
+		got := readAll(t, filename, WithFormat(FormatMsgPack))
+
+		if len(got) != len(want) {
+			t.Fatalf("Want: %d events; Got: %d", len(want), len(got))
+		}
+		for i := range want {
+			got[i].Modified = 0 // checked in TestLastModified
+			if got[i] != want[i] {
+				t.Errorf("Want: %+v; Got: %+v", want[i], got[i])
+			}
+		}
+	})
+
+	t.Run("Truncated Record Is An Error", func(t *testing.T) {
+		var buf bytes.Buffer
+		encodeEvent(&buf, FormatMsgPack, Event{Sequence: 1, EventType: EventPut, Key: "k", Value: "v"})
+
+		next := eventDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-1]), FormatMsgPack)
+		if _, err := next(); err == nil || err == io.EOF {
+			t.Errorf("Want: read failure; Got: %v", err)
+		}
+	})
+
+	t.Run("Oversized Length Is Refused", func(t *testing.T) {
+		// a corrupt length claiming 4 GiB, with no record after it
+		next := eventDecoder(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}), FormatMsgPack)
+		if _, err := next(); err == nil || !strings.Contains(err.Error(), "malformed record") {
+			t.Errorf("Want: malformed record; Got: %v", err)
+		}
+	})
+}
+
+func TestLargeValues(t *testing.T) {
+	// every byte of this value is query-escaped, tripling its size in TSV
+	value := strings.Repeat("\t", int(maxValueSize))
+
+	for _, f := range []LogFormat{FormatTSV, FormatMsgPack} {
+		t.Run(fmt.Sprintf("Replays A Value Of maxValueSize In Format %d", f), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "transact.log")
+			l, err := MakeFileTransactionLogger(filename, WithFormat(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Run()
+			l.WritePut("big", value)
+			l.WritePut("after", "v")
+			l.Close()
+
+			l, err = MakeFileTransactionLogger(filename, WithFormat(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			s := &KVS{M: make(map[string]string)}
+			if err := replay(l, s); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := s.Get("big"); v != value {
+				t.Errorf("Want: %d bytes; Got: %d", len(value), len(v))
+			}
+			if v, _ := s.Get("after"); v != "v" {
+				t.Errorf("Want: %s; Got: %s", "v", v)
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeEvent(b *testing.B) {
+	e := Event{Sequence: 12345, EventType: EventPut, Key: "some-key", Value: "some moderately sized value"}
+
+	for _, f := range []struct {
+		name   string
+		format LogFormat
+	}{{"TSV", FormatTSV}, {"MsgPack", FormatMsgPack}} {
+		b.Run(f.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				encodeEvent(io.Discard, f.format, e)
+			}
+		})
+	}
+}
+
+func BenchmarkFileTransactionLoggerWritePut(b *testing.B) {
+	cases := []struct {
+		name string
+		opts []FileLoggerOption
+	}{
+		{"NoGroupCommit", nil},
+		{"GroupCommit10ms", []FileLoggerOption{WithFlushInterval(10 * time.Millisecond)}},
+	}
+
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			l, err := MakeFileTransactionLogger(filepath.Join(b.TempDir(), "transact.log"), c.opts...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			l.Run()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				l.WritePut("key", "value")
+			}
+			l.Wait()
+			b.StopTimer()
+
+			l.Close()
+		})
+	}
+}
+
+func TestPostgresPing(t *testing.T) {
+	t.Run("Healthy Database", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		mock.ExpectPing()
+		l := &PostgresTransactionLogger{db: db}
+
+		if err := l.Ping(); err != nil {
+			t.Error(err)
+		}
+		// cached, so no second ping is expected
+		if err := l.Ping(); err != nil {
+			t.Error(err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Unreachable Database", func(t *testing.T) {
+		db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		down := errors.New("connection refused")
+		mock.ExpectPing().WillReturnError(down)
+		mock.ExpectPing()
+		clock := newFakeClock()
+		l := &PostgresTransactionLogger{db: db, clock: clock}
+
+		if err := l.Ping(); !errors.Is(err, down) {
+			t.Errorf("Want: %v; Got: %v", down, err)
+		}
+
+		clock.Advance(DefaultPingCacheTTL)
+
+		if err := l.Ping(); err != nil {
+			t.Errorf("Want: recovery after the cache expires; Got: %v", err)
+		}
+	})
+}
+
+func TestCompactStats(t *testing.T) {
+	t.Run("After Equals Surviving Keys", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.Run()
+
+		l.WritePut("a", "1")
+		l.WritePut("b", "1")
+		l.WritePut("a", "2")
+		l.WriteDelete("b")
+		l.WritePut("c", "1")
+		l.Wait()
+
+		before, after, err := l.CompactStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if before != 5 {
+			t.Errorf("Want: %d; Got: %d", 5, before)
+		}
+		if after != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, after)
+		}
+	})
+}
+
+func TestCompact(t *testing.T) {
+	t.Run("Keeps Latest Put Per Live Key", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		l.WritePut("a", "1")
+		l.WritePut("b", "1")
+		l.WritePut("a", "2")
+		l.WriteDelete("b")
+		l.Wait()
+
+		before, after, err := l.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if before != 4 || after != 1 {
+			t.Errorf("Want: 4 -> 1; Got: %d -> %d", before, after)
+		}
+
+		// new events carry on the sequence in the rewritten file
+		l.WritePut("c", "1")
+		l.Close()
+
+		got := readAll(t, filename)
+		want := []Event{
+			{Sequence: 3, EventType: EventPut, Key: "a", Value: "2"},
+			{Sequence: 5, EventType: EventPut, Key: "c", Value: "1"},
+			{Sequence: 6, EventType: EventShutdown},
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Want: %+v; Got: %+v", want, got)
+		}
+		for i := range want {
+			got[i].Modified = 0 // checked in TestLastModified
+			if got[i] != want[i] {
+				t.Errorf("Want: %+v; Got: %+v", want[i], got[i])
+			}
+		}
+	})
+	t.Run("Keeps Deletes A Snapshot Would Undo", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		l.WritePut("a", "1")
+		l.WritePut("b", "1")
+		l.Wait()
+		if _, err := l.Snapshot(map[string]string{"a": "1", "b": "1"}, map[string]uint64{"a": 1, "b": 1}); err != nil {
+			t.Fatal(err)
+		}
+		l.WriteDelete("a")
+		l.Wait()
+
+		if _, _, err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		l, err = MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		s := &KVS{M: make(map[string]string)}
+		if err := replay(l, s); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("a"); err != ErrorNoSuchKey {
+			t.Errorf("Want: %v; Got: %v", ErrorNoSuchKey, err)
+		}
+		if v, _ := s.Get("b"); v != "1" {
+			t.Errorf("Want: %s; Got: %s", "1", v)
+		}
+	})
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Run("Round Trips State And Sequence", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		l.Run()
+
+		seq, state, _, err := l.LoadSnapshot()
+		if err != nil || seq != 0 || state != nil {
+			t.Errorf("Want: no snapshot; Got: %d %v %v", seq, state, err)
+		}
+
+		l.WritePut("a", "1")
+		l.WritePut("b", "2")
+		l.Wait()
+
+		seq, err = l.Snapshot(map[string]string{"a": "1", "b": "2"},
+			map[string]uint64{"a": 1, "b": 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, seq)
+		}
+
+		seq, state, versions, err := l.LoadSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != 2 || state["a"] != "1" || state["b"] != "2" {
+			t.Errorf("Want: 2 map[a:1 b:2]; Got: %d %v", seq, state)
+		}
+		if versions["b"] != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, versions["b"])
+		}
+	})
+}
+
+func TestPostgresSnapshot(t *testing.T) {
+	t.Run("Snapshot Plus Incremental Replay Rebuilds State", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("create table if not exists Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create table if not exists SnapshotMeta").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("select sequence from SnapshotMeta").
+			WillReturnRows(sqlmock.NewRows([]string{"sequence"}).AddRow(5))
+		mock.ExpectQuery("select key, value, version from Snapshot").
+			WillReturnRows(sqlmock.NewRows([]string{"key", "value", "version"}).
+				AddRow("a", "1", 1).
+				AddRow("b", "2", 4))
+		mock.ExpectQuery("select sequence, event_type, key, value from Transactions").
+			WithArgs(5).
+			WillReturnRows(sqlmock.NewRows([]string{"sequence", "event_type", "key", "value"}).
+				AddRow(6, EventPut, "c", "3").
+				AddRow(7, EventDelete, "a", ""))
+
+		s := KVS{M: make(map[string]string)}
+		if err := replay(&PostgresTransactionLogger{db: db}, &s); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{"b": "2", "c": "3"}
+		if len(s.M) != len(want) {
+			t.Errorf("Want: %v; Got: %v", want, s.M)
+		}
+		for k, v := range want {
+			if s.M[k] != v {
+				t.Errorf("Want: %s=%s; Got: %s=%s", k, v, k, s.M[k])
+			}
+		}
+		if s.versions["b"] != 4 {
+			t.Errorf("Want: %d; Got: %d", 4, s.versions["b"])
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Snapshot Is Stamped With The Last Sequence", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("create table if not exists Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create table if not exists SnapshotMeta").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectBegin()
+		mock.ExpectQuery("select coalesce").
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(7))
+		mock.ExpectExec("delete from Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectPrepare("insert into Snapshot").
+			ExpectExec().WithArgs(7, "b", "2", 2).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("insert into SnapshotMeta").WithArgs(7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		l := &PostgresTransactionLogger{db: db}
+		seq, err := l.Snapshot(map[string]string{"b": "2"}, map[string]uint64{"b": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != 7 {
+			t.Errorf("Want: %d; Got: %d", 7, seq)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Empty Snapshot Keeps Its Sequence", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("create table if not exists Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create table if not exists SnapshotMeta").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("select sequence from SnapshotMeta").
+			WillReturnRows(sqlmock.NewRows([]string{"sequence"}).AddRow(9))
+		mock.ExpectQuery("select key, value, version from Snapshot").
+			WillReturnRows(sqlmock.NewRows([]string{"key", "value", "version"}))
+
+		l := &PostgresTransactionLogger{db: db}
+		seq, state, _, err := l.LoadSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != 9 || len(state) != 0 || l.readFrom != 9 {
+			t.Errorf("Want: 9 map[] 9; Got: %d %v %d", seq, state, l.readFrom)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Older Snapshots Fall Back To Their Rows", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("create table if not exists Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("alter table Snapshot").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("create table if not exists SnapshotMeta").
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("select sequence from SnapshotMeta").
+			WillReturnRows(sqlmock.NewRows([]string{"sequence"}))
+		mock.ExpectQuery("select coalesce\\(max\\(sequence\\), 0\\) from Snapshot").
+			WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(4))
+		mock.ExpectQuery("select key, value, version from Snapshot").
+			WillReturnRows(sqlmock.NewRows([]string{"key", "value", "version"}).AddRow("a", "1", 1))
+
+		l := &PostgresTransactionLogger{db: db}
+		seq, state, _, err := l.LoadSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != 4 || state["a"] != "1" {
+			t.Errorf("Want: 4 map[a:1]; Got: %d %v", seq, state)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestShutdownMarker(t *testing.T) {
+	t.Run("Close Marks A Clean Ending", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		l.WritePut("rob", "was here")
+		l.Close()
+
+		l, err = MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		var last Event
+		events, _ := l.ReadEvents()
+		for e := range events {
+			last = e
+		}
+
+		if last.EventType != EventShutdown {
+			t.Errorf("Want: %d; Got: %d", EventShutdown, last.EventType)
+		}
+		if !l.LastShutdownClean() {
+			t.Error("Want: clean; Got: unclean")
+		}
+	})
+
+	t.Run("Missing Marker Is Unclean", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		crashed := "1\t2\trob\twas\n2\t3\t\t\n3\t2\trob\there\n"
+		if err := os.WriteFile(filename, []byte(crashed), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		events, _ := l.ReadEvents()
+		for range events {
+		}
+
+		if l.LastShutdownClean() {
+			t.Error("Want: unclean; Got: clean")
+		}
+	})
+}
+
+func TestWriteBatch(t *testing.T) {
+	batch := []Event{
+		{EventType: EventPut, Key: "a", Value: "1", Version: 1},
+		{EventType: EventDelete, Key: "b"},
+	}
+
+	for _, f := range []LogFormat{FormatTSV, FormatMsgPack} {
+		t.Run(fmt.Sprintf("Replays Whole Without Markers In Format %d", f), func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "transact.log")
+			l, err := MakeFileTransactionLogger(filename, WithFormat(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.Run()
+			if err := l.WriteBatch(batch, false); err != nil {
+				t.Fatal(err)
+			}
+			l.Close()
+
+			got := readAll(t, filename, WithFormat(f))
+			if len(got) != 3 || got[0].Key != "a" || got[1].Key != "b" || got[2].EventType != EventShutdown {
+				t.Errorf("Want: put a, delete b, shutdown; Got: %v", got)
+			}
+		})
+
+		t.Run(fmt.Sprintf("Uncommitted Batch Is Dropped In Format %d", f), func(t *testing.T) {
+			// a crash part way through a batch
+			var crashed bytes.Buffer
+			writeHeader(&crashed, f)
+			for _, e := range []Event{
+				{Sequence: 1, EventType: EventPut, Key: "kept", Value: "1"},
+				{Sequence: 2, EventType: EventBegin},
+				{Sequence: 3, EventType: EventPut, Key: "torn", Value: "1"},
+			} {
+				encodeEvent(&crashed, f, e)
+			}
+			filename := filepath.Join(t.TempDir(), "transact.log")
+			if err := os.WriteFile(filename, crashed.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := MakeFileTransactionLogger(filename, WithFormat(f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			events, errs := l.ReadEvents()
+			for e := range events {
+				keys = append(keys, e.Key)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(keys, []string{"kept"}) {
+				t.Errorf("Want: [kept]; Got: %v", keys)
+			}
+
+			// what's logged next mustn't be taken for the rest of it
+			l.Run()
+			l.WritePut("later", "1")
+			l.Close()
+
+			keys = nil
+			for _, e := range readAll(t, filename, WithFormat(f)) {
+				if e.EventType == EventPut {
+					keys = append(keys, e.Key)
+				}
+			}
+			if !slices.Equal(keys, []string{"kept", "later"}) {
+				t.Errorf("Want: [kept later]; Got: %v", keys)
+			}
+		})
+	}
+
+	t.Run("Postgres Logs A Batch In One Transaction", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &PostgresTransactionLogger{db: db, retry: RetryPolicy{Attempts: 1}}
+		l.Run()
+		defer l.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("insert into Transactions").WithArgs(EventPut, "a", "1").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("insert into Transactions").WithArgs(EventDelete, "b", "").
+			WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectCommit()
+
+		if err := l.WriteBatch(batch, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Postgres Rolls Back A Failed Batch", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &PostgresTransactionLogger{db: db, retry: RetryPolicy{Attempts: 1}}
+		l.Run()
+		defer l.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("insert into Transactions").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("insert into Transactions").WillReturnError(errors.New("disk full"))
+		mock.ExpectRollback()
+
+		if err := l.WriteBatch(batch, false); err == nil {
+			t.Error("Want: an error; Got: none")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPostgresRetry(t *testing.T) {
+	insert := "insert into Transactions"
+	newLogger := func(t *testing.T) (*PostgresTransactionLogger, sqlmock.Sqlmock) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &PostgresTransactionLogger{db: db, retry: RetryPolicy{Attempts: 3, Backoff: time.Millisecond}}
+		l.Run()
+		t.Cleanup(func() { l.Close() })
+		return l, mock
+	}
+
+	t.Run("Transient Failure Is Retried", func(t *testing.T) {
+		l, mock := newLogger(t)
+		mock.ExpectExec(insert).WillReturnError(&pq.Error{Code: "40001"})
+		mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+
+		if err := l.WritePutChecked("k", "v", 0, 0); err != nil {
+			t.Errorf("Want: %v; Got: %v", nil, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Gives Up After The Last Attempt", func(t *testing.T) {
+		l, mock := newLogger(t)
+		for i := 0; i < 3; i++ {
+			mock.ExpectExec(insert).WillReturnError(io.ErrUnexpectedEOF)
+		}
+
+		if err := l.WritePutChecked("k", "v", 0, 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Want: %v; Got: %v", io.ErrUnexpectedEOF, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Other Errors Aren't Retried", func(t *testing.T) {
+		l, mock := newLogger(t)
+		mock.ExpectExec(insert).WillReturnError(&pq.Error{Code: "23505"})
+
+		if err := l.WriteDeleteChecked("k"); err == nil {
+			t.Error("Want: an error; Got: none")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestPostgresBreaker(t *testing.T) {
+	insert := "insert into Transactions"
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newFakeClock()
+	l := &PostgresTransactionLogger{
+		db:      db,
+		retry:   RetryPolicy{Attempts: 1},
+		breaker: breaker{policy: BreakerPolicy{Threshold: 3, Cooldown: time.Minute}, clock: clock},
+	}
+	l.Run()
+	t.Cleanup(func() { l.Close() })
+
+	t.Run("Repeated Failures Open It", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			mock.ExpectExec(insert).WillReturnError(io.ErrUnexpectedEOF)
+			if err := l.WritePutChecked("k", "v", 0, 0); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("Want: %v; Got: %v", io.ErrUnexpectedEOF, err)
+			}
+		}
+		if got := l.BreakerStats().State; got != BreakerOpen {
+			t.Errorf("Want: %s; Got: %s", BreakerOpen, got)
+		}
+	})
+
+	t.Run("Open Fails Fast", func(t *testing.T) {
+		// no Exec is expected, so trying one would fail the mock
+		err := l.WritePutChecked("k", "v", 0, 0)
+		if !errors.Is(err, ErrCircuitOpen) || !errors.Is(err, ErrUnavailable) {
+			t.Errorf("Want: %v; Got: %v", ErrCircuitOpen, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("A Failed Probe Reopens It", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		mock.ExpectExec(insert).WillReturnError(io.ErrUnexpectedEOF)
+		if err := l.WriteDeleteChecked("k"); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Want: %v; Got: %v", io.ErrUnexpectedEOF, err)
+		}
+		if err := l.WriteDeleteChecked("k"); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("Want: %v; Got: %v", ErrCircuitOpen, err)
+		}
+	})
+
+	t.Run("A Later Success Closes It", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		mock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(1, 1))
+		if err := l.WritePutChecked("k", "v", 0, 0); err != nil {
+			t.Errorf("Want: %v; Got: %v", nil, err)
+		}
+
+		got := l.BreakerStats()
+		if got.State != BreakerClosed || got.Failures != 0 || got.Trips != 1 {
+			t.Errorf("Want: closed, 0 failures, 1 trip; Got: %+v", got)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Bad Writes Don't Count", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			mock.ExpectExec(insert).WillReturnError(&pq.Error{Code: "22021"})
+			l.WritePutChecked("k", "\xff", 0, 0)
+		}
+		if got := l.BreakerStats().State; got != BreakerClosed {
+			t.Errorf("Want: %s; Got: %s", BreakerClosed, got)
+		}
+	})
+}
+
+func TestPostgresConnString(t *testing.T) {
+	cases := []struct {
+		name   string
+		params PostgresDBParams
+		want   string
+	}{
+		{
+			"Defaults",
+			PostgresDBParams{host: "db", dbName: "kvs", user: "rob", password: "secret"},
+			"host=db port=5432 dbname=kvs user=rob password=secret sslmode=require",
+		},
+		{
+			"Port And SSL Mode",
+			PostgresDBParams{host: "db", port: 6543, dbName: "kvs", user: "rob", password: "secret", sslmode: "verify-full"},
+			"host=db port=6543 dbname=kvs user=rob password=secret sslmode=verify-full",
+		},
+		{
+			"Quotes Awkward Values",
+			PostgresDBParams{host: "db", dbName: "kvs", user: "rob", password: "it's a secret"},
+			`host=db port=5432 dbname=kvs user=rob password='it\'s a secret' sslmode=require`,
+		},
+		{
+			"DSN Overrides Everything",
+			PostgresDBParams{host: "db", dsn: "postgres://rob@cloud/kvs?sslmode=verify-full"},
+			"postgres://rob@cloud/kvs?sslmode=verify-full",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.params.connString(); got != c.want {
+				t.Errorf("Want: %s; Got: %s", c.want, got)
+			}
+		})
+	}
+}
+
+func TestMultiTransactionLogger(t *testing.T) {
+	t.Run("Put Reaches Every Logger", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		file, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mem := MakeMemoryTransactionLogger()
+
+		l := MakeMultiTransactionLogger(file, mem)
+		l.Run()
+		l.WritePut("rob", "here")
+		l.WriteDelete("gone")
+		l.Wait()
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := mem.Events()
+		if len(got) != 2 || got[0].Key != "rob" || got[1].EventType != EventDelete {
+			t.Errorf("Want: put rob, delete gone; Got: %+v", got)
+		}
+
+		onDisk := readAll(t, filename)
+		if len(onDisk) < 2 || onDisk[0].Key != "rob" || onDisk[0].Value != "here" {
+			t.Errorf("Want: put rob on disk; Got: %+v", onDisk)
+		}
+	})
+
+	t.Run("ReadEvents Reads The Primary", func(t *testing.T) {
+		primary := MakeMemoryTransactionLogger()
+		primary.WritePut("a", "1")
+
+		l := MakeMultiTransactionLogger(primary, MakeMemoryTransactionLogger())
+
+		s := KVS{M: make(map[string]string)}
+		if err := replay(l, &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.M["a"] != "1" || len(s.M) != 1 {
+			t.Errorf("Want: map[a:1]; Got: %v", s.M)
+		}
+	})
+
+	t.Run("Close Doesn't Wait For Errors To Be Read", func(t *testing.T) {
+		mem := MakeMemoryTransactionLogger()
+		mem.errors = make(chan error, 2)
+		mem.errors <- errors.New("first")
+		mem.errors <- errors.New("second")
+
+		l := MakeMultiTransactionLogger(mem)
+		l.Run()
+		for len(mem.errors) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		closed := make(chan error, 1)
+		go func() { closed <- l.Close() }()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("Want: Close to return; Got: blocked on the unread error")
+		}
+	})
+}
+
+func BenchmarkFileTransactionLoggerWriteParallel(b *testing.B) {
+	l, err := MakeFileTransactionLogger(filepath.Join(b.TempDir(), "transact.log"),
+		WithFlushInterval(10*time.Millisecond))
+	if err != nil {
+		b.Fatal(err)
+	}
+	l.Run()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.WritePut("key", "value")
+		}
+	})
+	l.Wait()
+	b.StopTimer()
+
+	l.Close()
+}
+
+func TestReadEventsFrom(t *testing.T) {
+	read := func(input string) ([]Event, error) {
+		l := &FileTransactionLogger{}
+
+		var got []Event
+		events, errs := l.ReadEventsFrom(strings.NewReader(input))
+		for e := range events {
+			got = append(got, e)
+		}
+		return got, <-errs
+	}
+
+	t.Run("Parses Well Formed Lines", func(t *testing.T) {
+		got, err := read("1\t2\tclient rob\twas here\n2\t1\tclient rob\t\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []Event{
+			{Sequence: 1, EventType: EventPut, Key: "client rob", Value: "was here"},
+			{Sequence: 2, EventType: EventDelete, Key: "client rob"},
+		}
+		if len(got) != len(want) {
+			t.Fatalf("Want: %+v; Got: %+v", want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Want: %+v; Got: %+v", want[i], got[i])
+			}
+		}
+	})
+
+	malformed := []struct {
+		name  string
+		input string
+	}{
+		{"Too Few Fields", "1\t2\tkey\n"},
+		{"Bad Sequence", "one\t2\tkey\tvalue\n"},
+		{"Bad Event Type", "1\tput\tkey\tvalue\n"},
+		{"Bad Value Escape", "1\t2\tkey\t%zz\n"},
+		{"Out Of Sequence", "2\t2\ta\t1\n1\t2\tb\t2\n"},
+		{"Blank Line", "1\t2\ta\t1\n\n"},
+	}
+
+	for _, c := range malformed {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := read(c.input); err == nil {
+				t.Error("Want: error; Got: nil")
+			}
+		})
+	}
+
+	t.Run("Errors Name The Line", func(t *testing.T) {
+		_, err := read("1\t2\ta\t1\n2\t2\n")
+		if err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("Want: error on line 2; Got: %v", err)
+		}
+	})
+}
+
+func TestLogVersions(t *testing.T) {
+	t.Run("Reads A Legacy v0 Log", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		legacy := "1\t2\tclient rob\twas+here\n2\t1\tclient rob\t\n"
+		os.WriteFile(filename, []byte(legacy), 0644)
+
+		got := readAll(t, filename)
+		if len(got) != 2 || got[0].Key != "client rob" || got[0].Value != "was here" {
+			t.Errorf("Want: put client rob=was here; Got: %+v", got)
+		}
+	})
+
+	t.Run("Reads A Versioned v1 Log", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		v1 := "#cngo-log v1\n1\t2\tclient+rob\ta%09b%0Ac\n"
+		os.WriteFile(filename, []byte(v1), 0644)
+
+		got := readAll(t, filename)
+		if len(got) != 1 || got[0].Key != "client rob" || got[0].Value != "a\tb\nc" {
+			t.Errorf("Want: put client rob=a\\tb\\nc; Got: %+v", got)
+		}
+	})
+
+	t.Run("New Logs Get A Header And Escaped Fields", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		l.WritePut("tab\tkey", "multi\nline")
+		l.Close()
+
+		raw, _ := os.ReadFile(filename)
+		if !strings.HasPrefix(string(raw), "#cngo-log v3\n") {
+			t.Errorf("Want: v3 header; Got: %q", raw)
+		}
+
+		got := readAll(t, filename)
+		if got[0].Key != "tab\tkey" || got[0].Value != "multi\nline" {
+			t.Errorf("Want: round trip; Got: %+v", got[0])
+		}
+	})
+
+	t.Run("Legacy Logs Stay Legacy Until Compacted", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		os.WriteFile(filename, []byte("1\t2\ta\t1\n"), 0644)
+
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, _ := l.ReadEvents()
+		for range events {
+		}
+		l.Run()
+		l.WritePut("b", "2")
+		l.Wait()
+
+		raw, _ := os.ReadFile(filename)
+		if string(raw) != "1\t2\ta\t1\n2\t2\tb\t2\n" {
+			t.Errorf("Want: legacy lines appended; Got: %q", raw)
+		}
+
+		if _, _, err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		raw, _ = os.ReadFile(filename)
+		if !strings.HasPrefix(string(raw), "#cngo-log v3\n") {
+			t.Errorf("Want: upgraded to v3; Got: %q", raw)
+		}
+		if got := readAll(t, filename); len(got) != 3 {
+			t.Errorf("Want: 2 puts and a marker; Got: %+v", got)
+		}
+	})
+
+	t.Run("v1 Logs Are Appended Without Versions", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		os.WriteFile(filename, []byte("#cngo-log v1\n1\t2\ta\t1\n"), 0644)
+
+		l, err := MakeFileTransactionLogger(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, _ := l.ReadEvents()
+		for range events {
+		}
+		l.Run()
+		l.WritePutVersion("b", "2", 7, 0)
+		l.Close()
+
+		raw, _ := os.ReadFile(filename)
+		if !strings.HasPrefix(string(raw), "#cngo-log v1\n1\t2\ta\t1\n2\t2\tb\t2\n") {
+			t.Errorf("Want: v1 lines appended; Got: %q", raw)
+		}
+	})
+
+	t.Run("Rejects Newer Versions", func(t *testing.T) {
+		l := &FileTransactionLogger{}
+		events, errs := l.ReadEventsFrom(strings.NewReader("#cngo-log v9\n1\t2\ta\t1\n"))
+		for range events {
+		}
+		if err := <-errs; err == nil {
+			t.Error("Want: unsupported version error; Got: nil")
+		}
+	})
+
+	t.Run("Leaves The Logger's Sequence Alone", func(t *testing.T) {
+		l := &FileTransactionLogger{lastSequence: 5}
+
+		for _, input := range []string{"1\t2\ta\t1\n2\t2\tb\t2\n", "9\t2\ta\t1\n"} {
+			events, errs := l.ReadEventsFrom(strings.NewReader(input))
+			for range events {
+			}
+			if err := <-errs; err != nil {
+				t.Errorf("Want: nil; Got: %v", err)
+			}
+		}
+		if got := l.LastSequence(); got != 5 {
+			t.Errorf("Want: %d; Got: %d", 5, got)
+		}
+		if read, total := l.replayRead.Load(), l.replayTotal.Load(); read != 0 || total != 0 {
+			t.Errorf("Want: no replay progress; Got: %d of %d", read, total)
+		}
+	})
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	t.Run("Drained Logger Drops Nothing", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		l.WritePut("a", "1")
+
+		dropped, err := l.CloseWithTimeout(time.Second)
+		if err != nil || dropped != 0 {
+			t.Errorf("Want: 0 <nil>; Got: %d %v", dropped, err)
+		}
+	})
+
+	t.Run("Wedged Writer Reports Dropped Events", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		// holding the file lock stalls every write, like a hung disk
+		l.mu.Lock()
+		l.WritePut("a", "1")
+		l.WritePut("b", "2")
+		l.WriteDelete("a")
+
+		dropped, err := l.CloseWithTimeout(20 * time.Millisecond)
+		if !errors.Is(err, ErrCloseTimeout) {
+			t.Errorf("Want: %v; Got: %v", ErrCloseTimeout, err)
+		}
+		if dropped != 3 {
+			t.Errorf("Want: %d; Got: %d", 3, dropped)
+		}
+
+		l.mu.Unlock()
+		<-l.done
+	})
+}
+
+func TestErrUnread(t *testing.T) {
+	t.Run("Repeated Write Errors Don't Wedge The Writer", func(t *testing.T) {
+		var buf bytes.Buffer
+		useLogBuffer(t, &buf)
+
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		// every write now fails, and nothing reads Err
+		l.file.Close()
+		l.WritePut("a", "1")
+		l.WritePut("b", "2")
+		l.WriteDelete("a")
+
+		waited := make(chan struct{})
+		go func() {
+			l.Wait()
+			close(waited)
+		}()
+
+		select {
+		case <-waited:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Want: writer to keep going; Got: wedged")
+		}
+
+		if err := <-l.Err(); err == nil {
+			t.Error("Want: the first error on Err; Got: nil")
+		}
+		if !strings.Contains(buf.String(), "error dropped") {
+			t.Errorf("Want: overflow logged; Got: %q", buf.String())
+		}
+	})
+}
+
+func TestClose(t *testing.T) {
+	t.Run("Close Twice Is Safe", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		l.WritePut("a", "1")
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Errorf("Want: <nil>; Got: %v", err)
+		}
+	})
+
+	t.Run("Close Fsyncs The Log", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"),
+			WithFlushInterval(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		l.WritePut("a", "1")
+		l.WritePut("b", "2")
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if l.durable != l.lastSequence {
+			t.Errorf("Want: %d; Got: %d", l.lastSequence, l.durable)
+		}
+	})
+
+	t.Run("Postgres Closes The Database Once", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectClose()
+		l := &PostgresTransactionLogger{db: db}
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Errorf("Want: <nil>; Got: %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Multi Close Twice Is Safe", func(t *testing.T) {
+		file, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := MakeMultiTransactionLogger(file, MakeMemoryTransactionLogger())
+		l.Run()
+
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Errorf("Want: <nil>; Got: %v", err)
+		}
+	})
+}
+
+func TestShardedLogger(t *testing.T) {
+	t.Run("Replay Merges Shards In Sequence Order", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "transact.log")
+
+		l, err := MakeShardedTransactionLogger(path, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		for i := 0; i < 40; i++ {
+			l.WritePut(fmt.Sprintf("k%d", i%10), fmt.Sprint(i))
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 4; i++ {
+			if info, err := os.Stat(shardFile(path, i)); err != nil || info.Size() == 0 {
+				t.Errorf("Want: events in shard %d; Got: %v", i, err)
+			}
+		}
+
+		l, err = MakeShardedTransactionLogger(path, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		events, errs := l.ReadEvents()
+		var last uint64
+		puts := 0
+		latest := map[string]int{}
+		for e := range events {
+			if e.Sequence <= last {
+				t.Fatalf("Want: sequence after %d; Got: %d", last, e.Sequence)
+			}
+			last = e.Sequence
+			if e.EventType != EventPut {
+				continue
+			}
+			puts++
+
+			// shards interleave, but each key's puts stay in order
+			v, _ := strconv.Atoi(e.Value)
+			if prev, ok := latest[e.Key]; ok && v <= prev {
+				t.Errorf("Want: %s after %d; Got: %d", e.Key, prev, v)
+			}
+			latest[e.Key] = v
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		if puts != 40 {
+			t.Errorf("Want: %d puts; Got: %d", 40, puts)
+		}
+
+		// new events carry on after everything replayed
+		l.Run()
+		l.WritePut("k0", "next")
+		l.Wait()
+		if got := l.shard("k0").lastSequence; got <= last {
+			t.Errorf("Want: sequence after %d; Got: %d", last, got)
+		}
+	})
+
+	t.Run("Error Forwarding Stops When Nobody Reads", func(t *testing.T) {
+		in, out, done := make(chan error, 2), make(chan error, 1), make(chan struct{})
+		in <- errors.New("first")
+		in <- errors.New("second")
+
+		stopped := make(chan struct{})
+		go func() {
+			forwardErrors(in, out, done)
+			close(stopped)
+		}()
+
+		// the second error has nowhere to go until done is closed
+		for len(in) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("Want: forwarder stopped once done; Got: still blocked")
+		}
+		if err := <-out; err.Error() != "first" {
+			t.Errorf("Want: %s; Got: %v", "first", err)
+		}
+	})
+}
+
+func TestBackup(t *testing.T) {
+	t.Run("Backups Taken During Writes Are Consistent", func(t *testing.T) {
+		dir := t.TempDir()
+		l, err := MakeFileTransactionLogger(filepath.Join(dir, "transact.log"), WithRotateSize(2048))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		defer l.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 1000; i++ {
+				l.WritePut(fmt.Sprintf("k%d", i%7), strings.Repeat("v", i%50))
+			}
+		}()
+
+		reader, err := MakeFileTransactionLogger(filepath.Join(dir, "reader.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+
+		for b := 0; b < 5; b++ {
+			var buf bytes.Buffer
+			if err := l.Backup(&buf); err != nil {
+				t.Fatal(err)
+			}
+
+			events, errs := reader.ReadEventsFrom(&buf)
+			var want uint64 = 1
+			for e := range events {
+				if e.Sequence != want {
+					t.Fatalf("Want: sequence %d; Got: %d", want, e.Sequence)
+				}
+				want++
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-done
+
+		if !l.hasSegments() {
+			t.Error("Want: the log to have rotated during the test")
+		}
+	})
+}
+
+func TestSequenceErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		log  string
+		want error
+	}{
+		{"Repeated Number Is A Duplicate", "#cngo-log v2\n1\t2\ta\t1\t1\n1\t2\tb\t1\t1\n", ErrDuplicateSequence},
+		{"Lower Number Is Out Of Sequence", "#cngo-log v2\n2\t2\ta\t1\t1\n1\t2\tb\t1\t1\n", ErrOutOfSequence},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "transact.log")
+			os.WriteFile(filename, []byte(c.log), 0644)
+
+			l, err := MakeFileTransactionLogger(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			events, errs := l.ReadEvents()
+			for range events {
+			}
+
+			if err := <-errs; !errors.Is(err, c.want) {
+				t.Errorf("Want: %v; Got: %v", c.want, err)
+			}
+		})
+	}
+}
+
+func TestEventTypeJSON(t *testing.T) {
+	cases := []struct {
+		t    EventType
+		json string
+	}{
+		{EventPut, `"put"`},
+		{EventDelete, `"delete"`},
+		{EventShutdown, `"shutdown"`},
+		{EventType(9), `9`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.t.String(), func(t *testing.T) {
+			data, err := json.Marshal(c.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != c.json {
+				t.Errorf("Want: %s; Got: %s", c.json, data)
+			}
+
+			var back EventType
+			if err := json.Unmarshal(data, &back); err != nil {
+				t.Fatal(err)
+			}
+			if back != c.t {
+				t.Errorf("Want: %v; Got: %v", c.t, back)
+			}
+		})
+	}
+
+	t.Run("Event Round Trips", func(t *testing.T) {
+		e := Event{Sequence: 3, EventType: EventDelete, Key: "k"}
+		data, _ := json.Marshal(e)
+
+		var back Event
+		if err := json.Unmarshal(data, &back); err != nil {
+			t.Fatal(err)
+		}
+		if back != e {
+			t.Errorf("Want: %+v; Got: %+v", e, back)
+		}
+	})
+
+	t.Run("Unknown Name Is An Error", func(t *testing.T) {
+		var et EventType
+		if err := json.Unmarshal([]byte(`"upsert"`), &et); err == nil {
+			t.Error("Want: error; Got: nil")
+		}
+	})
+}
+
+func TestLogIndex(t *testing.T) {
+	// writeLog logs puts k1..k100 with an index entry every 10 events
+	writeLog := func(t *testing.T) string {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename, WithIndexInterval(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		for i := 1; i <= 100; i++ {
+			l.WritePut(fmt.Sprintf("k%d", i), "v")
+		}
+		l.Close()
+
+		return filename
+	}
+
+	readLog := func(t *testing.T, filename string, from uint64) []Event {
+		t.Helper()
+
+		l, err := MakeFileTransactionLogger(filename, WithIndexInterval(10))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		var got []Event
+		events, errs := l.ReadLog(from)
+		for e := range events {
+			got = append(got, e)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+
+		return got
+	}
+
+	check := func(t *testing.T, got []Event) {
+		t.Helper()
+
+		// puts 55 to 100, then the shutdown marker
+		if len(got) != 47 {
+			t.Fatalf("Want: %d events; Got: %d", 47, len(got))
+		}
+		if got[0].Sequence != 55 || got[0].Key != "k55" {
+			t.Errorf("Want: 55 k55; Got: %d %s", got[0].Sequence, got[0].Key)
+		}
+		if got[46].EventType != EventShutdown {
+			t.Errorf("Want: %v; Got: %v", EventShutdown, got[46].EventType)
+		}
+	}
+
+	t.Run("Seeks Past Earlier Events", func(t *testing.T) {
+		filename := writeLog(t)
+
+		// garble event 10 in place: a full scan fails on it, a seek never
+		// reads it
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := bytes.Split(data, []byte("\n"))
+		copy(lines[10], bytes.Repeat([]byte("x"), len(lines[10])))
+		if err := os.WriteFile(filename, bytes.Join(lines, []byte("\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, readLog(t, filename, 55))
+	})
+
+	t.Run("Missing Index Falls Back To A Full Scan", func(t *testing.T) {
+		filename := writeLog(t)
+		if err := os.Remove(filename + ".idx"); err != nil {
+			t.Fatal(err)
+		}
+
+		check(t, readLog(t, filename, 55))
+	})
+
+	t.Run("Replay Rebuilds A Missing Index", func(t *testing.T) {
+		filename := writeLog(t)
+		want, err := os.ReadFile(filename + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(filename + ".idx")
+
+		readAll(t, filename, WithIndexInterval(10))
+
+		got, err := os.ReadFile(filename + ".idx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("Want: %q; Got: %q", want, got)
+		}
+	})
+}
+
+func TestRotation(t *testing.T) {
+	t.Run("Replay Reads Every Segment", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename, WithRotateSize(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		for i := 1; i <= 50; i++ {
+			l.WritePut(fmt.Sprintf("k%d", i), "v")
+		}
+		l.Close()
+
+		if segs, _ := l.segments(); len(segs) < 2 {
+			t.Fatalf("Want: several segments; Got: %d", len(segs))
+		}
+
+		got := readAll(t, filename)
+		if len(got) != 51 {
+			t.Fatalf("Want: %d events; Got: %d", 51, len(got))
+		}
+		for i, e := range got {
+			if e.Sequence != uint64(i+1) {
+				t.Fatalf("Want: %d; Got: %d", i+1, e.Sequence)
+			}
+		}
+	})
+
+	t.Run("Retention Keeps The Configured Number Of Segments", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		opts := []FileLoggerOption{WithRotateSize(100), WithRetention(Retention{MaxSegments: 2})}
+		l, err := MakeFileTransactionLogger(filename, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		for i := 1; i <= 50; i++ {
+			l.WritePut(fmt.Sprintf("k%d", i), "v")
+		}
+		l.Wait()
+
+		// nothing is snapshotted yet, so every segment is still needed
+		if segs, _ := l.segments(); len(segs) <= 2 {
+			t.Fatalf("Want: more than 2 segments; Got: %d", len(segs))
+		}
+
+		if _, err := l.Snapshot(map[string]string{"k50": "v"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if segs, _ := l.segments(); len(segs) != 2 {
+			t.Errorf("Want: %d segments; Got: %d", 2, len(segs))
+		}
+		l.Close()
+
+		// the rest of the log still replays, and numbering carries on
+		l, err = MakeFileTransactionLogger(filename, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := l.LoadSnapshot(); err != nil {
+			t.Fatal(err)
+		}
+		events, errs := l.ReadEvents()
+		for range events {
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if l.lastSequence != 51 {
+			t.Errorf("Want: %d; Got: %d", 51, l.lastSequence)
+		}
+		l.Close()
+	})
+
+	t.Run("Compaction Keeps Deletes While Segments Exist", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+		l, err := MakeFileTransactionLogger(filename, WithRotateSize(60))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		l.WritePut("a", strings.Repeat("x", 60))
+		l.WriteDelete("a")
+		l.Wait()
+
+		if _, _, err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		got := readAll(t, filename)
+		if len(got) != 3 || got[1].EventType != EventDelete {
+			t.Errorf("Want: put, delete, shutdown; Got: %+v", got)
+		}
+	})
+}
+
+func TestSequenceLimit(t *testing.T) {
+	t.Run("Writes Fail At The Limit Until Compaction Renumbers", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "transact.log")
+
+		// 4 bits allows sequence numbers up to 15
+		l, err := MakeFileTransactionLogger(filename, WithSequenceBits(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+
+		for i := 0; i < 15; i++ {
+			l.WritePut(fmt.Sprintf("k%d", i%3), fmt.Sprint(i))
+		}
+		l.Wait()
+
+		l.WritePut("k0", "rejected")
+		l.Wait()
+		select {
+		case err := <-l.Err():
+			if !errors.Is(err, ErrSequenceExhausted) {
+				t.Errorf("Want: %v; Got: %v", ErrSequenceExhausted, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Want: an error at the limit")
+		}
+
+		if _, after, err := l.Compact(); err != nil || after != 3 {
+			t.Fatalf("Want: 3 <nil>; Got: %d %v", after, err)
+		}
+
+		l.WritePut("k0", "accepted")
+		l.Close()
+
+		got := readAll(t, filename, WithSequenceBits(4))
+		want := []string{"12", "13", "14", "accepted", ""}
+		if len(got) != len(want) {
+			t.Fatalf("Want: %d events; Got: %+v", len(want), got)
+		}
+		for i, e := range got {
+			if e.Sequence != uint64(i+1) || e.Value != want[i] {
+				t.Errorf("Want: %d %q; Got: %d %q", i+1, want[i], e.Sequence, e.Value)
+			}
+		}
+	})
+
+	t.Run("Compaction Keeps Numbers Far From The Limit", func(t *testing.T) {
+		l, err := MakeFileTransactionLogger(filepath.Join(t.TempDir(), "transact.log"), WithSequenceBits(8))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Run()
+		defer l.Close()
+
+		l.WritePut("a", "1")
+		l.WritePut("a", "2")
+		l.Wait()
+		if _, _, err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+
+		if l.lastSequence != 2 {
+			t.Errorf("Want: %d; Got: %d", 2, l.lastSequence)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// logger is the server's own log. Tests may swap it to capture output.
+var logger = slog.Default()
+
+// newLogger makes a logger writing to w in format, "text" or "json",
+// showing records at level ("debug", "info", "warn" or "error") and above
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.ToUpper(level))); err != nil {
+		return nil, fmt.Errorf("%w: unknown log level %q", ErrInvalidArgument, level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("%w: unknown log format %q", ErrInvalidArgument, format)
+	}
+}
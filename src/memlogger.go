@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryTransactionLogger keeps events in memory. It is not durable; it is
+// meant for tests and as a secondary target of a MultiTransactionLogger.
+type MemoryTransactionLogger struct {
+	mu      sync.Mutex
+	events  []Event
+	errors  chan error
+	written chan struct{}
+}
+
+// MakeMemoryTransactionLogger constructor func
+func MakeMemoryTransactionLogger() *MemoryTransactionLogger {
+	return &MemoryTransactionLogger{errors: make(chan error, 1)}
+}
+
+func (l *MemoryTransactionLogger) append(events ...Event) {
+	l.mu.Lock()
+	for _, e := range events {
+		e.Sequence = uint64(len(l.events)) + 1
+		l.events = append(l.events, e)
+	}
+	if l.written != nil {
+		close(l.written)
+		l.written = nil
+	}
+	l.mu.Unlock()
+}
+
+// Written returns a channel closed once the next event is recorded
+func (l *MemoryTransactionLogger) Written() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.written == nil {
+		l.written = make(chan struct{})
+	}
+
+	return l.written
+}
+
+// LastSequence is the sequence number of the last event recorded
+func (l *MemoryTransactionLogger) LastSequence() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(len(l.events))
+}
+
+// WritePut records a put event
+func (l *MemoryTransactionLogger) WritePut(key, value string) {
+	l.WritePutVersion(key, value, 0, time.Now().UnixNano())
+}
+
+// WritePutVersion records a put event with the key's new version and
+// when the store made it
+func (l *MemoryTransactionLogger) WritePutVersion(key, value string, version uint64, modified int64) {
+	l.append(Event{EventType: EventPut, Key: key, Value: value, Version: version, Modified: modified})
+}
+
+// WriteDelete records a delete event
+func (l *MemoryTransactionLogger) WriteDelete(key string) {
+	l.append(Event{EventType: EventDelete, Key: key})
+}
+
+// WriteBatch records the events together, so nothing reading the log sees
+// some of them without the rest. It can't fail, and sync changes nothing.
+func (l *MemoryTransactionLogger) WriteBatch(events []Event, _ bool) error {
+	batch := make([]Event, len(events))
+	for i, e := range events {
+		batch[i] = Event{EventType: e.EventType, Key: e.Key, Value: e.Value, Version: e.Version, Modified: e.Modified}
+	}
+
+	l.append(batch...)
+	return nil
+}
+
+// Err never delivers anything; memory writes can't fail
+func (l *MemoryTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// ReadEvents replays the events recorded so far
+func (l *MemoryTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	events := l.Events()
+	outEvent := make(chan Event)
+	outError := make(chan error)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for _, e := range events {
+			outEvent <- e
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// ReadLog is ReadEvents, skipping events before sequence from
+func (l *MemoryTransactionLogger) ReadLog(from uint64) (<-chan Event, <-chan error) {
+	events := l.Events()
+	outEvent := make(chan Event)
+	outError := make(chan error)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		for _, e := range events {
+			if e.Sequence >= from {
+				outEvent <- e
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// Run is a no-op; writes are applied synchronously
+func (l *MemoryTransactionLogger) Run() {}
+
+// Events returns a copy of the events recorded so far
+func (l *MemoryTransactionLogger) Events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]Event(nil), l.events...)
+}
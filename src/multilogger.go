@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// MultiTransactionLogger tees every write to several loggers, e.g. a file
+// and Postgres during a migration. Events are read back from the primary.
+type MultiTransactionLogger struct {
+	loggers []TransactionLogger // loggers[0] is the primary
+	errors  <-chan error
+	done    chan struct{} // closed to stop the error forwarders
+	wg      sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// MakeMultiTransactionLogger constructor func
+func MakeMultiTransactionLogger(primary TransactionLogger, others ...TransactionLogger) *MultiTransactionLogger {
+	return &MultiTransactionLogger{
+		loggers: append([]TransactionLogger{primary}, others...),
+	}
+}
+
+// WritePut sends the put to every logger
+func (l *MultiTransactionLogger) WritePut(key, value string) {
+	for _, t := range l.loggers {
+		t.WritePut(key, value)
+	}
+}
+
+// WritePutVersion sends the put to every logger, with its version and
+// modification time to those that record them
+func (l *MultiTransactionLogger) WritePutVersion(key, value string, version uint64, modified int64) {
+	for _, t := range l.loggers {
+		if vl, ok := t.(VersionLogger); ok {
+			vl.WritePutVersion(key, value, version, modified)
+		} else {
+			t.WritePut(key, value)
+		}
+	}
+}
+
+// WriteDelete sends the delete to every logger
+func (l *MultiTransactionLogger) WriteDelete(key string) {
+	for _, t := range l.loggers {
+		t.WriteDelete(key)
+	}
+}
+
+// Err delivers errors from any of the loggers
+func (l *MultiTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// ReadEvents reads from the primary only
+func (l *MultiTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.loggers[0].ReadEvents()
+}
+
+// Run starts every logger and merges their error channels
+func (l *MultiTransactionLogger) Run() {
+	errors := make(chan error, 1)
+	l.errors = errors
+	l.done = make(chan struct{})
+
+	for _, t := range l.loggers {
+		t.Run()
+
+		l.wg.Add(1)
+		go func(in <-chan error) {
+			defer l.wg.Done()
+			forwardErrors(in, errors, l.done)
+		}(t.Err())
+	}
+}
+
+// Wait for io on every logger that supports it
+func (l *MultiTransactionLogger) Wait() {
+	for _, t := range l.loggers {
+		if w, ok := t.(interface{ Wait() }); ok {
+			w.Wait()
+		}
+	}
+}
+
+// Close every logger that can be closed, returning the first error. Only
+// the first call does anything.
+func (l *MultiTransactionLogger) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.close()
+	})
+	return l.closeErr
+}
+
+func (l *MultiTransactionLogger) close() error {
+	var first error
+
+	for _, t := range l.loggers {
+		if c, ok := t.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+
+	if l.done != nil {
+		close(l.done)
+		l.wg.Wait()
+	}
+
+	return first
+}
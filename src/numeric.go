@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Integers can be held natively, as an int64 in KVS.ints with an empty
+// placeholder in M, so counters aren't parsed and formatted on every
+// increment. It's only a representation: reads render the decimal string,
+// the log records it as one, and any string put replaces it.
+
+// PutInt stores n at key as a native integer, otherwise as PutWithResult
+func (s *KVS) PutInt(key string, n int64, ttl time.Duration) (PutResult, error) {
+	key = s.NormalizeKey(key)
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	mu := s.stripes.lock(key)
+	s.Lock()
+	_, exists := s.M[key]
+	if exists && s.expired(key, now(s.Clock)) {
+		exists = false
+		delete(s.versions, key)
+	}
+	version, err := s.put(key, "", false, ttl)
+	if err == nil {
+		s.storeInt(key, n)
+	}
+	hooks := s.hooks
+	s.Unlock()
+	mu.Unlock()
+
+	if err != nil {
+		return PutResult{}, err
+	}
+
+	if len(hooks) > 0 {
+		notify(hooks, key, strconv.FormatInt(n, 10), false)
+	}
+	s.evict(key)
+	return PutResult{Version: version, Created: !exists}, nil
+}
+
+// storeInt sets key's value to the native integer n. Callers must hold
+// the lock.
+func (s *KVS) storeInt(key string, n int64) {
+	s.store(key, "", false)
+	if s.ints == nil {
+		s.ints = make(map[string]int64)
+	}
+	s.ints[key] = n
+}
+
+// addInt adds delta to the integer at key in place and returns the sum
+// and the key's new version. A missing key counts as 0 and a string
+// holding an integer is converted, so the key is native from then on.
+// Once it is, nothing is allocated unless OnChange hooks need the value.
+// The key's TTL is kept.
+func (s *KVS) addInt(key string, delta int64) (int64, uint64, error) {
+	key = s.NormalizeKey(key)
+	mu := s.stripes.lock(key)
+	s.Lock()
+	n, native := s.ints[key]
+	stored, exists := s.M[key]
+	if exists && s.expired(key, now(s.Clock)) {
+		exists, native = false, false
+		delete(s.versions, key)
+	}
+
+	switch {
+	case native:
+	case !exists:
+		if _, ok := s.M[key]; !ok && s.MaxKeys > 0 && len(s.M) >= s.MaxKeys {
+			s.Unlock()
+			mu.Unlock()
+			return 0, 0, fmt.Errorf("%w: limit is %d keys", ErrStoreFull, s.MaxKeys)
+		}
+		n = 0
+		delete(s.expires, key) // an expired key comes back without its old TTL
+	default:
+		if s.compressed[key] {
+			stored = s.unpack(stored)
+		}
+
+		var err error
+		if n, err = strconv.ParseInt(stored, 10, 64); err != nil {
+			s.Unlock()
+			mu.Unlock()
+			return 0, 0, fmt.Errorf("%w: %q", ErrNotInteger, stored)
+		}
+	}
+
+	n += delta
+	if native {
+		s.ints[key] = n
+		s.touch(key)
+	} else {
+		s.storeInt(key, n)
+	}
+	version := s.bump(key, 0)
+	hooks := s.hooks
+	s.Unlock()
+	mu.Unlock()
+
+	if len(hooks) > 0 {
+		notify(hooks, key, strconv.FormatInt(n, 10), false)
+	}
+	s.evict(key)
+	return n, version, nil
+}
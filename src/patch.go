@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MergePatchType is the media type of a JSON Merge Patch (RFC 7386)
+const MergePatchType = "application/merge-patch+json"
+
+// MergePatch applies the JSON Merge Patch patch to the JSON value at key
+// and returns the result and the key's new version. Members of the patch
+// set the stored object's, recursively, and null members delete them; a
+// patch that isn't an object replaces the value whole. fn, if not nil,
+// may check or change the result before it's stored. A missing key is
+// ErrorNoSuchKey, and either value not being JSON is ErrInvalidJSON. The
+// key's TTL is kept.
+func (s *KVS) MergePatch(key string, patch []byte, fn func(merged string) (string, error)) (string, uint64, error) {
+	p, err := decodeJSON(patch)
+	if err != nil {
+		return "", 0, fmt.Errorf("%w: patch: %v", ErrInvalidJSON, err)
+	}
+
+	return s.update(key, func(current string, exists bool) (string, error) {
+		if !exists {
+			return "", ErrorNoSuchKey
+		}
+
+		target, err := decodeJSON([]byte(current))
+		if err != nil {
+			return "", fmt.Errorf("%w: stored value: %v", ErrInvalidJSON, err)
+		}
+
+		merged, err := encodeJSON(mergePatch(target, p))
+		if err != nil || fn == nil {
+			return merged, err
+		}
+		return fn(merged)
+	})
+}
+
+// mergePatch is the MergePatch algorithm of RFC 7386 section 2. target's
+// objects are changed in place.
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any, len(p))
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+
+	return t
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers as written
+func decodeJSON(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("data after the value")
+	}
+	return v, nil
+}
+
+// encodeJSON encodes v compactly, without escaping HTML characters
+func encodeJSON(v any) (string, error) {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// KeyValuePatchHandler expects to be called from http PATCH at
+// "/v1/{key}" resource, with a JSON Merge Patch as the body and
+// Content-Type application/merge-patch+json. The patch is applied to the
+// key's stored JSON and the result stored, logged as a put, and returned.
+// Any PutTransform sees the merged value.
+func KeyValuePatchHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := requestKey(r)
+	if err == nil {
+		err = validateKey(key)
+	}
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != MergePatchType {
+		w.Header().Set("Accept-Patch", MergePatchType)
+		writeError(w, r, fmt.Errorf("%w: PATCH takes %s", ErrUnsupportedMediaType, MergePatchType))
+		return
+	}
+
+	body, err := readValue(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	done, err := beginWrite()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
+
+	start := time.Now()
+	value, version, err := kvs.MergePatch(key, body, func(merged string) (string, error) {
+		merged, err := transformValue(key, merged)
+		if err == nil && int64(len(merged)) > maxValueSize {
+			err = fmt.Errorf("%w: limit is %d bytes", ErrBodyTooLarge, maxValueSize)
+		}
+		return merged, err
+	})
+	observeOp("put", start)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if err := writePut(transact, key, value, version); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(VersionHeader, strconv.FormatUint(version, 10))
+	w.Write([]byte(value))
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Retention bounds how many rotated log segments are kept. A segment is
+// only ever deleted once a snapshot covers all of its events, so the
+// limits can be exceeded while snapshots lag behind. Zero fields are
+// unlimited.
+type Retention struct {
+	MaxSegments int
+	MaxBytes    int64
+	MaxAge      time.Duration
+}
+
+// WithRotateSize seals the log as a read-only segment and starts a new
+// one whenever it grows past n bytes
+func WithRotateSize(n int64) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.rotateSize = n
+	}
+}
+
+// WithRetention deletes the oldest rotated segments beyond r, checked
+// after each rotation and snapshot
+func WithRetention(r Retention) FileLoggerOption {
+	return func(l *FileTransactionLogger) {
+		l.retention = r
+	}
+}
+
+// segment is a sealed log file, named for the last sequence it holds
+type segment struct {
+	name    string
+	last    uint64
+	size    int64
+	modTime time.Time
+}
+
+func (l *FileTransactionLogger) segmentFile(last uint64) string {
+	return fmt.Sprintf("%s.%020d", l.filename, last)
+}
+
+// segments lists the sealed segments of the log, oldest first
+func (l *FileTransactionLogger) segments() ([]segment, error) {
+	names, err := filepath.Glob(l.filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var segs []segment
+	for _, name := range names {
+		suffix := name[len(l.filename)+1:]
+		if len(suffix) != 20 {
+			continue // the index, snapshot and such
+		}
+		last, err := strconv.ParseUint(suffix, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		segs = append(segs, segment{name: name, last: last, size: info.Size(), modTime: info.ModTime()})
+	}
+
+	sort.Slice(segs, func(i, j int) bool {
+		return segs[i].last < segs[j].last
+	})
+
+	return segs, nil
+}
+
+// openSegments opens the segments holding events from sequence from on.
+// Callers must hold l.mu so retention can't delete them underneath.
+func (l *FileTransactionLogger) openSegments(from uint64) ([]*os.File, error) {
+	segs, err := l.segments()
+	if err != nil {
+		return nil, fmt.Errorf("cannot list log segments: %w", err)
+	}
+
+	var files []*os.File
+	for _, s := range segs {
+		if s.last < from {
+			continue
+		}
+
+		f, err := os.Open(s.name)
+		if err != nil {
+			closeAll(files)
+			return nil, fmt.Errorf("cannot open log segment: %w", err)
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// hasSegments reports whether the log has been rotated. An unreadable
+// directory counts as rotated, the cautious answer for compaction.
+func (l *FileTransactionLogger) hasSegments() bool {
+	segs, err := l.segments()
+	return err != nil || len(segs) > 0
+}
+
+func closeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// rotate seals the log as a segment and starts an empty one in its place.
+// Callers must hold l.mu.
+func (l *FileTransactionLogger) rotate() error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+	if err := l.sync(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(l.filename, l.segmentFile(l.lastSequence)); err != nil {
+		return fmt.Errorf("cannot rotate log file: %w", err)
+	}
+
+	f, err := os.OpenFile(l.filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	l.file.Close()
+	l.file = f
+	l.buf.Reset(l.file)
+
+	n, err := writeHeader(l.file, l.format)
+	if err != nil {
+		return fmt.Errorf("cannot write log header: %w", err)
+	}
+	l.offset = int64(n)
+
+	if l.indexEvery > 0 {
+		l.index = nil
+		l.rewriteIndex()
+	}
+
+	return l.retain()
+}
+
+// retain deletes the oldest segments beyond the retention limits, as far
+// as the latest snapshot covers them. Callers must hold l.mu.
+func (l *FileTransactionLogger) retain() error {
+	r := l.retention
+	if r.MaxSegments == 0 && r.MaxBytes == 0 && r.MaxAge == 0 {
+		return nil
+	}
+
+	segs, err := l.segments()
+	if err != nil {
+		return fmt.Errorf("cannot list log segments: %w", err)
+	}
+
+	var total int64
+	for _, s := range segs {
+		total += s.size
+	}
+
+	for i, s := range segs {
+		over := r.MaxSegments > 0 && len(segs)-i > r.MaxSegments ||
+			r.MaxBytes > 0 && total > r.MaxBytes ||
+			r.MaxAge > 0 && time.Since(s.modTime) > r.MaxAge
+		if !over || s.last > l.snapshotSeq {
+			return nil
+		}
+
+		if err := os.Remove(s.name); err != nil {
+			return fmt.Errorf("cannot remove log segment: %w", err)
+		}
+		total -= s.size
+	}
+
+	return nil
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer serves the API from an empty store that logs to memory,
+// for the length of the test. The handlers use the package's kvs and
+// transact, so tests using it mustn't run in parallel.
+func newTestServer(t *testing.T) (*httptest.Server, *MemoryTransactionLogger) {
+	t.Helper()
+
+	l := MakeMemoryTransactionLogger()
+	saved := transact
+	transact = l
+	kvs = KVS{M: make(map[string]string)}
+
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		srv.Close()
+		transact = saved
+		kvs = KVS{M: make(map[string]string)}
+	})
+
+	return srv, l
+}
+
+// send makes a request to srv and returns the status and body
+func send(t *testing.T, srv *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestServerFixture(t *testing.T) {
+	t.Run("Put Get Delete", func(t *testing.T) {
+		srv, l := newTestServer(t)
+
+		if code, _ := send(t, srv, "PUT", "/v1/a", "1"); code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, code)
+		}
+		if code, body := send(t, srv, "GET", "/v1/a", ""); code != http.StatusOK || body != "1" {
+			t.Errorf("Want: 200 1; Got: %d %s", code, body)
+		}
+		if code, _ := send(t, srv, "DELETE", "/v1/a", ""); code != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, code)
+		}
+		if code, _ := send(t, srv, "GET", "/v1/a", ""); code != http.StatusNotFound {
+			t.Errorf("Want: %d; Got: %d", http.StatusNotFound, code)
+		}
+
+		events := l.Events()
+		if len(events) != 2 || events[0].EventType != EventPut || events[1].EventType != EventDelete {
+			t.Errorf("Want: put then delete; Got: %v", events)
+		}
+	})
+
+	t.Run("Each Server Starts Empty", func(t *testing.T) {
+		srv, l := newTestServer(t)
+
+		if code, _ := send(t, srv, "GET", "/v1/a", ""); code != http.StatusNotFound {
+			t.Errorf("Want: %d; Got: %d", http.StatusNotFound, code)
+		}
+		if n := len(l.Events()); n != 0 {
+			t.Errorf("Want: %d; Got: %d", 0, n)
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("Requests In Flight Are Logged", func(t *testing.T) {
+		l := useTempLogger(t)
+
+		// the first PUT stalls before reaching the router until released
+		started, release := make(chan struct{}), make(chan struct{})
+		router := newRouter()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v1/shutdown-inflight" {
+				close(started)
+				<-release
+			}
+			router.ServeHTTP(w, r)
+		}))
+		t.Cleanup(func() {
+			srv.Close()
+			writeGate.Unlock() // Shutdown keeps writes paused for good
+		})
+
+		codes := make(chan int, 1)
+		go func() {
+			code, _ := send(t, srv, "PUT", "/v1/shutdown-inflight", "1")
+			codes <- code
+		}()
+		<-started
+
+		stopped := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			stopped <- Shutdown(ctx, srv.Config)
+		}()
+
+		select {
+		case err := <-stopped:
+			t.Fatalf("Want: Shutdown to wait for the request; Got: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		close(release)
+
+		if code := <-codes; code != http.StatusCreated {
+			t.Errorf("Want: %d; Got: %d", http.StatusCreated, code)
+		}
+		if err := <-stopped; err != nil {
+			t.Fatal(err)
+		}
+
+		events := readAll(t, l.filename)
+		if len(events) != 2 || events[0].Key != "shutdown-inflight" || events[1].EventType != EventShutdown {
+			t.Errorf("Want: put then shutdown; Got: %v", events)
+		}
+	})
+
+	t.Run("Background Tasks Stop Before The Log Closes", func(t *testing.T) {
+		useTempLogger(t)
+		t.Cleanup(func() { writeGate.Unlock() })
+
+		var stopped atomic.Bool
+		tasks.start(func(ctx context.Context) { snapshotEvery(ctx, time.Millisecond) })
+		tasks.start(func(ctx context.Context) {
+			<-ctx.Done()
+			time.Sleep(20 * time.Millisecond)
+			stopped.Store(true)
+		})
+
+		if err := closeTransact(time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if !stopped.Load() {
+			t.Error("Want: tasks stopped before closeTransact returns")
+		}
+	})
+}
+
+func TestChanges(t *testing.T) {
+	// subscribe opens _changes on srv with token, returning its body
+	subscribe := func(t *testing.T, srv *httptest.Server, token string) io.ReadCloser {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/_changes", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Want: %d; Got: %d", http.StatusOK, resp.StatusCode)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp.Body
+	}
+
+	// expect reads the next len(want) changes from body
+	expect := func(t *testing.T, body io.Reader, want []Change) {
+		t.Helper()
+
+		scanner := bufio.NewScanner(body)
+		for _, w := range want {
+			var got Change
+			for scanner.Scan() {
+				if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+					json.Unmarshal([]byte(data), &got)
+					break
+				}
+			}
+			if got != w {
+				t.Errorf("Want: %v; Got: %v", w, got)
+			}
+		}
+	}
+
+	t.Run("Subscriber Sees Every Mutation", func(t *testing.T) {
+		useAdminToken(t)
+		srv, _ := newTestServer(t)
+		kvs.OnChange(changes.publish)
+		body := subscribe(t, srv, adminToken)
+
+		send(t, srv, "PUT", "/v1/a", "1")
+		send(t, srv, "PUT", "/v1/b", "2")
+		send(t, srv, "DELETE", "/v1/a", "")
+
+		expect(t, body, []Change{{"put", "a", "1"}, {"put", "b", "2"}, {"delete", "a", ""}})
+	})
+
+	t.Run("Needs A Token", func(t *testing.T) {
+		useAdminToken(t)
+		srv, _ := newTestServer(t)
+
+		if code, _ := send(t, srv, "GET", "/v1/_changes", ""); code != http.StatusUnauthorized {
+			t.Errorf("Want: %d; Got: %d", http.StatusUnauthorized, code)
+		}
+	})
+
+	t.Run("Denied Keys Are Left Out", func(t *testing.T) {
+		if err := setAuth(nil, []string{"alice:a-secret"}); err != nil {
+			t.Fatal(err)
+		}
+		SetAuthPolicy(func(method, key, user string) bool {
+			return !strings.HasPrefix(key, "secret/")
+		})
+		t.Cleanup(func() {
+			setAuthTokens()
+			SetAuthPolicy(nil)
+		})
+
+		srv, _ := newTestServer(t)
+		kvs.OnChange(changes.publish)
+		body := subscribe(t, srv, "a-secret")
+
+		kvs.Put("secret/plans", "hidden")
+		kvs.Put("alice/notes", "mine")
+
+		expect(t, body, []Change{{"put", "alice/notes", "mine"}})
+	})
+
+	t.Run("Slow Subscribers Are Dropped", func(t *testing.T) {
+		ch, cancel := changes.subscribe()
+		defer cancel()
+
+		for i := 0; i <= ChangeBuffer; i++ {
+			changes.publish("slow", "v", false)
+		}
+
+		n := 0
+		for range ch {
+			n++
+		}
+		if n != ChangeBuffer {
+			t.Errorf("Want: %d; Got: %d", ChangeBuffer, n)
+		}
+	})
+}
+
+func TestClientTimeouts(t *testing.T) {
+	t.Run("Stalled Reader Cancels The Handler", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		stream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(cancelled)
+
+			chunk := []byte(strings.Repeat("x", 32<<10))
+			for r.Context().Err() == nil {
+				w.Write(chunk)
+				w.(http.Flusher).Flush()
+			}
+		})
+		srv := httptest.NewServer(clientTimeouts(50*time.Millisecond, 0)(stream))
+		defer srv.Close()
+
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.(*net.TCPConn).SetReadBuffer(4 << 10)
+
+		// read the start of the response, then stop reading
+		io.WriteString(conn, "GET /v1/_changes HTTP/1.1\r\nHost: test\r\n\r\n")
+		if _, err := conn.Read(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-cancelled:
+		case <-time.After(10 * time.Second):
+			t.Error("Want: handler cancelled; Got: still writing")
+		}
+	})
+
+	t.Run("Slow Handler Is Cancelled", func(t *testing.T) {
+		h := clientTimeouts(0, 50*time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				writeError(w, r, fmt.Errorf("%w: %v", ErrUnavailable, r.Context().Err()))
+			case <-time.After(10 * time.Second):
+			}
+		}))
+
+		start := time.Now()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/slow", nil))
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("Want: cancelled after 50ms; Got: %v", took)
+		}
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, rec.Code)
+		}
+	})
+}
+
+func TestLimitRequests(t *testing.T) {
+	const n = 3
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(limitRequests(n, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		held <- struct{}{}
+		<-release
+	})))
+	defer srv.Close()
+
+	done := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				done <- 0
+				return
+			}
+			resp.Body.Close()
+			done <- resp.StatusCode
+		}()
+		<-held
+	}
+
+	t.Run("Request Beyond The Limit Is 503", func(t *testing.T) {
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Want: %d; Got: %d", http.StatusServiceUnavailable, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Retry-After"); got == "" {
+			t.Error("Want: Retry-After; Got: none")
+		}
+	})
+
+	close(release)
+	for i := 0; i < n; i++ {
+		if got := <-done; got != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, got)
+		}
+	}
+
+	t.Run("Slots Free Up", func(t *testing.T) {
+		go func() { <-held }()
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Want: %d; Got: %d", http.StatusOK, resp.StatusCode)
+		}
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	useAdminToken(t)
+	srv, l := newTestServer(t)
+
+	const n = 20000
+	value := func(i int) string { return strings.Repeat(fmt.Sprint(i), 10) }
+
+	// the dataset is generated as it's sent, never held whole
+	pr, pw := io.Pipe()
+	go func() {
+		enc := json.NewEncoder(pw)
+		for i := 0; i < n; i++ {
+			enc.Encode(ExportLine{Key: fmt.Sprintf("bulk/%05d", i), Value: value(i)})
+		}
+		pw.Close()
+	}()
+
+	t.Run("Import Streams Every Line", func(t *testing.T) {
+		resp, err := http.Post(srv.URL+"/v1/_import", "application/x-ndjson", pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var got ImportResponse
+		json.NewDecoder(resp.Body).Decode(&got)
+		if resp.StatusCode != http.StatusOK || got.Imported != n {
+			t.Fatalf("Want: %d %d; Got: %d %d", http.StatusOK, n, resp.StatusCode, got.Imported)
+		}
+		if got := len(l.Events()); got != n {
+			t.Errorf("Want: %d events logged; Got: %d", n, got)
+		}
+	})
+
+	t.Run("Export Streams Them Back In Order", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", srv.URL+"/v1/_export", nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		i := 0
+		scanner := bufio.NewScanner(resp.Body)
+		for ; scanner.Scan(); i++ {
+			var line ExportLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatal(err)
+			}
+			if want := fmt.Sprintf("bulk/%05d", i); line.Key != want || line.Value != value(i) {
+				t.Fatalf("Want: %s=%s; Got: %s=%s", want, value(i), line.Key, line.Value)
+			}
+		}
+		if i != n {
+			t.Errorf("Want: %d lines; Got: %d", n, i)
+		}
+	})
+
+	t.Run("Bad Line Is Named", func(t *testing.T) {
+		body := `{"key": "ok", "value": "1"}` + "\n" + `{"key": "", "value": "2"}` + "\n"
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/_import", strings.NewReader(body))
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, _ := io.ReadAll(resp.Body)
+		if got := string(b); resp.StatusCode != http.StatusBadRequest || !strings.Contains(got, "line 2") {
+			t.Errorf("Want: %d line 2; Got: %d %s", http.StatusBadRequest, resp.StatusCode, got)
+		}
+		if got := string(b); !strings.Contains(got, "1 lines imported") || resp.Header.Get(ImportedHeader) != "1" {
+			t.Errorf("Want: 1 imported; Got: %q %q", got, resp.Header.Get(ImportedHeader))
+		}
+		if v, err := kvs.Get("ok"); err != nil || v != "1" {
+			t.Errorf("Want: ok=1 kept; Got: %q %v", v, err)
+		}
+	})
+
+	t.Run("Inflated Line Is Too Large", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		fmt.Fprintf(zw, `{"key": "big", "value": "%s"}`+"\n", strings.Repeat("x", maxImportLine()))
+		zw.Close()
+
+		req, _ := http.NewRequest("POST", srv.URL+"/v1/_import", &buf)
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Want: %d; Got: %d", http.StatusRequestEntityTooLarge, resp.StatusCode)
+		}
+		if _, err := kvs.Get("big"); err == nil {
+			t.Error("Want: big not stored")
+		}
+	})
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedTransactionLogger spreads the log over several files, each with
+// its own writer, so writes aren't serialized on a single file. Events
+// are routed by key, keeping each key's events in order within one
+// shard, and numbered from a shared sequence so that replay can merge
+// the shards back into a single order.
+type ShardedTransactionLogger struct {
+	shards []*FileTransactionLogger
+	seq    atomic.Uint64 // the last sequence handed out to any shard
+	errors <-chan error
+	done   chan struct{} // closed to stop the error forwarders
+	wg     sync.WaitGroup
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// shardFile names shard i of the log
+func shardFile(filename string, i int) string {
+	return fmt.Sprintf("%s.shard%d", filename, i)
+}
+
+// MakeShardedTransactionLogger opens n shards of the log at filename,
+// each configured with opts
+func MakeShardedTransactionLogger(filename string, n int, opts ...FileLoggerOption) (*ShardedTransactionLogger, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("%w: need at least one shard, got %d", ErrInvalidArgument, n)
+	}
+
+	l := &ShardedTransactionLogger{}
+	for i := 0; i < n; i++ {
+		shard, err := MakeFileTransactionLogger(shardFile(filename, i), opts...)
+		if err != nil {
+			for _, s := range l.shards {
+				s.file.Close()
+			}
+			return nil, err
+		}
+		shard.shared = &l.seq
+		l.shards = append(l.shards, shard)
+	}
+
+	return l, nil
+}
+
+// shard picks the shard for key
+func (l *ShardedTransactionLogger) shard(key string) *FileTransactionLogger {
+	// FNV-1a, as for the key stripes
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return l.shards[h%uint32(len(l.shards))]
+}
+
+// WritePut sends the put to its key's shard
+func (l *ShardedTransactionLogger) WritePut(key, value string) {
+	l.shard(key).WritePut(key, value)
+}
+
+// WritePutVersion sends the put to its key's shard
+func (l *ShardedTransactionLogger) WritePutVersion(key, value string, version uint64, modified int64) {
+	l.shard(key).WritePutVersion(key, value, version, modified)
+}
+
+// WriteDelete sends the delete to its key's shard
+func (l *ShardedTransactionLogger) WriteDelete(key string) {
+	l.shard(key).WriteDelete(key)
+}
+
+// WritePutChecked sends the put to its key's shard and waits for it
+func (l *ShardedTransactionLogger) WritePutChecked(key, value string, version uint64, modified int64) error {
+	return l.shard(key).WritePutChecked(key, value, version, modified)
+}
+
+// WriteDeleteChecked sends the delete to its key's shard and waits for it
+func (l *ShardedTransactionLogger) WriteDeleteChecked(key string) error {
+	return l.shard(key).WriteDeleteChecked(key)
+}
+
+// WritePutSync sends the put to its key's shard and waits for it to be
+// fsynced
+func (l *ShardedTransactionLogger) WritePutSync(key, value string, version uint64, modified int64) error {
+	return l.shard(key).WritePutSync(key, value, version, modified)
+}
+
+// WriteDeleteSync sends the delete to its key's shard and waits for it to
+// be fsynced
+func (l *ShardedTransactionLogger) WriteDeleteSync(key string) error {
+	return l.shard(key).WriteDeleteSync(key)
+}
+
+// Err delivers errors from any of the shards
+func (l *ShardedTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// ReadEvents reads every shard at once, merging them by sequence number.
+// New events are numbered after the highest sequence read.
+func (l *ShardedTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	type head struct {
+		events <-chan Event
+		errors <-chan error
+		next   Event
+		ok     bool
+	}
+
+	heads := make([]*head, len(l.shards))
+	for i, s := range l.shards {
+		events, errors := s.ReadEvents()
+		heads[i] = &head{events: events, errors: errors}
+	}
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		// advance reads a shard's next event, or its error once it's done
+		advance := func(h *head) error {
+			if h.next, h.ok = <-h.events; !h.ok {
+				return <-h.errors
+			}
+			return nil
+		}
+
+		fail := func(err error) {
+			outError <- err
+			for _, h := range heads {
+				for range h.events {
+				}
+			}
+		}
+
+		for _, h := range heads {
+			if err := advance(h); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		for {
+			var min *head
+			for _, h := range heads {
+				if h.ok && (min == nil || h.next.Sequence < min.next.Sequence) {
+					min = h
+				}
+			}
+			if min == nil {
+				break
+			}
+
+			outEvent <- min.next
+			if err := advance(min); err != nil {
+				fail(err)
+				return
+			}
+		}
+
+		for _, s := range l.shards {
+			if s.lastSequence > l.seq.Load() {
+				l.seq.Store(s.lastSequence)
+			}
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// LastSequence is the last sequence number handed out to any shard. An
+// event with a lower number may still be on its way to its shard.
+func (l *ShardedTransactionLogger) LastSequence() uint64 {
+	return l.seq.Load()
+}
+
+// Run starts every shard and merges their error channels
+func (l *ShardedTransactionLogger) Run() {
+	errors := make(chan error, 1)
+	l.errors = errors
+	l.done = make(chan struct{})
+
+	for _, s := range l.shards {
+		s.Run()
+
+		l.wg.Add(1)
+		go func(in <-chan error) {
+			defer l.wg.Done()
+			forwardErrors(in, errors, l.done)
+		}(s.Err())
+	}
+}
+
+// forwardErrors sends the errors arriving on in to out until in is closed
+// or done is, never blocking past done, so Close can stop it while nobody
+// reads out
+func forwardErrors(in <-chan error, out chan<- error, done <-chan struct{}) {
+	for {
+		select {
+		case err, ok := <-in:
+			if !ok {
+				return
+			}
+			select {
+			case out <- err:
+			case <-done:
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Pending sums every shard's pending events
+func (l *ShardedTransactionLogger) Pending() int {
+	n := 0
+	for _, s := range l.shards {
+		n += s.Pending()
+	}
+	return n
+}
+
+// PeekPending returns up to n buffered events across the shards, in
+// sequence order
+func (l *ShardedTransactionLogger) PeekPending(n int) []Event {
+	var events []Event
+	for _, s := range l.shards {
+		events = append(events, s.PeekPending(n)...)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Sequence < events[j].Sequence })
+
+	if len(events) > n {
+		events = events[:n]
+	}
+	return events
+}
+
+// Wait for io on every shard
+func (l *ShardedTransactionLogger) Wait() {
+	for _, s := range l.shards {
+		s.Wait()
+	}
+}
+
+// Close every shard, returning the first error. Only the first call does
+// anything.
+func (l *ShardedTransactionLogger) Close() error {
+	l.closeOnce.Do(func() {
+		for _, s := range l.shards {
+			if err := s.Close(); err != nil && l.closeErr == nil {
+				l.closeErr = err
+			}
+		}
+
+		if l.done != nil {
+			close(l.done)
+			l.wg.Wait()
+		}
+	})
+	return l.closeErr
+}
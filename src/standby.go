@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/rhardin/cngo/client"
+)
+
+// ErrStandby refuses writes while the server replicates a primary
+var ErrStandby = fmt.Errorf("%w: read-only standby; promote it to take writes", ErrUnavailable)
+
+// ErrNotStandby is returned by PromoteHandler on a server that isn't one
+var ErrNotStandby = errors.New("not a standby")
+
+// follower is a standby's replication of its primary
+type follower struct {
+	replica *client.Replica
+	cancel  context.CancelFunc
+	done    chan struct{} // closed once the replica stops
+}
+
+// standby is set while the server follows a primary; writes are refused
+// until it's cleared by promotion
+var standby atomic.Pointer[follower]
+
+// standbyStore applies replicated events to kvs and logs each under the
+// primary's sequence number
+type standbyStore struct {
+	log SequencedWriter
+}
+
+func (s standbyStore) Put(key, value string) error {
+	return errors.New("standby needs whole events")
+}
+
+func (s standbyStore) Delete(key string) error {
+	return errors.New("standby needs whole events")
+}
+
+// Apply logs e before applying it, so the store never holds a change the
+// log would lose
+func (s standbyStore) Apply(ce client.Event) error {
+	e := Event{Sequence: ce.Sequence, Key: ce.Key, Value: ce.Value, Version: ce.Version, Modified: ce.Modified}
+	switch ce.Type {
+	case "put":
+		e.EventType = EventPut
+	case "delete":
+		e.EventType = EventDelete
+	default:
+		return nil
+	}
+
+	if err := s.log.WriteSequenced(e); err != nil {
+		return err
+	}
+	logCounts.add(e.EventType)
+	return applyEvent(&kvs, e)
+}
+
+// startStandby makes the server a standby of the primary at url: writes
+// are refused while transact follows the primary's log from the last
+// event it holds, asking for it with token
+func startStandby(url, token string) error {
+	w, ok := transact.(SequencedWriter)
+	if !ok {
+		return fmt.Errorf("standby %w", ErrNotSupported)
+	}
+	var from uint64
+	if s, ok := transact.(Sequencer); ok {
+		from = s.LastSequence()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{
+		replica: client.NewReplica(client.New(url), standbyStore{log: w}, from),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	f.replica.Token = token
+	standby.Store(f)
+
+	go func() {
+		defer close(f.done)
+		if err := f.replica.Run(ctx); !errors.Is(err, context.Canceled) {
+			logger.Error("standby stopped replicating", "primary", url, "err", err)
+		}
+	}()
+
+	logger.Info("running as standby", "primary", url, "from", from)
+	return nil
+}
+
+// stopStandby stops replicating, if the server is a standby, and waits
+// for the last event to be applied. It reports whether there was one to
+// stop.
+func stopStandby() bool {
+	f := standby.Load()
+	if f == nil {
+		return false
+	}
+
+	f.cancel()
+	<-f.done
+	return true
+}
+
+// PromoteResponse is the body returned by PromoteHandler
+type PromoteResponse struct {
+	Sequence uint64 `json:"sequence"` // of the last event replicated
+}
+
+// PromoteHandler expects to be called from http POST at "/v1/_promote"
+// resource, behind requireAuth. A standby stops replicating its primary
+// and starts taking writes, which carry on the primary's sequence numbers
+// from the last event replicated. It's 409 on a server that isn't a
+// standby.
+func PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	resume := pauseWrites()
+	defer resume()
+
+	if !stopStandby() {
+		writeError(w, r, ErrNotStandby)
+		return
+	}
+	standby.Store(nil)
+
+	var seq uint64
+	if s, ok := transact.(Sequencer); ok {
+		seq = s.LastSequence()
+	}
+	logger.Info("promoted from standby", "sequence", seq)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PromoteResponse{Sequence: seq})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// replayLogEvery is how many events replay goes between progress lines
+var replayLogEvery uint64 = 100000
+
+// progressReporter is a logger that knows how far through its log a
+// replay has read, in bytes
+type progressReporter interface {
+	ReplayProgress() (read, total int64)
+}
+
+// replayProgress tracks the startup replay for StartupHandler
+type replayProgress struct {
+	mu       sync.Mutex
+	running  bool
+	events   uint64
+	sequence uint64
+	source   progressReporter // nil if the logger can't tell
+}
+
+var startup replayProgress
+
+func (p *replayProgress) start(l TransactionLogger) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running, p.events, p.sequence = true, 0, 0
+	p.source, _ = l.(progressReporter)
+}
+
+// event counts a replayed event, logging progress every replayLogEvery
+func (p *replayProgress) event(seq uint64) {
+	p.mu.Lock()
+	p.events++
+	p.sequence = seq
+	n := p.events
+	p.mu.Unlock()
+
+	if n%replayLogEvery == 0 {
+		args := []any{"events", n, "sequence", seq}
+		if pct := p.response().Percent; pct != nil {
+			args = append(args, "percent", fmt.Sprintf("%.1f", *pct))
+		}
+		logger.Info("replay progress", args...)
+	}
+}
+
+func (p *replayProgress) finish() {
+	p.mu.Lock()
+	p.running = false
+	n, seq := p.events, p.sequence
+	p.mu.Unlock()
+
+	logger.Info("replay done", "events", n, "sequence", seq)
+}
+
+// StartupResponse is the body returned by StartupHandler
+type StartupResponse struct {
+	Replaying bool     `json:"replaying"`
+	Events    uint64   `json:"events"`
+	Sequence  uint64   `json:"sequence"`
+	Percent   *float64 `json:"percent,omitempty"` // of the log's bytes read, if known
+}
+
+func (p *replayProgress) response() StartupResponse {
+	p.mu.Lock()
+	resp := StartupResponse{Replaying: p.running, Events: p.events, Sequence: p.sequence}
+	source := p.source
+	p.mu.Unlock()
+
+	if source != nil {
+		if read, total := source.ReplayProgress(); total > 0 {
+			pct := 100 * float64(read) / float64(total)
+			if !resp.Replaying {
+				pct = 100
+			}
+			resp.Percent = &pct
+		}
+	}
+
+	return resp
+}
+
+// StartupHandler expects to be called from http GET at "/startup". It
+// reports how far replaying the transaction log has got, with a 503
+// until it's done, for use as a startup probe.
+func StartupHandler(w http.ResponseWriter, r *http.Request) {
+	resp := startup.response()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// startupGate is the server's handler from the moment it listens. Until
+// open is called it answers only the probes, and everything else with
+// 503, so /startup can be asked while the transaction log replays.
+type startupGate struct {
+	probes http.Handler
+	full   atomic.Pointer[http.Handler]
+}
+
+func newStartupGate() *startupGate {
+	r := mux.NewRouter()
+	r.HandleFunc("/ready", ReadyHandler).Methods("GET")
+	r.HandleFunc("/startup", StartupHandler).Methods("GET")
+	r.HandleFunc("/metrics", MetricsHandler).Methods("GET")
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, fmt.Errorf("%w: replaying transaction log", ErrUnavailable))
+	})
+
+	return &startupGate{probes: r}
+}
+
+// open hands every request from now on to h
+func (g *startupGate) open(h http.Handler) {
+	g.full.Store(&h)
+}
+
+func (g *startupGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := g.full.Load(); h != nil {
+		(*h).ServeHTTP(w, r)
+		return
+	}
+	g.probes.ServeHTTP(w, r)
+}
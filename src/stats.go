@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// histogram counts observations into fixed, ascending upper bounds, with a
+// final overflow bucket for anything larger
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+	min    float64
+	max    float64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe records one value
+func (h *histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+
+	h.mu.Lock()
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if h.count == 0 || v > h.max {
+		h.max = v
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// HistogramBucket is one bucket of a histogram. Le is the inclusive upper
+// bound; the overflow bucket has none.
+type HistogramBucket struct {
+	Le    *float64 `json:"le,omitempty"`
+	Count uint64   `json:"count"`
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram
+type HistogramSnapshot struct {
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+	Min     float64           `json:"min"`
+	Max     float64           `json:"max"`
+	Buckets []HistogramBucket `json:"buckets"`
+}
+
+func (h *histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	snap := HistogramSnapshot{Count: h.count, Sum: h.sum, Min: h.min, Max: h.max}
+	for i, c := range h.counts {
+		b := HistogramBucket{Count: c}
+		if i < len(h.bounds) {
+			le := h.bounds[i]
+			b.Le = &le
+		}
+		snap.Buckets = append(snap.Buckets, b)
+	}
+
+	return snap
+}
+
+// opDurationBounds are the store operation histogram buckets, in
+// microseconds
+var opDurationBounds = []float64{1, 5, 10, 50, 100, 500, 1000, 5000}
+
+// storeTimings holds a duration histogram per store operation
+var storeTimings = map[string]*histogram{
+	"get":    newHistogram(opDurationBounds...),
+	"put":    newHistogram(opDurationBounds...),
+	"delete": newHistogram(opDurationBounds...),
+	"txn":    newHistogram(opDurationBounds...),
+}
+
+// observeOp records how long a store operation took since start
+func observeOp(op string, start time.Time) {
+	storeTimings[op].Observe(float64(time.Since(start)) / float64(time.Microsecond))
+}
+
+// slowRequests is router middleware logging a warning for each request
+// taking at least threshold. Streams that follow the log are expected to
+// run long and are left out.
+func slowRequests(threshold time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			next.ServeHTTP(w, r)
+			took := time.Since(start)
+
+			if took < threshold || isStream(r) {
+				return
+			}
+			logger.Warn("slow request", "method", r.Method, "path", r.URL.Path,
+				"key", mux.Vars(r)["key"], "took", took)
+		})
+	}
+}
+
+// isStream reports whether r follows the log rather than returning, or
+// streams the whole store in or out
+func isStream(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/v1/_replicate", "/v1/_changes", "/v1/_export", "/v1/_import":
+		return true
+	}
+	tail, _ := strconv.ParseBool(r.URL.Query().Get("tail"))
+	return r.URL.Path == "/v1/_log" && tail
+}
+
+// DefaultValueSizeBounds are the value size histogram buckets, in bytes
+var DefaultValueSizeBounds = []float64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// valueSizes is the size of each value stored by a PUT
+var valueSizes = newHistogram(DefaultValueSizeBounds...)
+
+// SizeSummary sums up a size histogram
+type SizeSummary struct {
+	Count uint64  `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+}
+
+func summarize(h HistogramSnapshot) SizeSummary {
+	s := SizeSummary{Count: h.Count, Min: h.Min, Max: h.Max}
+	if h.Count > 0 {
+		s.Avg = h.Sum / float64(h.Count)
+	}
+	return s
+}
+
+// StatsResponse is the body returned by StatsHandler
+type StatsResponse struct {
+	Keys int `json:"keys"`
+
+	// OpDurations are store operation timings in microseconds
+	OpDurations map[string]HistogramSnapshot `json:"op_durations_us"`
+
+	// ValueSizes are the sizes of values put, in bytes
+	ValueSizes SizeSummary `json:"value_sizes"`
+
+	// PendingEvents are logged but not yet written out, so a crash now
+	// would lose them; Pending shows the first few. Both are left out for
+	// loggers that don't buffer.
+	PendingEvents *int           `json:"pending_events,omitempty"`
+	Pending       []PendingEvent `json:"pending,omitempty"`
+
+	// Compaction is the automatic compaction schedule, if there is one,
+	// and the latest compaction however it was started
+	Compaction CompactionStats `json:"compaction"`
+
+	// Events counts the puts and deletes in the transaction log
+	Events EventCounts `json:"events"`
+
+	// Breaker is the state of the circuit breaker guarding log writes,
+	// for loggers that have one
+	Breaker *BreakerStats `json:"breaker,omitempty"`
+}
+
+// EventCounts are the puts and deletes in the transaction log: those
+// replayed at startup, snapshotted or not, and those logged since.
+// Compaction drops events without changing the counts, so only a restart
+// brings them down to what it left.
+type EventCounts struct {
+	Puts    int64 `json:"puts"`
+	Deletes int64 `json:"deletes"`
+}
+
+// eventCounter keeps EventCounts as they change
+type eventCounter struct {
+	puts, deletes atomic.Int64
+}
+
+// logCounts counts the events in transact's log
+var logCounts eventCounter
+
+func (c *eventCounter) add(t EventType) {
+	switch t {
+	case EventPut:
+		c.puts.Add(1)
+	case EventDelete:
+		c.deletes.Add(1)
+	}
+}
+
+func (c *eventCounter) reset() {
+	c.puts.Store(0)
+	c.deletes.Store(0)
+}
+
+func (c *eventCounter) counts() EventCounts {
+	return EventCounts{Puts: c.puts.Load(), Deletes: c.deletes.Load()}
+}
+
+// PendingEvent identifies an event in StatsResponse.Pending, leaving out
+// its value
+type PendingEvent struct {
+	Sequence  uint64    `json:"sequence"`
+	EventType EventType `json:"type"`
+	Key       string    `json:"key"`
+}
+
+// statsPeek is how many pending events StatsHandler shows
+const statsPeek = 10
+
+// StatsHandler expects to be called from http GET at "/v1/_stats" resource
+func StatsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := StatsResponse{
+		Keys:        kvs.Len(),
+		OpDurations: make(map[string]HistogramSnapshot, len(storeTimings)),
+		ValueSizes:  summarize(valueSizes.Snapshot()),
+		Compaction:  compactionStats(),
+		Events:      logCounts.counts(),
+	}
+	for op, h := range storeTimings {
+		resp.OpDurations[op] = h.Snapshot()
+	}
+	if p, ok := transact.(PendingReporter); ok {
+		n := p.Pending()
+		resp.PendingEvents = &n
+		for _, e := range p.PeekPending(statsPeek) {
+			resp.Pending = append(resp.Pending, PendingEvent{Sequence: e.Sequence, EventType: e.EventType, Key: e.Key})
+		}
+	}
+
+	if b, ok := transact.(BreakerReporter); ok {
+		s := b.BreakerStats()
+		resp.Breaker = &s
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// MetricsHandler expects to be called from http GET at "/metrics"
+// resource. It writes the histograms, and the count of store integrity
+// anomalies found, in the Prometheus text format.
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writePromHistogram(w, "cngo_value_size_bytes", "Size of values stored by PUT.",
+		map[string]HistogramSnapshot{"": valueSizes.Snapshot()})
+
+	ops := make(map[string]HistogramSnapshot, len(storeTimings))
+	for op, h := range storeTimings {
+		ops[`op="`+op+`"`] = h.Snapshot()
+	}
+	writePromHistogram(w, "cngo_op_duration_microseconds", "Store operation latency.", ops)
+
+	fmt.Fprintf(w, "# HELP cngo_verify_anomalies_total Store integrity anomalies found.\n"+
+		"# TYPE cngo_verify_anomalies_total counter\ncngo_verify_anomalies_total %d\n", verifyAnomalies.Load())
+}
+
+// writePromHistogram writes one histogram metric, a series per label set
+func writePromHistogram(w io.Writer, name, help string, series map[string]HistogramSnapshot) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+
+	labels := make([]string, 0, len(series))
+	for l := range series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		h := series[l]
+		sep := ""
+		if l != "" {
+			sep = ","
+		}
+
+		var cumulative uint64
+		for _, b := range h.Buckets {
+			cumulative += b.Count
+			le := "+Inf"
+			if b.Le != nil {
+				le = strconv.FormatFloat(*b.Le, 'g', -1, 64)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, l, sep, le, cumulative)
+		}
+
+		braces := ""
+		if l != "" {
+			braces = "{" + l + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, braces, h.Sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, braces, h.Count)
+	}
+}
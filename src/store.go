@@ -2,42 +2,819 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // KVS type
 type KVS struct {
 	sync.RWMutex
-	M map[string]string
+	M       map[string]string // large values may be held compressed; use Get
+	Clock   Clock             // nil means the real clock
+	MaxKeys int               // reject puts of new keys beyond this many; 0 is no limit
+
+	// CompressAbove gzips values of at least this many bytes in memory,
+	// trading CPU for space. 0 disables compression.
+	CompressAbove int
+
+	// FoldCase makes keys case-insensitive: every key is lowercased on
+	// the way in, so "Foo" and "foo" are the same key. Set it before
+	// anything is put, and keep it set for the life of the store's log.
+	FoldCase bool
+
+	// Codec, if set, encodes every value held in memory and takes the
+	// place of CompressAbove; see ValueCodec. Native integers, see
+	// PutInt, aren't encoded.
+	Codec ValueCodec
+
+	// MaxBytes evicts keys once the store's keys and values, as held in
+	// memory, take up more than this many bytes; see evict. 0 never
+	// evicts.
+	MaxBytes int64
+
+	expires    map[string]time.Time // keys with a TTL, allocated lazily
+	versions   map[string]uint64    // bumped on every put, allocated lazily
+	compressed map[string]bool      // keys whose value in M is packed; see pack
+	ints       map[string]int64     // keys holding a native integer; see PutInt
+	modified   map[string]int64     // when each key was last put, in Unix nanoseconds
+	bytes      int64                // taken up by M; see entrySize
+	recent     recency              // when keys were last used, while MaxBytes is set
+	hooks      []ChangeFunc
+	evictors   []func(key string)
+	stripes    keyLocks // serialize mutations of a key; see update
+}
+
+// NewKVSWithCapacity makes an empty store with room for n keys, so a bulk
+// load doesn't keep rehashing the map as it grows
+func NewKVSWithCapacity(n int) *KVS {
+	return &KVS{
+		M:        make(map[string]string, n),
+		versions: make(map[string]uint64, n),
+	}
+}
+
+// NormalizeKey is key as the store holds it: lowercased if FoldCase is
+// set, otherwise unchanged
+func (s *KVS) NormalizeKey(key string) string {
+	if !s.FoldCase {
+		return key
+	}
+	return strings.ToLower(key)
+}
+
+// ChangeFunc is called after a key is put or deleted. For deletes, value
+// is empty.
+type ChangeFunc func(key, value string, deleted bool)
+
+// OnChange registers fn to be called after every successful mutation. Hooks
+// run outside the lock, in the mutating goroutine, so they may call back
+// into the store; slow hooks slow down writers.
+func (s *KVS) OnChange(fn ChangeFunc) {
+	s.Lock()
+	s.hooks = append(s.hooks, fn)
+	s.Unlock()
+}
+
+// notify runs hooks, which the caller copied while holding the lock
+func notify(hooks []ChangeFunc, key, value string, deleted bool) {
+	for _, fn := range hooks {
+		fn(key, value, deleted)
+	}
 }
 
 // ErrorNoSuchKey describes missing keys
 var ErrorNoSuchKey = errors.New("no such key")
 
+// ErrStoreFull is returned when putting a new key would exceed MaxKeys,
+// or a key and its value alone would exceed MaxBytes
+var ErrStoreFull = errors.New("store full")
+
+// expired reports whether key has a TTL that has run out. Callers must
+// hold at least the read lock.
+func (s *KVS) expired(key string, t time.Time) bool {
+	at, ok := s.expires[key]
+	return ok && !t.Before(at)
+}
+
 // Get a value stored at key
 func (s *KVS) Get(key string) (string, error) {
+	value, _, err := s.GetVersion(key)
+	return value, err
+}
+
+// GetVersion returns the value stored at key along with its version
+func (s *KVS) GetVersion(key string) (string, uint64, error) {
+	key = s.NormalizeKey(key)
+
 	s.RLock()
 	value, ok := s.M[key]
+	if ok && s.expired(key, now(s.Clock)) {
+		ok = false
+	}
+	version := s.versions[key]
+	packed := s.compressed[key]
+	n, native := s.ints[key]
+	if ok {
+		s.used(key)
+	}
 	s.RUnlock()
 	if !ok {
-		return "", ErrorNoSuchKey
+		return "", 0, ErrorNoSuchKey
+	}
+
+	switch {
+	case native:
+		value = strconv.FormatInt(n, 10)
+	case packed:
+		value = s.unpack(value)
 	}
 
-	return value, nil
+	return value, version, nil
+}
+
+// GetWithMeta returns the value stored at key with its version and when
+// it was last put, all from one read of the store; see ModTime
+func (s *KVS) GetWithMeta(key string) (value string, version uint64, modified time.Time, err error) {
+	key = s.NormalizeKey(key)
+
+	s.RLock()
+	value, ok := s.M[key]
+	if ok && s.expired(key, now(s.Clock)) {
+		ok = false
+	}
+	version = s.versions[key]
+	mod := s.modified[key]
+	packed := s.compressed[key]
+	n, native := s.ints[key]
+	if ok {
+		s.used(key)
+	}
+	s.RUnlock()
+	if !ok {
+		return "", 0, time.Time{}, ErrorNoSuchKey
+	}
+
+	switch {
+	case native:
+		value = strconv.FormatInt(n, 10)
+	case packed:
+		value = s.unpack(value)
+	}
+
+	return value, version, time.Unix(0, mod), nil
+}
+
+// GetInto writes the value stored at key to w without copying it first,
+// decompressing straight into w if need be
+func (s *KVS) GetInto(key string, w io.Writer) error {
+	key = s.NormalizeKey(key)
+
+	s.RLock()
+	value, ok := s.M[key]
+	if ok && s.expired(key, now(s.Clock)) {
+		ok = false
+	}
+	packed := s.compressed[key]
+	n, native := s.ints[key]
+	if ok {
+		s.used(key)
+	}
+	s.RUnlock()
+	if !ok {
+		return ErrorNoSuchKey
+	}
+
+	switch {
+	case native:
+		value = strconv.FormatInt(n, 10)
+	case packed:
+		return s.unpackTo(w, value)
+	}
+
+	_, err := io.WriteString(w, value)
+	return err
 }
 
 // Put something in our store ref'd by key
 func (s *KVS) Put(key, value string) error {
+	_, err := s.PutVersioned(key, value, 0)
+	return err
+}
+
+// PutWithTTL stores value at key until ttl has passed. A ttl of zero or
+// less means no expiry, just like Put.
+func (s *KVS) PutWithTTL(key, value string, ttl time.Duration) error {
+	_, err := s.PutVersioned(key, value, ttl)
+	return err
+}
+
+// PutVersioned is PutWithTTL, also returning the key's new version. Each
+// put bumps the version by one; a deleted or expired key starts again
+// from 1. Once the store holds MaxKeys keys, new keys get ErrStoreFull but
+// existing ones can still be updated. Expired keys count until they are
+// overwritten or deleted. With MaxBytes set, a put taking the store over
+// it evicts other keys; see evict.
+func (s *KVS) PutVersioned(key, value string, ttl time.Duration) (uint64, error) {
+	res, err := s.PutWithResult(key, value, ttl)
+	return res.Version, err
+}
+
+// PutResult describes a successful put
+type PutResult struct {
+	Version uint64 // the key's version after the put
+	Created bool   // the key was absent or expired before the put
+}
+
+// PutWithResult is PutVersioned, also reporting whether the put created
+// the key or updated it
+func (s *KVS) PutWithResult(key, value string, ttl time.Duration) (PutResult, error) {
+	key = s.NormalizeKey(key)
+	if ttl < 0 {
+		ttl = 0
+	}
+	stored, packed := s.pack(value)
+
+	mu := s.stripes.lock(key)
 	s.Lock()
-	s.M[key] = value
+	_, exists := s.M[key]
+	if exists && s.expired(key, now(s.Clock)) {
+		exists = false
+		delete(s.versions, key)
+	}
+	version, err := s.put(key, stored, packed, ttl)
+	hooks := s.hooks
 	s.Unlock()
-	return nil
+	mu.Unlock()
+
+	if err != nil {
+		return PutResult{}, err
+	}
+
+	notify(hooks, key, value, false)
+	s.evict(key)
+	return PutResult{Version: version, Created: !exists}, nil
+}
+
+// SetNX puts value at key only if the key is absent or expired, reporting
+// whether it did. With a ttl this is a lock: the first caller wins, and
+// the key frees itself if the holder goes away. A created key is always
+// at version 1.
+func (s *KVS) SetNX(key, value string, ttl time.Duration) (bool, error) {
+	key = s.NormalizeKey(key)
+	if ttl < 0 {
+		ttl = 0
+	}
+	stored, packed := s.pack(value)
+
+	mu := s.stripes.lock(key)
+	s.Lock()
+	if _, ok := s.M[key]; ok {
+		if !s.expired(key, now(s.Clock)) {
+			s.Unlock()
+			mu.Unlock()
+			return false, nil
+		}
+		delete(s.versions, key)
+	}
+	_, err := s.put(key, stored, packed, ttl)
+	hooks := s.hooks
+	s.Unlock()
+	mu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	notify(hooks, key, value, false)
+	s.evict(key)
+	return true, nil
+}
+
+// ErrVersionMismatch is returned by SetIfVersion when the key isn't at the
+// version expected
+var ErrVersionMismatch = fmt.Errorf("%w: version does not match", ErrPrecondition)
+
+// SetIfVersion puts value at key only if the key is at version expected,
+// where 0 means absent or expired, and returns its new version. Otherwise
+// nothing changes and the error is ErrVersionMismatch. Any TTL is cleared.
+func (s *KVS) SetIfVersion(key, value string, expected uint64) (uint64, error) {
+	res, err := s.setIfVersion(key, value, expected, 0)
+	return res.Version, err
+}
+
+// setIfVersion is SetIfVersion with a ttl, reporting as PutWithResult
+func (s *KVS) setIfVersion(key, value string, expected uint64, ttl time.Duration) (PutResult, error) {
+	key = s.NormalizeKey(key)
+	if ttl < 0 {
+		ttl = 0
+	}
+	stored, packed := s.pack(value)
+
+	mu := s.stripes.lock(key)
+	s.Lock()
+	_, exists := s.M[key]
+	if exists && s.expired(key, now(s.Clock)) {
+		exists = false
+	}
+
+	var current uint64
+	if exists {
+		current = s.versions[key]
+	}
+	if current != expected {
+		s.Unlock()
+		mu.Unlock()
+		return PutResult{}, fmt.Errorf("%w: key is at version %d, not %d", ErrVersionMismatch, current, expected)
+	}
+
+	if !exists {
+		delete(s.versions, key)
+	}
+	version, err := s.put(key, stored, packed, ttl)
+	hooks := s.hooks
+	s.Unlock()
+	mu.Unlock()
+
+	if err != nil {
+		return PutResult{}, err
+	}
+
+	notify(hooks, key, value, false)
+	s.evict(key)
+	return PutResult{Version: version, Created: !exists}, nil
+}
+
+// keepTTL tells put to leave a key's expiry as it is
+const keepTTL time.Duration = -1
+
+// put stores a packed value at key and bumps its version. A ttl of zero
+// clears any expiry. Callers must hold the lock and the key's stripe.
+func (s *KVS) put(key, stored string, packed bool, ttl time.Duration) (uint64, error) {
+	if _, ok := s.M[key]; !ok && s.MaxKeys > 0 && len(s.M) >= s.MaxKeys {
+		return 0, fmt.Errorf("%w: limit is %d keys", ErrStoreFull, s.MaxKeys)
+	}
+	if size := entrySize(key, stored); s.MaxBytes > 0 && size > s.MaxBytes {
+		return 0, fmt.Errorf("%w: %d bytes is over the limit of %d", ErrStoreFull, size, s.MaxBytes)
+	}
+
+	s.store(key, stored, packed)
+	switch {
+	case ttl > 0:
+		if s.expires == nil {
+			s.expires = make(map[string]time.Time)
+		}
+		s.expires[key] = now(s.Clock).Add(ttl)
+	case ttl == 0:
+		delete(s.expires, key)
+	}
+
+	return s.bump(key, 0), nil
+}
+
+// restore puts value at key with a version and modification time read
+// back from a log or snapshot. Version 0 means it wasn't recorded, so the
+// version is bumped as for any put; a modified time of 0 leaves the time
+// of the restore. MaxKeys isn't enforced; the put has already happened.
+func (s *KVS) restore(key, value string, version uint64, modified int64) {
+	key = s.NormalizeKey(key)
+	stored, packed := s.pack(value)
+
+	s.Lock()
+	s.store(key, stored, packed)
+	delete(s.expires, key)
+	s.bump(key, version)
+	if modified != 0 {
+		s.modified[key] = modified
+	}
+	s.Unlock()
+}
+
+// Import loads state, with its versions if known, in one go, as when
+// restoring a snapshot. An empty store is first reallocated to fit. Like
+// a replay, it doesn't call OnChange hooks or enforce MaxKeys.
+func (s *KVS) Import(state map[string]string, versions map[string]uint64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.M) == 0 {
+		sized := NewKVSWithCapacity(len(state))
+		s.M, s.versions = sized.M, sized.versions
+	}
+
+	for k, v := range state {
+		stored, packed := s.pack(v)
+		version := versions[k]
+		k = s.NormalizeKey(k)
+		s.store(k, stored, packed)
+		delete(s.expires, k)
+		s.bump(k, version)
+	}
+}
+
+// store sets the value in M and whether it's compressed, and marks the
+// key modified and used now. Callers must hold the lock.
+func (s *KVS) store(key, stored string, packed bool) {
+	if old, ok := s.M[key]; ok {
+		s.bytes -= entrySize(key, old)
+	}
+	s.M[key] = stored
+	s.bytes += entrySize(key, stored)
+	delete(s.ints, key)
+	s.touch(key)
+	s.used(key)
+
+	if !packed {
+		delete(s.compressed, key)
+		return
+	}
+	if s.compressed == nil {
+		s.compressed = make(map[string]bool)
+	}
+	s.compressed[key] = true
+}
+
+// touch marks key modified now. Callers must hold the lock.
+func (s *KVS) touch(key string) {
+	if s.modified == nil {
+		s.modified = make(map[string]int64)
+	}
+	s.modified[key] = now(s.Clock).UnixNano()
+}
+
+// ModTime is when key was last put, or the zero time if it's missing.
+// Keys restored from a snapshot, or from a log that didn't record the
+// time, count as modified when they were restored.
+func (s *KVS) ModTime(key string) time.Time {
+	key = s.NormalizeKey(key)
+	s.RLock()
+	defer s.RUnlock()
+
+	if _, ok := s.M[key]; !ok || s.expired(key, now(s.Clock)) {
+		return time.Time{}
+	}
+	return time.Unix(0, s.modified[key])
+}
+
+// putTime is when the store put key at version, in Unix nanoseconds, so
+// the log records the time the store gave the put. If key has changed
+// since, the put is as good as made now.
+func (s *KVS) putTime(key string, version uint64) int64 {
+	s.RLock()
+	defer s.RUnlock()
+
+	if m, ok := s.modified[key]; ok && s.versions[key] == version {
+		return m
+	}
+	return now(s.Clock).UnixNano()
+}
+
+// bump sets key's version, or increments it if version is 0. Callers must
+// hold the lock.
+func (s *KVS) bump(key string, version uint64) uint64 {
+	if s.versions == nil {
+		s.versions = make(map[string]uint64)
+	}
+	if version == 0 {
+		version = s.versions[key] + 1
+	}
+	s.versions[key] = version
+
+	return version
+}
+
+// remove deletes key and all that's kept about it, reporting whether it
+// was there. Callers must hold the lock.
+func (s *KVS) remove(key string) bool {
+	stored, ok := s.M[key]
+	if ok {
+		s.bytes -= entrySize(key, stored)
+	}
+	delete(s.M, key)
+	delete(s.expires, key)
+	delete(s.versions, key)
+	delete(s.compressed, key)
+	delete(s.ints, key)
+	delete(s.modified, key)
+	s.recent.forget(key)
+
+	return ok
 }
 
 // Delete a value at key
 func (s *KVS) Delete(key string) error {
+	key = s.NormalizeKey(key)
+	mu := s.stripes.lock(key)
 	s.Lock()
-	delete(s.M, key)
+	existed := s.remove(key)
+	hooks := s.hooks
 	s.Unlock()
+	mu.Unlock()
+
+	if existed {
+		notify(hooks, key, "", true)
+	}
 	return nil
 }
+
+// CompareAndDelete deletes key only if it currently holds old, reporting
+// whether it did. A missing key is ErrorNoSuchKey.
+func (s *KVS) CompareAndDelete(key, old string) (bool, error) {
+	key = s.NormalizeKey(key)
+	mu := s.stripes.lock(key)
+	s.Lock()
+
+	value, ok := s.M[key]
+	if !ok || s.expired(key, now(s.Clock)) {
+		s.Unlock()
+		mu.Unlock()
+		return false, ErrorNoSuchKey
+	}
+	if n, native := s.ints[key]; native {
+		value = strconv.FormatInt(n, 10)
+	} else if s.compressed[key] {
+		value = s.unpack(value)
+	}
+	if value != old {
+		s.Unlock()
+		mu.Unlock()
+		return false, nil
+	}
+
+	s.remove(key)
+	hooks := s.hooks
+	s.Unlock()
+	mu.Unlock()
+
+	notify(hooks, key, "", true)
+	return true, nil
+}
+
+// DeletePrefix deletes every key starting with prefix and returns how
+// many it deleted. Keys put while it runs may survive.
+func (s *KVS) DeletePrefix(prefix string) int {
+	return len(s.deletePrefix(prefix))
+}
+
+// deletePrefix is DeletePrefix, returning the deleted keys
+func (s *KVS) deletePrefix(prefix string) []string {
+	prefix = s.NormalizeKey(prefix)
+
+	s.RLock()
+	var keys []string
+	for k := range s.M {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	s.RUnlock()
+
+	sort.Strings(keys)
+
+	// key by key, each under its stripe, like Delete
+	deleted := keys[:0]
+	for _, k := range keys {
+		mu := s.stripes.lock(k)
+		s.Lock()
+		_, existed := s.M[k]
+		live := existed && !s.expired(k, now(s.Clock))
+		s.remove(k)
+		hooks := s.hooks
+		s.Unlock()
+		mu.Unlock()
+
+		if existed {
+			notify(hooks, k, "", true)
+		}
+		if live {
+			deleted = append(deleted, k)
+		}
+	}
+
+	return deleted
+}
+
+// Snapshot returns a point-in-time copy of the whole store, taken under the
+// read lock so it is consistent even while writes continue
+func (s *KVS) Snapshot() map[string]string {
+	m, _ := s.SnapshotVersions()
+	return m
+}
+
+// SnapshotVersions is Snapshot along with the version of every key in it
+func (s *KVS) SnapshotVersions() (map[string]string, map[string]uint64) {
+	s.RLock()
+	defer s.RUnlock()
+
+	t := now(s.Clock)
+	m := make(map[string]string, len(s.M))
+	versions := make(map[string]uint64, len(s.M))
+	for k, v := range s.M {
+		if !s.expired(k, t) {
+			if n, native := s.ints[k]; native {
+				v = strconv.FormatInt(n, 10)
+			} else if s.compressed[k] {
+				v = s.unpack(v)
+			}
+			m[k] = v
+			versions[k] = s.versions[k]
+		}
+	}
+
+	return m, versions
+}
+
+// Len is the number of live keys in the store
+func (s *KVS) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	t := now(s.Clock)
+	n := len(s.M)
+	for k := range s.expires {
+		if s.expired(k, t) {
+			n--
+		}
+	}
+
+	return n
+}
+
+// Scan returns up to limit keys in sorted order, starting strictly after
+// cursor, which is normalized like a key. next is the cursor for the
+// following page, or "" when there are no more keys.
+func (s *KVS) Scan(cursor string, limit int) (keys []string, next string) {
+	cursor = s.NormalizeKey(cursor)
+
+	s.RLock()
+	t := now(s.Clock)
+	all := make([]string, 0, len(s.M))
+	for k := range s.M {
+		if k > cursor && !s.expired(k, t) {
+			all = append(all, k)
+		}
+	}
+	s.RUnlock()
+
+	sort.Strings(all)
+
+	if limit > 0 && len(all) > limit {
+		return all[:limit], all[limit-1]
+	}
+
+	return all, ""
+}
+
+// GetPrefix returns the live keys starting with prefix and their values,
+// copied under the read lock so they're consistent with each other. If
+// limit is positive only the first limit keys, in sorted order, are
+// returned, and more reports that others matched.
+func (s *KVS) GetPrefix(prefix string, limit int) (pairs map[string]string, more bool) {
+	prefix = s.NormalizeKey(prefix)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	t := now(s.Clock)
+	var keys []string
+	for k := range s.M {
+		if strings.HasPrefix(k, prefix) && !s.expired(k, t) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+
+	pairs = make(map[string]string, len(keys))
+	for _, k := range keys {
+		v := s.M[k]
+		if n, native := s.ints[k]; native {
+			v = strconv.FormatInt(n, 10)
+		} else if s.compressed[k] {
+			v = s.unpack(v)
+		}
+		pairs[k] = v
+	}
+
+	return pairs, more
+}
+
+// TreeSeparator splits keys into path segments for Tree
+const TreeSeparator = "/"
+
+// Tree lists the level of the keyspace directly under prefix, treating
+// TreeSeparator as a path separator. keys are the live keys at that
+// level; dirs are the deeper prefixes, each ending in the separator so it
+// can be passed back to Tree. Both are sorted and hold full names.
+func (s *KVS) Tree(prefix string) (keys, dirs []string) {
+	return s.tree(prefix, nil)
+}
+
+// tree is Tree over only the keys keep accepts, so a prefix is listed in
+// dirs only if some key under it is kept. keep may be nil to keep them
+// all; it's called without the lock held.
+func (s *KVS) tree(prefix string, keep func(key string) bool) (keys, dirs []string) {
+	prefix = s.NormalizeKey(prefix)
+
+	var live []string
+	s.RLock()
+	t := now(s.Clock)
+	for k := range s.M {
+		if strings.HasPrefix(k, prefix) && !s.expired(k, t) {
+			live = append(live, k)
+		}
+	}
+	s.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, k := range live {
+		if keep != nil && !keep(k) {
+			continue
+		}
+
+		i := strings.Index(k[len(prefix):], TreeSeparator)
+		if i < 0 {
+			keys = append(keys, k)
+			continue
+		}
+
+		dir := k[:len(prefix)+i+len(TreeSeparator)]
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	sort.Strings(keys)
+	sort.Strings(dirs)
+
+	return keys, dirs
+}
+
+// ShardedKVS spreads keys over several KVS so unrelated keys don't
+// contend on the same lock
+type ShardedKVS struct {
+	shards    []*KVS
+	shardFunc func(key string) uint64
+}
+
+// ShardOption configures a ShardedKVS
+type ShardOption func(*ShardedKVS)
+
+// WithShardFunc overrides the key-to-shard hash, e.g. to colocate related
+// keys under one lock. The result is taken modulo the shard count.
+func WithShardFunc(fn func(key string) uint64) ShardOption {
+	return func(s *ShardedKVS) {
+		s.shardFunc = fn
+	}
+}
+
+// NewShardedKVS makes a store of n shards, hashed with fnv by default
+func NewShardedKVS(n int, opts ...ShardOption) *ShardedKVS {
+	if n < 1 {
+		n = 1
+	}
+
+	s := &ShardedKVS{shards: make([]*KVS, n), shardFunc: fnvShard}
+	for i := range s.shards {
+		s.shards[i] = &KVS{M: make(map[string]string)}
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+func fnvShard(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (s *ShardedKVS) shard(key string) *KVS {
+	return s.shards[s.shardFunc(key)%uint64(len(s.shards))]
+}
+
+// Get a value stored at key
+func (s *ShardedKVS) Get(key string) (string, error) {
+	return s.shard(key).Get(key)
+}
+
+// Put something in our store ref'd by key
+func (s *ShardedKVS) Put(key, value string) error {
+	return s.shard(key).Put(key, value)
+}
+
+// Delete a value at key
+func (s *ShardedKVS) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
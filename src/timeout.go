@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// clientTimeouts is router middleware protecting the server from slow
+// clients. Each write of a response must finish within write, so a
+// client that stops reading can't tie a handler up forever; once a write
+// fails the request's context is cancelled, which ends streams too.
+// Requests other than streams also have their context cancelled after
+// handler. Zero disables either timeout.
+func clientTimeouts(write, handler time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var ctx context.Context
+			var cancel context.CancelFunc
+			if handler > 0 && !isStream(r) {
+				ctx, cancel = context.WithTimeout(r.Context(), handler)
+			} else {
+				ctx, cancel = context.WithCancel(r.Context())
+			}
+			defer cancel()
+
+			if write > 0 {
+				w = &deadlineWriter{
+					ResponseWriter: w,
+					rc:             http.NewResponseController(w),
+					timeout:        write,
+					cancel:         cancel,
+				}
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// deadlineWriter gives every write of a response its own deadline, and
+// cancels the request when one fails
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+	cancel  context.CancelFunc
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil {
+		w.cancel()
+	}
+	return n, err
+}
+
+// Flush keeps streams working through the wrapper
+func (w *deadlineWriter) Flush() {
+	w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+
+	if err := w.rc.Flush(); err != nil {
+		w.cancel()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *deadlineWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ErrTxnAborted is returned when a transaction's precondition fails, in
+// which case none of it is applied
+var ErrTxnAborted = errors.New("transaction aborted")
+
+// ErrTxnNotLogged is returned when the log fails to record a transaction,
+// which is then undone, so neither the store nor the log holds any of it
+var ErrTxnNotLogged = errors.New("transaction log write failed; the transaction was undone")
+
+// MaxTxnOps is the most operations one transaction may hold
+const MaxTxnOps = 1000
+
+// TxnOp is one operation of a transaction. Compare and Version are
+// optional preconditions on the key as it was before the transaction.
+type TxnOp struct {
+	Op      string  `json:"op"` // "put" or "delete"
+	Key     string  `json:"key"`
+	Value   string  `json:"value,omitempty"`
+	Compare *string `json:"compare,omitempty"` // the key must hold this value
+	Version *uint64 `json:"version,omitempty"` // the key must be at this version; 0 means absent
+}
+
+// TxnResult is the outcome of one TxnOp
+type TxnResult struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version,omitempty"` // after a put
+	Deleted bool   `json:"deleted,omitempty"` // a delete removed a live key
+}
+
+// lockKeys locks the stripes of all keys in ascending order, like
+// lockPair, and returns a func that unlocks them
+func (l *keyLocks) lockKeys(keys []string) func() {
+	var held [keyStripes]bool
+	for _, k := range keys {
+		held[stripe(k)] = true
+	}
+
+	for i := range held {
+		if held[i] {
+			l[i].Lock()
+		}
+	}
+	return func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			if held[i] {
+				l[i].Unlock()
+			}
+		}
+	}
+}
+
+// Txn applies ops in order, all or nothing. Every precondition is checked
+// against the store as it was before the first op, so a later op can't
+// depend on an earlier one. If any fails, or the puts would take the
+// store past MaxKeys, or one alone is over MaxBytes, nothing is applied.
+// Once applied, the results are passed to log while the keys are still
+// locked, and if it fails the transaction is undone and its error
+// returned. Puts clear any TTL, and may evict other keys as any put may,
+// though never a key of the transaction; one larger than MaxBytes as a
+// whole leaves the store over it.
+func (s *KVS) Txn(ops []TxnOp, log func([]TxnResult) error) ([]TxnResult, error) {
+	ops = append([]TxnOp(nil), ops...)
+	keys := make([]string, len(ops))
+	stored := make([]string, len(ops))
+	packed := make([]bool, len(ops))
+	for i := range ops {
+		ops[i].Key = s.NormalizeKey(ops[i].Key)
+		op := ops[i]
+		keys[i] = op.Key
+		if op.Op == "put" {
+			stored[i], packed[i] = s.pack(op.Value)
+		}
+	}
+
+	unlock := s.stripes.lockKeys(keys)
+
+	s.Lock()
+	t := now(s.Clock)
+	live := func(key string) bool {
+		_, ok := s.M[key]
+		return ok && !s.expired(key, t)
+	}
+
+	for i, op := range ops {
+		if err := s.checkTxnOp(op, live(op.Key)); err != nil {
+			s.Unlock()
+			unlock()
+			return nil, fmt.Errorf("%w: op %d on %q: %v", ErrTxnAborted, i, op.Key, err)
+		}
+	}
+
+	if s.MaxKeys > 0 {
+		added := make(map[string]bool)
+		for _, op := range ops {
+			if _, ok := s.M[op.Key]; !ok {
+				added[op.Key] = op.Op == "put"
+			}
+		}
+		n := len(s.M)
+		for _, put := range added {
+			if put {
+				n++
+			}
+		}
+		if n > s.MaxKeys {
+			s.Unlock()
+			unlock()
+			return nil, fmt.Errorf("%w: limit is %d keys", ErrStoreFull, s.MaxKeys)
+		}
+	}
+
+	for i, op := range ops {
+		if size := entrySize(op.Key, stored[i]); op.Op == "put" && s.MaxBytes > 0 && size > s.MaxBytes {
+			s.Unlock()
+			unlock()
+			return nil, fmt.Errorf("%w: op %d on %q: %d bytes is over the limit of %d", ErrStoreFull, i, op.Key, size, s.MaxBytes)
+		}
+	}
+
+	var priors []txnPrior
+	for i, op := range ops {
+		if !slices.Contains(keys[:i], op.Key) {
+			priors = append(priors, s.prior(op.Key))
+		}
+	}
+
+	results := make([]TxnResult, len(ops))
+	for i, op := range ops {
+		results[i].Key = op.Key
+
+		if op.Op == "delete" {
+			results[i].Deleted = live(op.Key)
+			s.remove(op.Key)
+			continue
+		}
+
+		// as put, but MaxKeys was checked for the transaction as a whole
+		if !live(op.Key) {
+			delete(s.versions, op.Key)
+		}
+		s.store(op.Key, stored[i], packed[i])
+		delete(s.expires, op.Key)
+		results[i].Version = s.bump(op.Key, 0)
+	}
+	hooks := s.hooks
+	s.Unlock()
+
+	// no other write to the keys can come between the transaction and
+	// its undo, as their stripes are held until it's logged
+	if err := log(results); err != nil {
+		s.Lock()
+		for _, p := range priors {
+			s.undo(p)
+		}
+		s.Unlock()
+		unlock()
+		return nil, err
+	}
+	unlock()
+
+	for i, op := range ops {
+		if op.Op == "delete" {
+			if results[i].Deleted {
+				notify(hooks, op.Key, "", true)
+			}
+		} else {
+			notify(hooks, op.Key, op.Value, false)
+		}
+	}
+	s.evict(keys...)
+	return results, nil
+}
+
+// txnPrior is a key as it was before a transaction, kept to undo it
+type txnPrior struct {
+	key      string
+	stored   string
+	present  bool
+	packed   bool
+	n        int64
+	native   bool
+	version  uint64
+	modified int64
+	expires  time.Time
+	expiring bool
+}
+
+// prior records all that's kept about key. Callers must hold the lock.
+func (s *KVS) prior(key string) txnPrior {
+	p := txnPrior{key: key, packed: s.compressed[key], version: s.versions[key], modified: s.modified[key]}
+	p.stored, p.present = s.M[key]
+	p.n, p.native = s.ints[key]
+	p.expires, p.expiring = s.expires[key]
+	return p
+}
+
+// undo puts a key back as prior recorded it, version, TTL and all.
+// Callers must hold the lock.
+func (s *KVS) undo(p txnPrior) {
+	s.remove(p.key)
+	if !p.present {
+		return
+	}
+
+	s.store(p.key, p.stored, p.packed)
+	if p.native {
+		s.ints[p.key] = p.n
+	}
+	s.bump(p.key, p.version)
+	s.modified[p.key] = p.modified
+	if p.expiring {
+		s.expires[p.key] = p.expires
+	}
+}
+
+// checkTxnOp checks op's preconditions against its key's current state.
+// Callers must hold the lock.
+func (s *KVS) checkTxnOp(op TxnOp, live bool) error {
+	if op.Version != nil {
+		var version uint64
+		if live {
+			version = s.versions[op.Key]
+		}
+		if version != *op.Version {
+			return fmt.Errorf("version is %d, not %d", version, *op.Version)
+		}
+	}
+
+	if op.Compare != nil {
+		if !live {
+			return errors.New("no current value")
+		}
+
+		value := s.M[op.Key]
+		if n, native := s.ints[op.Key]; native {
+			value = strconv.FormatInt(n, 10)
+		} else if s.compressed[op.Key] {
+			value = s.unpack(value)
+		}
+		if value != *op.Compare {
+			return errors.New("value does not match")
+		}
+	}
+
+	return nil
+}
+
+// validateTxn checks a transaction is well formed before it's run
+func validateTxn(ops []TxnOp) error {
+	if len(ops) == 0 || len(ops) > MaxTxnOps {
+		return fmt.Errorf("%w: a transaction holds 1 to %d ops", ErrInvalidArgument, MaxTxnOps)
+	}
+
+	for i, op := range ops {
+		if op.Op != "put" && op.Op != "delete" {
+			return fmt.Errorf("%w: op %d is %q, not put or delete", ErrInvalidArgument, i, op.Op)
+		}
+		if err := validateKey(op.Key); err != nil {
+			return fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// TxnResponse is the body returned by TxnHandler
+type TxnResponse struct {
+	Results []TxnResult `json:"results"`
+}
+
+// TxnHandler expects to be called from http POST at "/v1/_txn" resource,
+// with a JSON array of TxnOp as the body. The ops are applied and logged
+// atomically: if any precondition fails it replies 409, and if the log
+// can't record them 500, and either way neither the store nor the log is
+// changed. The ops are logged as one batch, which a replay applies whole
+// or, if a crash cut it short, not at all. Any AuthPolicy is asked about
+// each op as a PUT or DELETE of its key.
+func TxnHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readValue(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer r.Body.Close()
+
+	var ops []TxnOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		writeError(w, r, fmt.Errorf("%w: %v", ErrInvalidJSON, err))
+		return
+	}
+	if err := validateTxn(ops); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for i, op := range ops {
+		method := "DELETE"
+		if op.Op == "put" {
+			method = "PUT"
+		}
+		if err := authorize(r, method, kvs.NormalizeKey(op.Key)); err != nil {
+			writeError(w, r, fmt.Errorf("op %d: %w", i, err))
+			return
+		}
+		if op.Op != "put" {
+			continue
+		}
+		if ops[i].Value, err = transformValue(kvs.NormalizeKey(op.Key), op.Value); err != nil {
+			writeError(w, r, fmt.Errorf("op %d: %w", i, err))
+			return
+		}
+	}
+
+	done, err := beginWrite()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer done()
+
+	start := time.Now()
+	results, err := kvs.Txn(ops, func(results []TxnResult) error {
+		if err := writeBatch(transact, txnEvents(ops, results)); err != nil {
+			return fmt.Errorf("%w: %w", ErrTxnNotLogged, err)
+		}
+		return nil
+	})
+	observeOp("txn", start)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TxnResponse{Results: results})
+}
+
+// txnEvents are the events that log ops, given their results, which hold
+// the keys as the store normalized them
+func txnEvents(ops []TxnOp, results []TxnResult) []Event {
+	events := make([]Event, len(ops))
+	for i, op := range ops {
+		if op.Op == "delete" {
+			events[i] = Event{EventType: EventDelete, Key: results[i].Key}
+		} else {
+			events[i] = Event{EventType: EventPut, Key: results[i].Key, Value: op.Value, Version: results[i].Version}
+		}
+	}
+	return events
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// ErrNotInteger is returned by Increment when the stored value isn't one
+var ErrNotInteger = errors.New("value is not an integer")
+
+// keyStripes is the number of locks keys are spread over
+const keyStripes = 64
+
+// keyLocks serializes mutations of the same key without serializing
+// unrelated keys. Every mutation takes its key's stripe before the store's
+// lock, so a read-modify-write can do its work between the two.
+type keyLocks [keyStripes]sync.Mutex
+
+// stripe is the index of key's stripe
+func stripe(key string) uint32 {
+	// inline FNV-1a; hash/fnv would allocate on every call
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+
+	return h % keyStripes
+}
+
+// lock locks and returns key's stripe
+func (l *keyLocks) lock(key string) *sync.Mutex {
+	mu := &l[stripe(key)]
+	mu.Lock()
+	return mu
+}
+
+// lockPair locks the stripes of both keys, always in the same order so
+// two callers can't deadlock, and returns a func that unlocks them
+func (l *keyLocks) lockPair(a, b string) func() {
+	i, j := stripe(a), stripe(b)
+	if i == j {
+		l[i].Lock()
+		return l[i].Unlock
+	}
+	if i > j {
+		i, j = j, i
+	}
+
+	l[i].Lock()
+	l[j].Lock()
+	return func() {
+		l[j].Unlock()
+		l[i].Unlock()
+	}
+}
+
+// errNoChange makes update leave the key as it is
+var errNoChange = errors.New("no change")
+
+// update replaces key's value with fn(old). Holding the key's stripe
+// keeps other writers of key out, so the store's lock is only taken
+// briefly to read and then to write, and not while fn runs. exists is
+// false for missing or expired keys, which start again at version 1. The
+// key's TTL is kept.
+func (s *KVS) update(key string, fn func(old string, exists bool) (string, error)) (string, uint64, error) {
+	key = s.NormalizeKey(key)
+	mu := s.stripes.lock(key)
+
+	s.RLock()
+	old, ok := s.M[key]
+	if ok && s.expired(key, now(s.Clock)) {
+		ok = false
+	}
+	if n, native := s.ints[key]; ok && native {
+		old = strconv.FormatInt(n, 10)
+	} else if ok && s.compressed[key] {
+		old = s.unpack(old)
+	}
+	s.RUnlock()
+
+	value, err := fn(old, ok)
+	if err != nil {
+		mu.Unlock()
+		return "", 0, err
+	}
+
+	ttl := keepTTL
+	if !ok {
+		ttl = 0 // an expired key comes back without its old TTL
+	}
+	stored, packed := s.pack(value)
+
+	s.Lock()
+	if !ok {
+		delete(s.versions, key)
+	}
+	version, err := s.put(key, stored, packed, ttl)
+	hooks := s.hooks
+	s.Unlock()
+	mu.Unlock()
+
+	if err != nil {
+		return "", 0, err
+	}
+
+	notify(hooks, key, value, false)
+	s.evict(key)
+	return value, version, nil
+}
+
+// CompareAndSwap sets key to new only if it currently holds old, reporting
+// whether it did. A missing key is ErrorNoSuchKey.
+func (s *KVS) CompareAndSwap(key, old, new string) (bool, error) {
+	swapped, _, err := s.compareAndSwap(key, old, new)
+	return swapped, err
+}
+
+// compareAndSwap is CompareAndSwap, also returning the new version
+func (s *KVS) compareAndSwap(key, old, new string) (bool, uint64, error) {
+	_, version, err := s.update(key, func(current string, exists bool) (string, error) {
+		if !exists {
+			return "", ErrorNoSuchKey
+		}
+		if current != old {
+			return "", errNoChange
+		}
+		return new, nil
+	})
+
+	if errors.Is(err, errNoChange) {
+		return false, 0, nil
+	}
+
+	return err == nil, version, err
+}
+
+// Increment adds delta to the integer stored at key, treating a missing
+// key as 0, and returns the result. The key is held as a native integer
+// from then on; see addInt.
+func (s *KVS) Increment(key string, delta int64) (int64, error) {
+	n, _, err := s.addInt(key, delta)
+	return n, err
+}
+
+// AddResult is the outcome of an Add
+type AddResult struct {
+	Value   int64
+	Version uint64
+	Retries int // times another writer got in first
+}
+
+// Add is Increment done optimistically: it reads the value, then swaps in
+// the sum with CompareAndSwap, starting over whenever another writer
+// changed the key in between. No lock is held across the read, so adds
+// never lose updates however many run at once. A missing key counts as 0.
+// A key already held as a native integer is simply added to in place.
+func (s *KVS) Add(key string, delta int64) (AddResult, error) {
+	key = s.NormalizeKey(key)
+	var res AddResult
+
+	s.RLock()
+	_, native := s.ints[key]
+	s.RUnlock()
+	if native {
+		var err error
+		res.Value, res.Version, err = s.addInt(key, delta)
+		return res, err
+	}
+
+	for ; ; res.Retries++ {
+		current, err := s.Get(key)
+		if errors.Is(err, ErrorNoSuchKey) {
+			res.Value = delta
+			created, err := s.SetNX(key, strconv.FormatInt(delta, 10), 0)
+			if err != nil {
+				return res, err
+			}
+			if created {
+				res.Version = 1
+				return res, nil
+			}
+			continue
+		}
+		if err != nil {
+			return res, err
+		}
+
+		n, err := strconv.ParseInt(current, 10, 64)
+		if err != nil {
+			return res, fmt.Errorf("%w: %q", ErrNotInteger, current)
+		}
+		res.Value = n + delta
+
+		swapped, version, err := s.compareAndSwap(key, current, strconv.FormatInt(res.Value, 10))
+		if errors.Is(err, ErrorNoSuchKey) {
+			continue // deleted since the read
+		}
+		if err != nil {
+			return res, err
+		}
+		if swapped {
+			res.Version = version
+			return res, nil
+		}
+	}
+}
+
+// Append adds suffix to the value at key, treating a missing key as
+// empty, and returns the new length
+func (s *KVS) Append(key, suffix string) (int, error) {
+	value, _, err := s.update(key, func(current string, _ bool) (string, error) {
+		return current + suffix, nil
+	})
+
+	return len(value), err
+}
+
+// Rename moves the value at oldKey to newKey, replacing any value there,
+// and deletes oldKey, all in one step. The value keeps its TTL, and
+// newKey's version goes up as for a put. A missing oldKey is
+// ErrorNoSuchKey. Under MaxBytes the value is refused with ErrStoreFull if
+// it's over the budget at newKey, and may evict other keys as a put may.
+func (s *KVS) Rename(oldKey, newKey string) error {
+	_, _, err := s.rename(oldKey, newKey)
+	return err
+}
+
+// rename is Rename, also returning the value and newKey's version
+func (s *KVS) rename(oldKey, newKey string) (string, uint64, error) {
+	oldKey, newKey = s.NormalizeKey(oldKey), s.NormalizeKey(newKey)
+	unlock := s.stripes.lockPair(oldKey, newKey)
+
+	s.Lock()
+	stored, ok := s.M[oldKey]
+	if !ok || s.expired(oldKey, now(s.Clock)) {
+		s.Unlock()
+		unlock()
+		return "", 0, ErrorNoSuchKey
+	}
+	packed := s.compressed[oldKey]
+	n, native := s.ints[oldKey]
+
+	value := stored
+	switch {
+	case native:
+		value = strconv.FormatInt(n, 10)
+	case packed:
+		value = s.unpack(stored)
+	}
+	if oldKey == newKey {
+		version := s.versions[oldKey]
+		s.Unlock()
+		unlock()
+		return value, version, nil
+	}
+	if size := entrySize(newKey, stored); s.MaxBytes > 0 && size > s.MaxBytes {
+		s.Unlock()
+		unlock()
+		return "", 0, fmt.Errorf("%w: %d bytes is over the limit of %d", ErrStoreFull, size, s.MaxBytes)
+	}
+
+	// an expired newKey is replaced as if it weren't there, so its
+	// version starts again as for a put
+	if _, exists := s.M[newKey]; exists && s.expired(newKey, now(s.Clock)) {
+		delete(s.versions, newKey)
+	}
+
+	// a rename never adds a key, so MaxKeys doesn't apply
+	if native {
+		s.storeInt(newKey, n)
+	} else {
+		s.store(newKey, stored, packed)
+	}
+	if exp, ok := s.expires[oldKey]; ok {
+		s.expires[newKey] = exp
+	} else {
+		delete(s.expires, newKey)
+	}
+	version := s.bump(newKey, 0)
+
+	s.remove(oldKey)
+	hooks := s.hooks
+	s.Unlock()
+	unlock()
+
+	notify(hooks, oldKey, "", true)
+	notify(hooks, newKey, value, false)
+	s.evict(newKey)
+	return value, version, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// verifyMaxAnomalies is how many anomalies one check lists before giving
+// up, like fsckMaxProblems
+const verifyMaxAnomalies = 100
+
+// Anomaly is a broken invariant found by verifying the store
+type Anomaly struct {
+	Key     string `json:"key,omitempty"` // "" for the store as a whole
+	Problem string `json:"problem"`
+}
+
+// verifyState is what one check keeps for the next, to see that versions
+// only go up
+type verifyState struct {
+	versions map[string]uint64
+	at       int64 // when the check ran, in Unix nanoseconds
+}
+
+// verify checks the store's invariants under the read lock: every key has
+// a version, and one no lower than at the last check unless the key has
+// been put since, as deleting and recreating it starts it again at 1;
+// no metadata is kept for a key that isn't there; keys and unpacked
+// values are within the limits, where maxValue is 0 for none; and a
+// native integer is held as one alone. It returns the state to pass to
+// the next check, which may be nil for the first.
+func (s *KVS) verify(maxValue int64, last *verifyState) ([]Anomaly, *verifyState) {
+	s.RLock()
+	defer s.RUnlock()
+
+	var found []Anomaly
+	anomaly := func(key, format string, args ...any) {
+		found = append(found, Anomaly{Key: key, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	if s.MaxKeys > 0 && len(s.M) > s.MaxKeys {
+		anomaly("", "store holds %d keys, over the limit of %d", len(s.M), s.MaxKeys)
+	}
+
+	next := &verifyState{versions: make(map[string]uint64, len(s.M)), at: now(s.Clock).UnixNano()}
+	for k, v := range s.M {
+		version := s.versions[k]
+		next.versions[k] = version
+
+		if version == 0 {
+			anomaly(k, "no version")
+		} else if last != nil {
+			if old, ok := last.versions[k]; ok && version < old && s.modified[k] <= last.at {
+				anomaly(k, "version went back from %d to %d", old, version)
+			}
+		}
+
+		if len(k) > MaxKeyLength {
+			anomaly(k, "key of %d bytes, over the limit of %d", len(k), MaxKeyLength)
+		}
+
+		_, native := s.ints[k]
+		switch {
+		case native && (v != "" || s.compressed[k]):
+			anomaly(k, "native integer also holds a stored value")
+		case !native && !s.compressed[k] && maxValue > 0 && int64(len(v)) > maxValue:
+			anomaly(k, "value of %d bytes, over the limit of %d", len(v), maxValue)
+		}
+	}
+
+	orphans := func(what string, keys []string) {
+		sort.Strings(keys)
+		for _, k := range keys {
+			anomaly(k, "%s for a key not in the store", what)
+		}
+	}
+	orphans("expiry", missingKeys(s.M, s.expires))
+	orphans("version", missingKeys(s.M, s.versions))
+	orphans("compression flag", missingKeys(s.M, s.compressed))
+	orphans("native integer", missingKeys(s.M, s.ints))
+	orphans("modification time", missingKeys(s.M, s.modified))
+
+	sort.Slice(found, func(i, j int) bool { return found[i].Key < found[j].Key })
+	return found, next
+}
+
+// missingKeys lists the keys of meta that aren't in m
+func missingKeys[V any](m map[string]string, meta map[string]V) []string {
+	var keys []string
+	for k := range meta {
+		if _, ok := m[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// VerifyReport is the outcome of a check of the store, as returned by
+// VerifyHandler
+type VerifyReport struct {
+	At        time.Time `json:"at"`
+	Keys      int       `json:"keys"`
+	Anomalies []Anomaly `json:"anomalies"`
+	Truncated bool      `json:"truncated,omitempty"` // more were found than listed
+}
+
+var (
+	verifyMu   sync.Mutex   // one check at a time, so each sees the last
+	lastVerify *verifyState // guarded by verifyMu
+
+	// verifyAnomalies counts anomalies found by every check so far, for
+	// /metrics
+	verifyAnomalies atomic.Int64
+)
+
+// verifyNow checks kvs against the limits it's served with, logging and
+// counting any anomalies
+func verifyNow() VerifyReport {
+	verifyMu.Lock()
+	found, next := kvs.verify(maxValueSize, lastVerify)
+	lastVerify = next
+	verifyMu.Unlock()
+
+	report := VerifyReport{At: time.Now().UTC(), Keys: len(next.versions), Anomalies: found}
+	if len(found) > verifyMaxAnomalies {
+		report.Anomalies, report.Truncated = found[:verifyMaxAnomalies], true
+	}
+	if report.Anomalies == nil {
+		report.Anomalies = []Anomaly{}
+	}
+
+	verifyAnomalies.Add(int64(len(found)))
+	for _, a := range report.Anomalies {
+		logger.Error("store integrity check failed", "key", a.Key, "problem", a.Problem)
+	}
+	if report.Truncated {
+		logger.Error("store integrity check found more anomalies than it lists",
+			"found", len(found), "listed", verifyMaxAnomalies)
+	}
+
+	return report
+}
+
+// verifyEvery checks the store every d until ctx is done
+func verifyEvery(ctx context.Context, d time.Duration) {
+	ticker := time.NewTicker(d)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report := verifyNow()
+			if len(report.Anomalies) == 0 {
+				logger.Debug("store integrity check passed", "keys", report.Keys)
+			}
+		}
+	}
+}
+
+// VerifyHandler expects to be called from http GET at "/v1/_verify"
+// resource. It checks the store's invariants there and then, as the
+// background check does, and reports what it found. Under an AuthPolicy
+// anomalies naming a key the caller may not GET are left out of the
+// report, though they're still logged.
+func VerifyHandler(w http.ResponseWriter, r *http.Request) {
+	report := verifyNow()
+
+	shown := []Anomaly{}
+	for _, a := range report.Anomalies {
+		if a.Key == "" || authorize(r, "GET", a.Key) == nil {
+			shown = append(shown, a)
+		}
+	}
+	report.Anomalies = shown
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}